@@ -31,7 +31,7 @@ func wireApp(configConfig *config.Config) (*app.App, func(), error) {
 	lockDao := dao.NewLockDao(baseData)
 	fileDao := dao.NewFileDao(downloaderDao, baseData, lockDao)
 	fileService := service.NewFileService(fileDao)
-	sysService := service.NewSysService(schedulerDao)
+	sysService := service.NewSysService(schedulerDao, downloaderDao)
 	localOperationService := service.NewLocalOperationService(schedulerDao)
 	fileHandler := handler.NewFileHandler(fileService, sysService, localOperationService)
 	metaDao := dao.NewMetaDao(fileDao, lockDao, baseData)
@@ -18,6 +18,7 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"os"
 	"sync"
 	"time"
 
@@ -26,6 +27,7 @@ import (
 	"dingospeed/pkg/config"
 	"dingospeed/pkg/consts"
 	myerr "dingospeed/pkg/error"
+	"dingospeed/pkg/prom"
 	"dingospeed/pkg/proto/manager"
 	"dingospeed/pkg/util"
 
@@ -34,6 +36,10 @@ import (
 
 type DownloaderDao struct {
 	schedulerDao *SchedulerDao
+
+	backgroundMu    sync.Mutex // 客户端断开后继续下载的全局预算
+	backgroundTasks int
+	backgroundBytes int64
 }
 
 func NewDownloaderDao(schedulerDao *SchedulerDao) *DownloaderDao {
@@ -45,19 +51,25 @@ func NewDownloaderDao(schedulerDao *SchedulerDao) *DownloaderDao {
 // 整个文件
 func (d *DownloaderDao) FileDownload(startPos, endPos int64, isInnerRequest bool, taskParam *downloader.TaskParam) error {
 	dingCacheManager := downloader.GetInstance()
-	dingFile, err := dingCacheManager.GetDingFile(taskParam.BlobsFile, taskParam.FileSize)
+	dingFile, err := dingCacheManager.GetDingFile(taskParam.BlobsFile, taskParam.FileSize, newProvenance(taskParam))
 	if err != nil {
 		zap.S().Errorf("GetDingFile err.%v", err)
 		return myerr.NewAppendCode(http.StatusInternalServerError, "Get DingFile err")
 	}
 	taskParam.DingFile = dingFile
+	taskParam.Claims = dingCacheManager.NewBlockClaims(taskParam.BlobsFile)
 	tasks, err := d.constructTask(startPos, endPos, isInnerRequest, taskParam)
 	if err != nil {
+		taskParam.Claims.Release()
+		dingCacheManager.ReleasedDingFile(taskParam.BlobsFile)
 		return err
 	}
+	journalId := d.addJournal(startPos, endPos, tasks, taskParam)
 	go func() {
 		defer close(taskParam.ResponseChan)
 		defer func() {
+			downloader.GetJournal().Remove(journalId)
+			taskParam.Claims.Release() // 未完成的块交由等待者自行回源
 			dingCacheManager.ReleasedDingFile(taskParam.BlobsFile)
 		}()
 		var wg sync.WaitGroup
@@ -72,7 +84,7 @@ func (d *DownloaderDao) FileDownload(startPos, endPos int64, isInnerRequest bool
 				}
 				task := tasks[i]
 				if i == 0 {
-					task.GetResponseChan() <- []byte{} // 先建立长连接
+					taskParam.ResponseChan <- util.Chunk{} // 先建立长连接
 				}
 				task.OutResult()
 			}
@@ -91,6 +103,184 @@ func (d *DownloaderDao) FileDownload(startPos, endPos int64, isInnerRequest bool
 	return nil
 }
 
+// addJournal 需要回源时记录本次下载，进程异常退出后可在启动时恢复
+func (d *DownloaderDao) addJournal(startPos, endPos int64, tasks []common.DownloadTask, taskParam *downloader.TaskParam) string {
+	if !config.SysConfig.EnableDownloadJournal() || !hasRemoteTask(tasks) {
+		return ""
+	}
+	id, err := downloader.GetJournal().Add(&downloader.JournalEntry{
+		BlobsFile: taskParam.BlobsFile,
+		FileName:  taskParam.FileName,
+		FileSize:  taskParam.FileSize,
+		OrgRepo:   taskParam.OrgRepo,
+		DataType:  taskParam.DataType,
+		Etag:      taskParam.Etag,
+		Uri:       taskParam.Uri,
+		XetHash:   taskParam.XetHash,
+		StartPos:  startPos,
+		EndPos:    endPos,
+	}, taskParam.Authorization)
+	if err != nil {
+		zap.S().Warnf("add download journal err.%v", err)
+	}
+	return id
+}
+
+func hasRemoteTask(tasks []common.DownloadTask) bool {
+	for _, task := range tasks {
+		switch task.(type) {
+		case *downloader.RemoteFileTask, *downloader.AdaptiveRemoteTask:
+			return true
+		}
+	}
+	return false
+}
+
+// ResumeJournal 恢复上次退出时未完成的回源下载，在后台重新下载缺失的块，已缓存的块不会重复下载。
+func (d *DownloaderDao) ResumeJournal() {
+	if !util.UpstreamOnline() { // 保留记录，待上游可用后重启时恢复
+		return
+	}
+	journal := downloader.GetJournal()
+	entries, err := journal.List()
+	if err != nil {
+		zap.S().Errorf("list download journal err.%v", err)
+		return
+	}
+	if len(entries) > 0 {
+		zap.S().Infof("resume %d unfinished downloads from journal", len(entries))
+	}
+	limit := make(chan struct{}, config.SysConfig.GetDownloadThroughMaxTasks())
+	for _, entry := range entries {
+		journal.Remove(entry.Id) // 恢复的下载会重新记录
+		if !util.FileExists(entry.BlobsFile) {
+			continue
+		}
+		authorization, err := journal.Authorization(entry)
+		if err != nil {
+			zap.S().Warnf("decrypt journal authorization of %s/%s err.%v", entry.OrgRepo, entry.FileName, err)
+		}
+		limit <- struct{}{}
+		go func() {
+			defer func() { <-limit }()
+			d.resumeDownload(entry, authorization)
+		}()
+	}
+}
+
+func (d *DownloaderDao) resumeDownload(entry *downloader.JournalEntry, authorization string) {
+	ctx, discard := downloader.WithDiscardOutput(context.WithValue(context.Background(), consts.PromSource, "localhost"))
+	discard()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	responseChan := make(chan util.Chunk, config.SysConfig.Download.RespChanSize)
+	taskParam := &downloader.TaskParam{
+		Context:       ctx,
+		Cancel:        cancel,
+		ResponseChan:  responseChan,
+		BlobsFile:     entry.BlobsFile,
+		FileName:      entry.FileName,
+		FileSize:      entry.FileSize,
+		OrgRepo:       entry.OrgRepo,
+		Authorization: authorization,
+		Uri:           entry.Uri,
+		DataType:      entry.DataType,
+		Etag:          entry.Etag,
+		XetHash:       entry.XetHash,
+		Priority:      downloader.PriorityBackground,
+	}
+	if err := d.FileDownload(entry.StartPos, entry.EndPos, false, taskParam); err != nil {
+		zap.S().Errorf("resume download %s/%s err.%v", entry.OrgRepo, entry.FileName, err)
+		return
+	}
+	for chunk := range responseChan { // 只需写入缓存，丢弃输出
+		chunk.Release()
+	}
+	zap.S().Infof("resume download %s/%s(%d-%d) end", entry.OrgRepo, entry.FileName, entry.StartPos, entry.EndPos)
+}
+
+// DownloadThrough 客户端已断开，按策略判断是否在后台继续下载[startPos,endPos)。继续时占用全局预算，
+// 返回的release需在下载结束后调用。
+func (d *DownloaderDao) DownloadThrough(startPos, endPos int64, taskParam *downloader.TaskParam) (func(), bool) {
+	dingFile := taskParam.DingFile
+	if dingFile == nil {
+		return nil, false
+	}
+	cached, total := dingFile.Progress()
+	switch config.SysConfig.GetDownloadThroughPolicy() {
+	case consts.DownloadThroughAlways:
+	case consts.DownloadThroughSize:
+		if taskParam.FileSize > config.SysConfig.GetDownloadThroughMaxFileSize() {
+			return nil, false
+		}
+	case consts.DownloadThroughProgress:
+		if total == 0 || cached*100 < int64(config.SysConfig.GetDownloadThroughMinProgress())*total {
+			return nil, false
+		}
+	default:
+		return nil, false
+	}
+	if cached == total {
+		return nil, false
+	}
+	remaining := min((total-cached)*dingFile.GetBlockSize(), endPos-startPos)
+	d.backgroundMu.Lock()
+	defer d.backgroundMu.Unlock()
+	budget := config.SysConfig.GetDownloadThroughMaxBudgetSize()
+	if d.backgroundTasks >= config.SysConfig.GetDownloadThroughMaxTasks() || (budget > 0 && d.backgroundBytes+remaining > budget) {
+		zap.S().Infof("background download budget exhausted, tasks:%d, bytes:%d, skip %s/%s", d.backgroundTasks, d.backgroundBytes, taskParam.OrgRepo, taskParam.FileName)
+		return nil, false
+	}
+	d.backgroundTasks++
+	d.backgroundBytes += remaining
+	d.reportBackground()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			d.backgroundMu.Lock()
+			defer d.backgroundMu.Unlock()
+			d.backgroundTasks--
+			d.backgroundBytes -= remaining
+			d.reportBackground()
+		})
+	}, true
+}
+
+// reportBackground 调用方需持有backgroundMu
+func (d *DownloaderDao) reportBackground() {
+	if config.SysConfig.EnableMetric() {
+		prom.BackgroundDownloadCnt.Set(float64(d.backgroundTasks))
+		prom.BackgroundDownloadByte.Set(float64(d.backgroundBytes))
+	}
+}
+
+// OpenCachedRange 请求范围已全部缓存时，返回定位到startPos的blob文件句柄，供响应直接发送。
+func (d *DownloaderDao) OpenCachedRange(startPos, endPos int64, taskParam *downloader.TaskParam) (*os.File, bool) {
+	if taskParam.FileSize <= 0 || !util.FileExists(taskParam.BlobsFile) {
+		return nil, false
+	}
+	dingCacheManager := downloader.GetInstance()
+	dingFile, err := dingCacheManager.GetDingFile(taskParam.BlobsFile, taskParam.FileSize, newProvenance(taskParam))
+	if err != nil {
+		zap.S().Errorf("GetDingFile err.%v", err)
+		return nil, false
+	}
+	defer dingCacheManager.ReleasedDingFile(taskParam.BlobsFile)
+	return dingFile.OpenCachedRange(startPos, endPos)
+}
+
+func newProvenance(taskParam *downloader.TaskParam) *downloader.Provenance {
+	org, repo := util.SplitOrgRepo(taskParam.OrgRepo)
+	return &downloader.Provenance{
+		Etag:     taskParam.Etag,
+		RepoType: taskParam.DataType,
+		Org:      org,
+		Repo:     repo,
+		FileName: taskParam.FileName,
+		Domain:   config.SysConfig.GetHFURLBase(),
+	}
+}
+
 func (d *DownloaderDao) constructTask(startPos, endPos int64, isInnerRequest bool, taskParam *downloader.TaskParam) ([]common.DownloadTask, error) {
 	var (
 		tasks        []common.DownloadTask
@@ -104,7 +294,7 @@ func (d *DownloaderDao) constructTask(startPos, endPos int64, isInnerRequest boo
 	}
 	// 分析下载类型是否全部存在，若文件不完整，返回当前已缓存的最大偏移量
 	fileComplete, curPos = analysisFilePosition(taskParam.DingFile, startPos, endPos)
-	if !fileComplete && !config.SysConfig.Online() { // 文件不完整，且当前节点为离线
+	if !fileComplete && !util.UpstreamOnline() { // 文件不完整，且当前节点为离线或上游已熔断
 		return nil, myerr.NewAppendCode(http.StatusNotFound, "Entry not found")
 	}
 	// isInnerRequest为true，即内部请求，是已经被调度过后，设置为内部域名的请求，这种请求将不会再次参与调度，直接做下载即可。
@@ -212,12 +402,9 @@ func analysisFilePosition(dingFile *downloader.DingCache, startPos, endPos int64
 	startBlock := startPos / dingFile.GetBlockSize()
 	endBlock := (endPos - 1) / dingFile.GetBlockSize()
 	for curBlock := startBlock; curBlock <= endBlock; curBlock++ {
-		blockExists, err := dingFile.HasBlock(curBlock)
-		if err != nil {
-			zap.S().Errorf("Failed to check block existence: %v", err)
-		}
-		if !blockExists {
-			curPos := curBlock * dingFile.GetBlockSize()
+		_, blockStartPos, blockEndPos := downloader.GetBlockInfo(curBlock*dingFile.GetBlockSize(), dingFile.GetBlockSize(), dingFile.GetFileSize())
+		if !dingFile.HasBlockRange(curBlock, max(startPos, blockStartPos), min(endPos, blockEndPos)) { // 整块或所需的子页已缓存即可
+			curPos := blockStartPos
 			if curPos < startPos { // 若startPos就不存在，将直接返回该位置。
 				curPos = startPos
 			}
@@ -239,28 +426,21 @@ func getContiguousRanges(startPos, endPos int64, taskParam *downloader.TaskParam
 		zap.S().Errorf("Invalid pos path=%s, startPos=%d, endPos=%d", dingFile.GetPath(), startPos, endPos)
 		return
 	}
-	startBlock := startPos / dingFile.GetBlockSize()
-	endBlock := (endPos - 1) / dingFile.GetBlockSize()
+	// 已缓存或正被其他请求下载的块从缓存读取，其余块由当前请求回源。
+	states := taskParam.Claims.Classify(dingFile, startPos, endPos)
+	isRemote := func(state downloader.BlockState) bool {
+		return state == downloader.BlockClaimed || state == downloader.BlockRemote
+	}
 
 	rangeStartPos, curPos := startPos, startPos
-	blockExists, err := dingFile.HasBlock(startBlock)
-	if err != nil {
-		zap.S().Errorf("Failed to check block existence: %v", err)
-		return
-	}
-	rangeIsRemote := !blockExists // 不存在，从远程获取，为true
+	rangeIsRemote := isRemote(states[0]) // 不存在，从远程获取，为true
 	taskNo := taskParam.TaskNo
-	for curBlock := startBlock; curBlock <= endBlock; curBlock++ {
+	for _, state := range states {
 		if ctx.Err() != nil {
 			return
 		}
 		_, _, blockEndPos := downloader.GetBlockInfo(curPos, dingFile.GetBlockSize(), dingFile.GetFileSize())
-		blockExists, err = dingFile.HasBlock(curBlock)
-		if err != nil {
-			zap.S().Errorf("HasBlock err. curBlock:%d,curPos:%d, %v", curBlock, curPos, err)
-			return
-		}
-		curIsRemote := !blockExists // 不存在，从远程获取，为true，存在为false。
+		curIsRemote := isRemote(state) // 不存在，从远程获取，为true，存在为false。
 		if rangeIsRemote != curIsRemote {
 			if rangeStartPos < curPos {
 				if rangeIsRemote {
@@ -290,6 +470,9 @@ func getContiguousRanges(startPos, endPos int64, taskParam *downloader.TaskParam
 }
 
 func splitRemoteRange(startPos, endPos int64, taskNo *int, taskParam *downloader.TaskParam) []common.DownloadTask {
+	if config.SysConfig.EnableAdaptiveRange() || config.SysConfig.EnableMultiSource() {
+		return []common.DownloadTask{createAdaptiveTask(taskNo, startPos, endPos, taskParam)}
+	}
 	rangeSize := config.SysConfig.Download.RemoteFileRangeSize
 	remoteTasks := make([]common.DownloadTask, 0)
 	if rangeSize == 0 {
@@ -319,9 +502,41 @@ func createCacheTask(taskNo int, start, end int64, taskParam *downloader.TaskPar
 	cache.FileName = taskParam.FileName
 	cache.OrgRepo = taskParam.OrgRepo
 	cache.ResponseChan = taskParam.ResponseChan
+	cache.Claims = taskParam.Claims
+	cache.Fallback = func(startPos, endPos int64) *downloader.RemoteFileTask {
+		if !util.UpstreamOnline() {
+			return nil
+		}
+		param := *taskParam
+		param.Domain = config.SysConfig.GetHFURLBase()
+		return createRemoteTask(taskNo, startPos, endPos, &param)
+	}
 	return cache
 }
 
+// createAdaptiveTask 整个远程区间交由一个自适应任务，按吞吐动态拆分为多个分段并发下载，开启多源时分段分布到多个上游。
+func createAdaptiveTask(taskNo *int, start, end int64, taskParam *downloader.TaskParam) *downloader.AdaptiveRemoteTask {
+	param := *taskParam // 同一请求的后续区间可能切换Domain，分段使用创建时的参数
+	segmentNo := *taskNo
+	var upstreams []config.Upstream
+	if config.SysConfig.EnableMultiSource() && !util.IsInnerDomain(param.Domain) { // 从集群内其他节点获取时不使用多源
+		upstreams = config.SysConfig.GetUpstreams()
+	}
+	adaptive := downloader.NewAdaptiveRemoteTask(segmentNo, start, end, upstreams, func(startPos, endPos int64) *downloader.RemoteFileTask {
+		return createRemoteTask(segmentNo, startPos, endPos, &param)
+	})
+	adaptive.Context = taskParam.Context
+	adaptive.DingFile = taskParam.DingFile
+	adaptive.ResponseChan = taskParam.ResponseChan
+	adaptive.TaskSize = taskParam.TaskSize
+	adaptive.FileName = taskParam.FileName
+	adaptive.OrgRepo = taskParam.OrgRepo
+	adaptive.Claims = taskParam.Claims
+	adaptive.Priority = taskParam.Priority
+	*taskNo++
+	return adaptive
+}
+
 func createRemoteTask(taskNo int, start, end int64, taskParam *downloader.TaskParam) *downloader.RemoteFileTask {
 	remote := downloader.NewRemoteFileTask(taskNo, start, end)
 	remote.Context = taskParam.Context
@@ -329,13 +544,16 @@ func createRemoteTask(taskNo int, start, end int64, taskParam *downloader.TaskPa
 	remote.Authorization = taskParam.Authorization
 	remote.Domain = taskParam.Domain
 	remote.Uri = taskParam.Uri
-	remote.Queue = make(chan []byte, getQueueSize(remote.RangeStartPos, remote.RangeEndPos))
+	remote.Queue = make(chan util.Chunk, getQueueSize(remote.RangeStartPos, remote.RangeEndPos))
 	remote.ResponseChan = taskParam.ResponseChan
 	remote.TaskSize = taskParam.TaskSize
 	remote.FileName = taskParam.FileName
 	remote.OrgRepo = taskParam.OrgRepo
 	remote.DataType = taskParam.DataType
 	remote.Etag = taskParam.Etag
+	remote.XetHash = taskParam.XetHash
 	remote.Cancel = taskParam.Cancel
+	remote.Claims = taskParam.Claims
+	remote.Priority = taskParam.Priority
 	return remote
 }
@@ -17,6 +17,7 @@ package dao
 import (
 	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
@@ -75,7 +76,7 @@ func (f *FileDao) GetFileCommitSha(repoType, orgRepo, commit, authorization stri
 		commitSha string
 		err       error
 	)
-	if config.SysConfig.Online() {
+	if util.UpstreamOnline() {
 		goto remoteRequestMeta
 	}
 	commitSha, err = f.GetCommitHfOffline(repoType, orgRepo, commit)
@@ -197,20 +198,30 @@ func (f *FileDao) FileGetGenerator(c echo.Context, repoType, orgRepo, commit, fi
 		zap.S().Warnf("repo:%s, commit:%s, fileName:%s is directory", orgRepo, commit, fileName)
 		return util.ErrorEntryNotFound(c)
 	}
-	respHeaders, etag, startPos, endPos := constructRespHeader(c, pathInfo, commit, fileName)
 	blobsDir := fmt.Sprintf("%s/files/%s/%s/blobs", config.SysConfig.Repos(), repoType, orgRepo)
+	etag := fileEtag(pathInfo)
 	blobsFile := fmt.Sprintf("%s/%s", blobsDir, etag)
+	// 同一etag的内容不变，以blob开始缓存的时间作为Last-Modified，不随文件信息缓存的刷新而变化
+	lastModified := downloader.BlobModTime(blobsFile)
+	resp := util.NewRangeResponse(c.Request(), pathInfo.Size, etag, lastModified, constructRespHeader(pathInfo, commit, fileName))
+	if resp.StatusCode == http.StatusNotModified || resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			zap.S().Warnf("file %s range %s not satisfiable, size: %d", fileName, c.Request().Header.Get("Range"), pathInfo.Size)
+		}
+		return resp.Write(c, nil)
+	}
 	filesDir := fmt.Sprintf("%s/files/%s/%s/resolve/%s", config.SysConfig.Repos(), repoType, orgRepo, commit)
 	filesPath := fmt.Sprintf("%s/%s", filesDir, fileName)
-	if err = f.ConstructBlobsAndFileFile(blobsFile, filesPath); err != nil {
+	storeFile, err := f.ConstructBlobsAndFileFile(blobsFile, filesPath)
+	if err != nil {
 		return util.ErrorProxyError(c)
 	}
 	if method == consts.RequestTypeHead {
-		return util.ResponseHeaders(c, http.StatusOK, respHeaders)
+		return util.ResponseHeaders(c, resp.StatusCode, resp.Headers)
 	} else if method == consts.RequestTypeGet {
 		taskParam := &downloader.TaskParam{
 			TaskNo:        0,
-			BlobsFile:     blobsFile,
+			BlobsFile:     storeFile,
 			FileName:      fileName,
 			FileSize:      pathInfo.Size,
 			OrgRepo:       orgRepo,
@@ -218,46 +229,34 @@ func (f *FileDao) FileGetGenerator(c echo.Context, repoType, orgRepo, commit, fi
 			Uri:           hfUri,
 			DataType:      repoType,
 			Etag:          etag,
+			XetHash:       pathInfo.XXetHash,
 		}
-		return f.FileChunkGet(c, taskParam, startPos, endPos, respHeaders)
+		if resp.Multipart != nil {
+			return f.FileRangesGet(c, taskParam, resp)
+		}
+		startPos, endPos := resp.Span()
+		return f.FileChunkGet(c, taskParam, startPos, endPos, resp.Headers)
 	} else {
 		return util.ErrorMethodError(c)
 	}
 }
 
-func constructRespHeader(c echo.Context, pathInfo *common.PathsInfo, commit, fileName string) (map[string]string, string, int64, int64) {
-	var startPos, endPos int64
-	var clientHasRange bool
-	if pathInfo.Size > 0 { // There exists a file of size 0
-		var headRange = c.Request().Header.Get("Range")
-		defaultEndPos := pathInfo.Size - 1
-		if headRange != "" {
-			clientHasRange = true
-		} else {
-			headRange = fmt.Sprintf("bytes=%d-%d", 0, defaultEndPos)
-		}
-		startPos, endPos = parseRangeParams(headRange, defaultEndPos)
-		endPos = endPos + 1
-	} else if pathInfo.Size == 0 {
+// constructRespHeader 构造文件响应头，校验值与区间相关的头由util.NewRangeResponse写入
+func constructRespHeader(pathInfo *common.PathsInfo, commit, fileName string) map[string]string {
+	if pathInfo.Size == 0 { // There exists a file of size 0
 		zap.S().Warnf("file %s size: %d", fileName, pathInfo.Size)
 	}
 	respHeaders := map[string]string{}
-	respHeaders[consts.HUGGINGFACE_HEADER_CONTENT_LENGTH] = util.Itoa(endPos - startPos)
-	if clientHasRange && pathInfo.Size > 0 {
-		respHeaders["Content-Range"] = fmt.Sprintf("bytes %d-%d/%d", startPos, endPos-1, pathInfo.Size)
-	}
+	respHeaders[echo.HeaderContentType] = util.ContentTypeByName(fileName)
 	if commit != "" {
 		respHeaders[strings.ToLower(consts.HUGGINGFACE_HEADER_X_REPO_COMMIT)] = commit
 	}
-	var etag string
-	if pathInfo.Lfs.Oid != "" {
-		etag = pathInfo.Lfs.Oid
-	} else {
-		etag = pathInfo.Oid
-	}
-	respHeaders[consts.HUGGINGFACE_HEADER_X_LINKED_ETAG] = etag
+	respHeaders[consts.HUGGINGFACE_HEADER_X_LINKED_ETAG] = util.QuoteEtag(fileEtag(pathInfo))
 	respHeaders[consts.HUGGINGFACE_HEADER_X_LINKED_SIZE] = util.Itoa(pathInfo.Size)
-	if pathInfo.Location != "" {
+	if pathInfo.XXetHash != "" { // 未返回Link时客户端不会走Xet协议，仍按普通文件经本服务下载
+		respHeaders[consts.HUGGINGFACE_HEADER_X_XET_HASH] = pathInfo.XXetHash
+	}
+	if pathInfo.Location != "" && config.SysConfig.EnableXetRedirect() { // 开启重定向时客户端直连cas-bridge下载
 		// clientHost := c.Request().Host
 		// clientScheme := "http"
 		// if c.Request().TLS != nil {
@@ -266,10 +265,17 @@ func constructRespHeader(c echo.Context, pathInfo *common.PathsInfo, commit, fil
 		// hfEndPoint := fmt.Sprintf("%s://%s", clientScheme, clientHost)
 		// loc := strings.ReplaceAll(pathInfo.Location, config.SysConfig.GetXetURLBase(), hfEndPoint)
 		respHeaders[consts.HUGGINGFACE_LOCATION] = pathInfo.Location
-		respHeaders[consts.HUGGINGFACE_HEADER_X_XET_HASH] = pathInfo.XXetHash
 		respHeaders[consts.HUGGINGFACE_Link] = pathInfo.Link
 	}
-	return respHeaders, etag, startPos, endPos
+	return respHeaders
+}
+
+// fileEtag LFS文件取LFS对象的sha256，其他文件取git对象的sha1
+func fileEtag(pathInfo *common.PathsInfo) string {
+	if pathInfo.Lfs.Oid != "" {
+		return pathInfo.Lfs.Oid
+	}
+	return pathInfo.Oid
 }
 
 func GetAnalysisFilePosition(dingFile *downloader.DingCache, startPos, endPos int64) int64 {
@@ -277,47 +283,51 @@ func GetAnalysisFilePosition(dingFile *downloader.DingCache, startPos, endPos in
 	return offset
 }
 
-func (f *FileDao) ConstructBlobsAndFileFile(blobsFile, filesPath string) (err error) {
-	if err = util.MakeDirs(blobsFile); err != nil {
+// ConstructBlobsAndFileFile 创建仓库下的blob与resolve链接，返回数据实际存放的路径（sha256对象位于全局存储中）。
+func (f *FileDao) ConstructBlobsAndFileFile(blobsFile, filesPath string) (string, error) {
+	if err := util.MakeDirs(blobsFile); err != nil {
 		zap.S().Errorf("create %s dir err.%v", blobsFile, err)
-		return err
+		return "", err
 	}
-	if err = util.MakeDirs(filesPath); err != nil {
+	if err := util.MakeDirs(filesPath); err != nil {
 		zap.S().Errorf("create %s dir err.%v", filesPath, err)
-		return err
+		return "", err
 	}
 	if exist := util.FileExists(filesPath); exist {
 		if b, localErr := util.IsSymlink(filesPath); localErr != nil {
 			zap.S().Errorf("IsSymlink %s err.%v", filesPath, localErr)
-			return err
+			return "", localErr
 		} else {
 			if !b {
 				zap.S().Infof("old data transfer, from %s to %s", filesPath, blobsFile)
 				if blobFileExist := util.FileExists(blobsFile); blobFileExist {
-					if err = util.DeleteFile(filesPath); err != nil {
-						return err
+					if err := util.DeleteFile(filesPath); err != nil {
+						return "", err
 					}
 				} else {
 					util.ReName(filesPath, blobsFile)
 				}
-				if err = util.CreateSymlinkIfNotExists(blobsFile, filesPath); err != nil {
+				if err := util.CreateSymlinkIfNotExists(blobsFile, filesPath); err != nil {
 					zap.S().Errorf("filesPath:%s is not link.%v", filesPath, err)
-					return err
+					return "", err
 				}
 			}
 		}
-	} else {
-		err = util.CreateFileIfNotExist(blobsFile)
-		if err != nil {
-			zap.S().Errorf("create filesPath:%s err.%v", filesPath, err)
-			return err
-		}
-		if err = util.CreateSymlinkIfNotExists(blobsFile, filesPath); err != nil {
-			zap.S().Errorf("filesPath:%s is not link.%v", filesPath, err)
-			return err
-		}
 	}
-	return
+	storePath, err := downloader.LinkBlob(blobsFile)
+	if err != nil {
+		zap.S().Errorf("link blob %s err.%v", blobsFile, err)
+		return "", err
+	}
+	if err = util.CreateSymlinkIfNotExists(blobsFile, filesPath); err != nil {
+		zap.S().Errorf("filesPath:%s is not link.%v", filesPath, err)
+		return "", err
+	}
+	return storePath, nil
+}
+
+func pathsInfoCachePath(repoType, orgRepo, commit, fileName string) string {
+	return fmt.Sprintf("%s/api/%s/%s/paths-info/%s/%s/paths-info_post.json", config.SysConfig.Repos(), repoType, orgRepo, commit, fileName)
 }
 
 func (f *FileDao) GetPathsInfo(hfUri, repoType, orgRepo, commit, authorization string, pathFileName string) (*common.PathsInfo, error) {
@@ -325,7 +335,7 @@ func (f *FileDao) GetPathsInfo(hfUri, repoType, orgRepo, commit, authorization s
 	if pathFileName == "" {
 		return nil, fmt.Errorf("pathFileName is null, %s/%s", orgRepo, commit)
 	}
-	apiPathInfoPath := fmt.Sprintf("%s/api/%s/%s/paths-info/%s/%s/paths-info_post.json", config.SysConfig.Repos(), repoType, orgRepo, commit, pathFileName)
+	apiPathInfoPath := pathsInfoCachePath(repoType, orgRepo, commit, pathFileName)
 	// 对每个用户检测是否有权限，在线、离线都检测，都需要携带token。
 	filePathInfoKey := GetFilePathInfoKey(repoType, orgRepo, authorization)
 	_, granted := f.baseData.Cache.Get(filePathInfoKey)
@@ -339,7 +349,7 @@ func (f *FileDao) GetPathsInfo(hfUri, repoType, orgRepo, commit, authorization s
 					zap.S().Errorf("pathsInfo Unmarshal err.%v", err)
 				} else {
 					if len(pathsInfos) > 0 {
-						if pathsInfos[0].Size > consts.MAX_HTTP_DOWNLOAD_SIZE {
+						if pathsInfos[0].Size > consts.MAX_HTTP_DOWNLOAD_SIZE && config.SysConfig.EnableXetRedirect() && util.UpstreamOnline() { // 重定向地址带有时效签名，需重新解析；离线时由本服务提供已缓存的数据
 							goto requestRemoteFileInfo
 						} else {
 							return &pathsInfos[0], nil
@@ -369,13 +379,21 @@ requestRemoteFileInfo:
 		} else {
 			return nil, myerr.NewAppendCode(http.StatusNotFound, "remoteRespPathsInfos is null")
 		}
-		if pathInfo.Size > consts.MAX_HTTP_DOWNLOAD_SIZE {
+		// paths-info未返回xetHash的大文件，通过resolve的响应头确认是否存放在Xet存储
+		if pathInfo.Size > consts.MAX_HTTP_DOWNLOAD_SIZE && (pathInfo.XXetHash == "" || config.SysConfig.EnableXetRedirect()) {
 			if resolveResp, err := f.requestFileResolve(hfUri, authorization); err != nil {
 				return nil, err
 			} else {
-				pathInfo.XXetHash = resolveResp.GetKey(consts.HUGGINGFACE_HEADER_X_XET_HASH)
-				pathInfo.Location = resolveResp.GetKey(consts.HUGGINGFACE_LOCATION)
-				pathInfo.Link = resolveResp.GetKey(consts.HUGGINGFACE_Link)
+				if xetHash := resolveResp.GetKey(consts.HUGGINGFACE_HEADER_X_XET_HASH); xetHash != "" {
+					pathInfo.XXetHash = xetHash
+				}
+				if linkedSize := resolveResp.GetKey(consts.HUGGINGFACE_HEADER_X_LINKED_SIZE); linkedSize != "" && linkedSize != util.Itoa(pathInfo.Size) {
+					zap.S().Warnf("resolve size %s differs from paths-info size %d, %s", linkedSize, pathInfo.Size, hfUri)
+				}
+				if config.SysConfig.EnableXetRedirect() {
+					pathInfo.Location = resolveResp.GetKey(consts.HUGGINGFACE_LOCATION)
+					pathInfo.Link = resolveResp.GetKey(consts.HUGGINGFACE_Link)
+				}
 			}
 		}
 		ret := []*common.PathsInfo{pathInfo}
@@ -448,31 +466,94 @@ func (f *FileDao) requestFilePathInfo(pathsInfoUri, authorization string, filePa
 }
 
 func (f *FileDao) FileChunkGet(c echo.Context, taskParam *downloader.TaskParam, startPos, endPos int64, respHeaders map[string]string) error {
-	responseChan := make(chan []byte, config.SysConfig.Download.RespChanSize)
+	responseChan := make(chan util.Chunk, config.SysConfig.Download.RespChanSize)
 	source := util.Itoa(c.Get(consts.PromSource))
-	bgCtx := context.WithValue(c.Request().Context(), consts.PromSource, source)
+	// 下载不随请求自动取消，客户端断开后按策略决定取消还是在后台继续
+	bgCtx, discard := downloader.WithDiscardOutput(context.WithValue(context.WithoutCancel(c.Request().Context()), consts.PromSource, source))
 	ctx, cancel := context.WithCancel(bgCtx)
+	detached := false
 	defer func() {
-		cancel()
+		if !detached {
+			cancel()
+		}
 	}()
 	var isInnerRequest bool
 	if value := c.Request().Header.Get(consts.RequestSourceInner); value == "1" {
 		isInnerRequest = true
+		taskParam.Priority = downloader.PriorityInner
+	}
+	fileName := fmt.Sprintf("%s/%s", taskParam.OrgRepo, taskParam.FileName)
+	if cachedFile, ok := f.downloaderDao.OpenCachedRange(startPos, endPos, taskParam); ok { // 已全部缓存，直接发送文件内容
+		defer cachedFile.Close()
+		if err := util.ResponseContent(c, fileName, respHeaders, cachedFile, endPos-startPos); err != nil {
+			zap.S().Errorf("FileChunkGet content err.%v", err)
+			return util.ErrorProxyTimeout(c)
+		}
+		return nil
 	}
 	taskParam.Context = ctx
 	taskParam.ResponseChan = responseChan
 	taskParam.Cancel = cancel
-	fileName := fmt.Sprintf("%s/%s", taskParam.OrgRepo, taskParam.FileName)
 	if err := f.downloaderDao.FileDownload(startPos, endPos, isInnerRequest, taskParam); err != nil {
 		return util.MultipleErrorProxyError(err, c)
 	}
-	if err := util.ResponseStream(c, fileName, respHeaders, responseChan); err != nil {
+	if err := util.ResponsePooledStream(c, fileName, respHeaders, responseChan, endPos-startPos); err != nil {
 		zap.S().Errorf("FileChunkGet stream err.%v", err)
+		if errors.Is(err, util.ErrShortResponse) { // 下载失败，已发送的长度不足，连接将被断开
+			return err
+		}
+		if release, ok := f.downloaderDao.DownloadThrough(startPos, endPos, taskParam); ok {
+			detached = true
+			discard()
+			zap.S().Infof("client disconnected, continue downloading %s(%d-%d) in background", fileName, startPos, endPos)
+			go func() {
+				defer release()
+				defer cancel()
+				for chunk := range responseChan { // 丢弃远程任务的输出，写满缓存后关闭
+					chunk.Release()
+				}
+			}()
+		}
 		return util.ErrorProxyTimeout(c)
 	}
 	return nil
 }
 
+// FileRangesGet 以multipart/byteranges发送多个区间，各区间依次从缓存读取或回源下载。
+func (f *FileDao) FileRangesGet(c echo.Context, taskParam *downloader.TaskParam, resp *util.RangeResponse) error {
+	return resp.Write(c, func(start, end int64) error {
+		if err := f.writeRange(c, *taskParam, start, end); err != nil { // 响应已开始，只能中断连接
+			zap.S().Errorf("FileRangesGet %s/%s(%d-%d) err.%v", taskParam.OrgRepo, taskParam.FileName, start, end, err)
+			return err
+		}
+		return nil
+	})
+}
+
+// writeRange 将[startPos,endPos)写入响应体，已全部缓存时直接读取文件
+func (f *FileDao) writeRange(c echo.Context, taskParam downloader.TaskParam, startPos, endPos int64) error {
+	fileName := fmt.Sprintf("%s/%s", taskParam.OrgRepo, taskParam.FileName)
+	if cachedFile, ok := f.downloaderDao.OpenCachedRange(startPos, endPos, &taskParam); ok {
+		defer cachedFile.Close()
+		return util.WriteContent(c, fileName, cachedFile, endPos-startPos)
+	}
+	source := util.Itoa(c.Get(consts.PromSource))
+	ctx, cancel := context.WithCancel(context.WithValue(c.Request().Context(), consts.PromSource, source))
+	defer cancel()
+	responseChan := make(chan util.Chunk, config.SysConfig.Download.RespChanSize)
+	taskParam.Context = ctx
+	taskParam.ResponseChan = responseChan
+	taskParam.Cancel = cancel
+	isInnerRequest := c.Request().Header.Get(consts.RequestSourceInner) == "1"
+	if isInnerRequest {
+		taskParam.Priority = downloader.PriorityInner
+	}
+	if err := f.downloaderDao.FileDownload(startPos, endPos, isInnerRequest, &taskParam); err != nil {
+		return err
+	}
+	return util.WritePooledStream(c, fileName, responseChan, endPos-startPos)
+}
+
 func (f *FileDao) WriteCacheRequest(apiPath string, statusCode int, headers map[string]string, content []byte) error {
 	lock := f.lockDao.getMetaFileLock(apiPath)
 	lock.Lock()
@@ -510,6 +591,7 @@ func (f *FileDao) ReadCacheRequest(apiPath string) (*common.CacheContent, error)
 		return nil, myerr.Wrap("DecodeString err.", err)
 	}
 	cacheContent.OriginContent = decodeByte
+	cacheContent.ModTime = util.GetFileModTime(apiPath)
 	return &cacheContent, nil
 }
 
@@ -530,33 +612,7 @@ func (f *FileDao) GetFileOffset(dataType string, org string, repo string, etag s
 		zap.S().Errorf("GetDingFile err.dingFile is nil,blobsFile:%s", blobsFile)
 		return 0
 	}
+	defer dingFile.Close()
 	curPos := GetAnalysisFilePosition(dingFile, 0, fileSize)
 	return curPos
 }
-
-func parseRangeParams(fileRange string, defaultEndPos int64) (int64, int64) {
-	if strings.Contains(fileRange, "/") {
-		split := strings.SplitN(fileRange, "/", 2)
-		fileRange = split[0]
-	}
-	if strings.HasPrefix(fileRange, "bytes=") {
-		fileRange = fileRange[6:]
-	}
-	parts := strings.Split(fileRange, "-")
-	if len(parts) != 2 {
-		panic("file range err.")
-	}
-	s1, s2 := util.Atoi64(parts[0]), util.Atoi64(parts[1])
-	var startPos, endPos int64
-	if s1 != 0 {
-		startPos = s1
-	} else {
-		startPos = 0
-	}
-	if s2 != 0 {
-		endPos = s2
-	} else {
-		endPos = defaultEndPos
-	}
-	return startPos, endPos
-}
@@ -19,6 +19,7 @@ import (
 	"net/http"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"dingospeed/internal/data"
 	"dingospeed/pkg/common"
@@ -120,7 +121,7 @@ func (m *MetaDao) GetMetadata(repoType, orgRepo, revision, method, authorization
 	}
 	apiDir := fmt.Sprintf("%s/api/%s/%s/revision/%s", config.SysConfig.Repos(), repoType, orgRepo, commitSha)
 	apiMetaPath := fmt.Sprintf("%s/%s", apiDir, fmt.Sprintf("meta_%s.json", method))
-	if config.SysConfig.Online() {
+	if util.UpstreamOnline() {
 		if util.FileExists(apiMetaPath) {
 			if cacheContent, err = m.fileDao.ReadCacheRequest(apiMetaPath); err != nil {
 				zap.S().Errorf("ReadCacheRequest err.%v", err)
@@ -181,6 +182,7 @@ func (m *MetaDao) requestAndSaveMeta(repoType, orgRepo, revision, commitSha, met
 		StatusCode:    resp.StatusCode,
 		Headers:       extractHeaders,
 		OriginContent: resp.Body,
+		ModTime:       time.Now(),
 	}, nil
 }
 
@@ -23,27 +23,19 @@ import (
 
 var BaseDataProvider = wire.NewSet(NewBaseData)
 
-// 缓存预读取的文件块，默认每个文件16个块
-
 type BaseData struct {
 	Cache *cache.Cache
 }
 
 func NewBaseData() *BaseData {
 	gCache := cache.New(config.SysConfig.GetDefaultExpiration(), config.SysConfig.GetCleanupInterval())
-	initGlobal(gCache)
+	initGlobal()
 	return &BaseData{
 		Cache: gCache,
 	}
 }
 
-func initGlobal(gCache *cache.Cache) {
-	if FileBlockCache == nil {
-		// 默认使用ristretto
-		FileBlockCache = &GoCache{
-			GCache: gCache,
-		}
-	}
+func initGlobal() {
 	if config.SysConfig.IsCluster() {
 		fileProcessChan = make(chan *FileProcessParam, 100)
 		localOperationChan = make(chan *LocalOperation, 100)
@@ -29,10 +29,7 @@ type FileProcessParam struct {
 	Status    int32  `json:"status"`
 }
 
-// 缓存预读取的文件块，默认每个文件16个块
-
 var (
-	FileBlockCache     Cache
 	fileProcessChan    chan *FileProcessParam
 	localOperationChan chan *LocalOperation
 )
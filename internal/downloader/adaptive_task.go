@@ -0,0 +1,291 @@
+//  Copyright (c) 2025 dingodb.com, Inc. All Rights Reserved
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http:www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package downloader
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+	"time"
+
+	"dingospeed/pkg/config"
+
+	"go.uber.org/zap"
+)
+
+const (
+	adaptiveSampleInterval = time.Second      // 吞吐采样周期
+	adaptiveThrottleHold   = 10 * time.Second // 被限流后暂停增加连接的时长
+	adaptiveGrowthRatio    = 1.1              // 吞吐提升超过该比例才继续增加连接
+)
+
+// AdaptiveRemoteTask 自适应分段下载一个连续的远程区间。先按InitialRanges均分，按整体吞吐逐步增加连接，
+// 连接空闲时拆分剩余最多的分段（work stealing），上游返回429/503时连接数减半。分段按区间顺序输出。
+// 配置了多个上游时，每个上游各自增减连接，速度快的上游拆走更多区间，出错的上游不再使用，其未完成的区间交给其他上游。
+// 只剩一个可用上游时，未完成的区间按退避间隔在该上游上重试，超过重试次数后取消请求。
+type AdaptiveRemoteTask struct {
+	*DownloadTask
+	newSegment func(startPos, endPos int64) *RemoteFileTask
+	mu         sync.Mutex
+	sources    []*sourceState
+	segments   []*RemoteFileTask // 按区间顺序排列
+	pending    []*RemoteFileTask // 尚未开始下载的分段
+	running    map[*RemoteFileTask]*sourceState
+	owner      map[*RemoteFileTask]*sourceState  // 分段由哪个上游下载
+	settled    map[*RemoteFileTask]chan struct{} // 分段结束且剩余区间已重新排入后关闭
+	retries    int                               // 在同一上游上重试的次数
+	waiting    int                               // 等待退避结束的分段数
+	done       chan struct{}
+	doneOnce   sync.Once
+}
+
+// sourceState 一个上游的连接数与吞吐
+type sourceState struct {
+	upstream       *config.Upstream // 为空时按默认方式选择上游
+	limit          int              // 当前允许的连接数
+	running        int
+	failed         bool
+	bestRate       float64
+	lastReceived   int64
+	throttledUntil time.Time
+}
+
+func NewAdaptiveRemoteTask(taskNo int, rangeStartPos, rangeEndPos int64, upstreams []config.Upstream, newSegment func(startPos, endPos int64) *RemoteFileTask) *AdaptiveRemoteTask {
+	a := &AdaptiveRemoteTask{
+		DownloadTask: &DownloadTask{TaskNo: taskNo, RangeStartPos: rangeStartPos, RangeEndPos: rangeEndPos},
+		newSegment:   newSegment,
+		running:      make(map[*RemoteFileTask]*sourceState),
+		owner:        make(map[*RemoteFileTask]*sourceState),
+		settled:      make(map[*RemoteFileTask]chan struct{}),
+		done:         make(chan struct{}),
+	}
+	initial := config.SysConfig.GetAdaptiveInitialRanges()
+	for i := range upstreams {
+		a.sources = append(a.sources, &sourceState{upstream: &upstreams[i], limit: initial})
+	}
+	if len(a.sources) == 0 {
+		a.sources = append(a.sources, &sourceState{limit: initial})
+	}
+	for _, r := range splitEvenly(rangeStartPos, rangeEndPos, initial*len(a.sources), config.SysConfig.GetAdaptiveMinSplitSize(), config.SysConfig.Download.BlockSize) {
+		segment := a.newSegment(r[0], r[1])
+		a.segments = append(a.segments, segment)
+		a.pending = append(a.pending, segment)
+	}
+	return a
+}
+
+// splitEvenly 将区间在块边界处均分为最多n段，每段不小于minSize。
+func splitEvenly(startPos, endPos int64, n int, minSize, blockSize int64) [][2]int64 {
+	n = int(max(min(int64(n), (endPos-startPos)/max(minSize, 1)), 1))
+	ranges := make([][2]int64, 0, n)
+	step := (endPos - startPos) / int64(n)
+	for i := 0; i < n; i++ {
+		end := endPos
+		if i < n-1 {
+			end = (startPos + step + blockSize - 1) / blockSize * blockSize
+			if end >= endPos {
+				end = endPos
+			}
+		}
+		ranges = append(ranges, [2]int64{startPos, end})
+		startPos = end
+		if startPos >= endPos {
+			break
+		}
+	}
+	return ranges
+}
+
+func (a *AdaptiveRemoteTask) DoTask() {
+	zap.S().Infof("start adaptive dotask:%s/%s, taskNo:%d, startPos:%d, endPos:%d, ranges:%d, sources:%d", a.OrgRepo, a.FileName, a.TaskNo, a.RangeStartPos, a.RangeEndPos, len(a.segments), len(a.sources))
+	ticker := time.NewTicker(adaptiveSampleInterval)
+	defer ticker.Stop()
+	a.mu.Lock()
+	a.fill()
+	a.mu.Unlock()
+	for {
+		select {
+		case <-a.done: // 分段自身会响应Context取消，这里等待全部分段退出
+			zap.S().Infof("end adaptive dotask:%s/%s, taskNo:%d, ranges:%d", a.OrgRepo, a.FileName, a.TaskNo, len(a.segments))
+			return
+		case <-ticker.C:
+			a.mu.Lock()
+			received := make(map[*sourceState]int64, len(a.sources))
+			for segment, src := range a.owner {
+				received[src] += segment.received()
+			}
+			for _, src := range a.sources {
+				rate := float64(received[src]-src.lastReceived) / adaptiveSampleInterval.Seconds()
+				src.lastReceived = received[src]
+				// 连接全部在用且吞吐仍在提升时，再增加一个连接
+				if !src.failed && time.Now().After(src.throttledUntil) && src.running >= src.limit &&
+					src.limit < config.SysConfig.Download.GoroutineMaxNumPerFile && rate > src.bestRate*adaptiveGrowthRatio {
+					src.limit++
+					src.bestRate = rate
+				}
+			}
+			a.fill()
+			a.mu.Unlock()
+		}
+	}
+}
+
+// fill 在各上游连接数允许的范围内启动分段，调用方需持有mu。
+func (a *AdaptiveRemoteTask) fill() {
+	for _, src := range a.sources {
+		for !src.failed && src.running < src.limit && a.Context.Err() == nil {
+			segment := a.next()
+			if segment == nil {
+				break
+			}
+			a.start(src, segment)
+		}
+	}
+	if len(a.running) == 0 && a.waiting == 0 {
+		a.doneOnce.Do(func() { close(a.done) })
+	}
+}
+
+func (a *AdaptiveRemoteTask) start(src *sourceState, segment *RemoteFileTask) {
+	if src.upstream != nil {
+		segment.Source = src.upstream
+		segment.Domain = src.upstream.Domain
+	}
+	segment.OnThrottle = func(wait time.Duration) {
+		a.onThrottle(src, wait)
+	}
+	segment.OnError = func(error) bool {
+		return true // 由run改用其他上游或重试剩余区间
+	}
+	src.running++
+	a.running[segment] = src
+	a.owner[segment] = src
+	a.settled[segment] = make(chan struct{})
+	go a.run(segment)
+}
+
+func (a *AdaptiveRemoteTask) run(segment *RemoteFileTask) {
+	segment.DoTask()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	src := a.running[segment]
+	delete(a.running, segment)
+	src.running--
+	if startPos, endPos := segment.unfinished(); startPos < endPos && a.Context.Err() == nil {
+		a.retry(src, segment, startPos, endPos)
+	}
+	close(a.settled[segment])
+	a.fill()
+}
+
+// retry 分段未能下载完，剩余区间紧跟在原分段之后重新下载。有其他可用上游时停用该上游，交给其他上游；
+// 否则按退避间隔在该上游上重试，超过重试次数后取消请求。
+func (a *AdaptiveRemoteTask) retry(src *sourceState, segment *RemoteFileTask, startPos, endPos int64) {
+	zap.S().Warnf("%s/%s, taskNo:%d, source %s failed at %d-%d", a.OrgRepo, a.FileName, a.TaskNo, segment.Domain, startPos, endPos)
+	if slices.ContainsFunc(a.sources, func(s *sourceState) bool { return s != src && !s.failed }) {
+		src.failed = true
+		rest := a.newSegment(startPos, endPos)
+		a.segments = slices.Insert(a.segments, slices.Index(a.segments, segment)+1, rest)
+		a.pending = slices.Insert(a.pending, 0, rest)
+		return
+	}
+	if a.retries >= int(config.SysConfig.Retry.Attempts) {
+		segment.Cancel()
+		return
+	}
+	delay := min(config.SysConfig.GetRetryDelay()<<a.retries, config.SysConfig.GetRetryMaxDelay())
+	a.retries++
+	rest := a.newSegment(startPos, endPos)
+	a.segments = slices.Insert(a.segments, slices.Index(a.segments, segment)+1, rest)
+	a.waiting++
+	go func() {
+		select {
+		case <-time.After(delay):
+		case <-a.Context.Done():
+		}
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		a.waiting--
+		a.pending = slices.Insert(a.pending, 0, rest)
+		a.fill()
+	}()
+}
+
+// next 优先取未开始的分段，否则从剩余最多的分段拆出后半部分。
+func (a *AdaptiveRemoteTask) next() *RemoteFileTask {
+	if len(a.pending) > 0 {
+		segment := a.pending[0]
+		a.pending = a.pending[1:]
+		return segment
+	}
+	type candidate struct {
+		segment   *RemoteFileTask
+		remaining int64
+	}
+	victims := make([]candidate, 0, len(a.running))
+	for segment := range a.running {
+		victims = append(victims, candidate{segment: segment, remaining: segment.remaining()})
+	}
+	slices.SortFunc(victims, func(x, y candidate) int {
+		return cmp.Compare(y.remaining, x.remaining)
+	})
+	for _, c := range victims {
+		victim := c.segment
+		startPos, endPos, ok := victim.trySplit(config.SysConfig.GetAdaptiveMinSplitSize(), config.SysConfig.GetAdaptiveMinStealTime())
+		if !ok {
+			continue
+		}
+		segment := a.newSegment(startPos, endPos)
+		i := slices.Index(a.segments, victim)
+		a.segments = slices.Insert(a.segments, i+1, segment)
+		zap.S().Debugf("%s/%s, taskNo:%d, split range %d-%d, ranges:%d", a.OrgRepo, a.FileName, a.TaskNo, startPos, endPos, len(a.segments))
+		return segment
+	}
+	return nil
+}
+
+// onThrottle 上游限流，该上游连接数减半，并在一段时间内不再增加连接。
+func (a *AdaptiveRemoteTask) onThrottle(src *sourceState, wait time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	src.limit = max(src.limit/2, 1)
+	src.bestRate = 0
+	src.throttledUntil = time.Now().Add(max(wait, adaptiveThrottleHold))
+}
+
+// OutResult 按区间顺序输出各分段。拆分出的分段总是插在被拆分段之后，而被拆分段尚未输出完，因此顺序遍历即可。
+// 分段失败后剩余区间在其结束后才插入，需等分段结算完再取下一段。
+func (a *AdaptiveRemoteTask) OutResult() {
+	for i := 0; a.Context.Err() == nil; i++ {
+		a.mu.Lock()
+		if i >= len(a.segments) {
+			a.mu.Unlock()
+			return
+		}
+		segment := a.segments[i]
+		a.mu.Unlock()
+		segment.OutResult()
+		a.mu.Lock()
+		settled := a.settled[segment]
+		a.mu.Unlock()
+		if settled != nil {
+			select {
+			case <-settled:
+			case <-a.Context.Done():
+				return
+			}
+		}
+	}
+}
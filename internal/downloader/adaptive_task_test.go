@@ -0,0 +1,155 @@
+//  Copyright (c) 2025 dingodb.com, Inc. All Rights Reserved
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http:www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"dingospeed/pkg/config"
+	"dingospeed/pkg/util"
+)
+
+func TestAdaptiveRemoteTask(t *testing.T) {
+	content := setupAdaptiveTest()
+	server := httptest.NewServer(rangeHandler(content, func(start int64) time.Duration {
+		if start > 0 { // 后半部分下载较慢，前半部分完成后应被拆分
+			return 10 * time.Millisecond
+		}
+		return 0
+	}))
+	defer server.Close()
+	task, dingFile := runAdaptiveTask(t, content, nil, server.URL)
+	if len(task.segments) <= 2 {
+		t.Fatalf("slow range should be split, segments:%d", len(task.segments))
+	}
+	for i := int64(0); i < dingFile.getBlockNumber(); i++ {
+		if exist, _ := dingFile.HasBlock(i); !exist {
+			t.Fatalf("block %d should be cached", i)
+		}
+	}
+}
+
+func TestMultiSourceTask(t *testing.T) {
+	content := setupAdaptiveTest()
+	good := httptest.NewServer(rangeHandler(content, func(int64) time.Duration { return time.Millisecond }))
+	defer good.Close()
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer bad.Close()
+	upstreams := []config.Upstream{{Domain: bad.URL}, {Domain: good.URL}}
+	task, _ := runAdaptiveTask(t, content, upstreams, "")
+	if !task.sources[0].failed || task.sources[1].failed {
+		t.Fatalf("only the bad source should be disabled")
+	}
+}
+
+func TestAdaptiveRetry(t *testing.T) {
+	content := setupAdaptiveTest()
+	var failed atomic.Bool
+	serve := rangeHandler(content, func(int64) time.Duration { return 0 })
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if failed.CompareAndSwap(false, true) { // 只有一个上游，出错的区间退避后在同一上游上重试
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		serve(w, req)
+	}))
+	defer server.Close()
+	task, _ := runAdaptiveTask(t, content, nil, server.URL)
+	if task.retries != 1 || task.sources[0].failed {
+		t.Fatalf("failed range should be retried on the same source, retries:%d", task.retries)
+	}
+}
+
+func setupAdaptiveTest() []byte {
+	config.SysConfig = &config.Config{}
+	config.SysConfig.Retry.Attempts = 1
+	config.SysConfig.Download.RespChunkSize = 512
+	config.SysConfig.Download.GoroutineMaxNumPerFile = 4
+	config.SysConfig.Download.BlockSize = 1024
+	config.SysConfig.Download.AdaptiveRange = config.AdaptiveRange{Enabled: true, InitialRanges: 2, MinSplitSize: 2048, MinStealTime: 1}
+	content := make([]byte, 1024*16+100)
+	for i := range content {
+		content[i] = byte(i % 253)
+	}
+	return content
+}
+
+func rangeHandler(content []byte, delay func(start int64) time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		var start, end int64
+		if _, err := fmt.Sscanf(req.Header.Get("Range"), "bytes=%d-%d", &start, &end); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Length", util.Itoa(end-start+1))
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(content)))
+		w.WriteHeader(http.StatusPartialContent)
+		for pos := start; pos <= end; pos += 512 {
+			time.Sleep(delay(start))
+			if _, err := w.Write(content[pos:min(pos+512, end+1)]); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+		}
+	}
+}
+
+// runAdaptiveTask 下载整个文件，校验输出顺序与内容
+func runAdaptiveTask(t *testing.T, content []byte, upstreams []config.Upstream, domain string) (*AdaptiveRemoteTask, *DingCache) {
+	blockSize := config.SysConfig.Download.BlockSize
+	dingFile := newTestFile(t, filepath.Join(t.TempDir(), "cachefile"), blockSize, int64(len(content)))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	responseChan := make(chan util.Chunk, 1024)
+	task := NewAdaptiveRemoteTask(0, 0, int64(len(content)), upstreams, func(startPos, endPos int64) *RemoteFileTask {
+		r := NewRemoteFileTask(0, startPos, endPos)
+		r.Context = ctx
+		r.Cancel = cancel
+		r.DingFile = dingFile
+		r.Domain = domain
+		r.Queue = make(chan util.Chunk, 1024)
+		r.ResponseChan = responseChan
+		return r
+	})
+	task.Context = ctx
+	task.ResponseChan = responseChan
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		task.DoTask()
+	}()
+	task.OutResult()
+	<-finished
+	close(responseChan)
+	var got []byte
+	for chunk := range responseChan {
+		got = append(got, chunk.Data...)
+		chunk.Release()
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatalf("adaptive output mismatch, got %d bytes", len(got))
+	}
+	return task, dingFile
+}
@@ -68,6 +68,19 @@ func (b *Bitset) Test(index uint64) (bool, error) {
 	return (b.bits[byteIndex] & (1 << bitIndex)) != 0, nil
 }
 
+// Resize 返回指定大小的新 Bitset，保留原有的位，缩小时清除超出范围的位
+func (b *Bitset) Resize(size uint64) *Bitset {
+	n := NewBitset(size)
+	if b == nil {
+		return n
+	}
+	copy(n.bits, b.bits)
+	if tail := size % 8; tail != 0 && len(n.bits) > 0 {
+		n.bits[len(n.bits)-1] &= byte(1<<tail) - 1
+	}
+	return n
+}
+
 // String 返回 Bitset 的字符串表示
 func (b *Bitset) String() string {
 	result := ""
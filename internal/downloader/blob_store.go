@@ -0,0 +1,313 @@
+//  Copyright (c) 2025 dingodb.com, Inc. All Rights Reserved
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http:www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"dingospeed/pkg/config"
+	"dingospeed/pkg/util"
+
+	"github.com/bytedance/sonic"
+	"go.uber.org/zap"
+)
+
+const (
+	// BlobStoreDir 全局内容寻址存储目录，位于repos/files下，按sha256 etag存放各仓库共享的LFS对象。
+	BlobStoreDir = ".store"
+	RefsSuffix   = ".refs"
+)
+
+// storeLock 保护全局存储中对象的创建、删除与引用计数
+var storeLock sync.Mutex
+
+// BlobRefs 全局存储对象的引用记录，Refs为引用该对象的仓库blob链接（相对repos/files的路径）。
+type BlobRefs struct {
+	Refs []string `json:"refs"`
+}
+
+func filesRoot() string {
+	return filepath.Join(config.SysConfig.Repos(), "files")
+}
+
+// IsSharedEtag etag为sha256时，对象进入全局存储；git sha1的普通小文件仍按仓库存放。
+func IsSharedEtag(etag string) bool {
+	algorithm, _ := hashAlgorithm(etag)
+	return algorithm == algorithmSha256
+}
+
+// GetStorePath 返回etag在全局存储中的路径：files/.store/<etag前两位>/<etag>
+func GetStorePath(etag string) string {
+	return filepath.Join(filesRoot(), BlobStoreDir, strings.ToLower(etag[:2]), strings.ToLower(etag))
+}
+
+// IsStorePath 路径是否位于全局存储中
+func IsStorePath(path string) bool {
+	rel, err := filepath.Rel(filepath.Join(filesRoot(), BlobStoreDir), path)
+	return err == nil && !strings.HasPrefix(rel, "..")
+}
+
+func getRefsPath(storePath string) string {
+	return storePath + RefsSuffix
+}
+
+// GetBlobRefs 返回引用全局存储对象的仓库blob链接（绝对路径）
+func GetBlobRefs(storePath string) []string {
+	refs := readRefs(storePath)
+	paths := make([]string, 0, len(refs.Refs))
+	for _, ref := range refs.Refs {
+		paths = append(paths, filepath.Join(filesRoot(), ref))
+	}
+	return paths
+}
+
+func readRefs(storePath string) *BlobRefs {
+	refs := &BlobRefs{}
+	b, err := os.ReadFile(getRefsPath(storePath))
+	if err != nil {
+		return refs
+	}
+	if err = sonic.Unmarshal(b, refs); err != nil {
+		zap.S().Warnf("unmarshal refs err. %s, %v", storePath, err)
+	}
+	return refs
+}
+
+func writeRefs(storePath string, refs *BlobRefs) error {
+	if len(refs.Refs) == 0 {
+		if err := os.Remove(getRefsPath(storePath)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return util.WriteDataToFile(getRefsPath(storePath), refs)
+}
+
+// LinkBlob 将仓库下的blob链接到全局存储并增加引用计数，返回数据实际存放的路径。
+// 仓库下已有的普通blob文件会被移入全局存储，全局存储中已有相同对象时保留更完整的一份。
+func LinkBlob(repoBlobPath string) (string, error) {
+	etag := filepath.Base(repoBlobPath)
+	if !IsSharedEtag(etag) {
+		return repoBlobPath, util.CreateFileIfNotExist(repoBlobPath)
+	}
+	storePath := GetStorePath(etag)
+	if isLinkedTo(repoBlobPath, storePath) {
+		return storePath, nil
+	}
+	storeLock.Lock()
+	defer storeLock.Unlock()
+	if err := util.MakeDirs(storePath); err != nil {
+		return "", err
+	}
+	if info, err := os.Lstat(repoBlobPath); err == nil {
+		if info.Mode()&os.ModeSymlink != 0 { // 失效或指向其他位置的链接，重新创建
+			if err = os.Remove(repoBlobPath); err != nil {
+				return "", err
+			}
+		} else if err = adoptBlob(repoBlobPath, storePath); errors.Is(err, ErrBlobInUse) { // 仓库下的blob正被使用，暂不并入
+			zap.S().Infof("blob %s is in use, adopt it later", repoBlobPath)
+			return repoBlobPath, nil
+		} else if err != nil {
+			return "", err
+		}
+	}
+	if err := util.CreateFileIfNotExist(storePath); err != nil {
+		return "", err
+	}
+	if err := util.CreateSymlinkIfNotExists(storePath, repoBlobPath); err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(filesRoot(), repoBlobPath)
+	if err != nil {
+		return "", err
+	}
+	refs := readRefs(storePath)
+	if !slices.Contains(refs.Refs, rel) {
+		refs.Refs = append(refs.Refs, rel)
+		if err = writeRefs(storePath, refs); err != nil {
+			return "", err
+		}
+	}
+	return storePath, nil
+}
+
+// IsStoreLink 路径是否为仓库下指向全局存储的blob链接
+func IsStoreLink(path string) bool {
+	target, err := os.Readlink(path)
+	if err != nil {
+		return false
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(path), target)
+	}
+	return IsStorePath(target)
+}
+
+func isLinkedTo(repoBlobPath, storePath string) bool {
+	linkInfo, err := os.Stat(repoBlobPath)
+	if err != nil {
+		return false
+	}
+	storeInfo, err := os.Stat(storePath)
+	return err == nil && os.SameFile(linkInfo, storeInfo)
+}
+
+// adoptBlob 将仓库下的普通blob文件并入全局存储，调用方需持有storeLock。
+// 仓库下的blob正被使用时返回ErrBlobInUse；全局存储中的对象正被使用时只删除仓库下的重复文件。
+func adoptBlob(repoBlobPath, storePath string) error {
+	m := GetInstance()
+	return m.whenClosed(func() error {
+		if !util.FileExists(storePath) || (!m.inUse(storePath) && cachedBlocks(repoBlobPath) > cachedBlocks(storePath)) {
+			zap.S().Infof("move blob %s to store %s", repoBlobPath, storePath)
+			if err := os.Rename(repoBlobPath, storePath); err != nil {
+				return err
+			}
+			GetBlockCache().RemoveFile(repoBlobPath)
+			GetBlockCache().RemoveFile(storePath)
+			_ = os.Remove(GetVerifyPath(storePath))
+			if util.FileExists(GetVerifyPath(repoBlobPath)) {
+				return os.Rename(GetVerifyPath(repoBlobPath), GetVerifyPath(storePath))
+			}
+			return nil
+		}
+		zap.S().Infof("blob %s already in store, remove duplicate", repoBlobPath)
+		_ = os.Remove(GetVerifyPath(repoBlobPath))
+		GetBlockCache().RemoveFile(repoBlobPath)
+		return os.Remove(repoBlobPath)
+	}, repoBlobPath)
+}
+
+// cachedBlocks 返回缓存文件中已下载的块数量，无法识别时返回-1。
+func cachedBlocks(path string) int64 {
+	header, err := readHeader(path)
+	if err != nil {
+		return -1
+	}
+	var n int64
+	for i := uint64(0); i < header.BlockNumber; i++ {
+		if ok, _ := header.BlockMask.Test(i); ok {
+			n++
+		}
+	}
+	return n
+}
+
+// UnlinkBlob 删除仓库下指向全局存储的blob链接并减少引用计数，计数归零时删除对象，返回释放的磁盘空间。
+func UnlinkBlob(repoBlobPath string) (int64, error) {
+	target, err := os.Readlink(repoBlobPath)
+	if err != nil {
+		return 0, err
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(repoBlobPath), target)
+	}
+	storeLock.Lock()
+	defer storeLock.Unlock()
+	if err = os.Remove(repoBlobPath); err != nil {
+		return 0, err
+	}
+	GetBlockCache().RemoveFile(repoBlobPath)
+	if !IsStorePath(target) {
+		return 0, nil
+	}
+	rel, err := filepath.Rel(filesRoot(), repoBlobPath)
+	if err != nil {
+		return 0, err
+	}
+	refs := readRefs(target)
+	refs.Refs = slices.DeleteFunc(refs.Refs, func(ref string) bool { return ref == rel })
+	if len(refs.Refs) > 0 {
+		return 0, writeRefs(target, refs)
+	}
+	var freed int64
+	err = GetInstance().whenClosed(func() (err error) {
+		freed, err = removeStoreObject(target)
+		return err
+	}, target)
+	if errors.Is(err, ErrBlobInUse) { // 仍在下载或读取，保留对象，等待下次清理
+		return 0, writeRefs(target, refs)
+	}
+	return freed, err
+}
+
+// RemoveStoreBlob 从全局存储中删除对象及所有仓库下指向它的链接，返回被删除的仓库blob链接。
+// 对象正被使用时返回ErrBlobInUse，不做任何修改。
+func RemoveStoreBlob(storePath string) ([]string, error) {
+	storeLock.Lock()
+	defer storeLock.Unlock()
+	links := GetBlobRefs(storePath)
+	err := GetInstance().whenClosed(func() error {
+		for _, link := range links {
+			if err := os.Remove(link); err != nil && !os.IsNotExist(err) {
+				zap.S().Errorf("remove blob link err. %s, %v", link, err)
+			}
+			GetBlockCache().RemoveFile(link)
+		}
+		_, err := removeStoreObject(storePath)
+		return err
+	}, storePath)
+	if err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+// RemoveBlob 删除仓库下的普通blob文件及其校验结果，文件正被使用时返回ErrBlobInUse。
+func RemoveBlob(blobPath string) error {
+	return GetInstance().whenClosed(func() error {
+		if err := os.Remove(blobPath); err != nil {
+			return err
+		}
+		_ = os.Remove(GetVerifyPath(blobPath))
+		GetBlockCache().RemoveFile(blobPath)
+		return nil
+	}, blobPath)
+}
+
+// removeStoreObject 删除对象及其校验结果、引用记录，调用方需持有storeLock。
+func removeStoreObject(storePath string) (int64, error) {
+	var size int64
+	if info, err := os.Stat(storePath); err == nil {
+		if size, err = util.GetFilePhysicalSize(info, storePath); err != nil {
+			size = info.Size()
+		}
+	}
+	_ = os.Remove(GetVerifyPath(storePath))
+	_ = os.Remove(getRefsPath(storePath))
+	if err := os.Remove(storePath); err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	GetBlockCache().RemoveFile(storePath)
+	zap.S().Infof("remove store blob %s, size:%s", storePath, util.ConvertBytesToHumanReadable(size))
+	return size, nil
+}
+
+// repoBlobOf 返回可用于推断仓库信息的blob路径，全局存储对象取第一个引用。
+func repoBlobOf(blobPath string) (string, error) {
+	if !IsStorePath(blobPath) {
+		return blobPath, nil
+	}
+	refs := GetBlobRefs(blobPath)
+	if len(refs) == 0 {
+		return "", fmt.Errorf("store blob %s has no refs", blobPath)
+	}
+	return refs[0], nil
+}
@@ -0,0 +1,116 @@
+//  Copyright (c) 2025 dingodb.com, Inc. All Rights Reserved
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http:www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package downloader
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"dingospeed/pkg/config"
+	"dingospeed/pkg/util"
+)
+
+func TestBlobStore(t *testing.T) {
+	repos := setupRepos(t)
+	etag := strings.Repeat("ab", 32)
+	repoBlob := func(repo string) string {
+		path := filepath.Join(repos, "files", "models", "org", repo, "blobs", etag)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	base, fork := repoBlob("base"), repoBlob("fork")
+	if err := os.WriteFile(base, []byte("legacy"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	storePath, err := LinkBlob(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if storePath != GetStorePath(etag) || !IsStoreLink(base) {
+		t.Fatalf("legacy blob should be moved into store")
+	}
+	if b, _ := os.ReadFile(base); string(b) != "legacy" {
+		t.Fatalf("link should point to adopted blob")
+	}
+	if _, err = LinkBlob(fork); err != nil {
+		t.Fatal(err)
+	}
+	if refs := GetBlobRefs(storePath); len(refs) != 2 {
+		t.Fatalf("expect 2 refs, got %v", refs)
+	}
+	if _, err = UnlinkBlob(base); err != nil {
+		t.Fatal(err)
+	}
+	if !util.FileExists(storePath) {
+		t.Fatalf("store blob should be kept while referenced")
+	}
+	if _, err = UnlinkBlob(fork); err != nil {
+		t.Fatal(err)
+	}
+	if util.FileExists(storePath) || util.FileExists(storePath+RefsSuffix) {
+		t.Fatalf("store blob should be removed with the last ref")
+	}
+}
+
+func TestBlobStoreInUse(t *testing.T) {
+	repos := setupRepos(t)
+	config.SysConfig.Download.BlockSize = 1024
+	etag := strings.Repeat("cd", 32)
+	blobsDir := filepath.Join(repos, "files", "models", "org", "repo", "blobs")
+	if err := os.MkdirAll(blobsDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	repoBlob := filepath.Join(blobsDir, etag)
+	manager := GetInstance()
+	// 仓库下的blob正被下载时不并入全局存储
+	if _, err := manager.GetDingFile(repoBlob, 4096, nil); err != nil {
+		t.Fatal(err)
+	}
+	path, err := LinkBlob(repoBlob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != repoBlob || IsStoreLink(repoBlob) || util.FileExists(GetStorePath(etag)) {
+		t.Fatalf("open blob should not be adopted, path:%s", path)
+	}
+	if err = RemoveBlob(repoBlob); !errors.Is(err, ErrBlobInUse) || !util.FileExists(repoBlob) {
+		t.Fatalf("open blob should not be removed, err:%v", err)
+	}
+	manager.ReleasedDingFile(repoBlob)
+	storePath, err := LinkBlob(repoBlob)
+	if err != nil || storePath != GetStorePath(etag) || !IsStoreLink(repoBlob) {
+		t.Fatalf("closed blob should be adopted, path:%s, err:%v", storePath, err)
+	}
+	// 全局存储中的对象正被读取时不删除，也不删除仓库下的链接
+	if _, err = manager.GetDingFile(storePath, 4096, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = RemoveStoreBlob(storePath); !errors.Is(err, ErrBlobInUse) {
+		t.Fatalf("open store blob should not be removed, err:%v", err)
+	}
+	if !util.FileExists(storePath) || !IsStoreLink(repoBlob) {
+		t.Fatal("store blob and its link should be kept")
+	}
+	manager.ReleasedDingFile(storePath)
+	links, err := RemoveStoreBlob(storePath)
+	if err != nil || len(links) != 1 || util.FileExists(storePath) || util.FileExists(repoBlob) {
+		t.Fatalf("closed store blob should be removed, links:%v, err:%v", links, err)
+	}
+}
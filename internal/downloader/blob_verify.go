@@ -0,0 +1,434 @@
+//  Copyright (c) 2025 dingodb.com, Inc. All Rights Reserved
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http:www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package downloader
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"dingospeed/pkg/config"
+	"dingospeed/pkg/prom"
+	"dingospeed/pkg/util"
+
+	"github.com/bytedance/sonic"
+	"go.uber.org/zap"
+)
+
+const (
+	VerifySuffix  = ".verify"
+	QuarantineDir = ".quarantine"
+
+	VerifyStatusVerified = "verified"
+	VerifyStatusMismatch = "mismatch"
+
+	algorithmSha256        = "sha256"
+	algorithmGitSha1       = "git-sha1"
+	algorithmBlockChecksum = "block-checksum" // etag不是内容哈希时，逐块核对头部记录的校验值
+)
+
+// BlobVerifyResult 记录在blob旁的sidecar文件中的校验结果
+type BlobVerifyResult struct {
+	Etag       string `json:"etag"`
+	Algorithm  string `json:"algorithm"`
+	Status     string `json:"status"`
+	Digest     string `json:"digest"`
+	FileSize   int64  `json:"fileSize"`
+	VerifyTime int64  `json:"verifyTime"`
+}
+
+// blobSnapshot 触发校验时的文件信息，校验在后台执行，期间DingCache可能已被关闭。
+type blobSnapshot struct {
+	path       string
+	info       os.FileInfo // 快照时的文件，隔离前据此确认路径下仍是同一个文件
+	headerSize int64
+	fileSize   int64
+	blockSize  int64
+
+	compression uint64
+	index       []BlockLocation // 压缩文件的块索引，未压缩时为nil
+	checksums   []uint64        // 块校验值，旧版本文件为nil
+}
+
+// GetVerifyPath 返回blob对应的校验结果文件路径
+func GetVerifyPath(blobPath string) string {
+	return blobPath + VerifySuffix
+}
+
+// ReadVerifyResult 读取blob的校验结果，不存在时返回nil。
+func ReadVerifyResult(blobPath string) *BlobVerifyResult {
+	b, err := os.ReadFile(GetVerifyPath(blobPath))
+	if err != nil {
+		return nil
+	}
+	result := &BlobVerifyResult{}
+	if err = sonic.Unmarshal(b, result); err != nil {
+		zap.S().Warnf("unmarshal verify result err. %s, %v", blobPath, err)
+		return nil
+	}
+	return result
+}
+
+// IsBlobVerified blob是否已通过完整性校验
+func IsBlobVerified(blobPath string, fileSize int64) bool {
+	result := ReadVerifyResult(blobPath)
+	return result != nil && result.Status == VerifyStatusVerified && result.FileSize == fileSize
+}
+
+// hashAlgorithm 根据etag推断校验算法，LFS文件的oid为sha256，普通文件的oid为git blob的sha1。
+func hashAlgorithm(etag string) (string, hash.Hash) {
+	if _, err := hex.DecodeString(etag); err != nil {
+		return "", nil
+	}
+	switch len(etag) {
+	case sha256.Size * 2:
+		return algorithmSha256, sha256.New()
+	case sha1.Size * 2:
+		return algorithmGitSha1, sha1.New()
+	default:
+		return "", nil
+	}
+}
+
+// scheduleVerify 打开已下载完成但尚未通过校验的blob时，在后台补做校验，如迁移升级的旧文件、校验被进程退出中断的文件。
+func (c *DingCache) scheduleVerify() {
+	c.fileLock.RLock()
+	defer c.fileLock.RUnlock()
+	if c.header.HasChecksum() && c.header.IsComplete() && !c.verified.Load() {
+		c.startVerify()
+	}
+}
+
+// startVerify 所有块写入完成后，在后台校验整个blob，同一时刻只有一个校验任务。调用方需持有fileLock。
+func (c *DingCache) startVerify() {
+	if !c.verifying.CompareAndSwap(false, true) {
+		return
+	}
+	snapshot, err := c.newSnapshot()
+	if err != nil {
+		c.verifying.Store(false)
+		zap.S().Errorf("snapshot blob err. %s, %v", c.path, err)
+		return
+	}
+	go func() {
+		defer c.verifying.Store(false)
+		result, err := verifyBlob(snapshot)
+		if err != nil {
+			zap.S().Errorf("verify blob err. %s, %v", snapshot.path, err)
+			return
+		}
+		if result == nil {
+			return
+		}
+		if result.Status == VerifyStatusVerified {
+			if saveVerifyResult(snapshot.path, result) {
+				c.verified.Store(true)
+			}
+			return
+		}
+		c.quarantine(snapshot, result)
+	}()
+}
+
+// newSnapshot 记录校验所需的头部信息，调用方需持有fileLock。
+func (c *DingCache) newSnapshot() (*blobSnapshot, error) {
+	info, err := c.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &blobSnapshot{
+		path:       c.path,
+		info:       info,
+		headerSize: c.getHeaderSize(),
+		fileSize:   c.GetFileSize(),
+		blockSize:  c.GetBlockSize(),
+	}
+	if c.header.HasChecksum() {
+		snapshot.checksums = slices.Clone(c.header.BlockChecksums)
+	}
+	if c.header.IsCompressed() {
+		snapshot.compression = c.header.Compression
+		snapshot.index = slices.Clone(c.header.BlockIndex)
+	}
+	return snapshot, nil
+}
+
+// verifyMigrated 迁移任务升级完整的blob后立即校验。校验不一致时只记录日志，文件被打开时会重新校验并隔离。
+func verifyMigrated(path string, header *DingCacheHeader) {
+	snapshot := &blobSnapshot{
+		path:       path,
+		headerSize: header.GetHeaderSize(),
+		fileSize:   int64(header.FileSize),
+		blockSize:  int64(header.BlockSize),
+		checksums:  header.BlockChecksums,
+	}
+	result, err := verifyBlob(snapshot)
+	if err != nil {
+		zap.S().Errorf("verify migrated blob err. %s, %v", path, err)
+		return
+	}
+	if result == nil {
+		return
+	}
+	if result.Status == VerifyStatusVerified {
+		saveVerifyResult(path, result)
+		return
+	}
+	zap.S().Warnf("migrated blob mismatch. %s, expected:%s, actual:%s", path, result.Etag, result.Digest)
+}
+
+// saveVerifyResult 记录校验通过的结果，之后打开该blob时无需重新校验
+func saveVerifyResult(blobPath string, result *BlobVerifyResult) bool {
+	if err := util.WriteDataToFile(GetVerifyPath(blobPath), result); err != nil {
+		zap.S().Errorf("write verify result err. %s, %v", blobPath, err)
+		return false
+	}
+	zap.S().Infof("blob verified. %s, %s:%s", blobPath, result.Algorithm, result.Digest)
+	return true
+}
+
+func verifyBlob(snapshot *blobSnapshot) (*BlobVerifyResult, error) {
+	etag := filepath.Base(snapshot.path)
+	algorithm, h := hashAlgorithm(etag)
+	if h == nil && snapshot.checksums == nil {
+		zap.S().Debugf("etag %s is not a content hash, skip verify.", etag)
+		return nil, nil
+	}
+	result, err := verifyContent(snapshot, etag, algorithm, h)
+	if err == nil && config.SysConfig.EnableMetric() {
+		prom.BlobVerifyCnt.WithLabelValues(result.Status).Inc()
+	}
+	return result, err
+}
+
+func verifyContent(snapshot *blobSnapshot, etag, algorithm string, h hash.Hash) (*BlobVerifyResult, error) {
+	f, err := os.Open(snapshot.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var content io.Reader = io.NewSectionReader(f, snapshot.headerSize, snapshot.fileSize)
+	if snapshot.index != nil {
+		content = &compressedReader{f: f, snapshot: snapshot}
+	}
+	if h == nil {
+		return verifyChecksums(snapshot, etag, content)
+	}
+	if algorithm == algorithmGitSha1 {
+		h.Write([]byte(fmt.Sprintf("blob %d\x00", snapshot.fileSize)))
+	}
+	n, err := io.Copy(h, content)
+	if err != nil {
+		return nil, err
+	}
+	if n != snapshot.fileSize {
+		return nil, fmt.Errorf("blob is incomplete, expected %d, read %d", snapshot.fileSize, n)
+	}
+	digest := hex.EncodeToString(h.Sum(nil))
+	result := &BlobVerifyResult{
+		Etag:       etag,
+		Algorithm:  algorithm,
+		Digest:     digest,
+		FileSize:   snapshot.fileSize,
+		VerifyTime: time.Now().Unix(),
+		Status:     VerifyStatusVerified,
+	}
+	if !strings.EqualFold(digest, etag) {
+		result.Status = VerifyStatusMismatch
+	}
+	return result, nil
+}
+
+// verifyChecksums etag不是内容哈希时，按块读取内容，逐块核对头部记录的校验值
+func verifyChecksums(snapshot *blobSnapshot, etag string, content io.Reader) (*BlobVerifyResult, error) {
+	buf := util.GetBuffer(int(snapshot.blockSize))
+	defer util.PutBuffer(buf)
+	result := &BlobVerifyResult{
+		Etag:      etag,
+		Algorithm: algorithmBlockChecksum,
+		FileSize:  snapshot.fileSize,
+		Status:    VerifyStatusVerified,
+	}
+	for blockIndex, pos := 0, int64(0); pos < snapshot.fileSize; blockIndex++ {
+		block := buf[:min(snapshot.blockSize, snapshot.fileSize-pos)]
+		if _, err := io.ReadFull(content, block); err != nil {
+			return nil, fmt.Errorf("read block %d err.%v", blockIndex, err)
+		}
+		pos += int64(len(block))
+		if blockIndex >= len(snapshot.checksums) || snapshot.checksums[blockIndex] != BlockChecksum(block) {
+			result.Status = VerifyStatusMismatch
+			result.Digest = fmt.Sprintf("block %d", blockIndex)
+			break
+		}
+	}
+	result.VerifyTime = time.Now().Unix()
+	return result, nil
+}
+
+// quarantine 将校验失败的blob移入隔离目录，删除指向它的软链接与paths-info缓存，并重置为空文件重新下载。
+// 校验在后台进行，期间原实例可能已关闭、文件被重新打开，因此持有文件管理器的锁确认路径下仍是快照时的文件，
+// 并重置当前打开该文件的实例。
+func (c *DingCache) quarantine(snapshot *blobSnapshot, result *BlobVerifyResult) {
+	zap.S().Errorf("blob mismatch, quarantine. %s, expected:%s, actual:%s", snapshot.path, result.Etag, result.Digest)
+	GetInstance().withOpenFile(snapshot.path, func(live *DingCache) {
+		owner := c
+		if live != nil { // 原实例已关闭时为重新打开的实例
+			owner = live
+		}
+		owner.fileLock.Lock()
+		defer owner.fileLock.Unlock()
+		if info, err := os.Stat(snapshot.path); err != nil || !os.SameFile(info, snapshot.info) {
+			zap.S().Warnf("blob has been replaced, skip quarantine. %s", snapshot.path)
+			return
+		}
+		quarantinePath := getQuarantinePath(snapshot.path)
+		if err := util.MakeDirs(quarantinePath); err != nil {
+			zap.S().Errorf("create quarantine dir err. %s, %v", quarantinePath, err)
+			return
+		}
+		if err := os.Rename(snapshot.path, quarantinePath); err != nil {
+			zap.S().Errorf("move blob to quarantine err. %s, %v", snapshot.path, err)
+			return
+		}
+		if err := util.WriteDataToFile(GetVerifyPath(quarantinePath), result); err != nil {
+			zap.S().Errorf("write verify result err. %s, %v", quarantinePath, err)
+		}
+		_ = os.Remove(GetVerifyPath(snapshot.path))
+		GetBlockCache().RemoveFile(snapshot.path)
+		invalidateBlobLinks(snapshot.path)
+		if owner.isOpen && owner.path == snapshot.path {
+			if err := owner.reset(snapshot.blockSize, snapshot.fileSize); err != nil {
+				zap.S().Errorf("reset blob err. %s, %v", snapshot.path, err)
+			}
+		}
+	})
+}
+
+// reset 重建一个空的缓存文件并替换文件句柄，仍被持有的DingCache可以继续写入，调用方需持有fileLock。
+func (c *DingCache) reset(blockSize, fileSize int64) error {
+	header := NewDingCacheHeader(CURRENT_OLAH_CACHE_VERSION, uint64(blockSize), uint64(fileSize))
+	header.SetCompression(c.header.Compression)
+	if c.header.HasProvenance() {
+		p := *c.header.Provenance
+		p.CreateTime, p.CompleteTime = header.Provenance.CreateTime, 0
+		header.Provenance = &p
+	}
+	f, err := os.OpenFile(c.path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if err = writeHeader(f, header); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Truncate(header.GetHeaderSize() + header.DataSize()); err != nil {
+		f.Close()
+		return err
+	}
+	_ = c.file.Close() // 原句柄指向已被隔离的文件
+	c.file = f
+	c.dirtyBlocks = 0
+	c.verified.Store(false)
+	c.headerLock.Lock()
+	c.header = header
+	c.headerLock.Unlock()
+	c.dropBlockCache()
+	return nil
+}
+
+func getQuarantinePath(blobPath string) string {
+	suffix := fmt.Sprintf(".%d", time.Now().Unix())
+	rel, err := filepath.Rel(filesRoot(), blobPath)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return blobPath + suffix + QuarantineDir
+	}
+	return filepath.Join(filesRoot(), QuarantineDir, rel) + suffix
+}
+
+// findBlobLinks 查找resolve目录下指向该blob的软链接。
+// blob路径为files/<type>/<org>/<repo>/blobs/<etag>，软链接位于files/<type>/<org>/<repo>/resolve/<commit>/<fileName>。
+func findBlobLinks(blobPath string) []string {
+	absBlob, err := filepath.Abs(blobPath)
+	if err != nil {
+		return nil
+	}
+	links := make([]string, 0)
+	resolveDir := filepath.Join(filepath.Dir(filepath.Dir(blobPath)), "resolve")
+	_ = filepath.Walk(resolveDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+		target, err := os.Readlink(path)
+		if err != nil {
+			return nil
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(path), target)
+		}
+		if absTarget, err := filepath.Abs(target); err == nil && absTarget == absBlob {
+			links = append(links, path)
+		}
+		return nil
+	})
+	return links
+}
+
+// invalidateBlobLinks 删除指向该blob的软链接，以及对应文件的paths-info缓存。全局存储中的对象需处理所有引用它的仓库。
+func invalidateBlobLinks(blobPath string) {
+	if IsStorePath(blobPath) {
+		for _, ref := range GetBlobRefs(blobPath) {
+			invalidateBlobLinks(ref)
+		}
+		return
+	}
+	repoDir := filepath.Dir(filepath.Dir(blobPath))
+	resolveDir := filepath.Join(repoDir, "resolve")
+	typeOrgRepo, err := filepath.Rel(filesRoot(), repoDir)
+	if err != nil || strings.HasPrefix(typeOrgRepo, "..") {
+		typeOrgRepo = ""
+	}
+	for _, link := range findBlobLinks(blobPath) {
+		if err = os.Remove(link); err != nil {
+			zap.S().Errorf("remove link err. %s, %v", link, err)
+			continue
+		}
+		zap.S().Warnf("remove link %s of quarantined blob %s", link, blobPath)
+		if typeOrgRepo == "" {
+			continue
+		}
+		commitFile, err := filepath.Rel(resolveDir, link)
+		if err != nil {
+			continue
+		}
+		parts := strings.SplitN(filepath.ToSlash(commitFile), "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		apiPathInfoPath := fmt.Sprintf("%s/api/%s/paths-info/%s/%s/paths-info_post.json", config.SysConfig.Repos(), filepath.ToSlash(typeOrgRepo), parts[0], parts[1])
+		if util.FileExists(apiPathInfoPath) {
+			if err = os.Remove(apiPathInfoPath); err != nil {
+				zap.S().Errorf("remove paths-info err. %s, %v", apiPathInfoPath, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,174 @@
+//  Copyright (c) 2025 dingodb.com, Inc. All Rights Reserved
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http:www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package downloader
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"dingospeed/pkg/config"
+	"dingospeed/pkg/util"
+)
+
+func TestBlobVerify(t *testing.T) {
+	repos := setupRepos(t)
+	blockSize := int64(1024)
+	content := testContent(blockSize + 10)
+	sum := sha256.Sum256(content)
+	writeBlob := func(etag string) (string, string) {
+		blobPath := filepath.Join(repos, "files", "models", "org", "repo", "blobs", etag)
+		linkPath := filepath.Join(repos, "files", "models", "org", "repo", "resolve", "main", "model.bin")
+		if err := os.MkdirAll(filepath.Dir(linkPath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		_ = os.Remove(linkPath)
+		if err := os.Symlink(filepath.Join("..", "..", "blobs", etag), linkPath); err != nil {
+			t.Fatal(err)
+		}
+		dingFile := newTestFile(t, blobPath, blockSize, int64(len(content)))
+		writeTestBlocks(t, dingFile, content)
+		waitVerify(dingFile)
+		return blobPath, linkPath
+	}
+
+	blobPath, linkPath := writeBlob(hex.EncodeToString(sum[:]))
+	if !IsBlobVerified(blobPath, int64(len(content))) {
+		t.Fatalf("blob should be verified")
+	}
+	if _, err := os.Lstat(linkPath); err != nil {
+		t.Fatalf("link should be kept.%v", err)
+	}
+
+	badEtag := hex.EncodeToString(make([]byte, sha256.Size))
+	blobPath, linkPath = writeBlob(badEtag)
+	if result := ReadVerifyResult(blobPath); result != nil {
+		t.Fatalf("mismatched blob should not be marked, %v", result)
+	}
+	if _, err := os.Lstat(linkPath); !os.IsNotExist(err) {
+		t.Fatalf("link of mismatched blob should be removed.%v", err)
+	}
+	quarantined, _ := filepath.Glob(filepath.Join(repos, "files", QuarantineDir, "models", "org", "repo", "blobs", badEtag+".*"))
+	if len(quarantined) == 0 {
+		t.Fatalf("mismatched blob should be quarantined")
+	}
+
+	// etag不是内容哈希时按块校验值校验
+	blobPath, _ = writeBlob("not-a-hash")
+	if result := ReadVerifyResult(blobPath); result == nil || result.Status != VerifyStatusVerified || result.Algorithm != algorithmBlockChecksum {
+		t.Fatalf("blob with non-hash etag should be verified by block checksums, %v", result)
+	}
+}
+
+func TestQuarantineBlockCache(t *testing.T) {
+	repos := setupRepos(t)
+	config.SysConfig.Cache.ReadBlock = config.ReadBlock{Enabled: true, PrefetchBlocks: 4, MaxSize: 1 << 20}
+	blockSize := int64(1024)
+	badEtag := hex.EncodeToString(make([]byte, sha256.Size))
+	blobPath := filepath.Join(repos, "files", "models", "org", "repo", "blobs", badEtag)
+	content := testContent(blockSize * 2)
+	dingFile := newTestFile(t, blobPath, blockSize, int64(len(content)))
+	// 第一块在校验前被读取并放入块缓存
+	if err := dingFile.WriteBlock(0, content[:blockSize]); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := dingFile.ReadBlock(0); err != nil || !bytes.Equal(got, content[:blockSize]) {
+		t.Fatalf("read block 0 err.%v", err)
+	}
+	if !GetBlockCache().Contains(dingFile.blockKey(0)) {
+		t.Fatal("block 0 should be cached")
+	}
+	if err := dingFile.WriteBlock(1, content[blockSize:]); err != nil {
+		t.Fatal(err)
+	}
+	waitVerify(dingFile)
+	// 校验失败后文件被隔离并重置，内存中的旧数据不能再被读到
+	if got, err := dingFile.ReadBlock(0); err != nil || got != nil {
+		t.Fatalf("quarantined block should not be served from memory, %v", err)
+	}
+	redownload := bytes.Repeat([]byte{0xAB}, int(blockSize))
+	if err := dingFile.WriteBlock(0, redownload); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := dingFile.ReadBlock(0); err != nil || !bytes.Equal(got, redownload) {
+		t.Fatalf("re-downloaded block should be read, err.%v", err)
+	}
+
+	GetBlockCache().RemoveFile(blobPath)
+	if GetBlockCache().Contains(dingFile.blockKey(0)) {
+		t.Fatal("RemoveFile should purge cached blocks of the path")
+	}
+}
+
+func TestQuarantineReopened(t *testing.T) {
+	repos := setupRepos(t)
+	config.SysConfig.Download.BlockSize = 1024
+	blockSize := int64(1024)
+	badEtag := hex.EncodeToString(make([]byte, sha256.Size))
+	blobPath := filepath.Join(repos, "files", "models", "org", "repo", "blobs", badEtag)
+	if err := os.MkdirAll(filepath.Dir(blobPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	content := testContent(blockSize * 2)
+	manager := GetInstance()
+	oldFile, err := manager.GetDingFile(blobPath, int64(len(content)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = oldFile.WriteBlock(0, content[:blockSize]); err != nil {
+		t.Fatal(err)
+	}
+	oldFile.fileLock.RLock()
+	snapshot, err := oldFile.newSnapshot()
+	oldFile.fileLock.RUnlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 校验结束前原实例已关闭，同一路径被重新打开
+	manager.ReleasedDingFile(blobPath)
+	newFile, err := manager.GetDingFile(blobPath, int64(len(content)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.ReleasedDingFile(blobPath)
+	result := &BlobVerifyResult{Etag: badEtag, Digest: "other", Status: VerifyStatusMismatch}
+	oldFile.quarantine(snapshot, result)
+	quarantined, _ := filepath.Glob(filepath.Join(repos, "files", QuarantineDir, "models", "org", "repo", "blobs", badEtag+".*"))
+	if len(quarantined) == 0 {
+		t.Fatal("mismatched blob should be quarantined")
+	}
+	// 重新打开的实例被重置，继续写入路径下的新文件
+	if exist, _ := newFile.HasBlock(0); exist {
+		t.Fatal("reopened instance should be reset")
+	}
+	if err = newFile.WriteBlock(1, content[blockSize:]); err != nil {
+		t.Fatal(err)
+	}
+	current, err := os.Stat(blobPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened, err := newFile.file.Stat(); err != nil || !os.SameFile(current, opened) {
+		t.Fatalf("reopened instance should write to the new file, err.%v", err)
+	}
+	// 快照之后文件已被替换时不再隔离
+	oldFile.quarantine(snapshot, result)
+	if exist, _ := newFile.HasBlock(1); !exist || !util.FileExists(blobPath) {
+		t.Fatal("replaced blob should not be quarantined again")
+	}
+}
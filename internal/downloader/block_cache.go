@@ -0,0 +1,319 @@
+//  Copyright (c) 2025 dingodb.com, Inc. All Rights Reserved
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http:www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package downloader
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"dingospeed/pkg/config"
+	"dingospeed/pkg/prom"
+)
+
+const (
+	blockCacheSmallRatio = 10 // 小队列占总容量的百分比
+	blockCacheMaxFreq    = 3
+)
+
+// blockKey 块在缓存中的键。gen为写入时文件的缓存代数，文件重新打开、块被判定损坏或blob被重置后代数改变，
+// 之前放入的块（包括与重置并发的读取放入的旧数据）不再命中，等待淘汰。
+type blockKey struct {
+	path  string
+	gen   uint64
+	index int64
+}
+
+// blockCacheGen 全局递增的缓存代数，同一路径先后打开的文件不会使用相同的代数
+var blockCacheGen atomic.Uint64
+
+type blockEntry struct {
+	key        blockKey
+	data       []byte // 写入后不再修改，淘汰后可能仍在被拷贝，不能归还缓冲池
+	freq       int
+	small      bool // 在小队列中
+	prefetched bool // 预读放入且尚未被读取，第一次读取是预读所预期的，不计入访问次数
+	elem       *list.Element
+}
+
+// BlockCache 所有读取者共享的内存块缓存，按字节数限制容量，使用S3-FIFO淘汰：新块先进入小队列，
+// 在小队列中被再次访问过的块才进入主队列，只读一遍的顺序扫描不会挤掉热点块。预读放入的块第一次被读取时不计入访问次数，
+// 否则顺序读取流预读的每个块都会进入主队列。从小队列淘汰的块记入ghost队列，短时间内再次读取时直接进入主队列。
+type BlockCache struct {
+	mu        sync.Mutex
+	maxSize   int64
+	size      int64
+	smallSize int64
+	entries   map[blockKey]*blockEntry
+	small     *list.List // 队首为最新
+	main      *list.List
+	ghost     *list.List // 只记录key
+	ghosts    map[blockKey]*list.Element
+}
+
+var (
+	blockCache     *BlockCache
+	blockCacheOnce sync.Once
+)
+
+// GetBlockCache 未启用块缓存时返回nil，nil可直接使用，此时不缓存。
+func GetBlockCache() *BlockCache {
+	if !config.SysConfig.EnableReadBlockCache() {
+		return nil
+	}
+	blockCacheOnce.Do(func() {
+		blockCache = NewBlockCache(config.SysConfig.GetBlockCacheMaxSize())
+	})
+	return blockCache
+}
+
+func NewBlockCache(maxSize int64) *BlockCache {
+	return &BlockCache{
+		maxSize: maxSize,
+		entries: make(map[blockKey]*blockEntry),
+		small:   list.New(),
+		main:    list.New(),
+		ghost:   list.New(),
+		ghosts:  make(map[blockKey]*list.Element),
+	}
+}
+
+// Get 命中时把块数据拷贝到dst，返回拷贝的字节数
+func (b *BlockCache) Get(key blockKey, dst []byte) (int, bool) {
+	if b == nil {
+		return 0, false
+	}
+	b.mu.Lock()
+	entry, ok := b.entries[key]
+	var data []byte
+	if ok {
+		if entry.prefetched {
+			entry.prefetched = false
+		} else {
+			entry.freq = min(entry.freq+1, blockCacheMaxFreq)
+		}
+		data = entry.data
+	}
+	b.mu.Unlock()
+	if config.SysConfig.EnableMetric() {
+		if ok {
+			prom.BlockCacheHitCnt.Inc()
+		} else {
+			prom.BlockCacheMissCnt.Inc()
+		}
+	}
+	return copy(dst, data), ok
+}
+
+// Contains 是否已缓存，不计入访问次数
+func (b *BlockCache) Contains(key blockKey) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.entries[key]
+	return ok
+}
+
+// Add 缓存块数据的拷贝，超过容量时淘汰其他块。prefetched表示由预读放入。
+func (b *BlockCache) Add(key blockKey, data []byte, prefetched bool) {
+	if b == nil || int64(len(data)) > b.maxSize/2 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.entries[key]; ok {
+		return
+	}
+	entry := &blockEntry{key: key, data: bytes.Clone(data), prefetched: prefetched}
+	if elem, ok := b.ghosts[key]; ok { // 最近刚被淘汰，说明不是一次性访问
+		b.ghost.Remove(elem)
+		delete(b.ghosts, key)
+		entry.elem = b.main.PushFront(entry)
+	} else {
+		entry.small = true
+		entry.elem = b.small.PushFront(entry)
+		b.smallSize += int64(len(entry.data))
+	}
+	b.entries[key] = entry
+	b.size += int64(len(entry.data))
+	for b.size > b.maxSize {
+		if b.smallSize > b.maxSize*blockCacheSmallRatio/100 || b.main.Len() == 0 {
+			b.evictSmall()
+		} else {
+			b.evictMain()
+		}
+	}
+	b.report()
+}
+
+// RemoveFile 删除路径下所有代数的块，文件被重置、隔离、删除或移动时调用
+func (b *BlockCache) RemoveFile(path string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for key, entry := range b.entries {
+		if key.path == path {
+			b.remove(entry)
+		}
+	}
+	for key, elem := range b.ghosts {
+		if key.path == path {
+			b.ghost.Remove(elem)
+			delete(b.ghosts, key)
+		}
+	}
+	b.report()
+}
+
+// evictSmall 小队列中被再次访问过的块移入主队列，其余淘汰并记入ghost队列
+func (b *BlockCache) evictSmall() {
+	for elem := b.small.Back(); elem != nil; elem = b.small.Back() {
+		entry := elem.Value.(*blockEntry)
+		b.small.Remove(elem)
+		b.smallSize -= int64(len(entry.data))
+		if entry.freq >= 1 {
+			entry.small = false
+			entry.freq = 0
+			entry.elem = b.main.PushFront(entry)
+			continue
+		}
+		b.ghosts[entry.key] = b.ghost.PushFront(entry.key)
+		for b.ghost.Len() > max(len(b.entries), 16) {
+			delete(b.ghosts, b.ghost.Remove(b.ghost.Back()).(blockKey))
+		}
+		entry.elem = nil // 已从小队列中移除
+		b.evict(entry)
+		return
+	}
+}
+
+// evictMain 主队列按FIFO淘汰，访问过的块降低访问次数后重新插入队首
+func (b *BlockCache) evictMain() {
+	for elem := b.main.Back(); elem != nil; elem = b.main.Back() {
+		entry := elem.Value.(*blockEntry)
+		if entry.freq > 0 {
+			entry.freq--
+			b.main.MoveToFront(elem)
+			continue
+		}
+		b.evict(entry)
+		return
+	}
+}
+
+func (b *BlockCache) evict(entry *blockEntry) {
+	b.remove(entry)
+	if config.SysConfig.EnableMetric() {
+		prom.BlockCacheEvictCnt.Inc()
+	}
+}
+
+func (b *BlockCache) remove(entry *blockEntry) {
+	if entry.elem != nil {
+		if entry.small {
+			b.small.Remove(entry.elem)
+			b.smallSize -= int64(len(entry.data))
+		} else {
+			b.main.Remove(entry.elem)
+		}
+	}
+	delete(b.entries, entry.key)
+	b.size -= int64(len(entry.data))
+}
+
+// report 调用方需持有mu
+func (b *BlockCache) report() {
+	if config.SysConfig.EnableMetric() {
+		prom.BlockCacheByte.Set(float64(b.size))
+		prom.BlockCacheBlockCnt.Set(float64(len(b.entries)))
+	}
+}
+
+// blockReader 一个读取流按顺序读取块。连续读取相邻的块时预读窗口从1个块开始逐步翻倍，最大为PrefetchBlocks，
+// 跳跃读取时窗口归零。预读在后台进行，预读的块放入共享的块缓存。
+type blockReader struct {
+	ctx      context.Context
+	file     *DingCache
+	endBlock int64 // 读取流的最后一个块，不预读超出的部分
+	next     int64 // 顺序读取时的下一个块
+	window   int64
+	ahead    int64 // 已预读到的块（不含）
+	running  atomic.Bool
+	wg       sync.WaitGroup
+}
+
+// newBlockReader 读取流从startBlock开始，第一次读取startBlock视为顺序读取
+func newBlockReader(ctx context.Context, file *DingCache, startBlock, endBlock int64) *blockReader {
+	return &blockReader{ctx: ctx, file: file, endBlock: endBlock, next: startBlock}
+}
+
+// ReadBlock 读取块，并按访问模式调整预读窗口
+func (r *blockReader) ReadBlock(blockIndex int64) ([]byte, error) {
+	block, err := r.file.ReadBlock(blockIndex)
+	if err == nil && block != nil {
+		r.readAhead(blockIndex)
+	}
+	return block, err
+}
+
+func (r *blockReader) readAhead(blockIndex int64) {
+	if blockIndex == r.next {
+		r.window = min(max(r.window*2, 1), config.SysConfig.GetPrefetchBlocks())
+	} else {
+		r.window, r.ahead = 0, 0
+	}
+	r.next = blockIndex + 1
+	if r.window == 0 || GetBlockCache() == nil || memoryPressure() || r.running.Load() { // 上一次预读尚未结束
+		return
+	}
+	start, end := max(r.ahead, blockIndex+1), min(blockIndex+1+r.window, r.endBlock+1)
+	if start >= end {
+		return
+	}
+	r.ahead = end
+	r.running.Store(true)
+	r.wg.Add(1)
+	go func() {
+		defer func() {
+			r.running.Store(false)
+			r.wg.Done()
+		}()
+		for i := start; i < end && r.ctx.Err() == nil; i++ {
+			if !r.file.prefetchBlock(i) {
+				return
+			}
+		}
+	}()
+}
+
+// Close 等待后台预读结束，之后才能释放文件
+func (r *blockReader) Close() {
+	r.wg.Wait()
+}
+
+// memoryPressure 系统内存使用率超过阈值时不再预读
+func memoryPressure() bool {
+	if config.SystemInfo == nil {
+		return false
+	}
+	memoryUsedPercent := config.SystemInfo.MemoryUsedPercent
+	return memoryUsedPercent != 0 && memoryUsedPercent >= config.SysConfig.GetPrefetchMemoryUsedThreshold()
+}
@@ -0,0 +1,102 @@
+//  Copyright (c) 2025 dingodb.com, Inc. All Rights Reserved
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http:www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+
+	"dingospeed/pkg/config"
+)
+
+func TestBlockCache(t *testing.T) {
+	config.SysConfig = &config.Config{}
+	block := make([]byte, 1024)
+	cache := NewBlockCache(16 * 1024)
+	// 热点块被再次读取一次后，一次性的顺序扫描不应挤掉它们
+	for i := int64(0); i < 4; i++ {
+		cache.Add(blockKey{path: "hot", index: i}, block, false)
+		if _, ok := cache.Get(blockKey{path: "hot", index: i}, block); !ok {
+			t.Fatalf("hot block %d should be cached", i)
+		}
+	}
+	// 读取时未命中后放入的块，以及预读后只被读取一次的块都属于一次性访问
+	for i := int64(0); i < 100; i++ {
+		cache.Add(blockKey{path: "scan", index: i}, block, false)
+		cache.Add(blockKey{path: "prefetch", index: i}, block, true)
+		cache.Get(blockKey{path: "prefetch", index: i}, block)
+		if cache.size > cache.maxSize {
+			t.Fatalf("cache size %d exceeds %d", cache.size, cache.maxSize)
+		}
+	}
+	for i := int64(0); i < 4; i++ {
+		if !cache.Contains(blockKey{path: "hot", index: i}) {
+			t.Fatalf("hot block %d should survive the scan", i)
+		}
+	}
+	// 刚从小队列淘汰的块再次放入时直接进入主队列
+	if cache.Contains(blockKey{path: "scan", index: 90}) || cache.ghosts[blockKey{path: "scan", index: 90}] == nil {
+		t.Fatal("scanned block should be evicted into the ghost queue")
+	}
+	cache.Add(blockKey{path: "scan", index: 90}, block, false)
+	if entry := cache.entries[blockKey{path: "scan", index: 90}]; entry == nil || entry.small {
+		t.Fatal("block in the ghost queue should be added to the main queue")
+	}
+}
+
+func TestBlockReadAhead(t *testing.T) {
+	config.SysConfig = &config.Config{}
+	config.SysConfig.Cache.ReadBlock = config.ReadBlock{Enabled: true, PrefetchBlocks: 4, MaxSize: 1 << 20}
+	blockSize := int64(1024)
+	dingFile := newTestFile(t, filepath.Join(t.TempDir(), "cachefile"), blockSize, blockSize*32)
+	for i := int64(0); i < 32; i++ {
+		if err := dingFile.WriteBlock(i, bytes.Repeat([]byte{byte(i)}, int(blockSize))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cached := func(i int64) bool { return GetBlockCache().Contains(dingFile.blockKey(i)) }
+	// 跳跃读取不预读
+	reader := newBlockReader(context.Background(), dingFile, 0, 31)
+	for _, i := range []int64{20, 10} {
+		if _, err := reader.ReadBlock(i); err != nil {
+			t.Fatal(err)
+		}
+		reader.Close()
+	}
+	if cached(21) || cached(11) {
+		t.Fatal("random reads should not read ahead")
+	}
+	// 顺序读取时窗口逐步扩大，不超过读取流的范围
+	reader = newBlockReader(context.Background(), dingFile, 0, 5)
+	for i := int64(0); i < 3; i++ {
+		got, err := reader.ReadBlock(i)
+		if err != nil || got[0] != byte(i) {
+			t.Fatalf("read block %d err.%v", i, err)
+		}
+		reader.Close()
+	}
+	if !cached(1) || !cached(5) || cached(6) {
+		t.Fatal("sequential reads should read ahead within the stream")
+	}
+	if reader.window != 4 {
+		t.Fatalf("window should grow to 4, got %d", reader.window)
+	}
+	got, err := dingFile.ReadBlock(5) // 其他读取者直接命中
+	if err != nil || got[0] != 5 {
+		t.Fatalf("read prefetched block err.%v", err)
+	}
+}
@@ -16,6 +16,10 @@ package downloader
 
 import (
 	"context"
+	"errors"
+	"sync/atomic"
+
+	"dingospeed/pkg/util"
 
 	"go.uber.org/zap"
 )
@@ -28,14 +32,17 @@ type TaskParam struct {
 	BlobsFile     string
 	FileName      string
 	FileSize      int64
-	ResponseChan  chan []byte
+	ResponseChan  chan util.Chunk
 	OrgRepo       string
 	Authorization string
 	Domain        string
 	Uri           string
 	DataType      string
 	Etag          string
+	XetHash       string
 	Cancel        context.CancelFunc
+	Claims        *BlockClaims
+	Priority      Priority
 }
 
 type DownloadTask struct {
@@ -45,10 +52,12 @@ type DownloadTask struct {
 	TaskSize      int
 	FileName      string
 	DingFile      *DingCache      `json:"-"`
-	ResponseChan  chan []byte     `json:"-"`
+	ResponseChan  chan util.Chunk `json:"-"` // 输出的chunk由接收方持有，写出后调用Release
 	Context       context.Context `json:"-"`
 	OrgRepo       string
 	Preheat       bool
+	Claims        *BlockClaims `json:"-"` // 请求登记的在途块
+	Priority      Priority     // 回源连接的调度优先级
 }
 
 func (d *DownloadTask) GetTaskNo() int {
@@ -65,6 +74,21 @@ func (d *DownloadTask) GetCancelFun() context.CancelFunc {
 
 type CacheFileTask struct {
 	*DownloadTask
+	Fallback func(startPos, endPos int64) *RemoteFileTask `json:"-"` // 缓存块校验失败时，改为从远端获取剩余区间
+}
+
+type discardOutputKey struct{}
+
+// WithDiscardOutput 返回带输出开关的context，调用discard后缓存任务不再读取和输出数据，
+// 远程任务仍下载到结束并写入缓存。用于客户端断开后在后台继续下载。
+func WithDiscardOutput(ctx context.Context) (context.Context, func()) {
+	discarded := &atomic.Bool{}
+	return context.WithValue(ctx, discardOutputKey{}, discarded), func() { discarded.Store(true) }
+}
+
+func outputDiscarded(ctx context.Context) bool {
+	discarded, _ := ctx.Value(discardOutputKey{}).(*atomic.Bool)
+	return discarded != nil && discarded.Load()
 }
 
 func NewCacheFileTask(taskNo int, rangeStartPos int64, rangeEndPos int64) *CacheFileTask {
@@ -85,46 +109,85 @@ func (c *CacheFileTask) OutResult() {
 	endBlock := (c.RangeEndPos - 1) / c.DingFile.GetBlockSize()
 	blockNumber := c.DingFile.getBlockNumber()
 	curPos := c.RangeStartPos
+	reader := newBlockReader(c.Context, c.DingFile, startBlock, endBlock)
+	defer reader.Close()
 	for curBlock := startBlock; curBlock <= endBlock; curBlock++ {
 		if c.Context.Err() != nil {
 			zap.S().Errorf("for cache ctx err :%s, %v", c.FileName, c.Context.Err())
 			return
 		}
+		if outputDiscarded(c.Context) { // 已缓存的区间无需再读取
+			zap.S().Infof("cache out discarded:%s/%s, taskNo:%d, curPos:%d", c.OrgRepo, c.FileName, c.TaskNo, curPos)
+			return
+		}
 		_, blockStartPos, blockEndPos := GetBlockInfo(curPos, c.DingFile.GetBlockSize(), c.DingFile.GetFileSize())
+		maxStart, minEnd := max(c.RangeStartPos, blockStartPos), min(c.RangeEndPos, blockEndPos)
 		hasBlockBool, err := c.DingFile.HasBlock(curBlock)
 		if err != nil {
 			zap.S().Errorf("HasBlock err. file:%s, curBlock:%d, curPos:%d, %v", c.FileName, curBlock, curPos, err)
 			continue
 		}
 		if !hasBlockBool {
-			zap.S().Errorf("block not exist. file:%s, curBlock:%d,curPos:%d", c.FileName, curBlock, curPos)
-			break
+			if done := c.Claims.Wait(curBlock); done != nil { // 其他请求正在下载该块，等待其写入缓存
+				select {
+				case <-done:
+				case <-c.Context.Done():
+					return
+				}
+				hasBlockBool, err = c.DingFile.HasBlock(curBlock)
+			}
+		}
+		if !hasBlockBool && c.DingFile.HasBlockRange(curBlock, maxStart, minEnd) { // 块不完整，所需的子页已缓存
+			pages, err := c.DingFile.ReadPages(maxStart, minEnd)
+			if err == nil {
+				chunk := util.NewChunk(pages, pages)
+				select {
+				case c.ResponseChan <- chunk:
+					zap.S().Debugf("%s/%s, taskNo:%d, block：%d(%d) pages write done, range：%d-%d.", c.OrgRepo, c.FileName, c.TaskNo, curBlock, blockNumber, maxStart, minEnd)
+				case <-c.Context.Done():
+					chunk.Release()
+					return
+				}
+				curPos += int64(len(pages))
+				continue
+			}
+			zap.S().Errorf("ReadPages err file:%s, %v", c.FileName, err)
+		}
+		if !hasBlockBool {
+			zap.S().Warnf("block not exist. file:%s, curBlock:%d,curPos:%d", c.FileName, curBlock, curPos)
+			c.outRemoteResult(curPos)
+			return
 		}
-		rawBlock, err := c.DingFile.ReadBlock(curBlock)
+		rawBlock, err := reader.ReadBlock(curBlock)
 		if err != nil {
+			if errors.Is(err, ErrBlockChecksum) {
+				c.outRemoteResult(curPos)
+				return
+			}
 			zap.S().Errorf("ReadBlock err file:%s, %v", c.FileName, err)
 			continue
 		}
-		maxStart, minEnd := max(c.RangeStartPos, blockStartPos), min(c.RangeEndPos, blockEndPos)
 		sPos := maxStart - blockStartPos
 		ePos := minEnd - blockStartPos
 		rawLen := int64(len(rawBlock))
 		if rawLen == 0 || sPos > rawLen {
 			zap.S().Errorf("read rawBlock err,%s, rawLen:%d, sPos:%d,ePos:%d, %v", c.FileName, rawLen, sPos, ePos, err)
+			util.PutBuffer(rawBlock)
 			continue
 		}
 		if ePos > rawLen {
 			zap.S().Warnf("block incomplete,%s, rawLen:%d, sPos:%d,ePos:%d, %v", c.FileName, rawLen, sPos, ePos, err)
 			ePos = rawLen
 		}
-		chunk := rawBlock[sPos:ePos]
+		chunk := util.NewChunk(rawBlock, rawBlock[sPos:ePos]) // 从块中间开始时直接发送子切片，释放时归还整个块
 		select {
 		case c.ResponseChan <- chunk:
 			zap.S().Debugf("%s/%s, taskNo:%d, block：%d(%d)write done, range：%d-%d.", c.OrgRepo, c.FileName, c.TaskNo, curBlock, blockNumber, maxStart, minEnd)
 		case <-c.Context.Done():
+			chunk.Release()
 			return
 		}
-		curPos += int64(len(chunk))
+		curPos += int64(len(chunk.Data))
 	}
 	if curPos != c.RangeEndPos {
 		zap.S().Errorf("file:%s, cache range from %d to %d is incomplete.", c.FileName, c.RangeStartPos, c.RangeEndPos)
@@ -132,6 +195,18 @@ func (c *CacheFileTask) OutResult() {
 	zap.S().Infof("cache out:%s/%s, taskNo:%d, size:%d, startPos:%d, endPos:%d", c.OrgRepo, c.FileName, c.TaskNo, c.TaskSize, c.RangeStartPos, c.RangeEndPos)
 }
 
-func (c *CacheFileTask) GetResponseChan() chan []byte {
-	return c.ResponseChan
+// outRemoteResult 块数据已损坏或未能缓存，不能从缓存输出给客户端，剩余区间由远程任务重新下载并写回缓存。
+func (c *CacheFileTask) outRemoteResult(curPos int64) {
+	if c.Fallback == nil {
+		zap.S().Errorf("file:%s, block at %d is unavailable and can not be fetched again.", c.FileName, curPos)
+		return
+	}
+	remote := c.Fallback(curPos, c.RangeEndPos)
+	if remote == nil {
+		zap.S().Errorf("file:%s, block at %d is unavailable and the remote fallback is disabled.", c.FileName, curPos)
+		return
+	}
+	zap.S().Warnf("file:%s/%s, taskNo:%d, refetch range %d-%d from %s.", c.OrgRepo, c.FileName, c.TaskNo, curPos, c.RangeEndPos, remote.Domain)
+	go remote.DoTask()
+	remote.OutResult()
 }
@@ -0,0 +1,77 @@
+//  Copyright (c) 2025 dingodb.com, Inc. All Rights Reserved
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http:www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+
+	"dingospeed/pkg/config"
+	"dingospeed/pkg/util"
+)
+
+func TestDiscardOutput(t *testing.T) {
+	config.SysConfig = &config.Config{}
+	blockSize := int64(1024)
+	dingFile := newTestFile(t, filepath.Join(t.TempDir(), "cachefile"), blockSize, blockSize*4)
+	for i := int64(0); i < 4; i++ {
+		if err := dingFile.WriteBlock(i, bytes.Repeat([]byte{byte(i)}, int(blockSize))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, discard := WithDiscardOutput(context.Background())
+	newTask := func() *CacheFileTask {
+		task := NewCacheFileTask(0, 0, blockSize*4)
+		task.Context = ctx
+		task.DingFile = dingFile
+		task.ResponseChan = make(chan util.Chunk, 4)
+		return task
+	}
+	task := newTask()
+	task.OutResult()
+	if len(task.ResponseChan) != 4 {
+		t.Fatalf("expect 4 chunks, got %d", len(task.ResponseChan))
+	}
+	// 客户端断开后缓存任务不再输出
+	discard()
+	task = newTask()
+	task.OutResult()
+	if len(task.ResponseChan) != 0 {
+		t.Fatalf("discarded output should not be sent, got %d chunks", len(task.ResponseChan))
+	}
+}
+
+// BenchmarkCacheOutResult 从缓存读取并输出给响应方，区间从块中间开始
+func BenchmarkCacheOutResult(b *testing.B) {
+	content := setupBenchmark(b)
+	dingFile := newBenchmarkFile(b, content)
+	b.SetBytes(int64(len(content)) - 100)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		task := NewCacheFileTask(0, 100, int64(len(content)))
+		task.Context = context.Background()
+		task.DingFile = dingFile
+		task.ResponseChan = make(chan util.Chunk, 100)
+		go func() {
+			defer close(task.ResponseChan)
+			task.OutResult()
+		}()
+		for chunk := range task.ResponseChan {
+			chunk.Release()
+		}
+	}
+}
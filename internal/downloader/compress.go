@@ -0,0 +1,113 @@
+//  Copyright (c) 2025 dingodb.com, Inc. All Rights Reserved
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http:www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package downloader
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+// EncodeAll/DecodeAll可并发调用，全局共享一组编解码器。
+func initZstd() {
+	zstdOnce.Do(func() {
+		var err error
+		if zstdEncoder, err = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault)); err != nil {
+			panic(err)
+		}
+		if zstdDecoder, err = zstd.NewReader(nil); err != nil {
+			panic(err)
+		}
+	})
+}
+
+// compressBlock 压缩块数据，压缩后不小于原数据时按原样存放。
+func compressBlock(compression uint64, src []byte) ([]byte, uint32) {
+	if compression != CompressionZstd {
+		return src, BlockStoredRaw
+	}
+	initZstd()
+	dst := zstdEncoder.EncodeAll(src, make([]byte, 0, len(src)))
+	if len(dst) >= len(src) {
+		return src, BlockStoredRaw
+	}
+	return dst, 0
+}
+
+// decompressBlock 将存放的块数据还原到dst中，返回还原后的长度。
+func decompressBlock(compression uint64, loc BlockLocation, src, dst []byte) (int, error) {
+	if loc.Flags&BlockStoredRaw != 0 {
+		return copy(dst, src), nil
+	}
+	if compression != CompressionZstd {
+		return 0, fmt.Errorf("unknown compression %d", compression)
+	}
+	initZstd()
+	out, err := zstdDecoder.DecodeAll(src, dst[:0])
+	if err != nil {
+		return 0, err
+	}
+	if len(out) > len(dst) {
+		return 0, fmt.Errorf("decompressed block is too large: %d", len(out))
+	}
+	return copy(dst, out), nil
+}
+
+// compressedReader 按块还原压缩文件的内容，用于整体校验。
+type compressedReader struct {
+	f           *os.File
+	snapshot    *blobSnapshot
+	nextBlock   int
+	pending     []byte
+	blockBuffer []byte
+}
+
+func (r *compressedReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.nextBlock >= len(r.snapshot.index) {
+			return 0, io.EOF
+		}
+		loc := r.snapshot.index[r.nextBlock]
+		src := make([]byte, loc.Length)
+		if _, err := r.f.ReadAt(src, r.snapshot.headerSize+int64(loc.Offset)); err != nil && err != io.EOF {
+			return 0, err
+		}
+		realSize := min(r.snapshot.blockSize, r.snapshot.fileSize-int64(r.nextBlock)*r.snapshot.blockSize)
+		if r.blockBuffer == nil {
+			r.blockBuffer = make([]byte, r.snapshot.blockSize)
+		}
+		n, err := decompressBlock(r.snapshot.compression, loc, src, r.blockBuffer)
+		if err != nil {
+			return 0, err
+		}
+		if int64(n) < realSize {
+			return 0, fmt.Errorf("block %d is truncated, expected %d, got %d", r.nextBlock, realSize, n)
+		}
+		r.pending = r.blockBuffer[:realSize]
+		r.nextBlock++
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
@@ -0,0 +1,77 @@
+//  Copyright (c) 2025 dingodb.com, Inc. All Rights Reserved
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http:www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package downloader
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCompressedBlocks(t *testing.T) {
+	repos := setupRepos(t)
+	blockSize := int64(4096)
+	content := []byte(strings.Repeat(`{"text": "hello world"}`+"\n", 500))
+	random := make([]byte, blockSize)
+	for i := range random {
+		random[i] = byte((i*7919 + i*i*31) >> 3)
+	}
+	copy(content[blockSize:], random) // 第二个块不可压缩，按原样存放
+	sum := sha256.Sum256(content)
+	blobPath := filepath.Join(repos, "files", "datasets", "org", "repo", "blobs", hex.EncodeToString(sum[:]))
+	dingFile := newTestFile(t, blobPath, blockSize, 0)
+	if err := dingFile.SetCompression(CompressionZstd); err != nil {
+		t.Fatal(err)
+	}
+	if err := dingFile.Resize(int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+	blockNumber := (int64(len(content)) + blockSize - 1) / blockSize
+	for i := blockNumber - 1; i >= 0; i-- { // 乱序写入
+		block := make([]byte, blockSize)
+		copy(block, content[i*blockSize:])
+		if err := dingFile.WriteBlock(i, block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := int64(0); i < blockNumber; i++ {
+		block, err := dingFile.ReadBlock(i)
+		if err != nil {
+			t.Fatalf("ReadBlock %d err.%v", i, err)
+		}
+		end := min((i+1)*blockSize, int64(len(content)))
+		if !bytes.Equal(block[:end-i*blockSize], content[i*blockSize:end]) {
+			t.Fatalf("block %d mismatch", i)
+		}
+	}
+	if _, ok := dingFile.OpenCachedRange(0, int64(len(content))); ok {
+		t.Fatalf("compressed file should not be served from file directly")
+	}
+	waitVerify(dingFile)
+	if !IsBlobVerified(blobPath, int64(len(content))) {
+		t.Fatalf("compressed blob should be verified")
+	}
+	info, err := os.Stat(blobPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() >= int64(len(content)) {
+		t.Fatalf("compressed file is not smaller: %d >= %d", info.Size(), len(content))
+	}
+}
@@ -17,32 +17,51 @@ package downloader
 import (
 	"bytes"
 	"errors"
-	"fmt"
+	"io"
 	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	cache "dingospeed/internal/data"
 	"dingospeed/pkg/config"
+	"dingospeed/pkg/consts"
+	"dingospeed/pkg/prom"
 	"dingospeed/pkg/util"
 
 	"go.uber.org/zap"
 )
 
 const (
-	CURRENT_OLAH_CACHE_VERSION = 8
+	CURRENT_OLAH_CACHE_VERSION = 13
 	// DEFAULT_BLOCK_MASK_MAX     = 30
+	// DEFAULT_BLOCK_MASK_MAX v11之前版本的固定位图大小
 	DEFAULT_BLOCK_MASK_MAX uint64 = 1024 * 1024
+	// DEFAULT_MOVE_CHUNK_SIZE 头部长度变化时拷贝数据的分段大小
+	DEFAULT_MOVE_CHUNK_SIZE int64 = 8 * 1024 * 1024
+	// resizingSuffix 头部长度变化时重写文件使用的临时文件
+	resizingSuffix = ".resizing"
 
 	cost = 1
 )
 
+// ErrBlockChecksum 块数据与头部记录的校验值不一致，该块已被标记为不存在，需要重新获取。
+var ErrBlockChecksum = errors.New("block checksum mismatch")
+
 // DingCache 结构体表示 Olah 缓存文件
 type DingCache struct {
 	path       string
 	header     *DingCacheHeader
 	isOpen     bool
+	file       *os.File // 打开期间一直持有的文件句柄，数据读写均使用ReadAt/WriteAt
 	headerLock sync.RWMutex
 	fileLock   sync.RWMutex
+	verifying  atomic.Bool   // 是否正在后台校验整个blob
+	verified   atomic.Bool   // 整个blob已通过校验，打开时从校验结果读取，块校验失败时清除
+	cacheGen   atomic.Uint64 // 块缓存代数，见blockKey
+
+	dirtyBlocks int         // 已写入但头部尚未刷新的块数量
+	lastFlush   time.Time   // 上次刷新头部的时间
+	flushTimer  *time.Timer // 头部延迟刷新的定时器
 }
 
 func NewDingCache(path string, blockSize int64) (*DingCache, error) {
@@ -62,35 +81,24 @@ func (c *DingCache) Open(path string, blockSize int64) error {
 	if c.isOpen {
 		return errors.New("this file has been open")
 	}
-	var f *os.File
-	if _, err := os.Stat(path); err == nil { // 文件存在
-		c.headerLock.Lock()
-		defer c.headerLock.Unlock()
-		f, err = os.OpenFile(path, os.O_RDWR, 0644) // null file
-		if err != nil {
-			return err
-		}
-		defer f.Close()
-		c.header = &DingCacheHeader{}
-		if err = c.header.Read(f); err != nil {
-			c.header = NewDingCacheHeader(CURRENT_OLAH_CACHE_VERSION, uint64(blockSize), 0)
-			if err = c.header.Write(f); err != nil {
-				return err
-			}
-		}
-	} else {
-		c.headerLock.Lock()
-		defer c.headerLock.Unlock()
-		f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
-		if err != nil {
-			return err
-		}
-		defer f.Close()
+	c.headerLock.Lock()
+	defer c.headerLock.Unlock()
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	c.header = &DingCacheHeader{}
+	if err = c.header.Read(f); err != nil { // 新建的文件或无法识别的文件，重新写入头部
 		c.header = NewDingCacheHeader(CURRENT_OLAH_CACHE_VERSION, uint64(blockSize), 0)
-		if err = c.header.Write(f); err != nil {
+		if err = writeHeader(f, c.header); err != nil {
+			f.Close()
 			return err
 		}
 	}
+	c.file = f
+	c.lastFlush = time.Now()
+	c.verified.Store(c.header.HasChecksum() && IsBlobVerified(path, int64(c.header.FileSize)))
+	c.cacheGen.Store(blockCacheGen.Add(1))
 	c.isOpen = true
 	return nil
 }
@@ -103,27 +111,77 @@ func (c *DingCache) Close() error {
 	c.fileLock.Lock()
 	defer c.fileLock.Unlock()
 	// 20250619 fix when the file is read, the update date is modified
-	// if err := c.flushHeader(); err != nil {
-	// 	return err
-	// }
+	// 只刷新尚未落盘的头部，只读的文件不会被修改。
+	err := c.flushDirtyHeader()
+	if c.flushTimer != nil {
+		c.flushTimer.Stop()
+		c.flushTimer = nil
+	}
+	if closeErr := c.file.Close(); err == nil {
+		err = closeErr
+	}
+	c.file = nil
 	c.path = ""
 	c.header = nil
 	c.isOpen = false
-	return nil
+	return err
 }
 
+// flushHeader 立即将头部写入文件，调用方需持有fileLock。
 func (c *DingCache) flushHeader() error {
-	// c.headerLock.Lock()
-	// defer c.headerLock.Unlock()
-	f, err := os.OpenFile(c.path, os.O_RDWR, 0644)
-	if err != nil {
+	if err := writeHeader(c.file, c.header); err != nil {
 		return err
 	}
-	defer f.Close()
-	if _, err := f.Seek(0, 0); err != nil {
+	c.dirtyBlocks = 0
+	c.lastFlush = time.Now()
+	if config.SysConfig.GetFsyncMode() != consts.FsyncNone {
+		return c.file.Sync()
+	}
+	return nil
+}
+
+// flushDirtyHeader 存在未刷新的块时刷新头部，调用方需持有fileLock。
+func (c *DingCache) flushDirtyHeader() error {
+	if c.dirtyBlocks == 0 {
+		return nil
+	}
+	return c.flushHeader()
+}
+
+// markBlockDirty 按刷新策略（每N个块或超过T毫秒）刷新头部，其余的由定时器或Close刷新，调用方需持有fileLock。
+// 头部落后于数据只会导致已写入的块被重新下载，不会读到错误的数据。
+func (c *DingCache) markBlockDirty() error {
+	c.dirtyBlocks++
+	interval := config.SysConfig.GetHeaderFlushInterval()
+	if c.dirtyBlocks >= config.SysConfig.GetHeaderFlushBlocks() || time.Since(c.lastFlush) >= interval {
+		return c.flushHeader()
+	}
+	if c.flushTimer == nil {
+		c.flushTimer = time.AfterFunc(interval, c.timedFlushHeader)
+	}
+	return nil
+}
+
+func (c *DingCache) timedFlushHeader() {
+	c.fileLock.Lock()
+	defer c.fileLock.Unlock()
+	c.flushTimer = nil
+	if !c.isOpen {
+		return
+	}
+	if err := c.flushDirtyHeader(); err != nil {
+		zap.S().Errorf("flushHeader err. file:%s, %v", c.path, err)
+	}
+}
+
+// writeHeader 序列化头部后一次性写入文件起始处，不改变文件句柄的读写位置。
+func writeHeader(f *os.File, header *DingCacheHeader) error {
+	var buf bytes.Buffer
+	if err := header.Write(&buf); err != nil {
 		return err
 	}
-	return c.header.Write(f)
+	_, err := f.WriteAt(buf.Bytes(), 0)
+	return err
 }
 
 func (c *DingCache) GetPath() string {
@@ -158,10 +216,20 @@ func (c *DingCache) getHeaderSize() int64 {
 	return c.header.GetHeaderSize()
 }
 
-func (c *DingCache) setHeaderBlock(blockIndex int64) error {
-	// c.headerLock.Lock()
-	// defer c.headerLock.Unlock()
-	return c.header.BlockMask.Set(uint64(blockIndex))
+// setHeaderBlock 记录块的校验和并标记为已缓存，返回文件是否已下载完成，调用方需持有fileLock。
+func (c *DingCache) setHeaderBlock(blockIndex int64, realBlockBytes []byte) (bool, error) {
+	c.headerLock.Lock()
+	defer c.headerLock.Unlock()
+	c.header.SetChecksum(uint64(blockIndex), realBlockBytes)
+	if err := c.header.BlockMask.Set(uint64(blockIndex)); err != nil {
+		return false, err
+	}
+	c.header.ClearPages(uint64(blockIndex))
+	complete := c.header.IsComplete()
+	if complete && c.header.HasProvenance() {
+		c.header.Provenance.CompleteTime = time.Now().Unix()
+	}
+	return complete, nil
 }
 
 func (c *DingCache) HasBlock(blockIndex int64) (bool, error) {
@@ -170,8 +238,30 @@ func (c *DingCache) HasBlock(blockIndex int64) (bool, error) {
 	return c.header.BlockMask.Test(uint64(blockIndex))
 }
 
-// ReadBlock 读取块数据，该操作会预先缓存prefetchBlocks个块数据，避免每次读取时对文件做操作。
+// HasBlockRange 块内[startPos,endPos)是否已缓存，位置为文件内的偏移。块已完整缓存，或区间涉及的子页都已缓存时返回true。
+func (c *DingCache) HasBlockRange(blockIndex, startPos, endPos int64) bool {
+	c.headerLock.RLock()
+	defer c.headerLock.RUnlock()
+	if ok, err := c.header.BlockMask.Test(uint64(blockIndex)); err == nil && ok {
+		return true
+	}
+	if c.header.PagesPerBlock() == 0 || endPos <= startPos {
+		return false
+	}
+	blockStartPos := blockIndex * int64(c.header.BlockSize)
+	first, last := c.header.touchedPages(uint64(startPos-blockStartPos), uint64(endPos-blockStartPos))
+	return c.header.TestPages(uint64(blockIndex), first, last)
+}
 
+// Progress 返回已缓存的块数与总块数
+func (c *DingCache) Progress() (int64, int64) {
+	c.headerLock.RLock()
+	defer c.headerLock.RUnlock()
+	return c.header.CachedBlocks(), int64(c.header.BlockNumber)
+}
+
+// ReadBlock 读取块数据，启用块缓存时先从内存读取，未命中时读取文件后放入缓存。
+// 返回的缓冲区取自util.GetBuffer，由调用方持有，末尾不足一块的部分填充为0。
 func (c *DingCache) ReadBlock(blockIndex int64) ([]byte, error) {
 	if !c.isOpen {
 		return nil, errors.New("this file has been closed")
@@ -179,93 +269,103 @@ func (c *DingCache) ReadBlock(blockIndex int64) ([]byte, error) {
 	if blockIndex >= c.getBlockNumber() {
 		return nil, errors.New("Invalid block index.")
 	}
-	key := c.getBlockKey(blockIndex)
-	if config.SysConfig.EnableReadBlockCache() {
-		if blockData, ok := cache.FileBlockCache.Get(key); ok {
-			// 若当前为最后一个块，则移除最近的16个块
-			if blockIndex == c.getBlockNumber()-1 {
-				for i := config.SysConfig.GetPrefetchBlocks(); i >= 0; i-- {
-					no := blockIndex - i
-					if no >= 0 {
-						oldKey := c.getBlockKey(no)
-						cache.FileBlockCache.Delete(oldKey)
-					}
-				}
-			}
-			return blockData.([]byte), nil
-		}
-	}
+	blockCache := GetBlockCache()
+	key := c.blockKey(blockIndex) // 先取代数，读取期间文件被重置时放入的数据不会再命中
 	hasBlock, err := c.HasBlock(blockIndex)
-	if err != nil {
+	if err != nil || !hasBlock {
 		return nil, err
 	}
-	if !hasBlock {
-		return nil, nil
+	rawBlock := util.GetBuffer(int(c.GetBlockSize())) // 读取当前块（blockIndex）的数据
+	if n, ok := blockCache.Get(key, rawBlock); ok {
+		clear(rawBlock[n:])
+		return rawBlock, nil
 	}
-	offset := c.getHeaderSize() + blockIndex*c.GetBlockSize()
-	f, err := os.OpenFile(c.path, os.O_RDONLY, 0644)
-	if err != nil {
+	if err = c.readVerifiedBlock(blockIndex, rawBlock); err != nil {
+		util.PutBuffer(rawBlock)
 		return nil, err
 	}
-	defer f.Close()
-	if _, err := f.Seek(offset, 0); err != nil {
-		return nil, err
+	realSize := c.getBlockRealSize(blockIndex)
+	blockCache.Add(key, rawBlock[:realSize], false)
+	clear(rawBlock[realSize:]) // 缓冲区是复用的，需清除末尾的旧数据
+	return rawBlock, nil
+}
+
+// blockKey 块在块缓存中的键，使用文件当前的缓存代数
+func (c *DingCache) blockKey(blockIndex int64) blockKey {
+	return blockKey{path: c.path, gen: c.cacheGen.Load(), index: blockIndex}
+}
+
+// dropBlockCache 文件内容被重置或块被判定损坏后更换缓存代数，并删除块缓存中该路径的数据
+func (c *DingCache) dropBlockCache() {
+	c.cacheGen.Store(blockCacheGen.Add(1))
+	GetBlockCache().RemoveFile(c.path)
+}
+
+// prefetchBlock 把文件中已缓存的块预读到块缓存，块不存在或读取失败时返回false。
+func (c *DingCache) prefetchBlock(blockIndex int64) bool {
+	blockCache := GetBlockCache()
+	if !c.isOpen || blockIndex >= c.getBlockNumber() {
+		return false
 	}
-	rawBlock := make([]byte, c.GetBlockSize()) // 读取当前块（blockIndex）的数据
-	if _, err := f.Read(rawBlock); err != nil {
-		return nil, err
+	key := c.blockKey(blockIndex)
+	if blockCache.Contains(key) {
+		return true
 	}
-	if config.SysConfig.EnableReadBlockCache() {
-		c.readBlockAndCache(f, blockIndex)
+	hasBlock, err := c.HasBlock(blockIndex)
+	if err != nil || !hasBlock {
+		return false
 	}
-	block := c.padBlock(rawBlock)
-	return block, nil
+	rawBlock := util.GetBuffer(int(c.GetBlockSize()))
+	defer util.PutBuffer(rawBlock)
+	if err = c.readVerifiedBlock(blockIndex, rawBlock); err != nil {
+		zap.S().Warnf("prefetch block err. file:%s, block:%d, %v", c.path, blockIndex, err)
+		return false
+	}
+	blockCache.Add(key, rawBlock[:c.getBlockRealSize(blockIndex)], true)
+	if config.SysConfig.EnableMetric() {
+		prom.BlockCachePrefetchCnt.Inc()
+	}
+	return true
 }
 
-func (c *DingCache) readBlockAndCache(f *os.File, blockIndex int64) {
-	memoryUsedPercent := config.SystemInfo.MemoryUsedPercent
-	if memoryUsedPercent != 0 && memoryUsedPercent >= config.SysConfig.GetPrefetchMemoryUsedThreshold() {
-		return
+// readVerifiedBlock 读取块并按校验值检查，校验失败时将块标记为不存在并返回ErrBlockChecksum。
+func (c *DingCache) readVerifiedBlock(blockIndex int64, rawBlock []byte) error {
+	if err := c.readRawBlock(blockIndex, rawBlock); err != nil {
+		return err
 	}
-	// 读取并缓存当前块后的16个块
-	for blockOffset := int64(1); blockOffset <= config.SysConfig.GetPrefetchBlocks(); blockOffset++ {
-		newOffsetBlock := blockIndex + blockOffset
-		if newOffsetBlock >= c.getBlockNumber() {
-			break
-		}
-		hasNextBlock, err := c.HasBlock(newOffsetBlock)
-		if err != nil {
-			zap.S().Errorf("hasBlock err. newOffsetBlock:%d, %v", newOffsetBlock, err)
-			break
-		}
-		if hasNextBlock {
-			key := c.getBlockKey(newOffsetBlock)
-			prefetchRawBlock := make([]byte, c.GetBlockSize())
-			if _, err := f.Read(prefetchRawBlock); err != nil {
-				zap.S().Errorf("read err. newOffsetBlock:%d, %v", newOffsetBlock, err)
-				break
-			}
-			blockByte := c.padBlock(prefetchRawBlock)
-			cache.FileBlockCache.Set(key, blockByte)
-			// 删除上一个缓存周期的内容，释放内存
-			oldOffsetBlock := newOffsetBlock - config.SysConfig.GetPrefetchBlocks() - 1
-			if oldOffsetBlock > 0 {
-				oldKey := c.getBlockKey(newOffsetBlock)
-				cache.FileBlockCache.Delete(oldKey)
-			}
-		} else {
-			break
-		}
+	if !c.verifyBlock(blockIndex, rawBlock) {
+		c.invalidateBlock(blockIndex)
+		return ErrBlockChecksum
 	}
+	return nil
 }
 
-// padBlock 填充块数据
-func (c *DingCache) padBlock(rawBlock []byte) []byte {
-	blockSize := c.GetBlockSize()
-	if int64(len(rawBlock)) < blockSize {
-		return append(rawBlock, bytes.Repeat([]byte{0}, int(blockSize)-len(rawBlock))...)
+// readRawBlock 按块读取数据，最后一个块读到文件末尾为止。
+func (c *DingCache) readRawBlock(blockIndex int64, rawBlock []byte) error {
+	c.fileLock.RLock()
+	defer c.fileLock.RUnlock()
+	if c.header.IsCompressed() {
+		return c.readCompressedBlock(blockIndex, rawBlock)
+	}
+	offset := c.getHeaderSize() + blockIndex*c.GetBlockSize()
+	if _, err := c.file.ReadAt(rawBlock, offset); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// readCompressedBlock 按块索引读取并解压，数据损坏时返回全零的块，由校验值发现并重新获取。调用方需持有fileLock。
+func (c *DingCache) readCompressedBlock(blockIndex int64, rawBlock []byte) error {
+	loc := c.header.BlockIndex[blockIndex]
+	src := make([]byte, loc.Length)
+	if _, err := c.file.ReadAt(src, c.getHeaderSize()+int64(loc.Offset)); err != nil && err != io.EOF {
+		return err
 	}
-	return rawBlock
+	if _, err := decompressBlock(c.header.Compression, loc, src, rawBlock); err != nil {
+		zap.S().Warnf("decompress block err. file:%s, block:%d, %v", c.path, blockIndex, err)
+		clear(rawBlock)
+	}
+	return nil
 }
 
 func (c *DingCache) WriteBlock(blockIndex int64, blockBytes []byte) error {
@@ -278,96 +378,397 @@ func (c *DingCache) WriteBlock(blockIndex int64, blockBytes []byte) error {
 	if int64(len(blockBytes)) != c.GetBlockSize() {
 		return errors.New("block size does not match the cache's block size")
 	}
-	offset := c.getHeaderSize() + blockIndex*c.GetBlockSize()
-	f, err := os.OpenFile(c.path, os.O_RDWR, 0644)
-	if err != nil {
+	realBlockBytes := blockBytes[:c.getBlockRealSize(blockIndex)]
+	if err := c.writeRawBlock(blockIndex, realBlockBytes); err != nil {
 		return err
 	}
-	defer f.Close()
-	if _, err := f.Seek(offset, 0); err != nil {
+	c.fileLock.Lock()
+	defer c.fileLock.Unlock()
+	return c.commitBlock(blockIndex, realBlockBytes)
+}
+
+// commitBlock 块数据已写入，记录到头部并按刷新策略刷新，调用方需持有fileLock。
+func (c *DingCache) commitBlock(blockIndex int64, realBlockBytes []byte) error {
+	complete, err := c.setHeaderBlock(blockIndex, realBlockBytes)
+	if err != nil {
 		return err
 	}
-	if (blockIndex+1)*c.GetBlockSize() > c.GetFileSize() {
-		realBlockBytes := blockBytes[:c.GetFileSize()-blockIndex*c.GetBlockSize()]
-		if _, err = f.Write(realBlockBytes); err != nil {
-			return err
-		}
-	} else {
-		if _, err = f.Write(blockBytes); err != nil {
+	if complete { // 文件下载完成时立即刷新，其他请求据此判断是否可直接使用缓存
+		if err := c.flushHeader(); err != nil {
 			return err
 		}
+	} else if err := c.markBlockDirty(); err != nil {
+		return err
+	}
+	if complete {
+		c.startVerify()
+	}
+	return nil
+}
+
+func (c *DingCache) writeRawBlock(blockIndex int64, realBlockBytes []byte) error {
+	if compression := c.getCompression(); compression != CompressionNone {
+		data, flags := compressBlock(compression, realBlockBytes)
+		return c.appendBlock(blockIndex, data, flags)
+	}
+	return c.writeData(blockIndex*c.GetBlockSize(), realBlockBytes)
+}
+
+// writeData 将数据写入数据区的pos处，只用于不压缩存放的文件。
+func (c *DingCache) writeData(pos int64, data []byte) error {
+	c.fileLock.RLock()
+	defer c.fileLock.RUnlock()
+	if _, err := c.file.WriteAt(data, c.getHeaderSize()+pos); err != nil {
+		return err
+	}
+	if config.SysConfig.GetFsyncMode() == consts.FsyncAlways {
+		return c.file.Sync()
+	}
+	return nil
+}
+
+// WritePages 缓存不完整的块中被data完整覆盖的子页，data从文件偏移startPos开始且位于同一个块内。
+// 块的所有子页都已缓存时，计算整块的校验值并标记为已缓存的块。不使用子页的文件直接忽略。
+func (c *DingCache) WritePages(startPos int64, data []byte) error {
+	if !c.isOpen {
+		return errors.New("this file has been closed")
+	}
+	blockSize := c.GetBlockSize()
+	blockIndex := startPos / blockSize
+	blockStartPos := blockIndex * blockSize
+	endPos := startPos + int64(len(data))
+	if startPos < 0 || blockIndex >= c.getBlockNumber() || endPos > blockStartPos+c.getBlockRealSize(blockIndex) {
+		return errors.New("invalid page range")
+	}
+	c.headerLock.RLock()
+	pages, pageSize := c.header.PagesPerBlock(), int64(c.header.PageSize)
+	var first, last uint64
+	if pages > 0 {
+		first, last = c.header.coveredPages(uint64(blockIndex), uint64(startPos-blockStartPos), uint64(endPos-blockStartPos))
+	}
+	c.headerLock.RUnlock()
+	if pages == 0 || first >= last {
+		return nil
+	}
+	if hasBlock, err := c.HasBlock(blockIndex); err != nil || hasBlock {
+		return err
+	}
+	realSize := c.getBlockRealSize(blockIndex)
+	pageStartPos := blockStartPos + int64(first)*pageSize
+	pageEndPos := blockStartPos + min(int64(last)*pageSize, realSize)
+	if err := c.writeData(pageStartPos, data[pageStartPos-startPos:pageEndPos-startPos]); err != nil {
+		return err
 	}
 	c.fileLock.Lock()
 	defer c.fileLock.Unlock()
-	if err = c.setHeaderBlock(blockIndex); err != nil {
+	c.headerLock.Lock()
+	c.header.SetPages(uint64(blockIndex), first, last)
+	filled := c.header.TestPages(uint64(blockIndex), 0, (uint64(realSize)+uint64(pageSize)-1)/uint64(pageSize))
+	c.headerLock.Unlock()
+	if !filled {
+		return c.markBlockDirty()
+	}
+	// 所有子页都已缓存，读出整块数据计算校验值
+	realBlockBytes := make([]byte, realSize)
+	if _, err := c.file.ReadAt(realBlockBytes, c.getHeaderSize()+blockStartPos); err != nil && err != io.EOF {
 		return err
 	}
-	if err = c.flushHeader(); err != nil {
+	return c.commitBlock(blockIndex, realBlockBytes)
+}
+
+// ReadPages 读取块内已由子页缓存的[startPos,endPos)，位置为文件内的偏移。子页没有校验值，块完整后才按块校验。
+// 返回的缓冲区由调用方持有。
+func (c *DingCache) ReadPages(startPos, endPos int64) ([]byte, error) {
+	if !c.isOpen {
+		return nil, errors.New("this file has been closed")
+	}
+	if !c.HasBlockRange(startPos/c.GetBlockSize(), startPos, endPos) {
+		return nil, errors.New("pages are not cached")
+	}
+	c.fileLock.RLock()
+	defer c.fileLock.RUnlock()
+	if c.header.IsCompressed() {
+		return nil, errors.New("compressed file can not be read by pages")
+	}
+	buf := util.GetBuffer(int(endPos - startPos))
+	if _, err := c.file.ReadAt(buf, c.getHeaderSize()+startPos); err != nil && err != io.EOF {
+		util.PutBuffer(buf)
+		return nil, err
+	}
+	return buf, nil
+}
+
+// appendBlock 将压缩后的块追加到数据区末尾并记录位置，重新写入的块不复用旧的空间。
+func (c *DingCache) appendBlock(blockIndex int64, data []byte, flags uint32) error {
+	c.fileLock.Lock()
+	defer c.fileLock.Unlock()
+	offset := c.header.DataSize()
+	if _, err := c.file.WriteAt(data, c.getHeaderSize()+offset); err != nil {
 		return err
 	}
-	// key := c.getBlockKey(blockIndex)  不需要删除，本来就没有
-	// cache.FileBlockCache.Del(key)
+	if config.SysConfig.GetFsyncMode() == consts.FsyncAlways {
+		if err := c.file.Sync(); err != nil {
+			return err
+		}
+	}
+	c.headerLock.Lock()
+	c.header.BlockIndex[blockIndex] = BlockLocation{Offset: uint64(offset), Length: uint32(len(data)), Flags: flags}
+	c.headerLock.Unlock()
 	return nil
 }
 
-func (c *DingCache) Resize(fileSize int64) error {
+func (c *DingCache) getCompression() uint64 {
+	c.headerLock.RLock()
+	defer c.headerLock.RUnlock()
+	if !c.header.IsCompressed() {
+		return CompressionNone
+	}
+	return c.header.Compression
+}
+
+// SetCompression 设置块的压缩方式，只对尚未写入数据的文件生效。
+func (c *DingCache) SetCompression(compression uint64) error {
 	if !c.isOpen {
 		return errors.New("this file has been closed")
 	}
-	bs := c.GetBlockSize()
-	newBlockNum := (fileSize + bs - 1) / bs
 	c.fileLock.Lock()
 	defer c.fileLock.Unlock()
-	if err := c.resizeFileSize(fileSize); err != nil {
-		return err
+	if !c.header.HasCompression() || c.GetFileSize() != 0 || c.header.Compression == compression {
+		return nil
 	}
-	// 设置块数量、文件大小参数
-	if err := c.resizeHeader(newBlockNum, fileSize); err != nil {
+	oldHeaderSize, oldDataSize := c.getHeaderSize(), c.getDataSize()
+	c.headerLock.Lock()
+	c.header.SetCompression(compression)
+	c.headerLock.Unlock()
+	if err := c.resizeFileSize(oldHeaderSize, oldDataSize); err != nil {
 		return err
 	}
 	return c.flushHeader()
 }
 
-func (c *DingCache) resizeFileSize(fileSize int64) error {
+// getDataSize 返回数据区的长度
+func (c *DingCache) getDataSize() int64 {
+	c.headerLock.RLock()
+	defer c.headerLock.RUnlock()
+	return c.header.DataSize()
+}
+
+func (c *DingCache) Resize(fileSize int64) error {
 	if !c.isOpen {
 		return errors.New("this file has been closed")
 	}
 	if fileSize == c.GetFileSize() {
 		return nil
 	}
-
 	if fileSize < c.GetFileSize() {
 		return errors.New("invalid resize file size. New file size must be greater than the current file size")
 	}
-	f, err := os.OpenFile(c.path, os.O_RDWR, 0644)
+	bs := c.GetBlockSize()
+	newBlockNum := (fileSize + bs - 1) / bs
+	c.fileLock.Lock()
+	defer c.fileLock.Unlock()
+	oldHeaderSize, oldDataSize := c.getHeaderSize(), c.getDataSize()
+	// 设置块数量、文件大小参数
+	if err := c.resizeHeader(newBlockNum, fileSize); err != nil {
+		return err
+	}
+	if err := c.resizeFileSize(oldHeaderSize, oldDataSize); err != nil {
+		return err
+	}
+	c.dropBlockCache() // 原来不足一块的末尾块已被清除
+	c.verified.Store(false)
+	return c.flushHeader()
+}
+
+// resizeFileSize 按新的头部和数据区大小调整缓存文件，头部长度变化且已有数据时重写整个文件。
+func (c *DingCache) resizeFileSize(oldHeaderSize, oldDataSize int64) error {
+	newHeaderSize := c.getHeaderSize()
+	if oldDataSize > 0 && newHeaderSize != oldHeaderSize {
+		return c.rewriteFile(oldHeaderSize, oldDataSize)
+	}
+	newBinSize := newHeaderSize + c.getDataSize()
+	if newBinSize == 0 {
+		return nil
+	}
+	return c.file.Truncate(newBinSize)
+}
+
+// rewriteFile 将新头部与已有数据写入<path>.resizing，刷盘后替换原文件并切换句柄，调用方需持有fileLock。
+// 原地搬移数据后再写头部时，中途崩溃会留下指向已搬移数据的旧头部，因此与迁移一样经临时文件原子替换。
+func (c *DingCache) rewriteFile(oldHeaderSize, oldDataSize int64) error {
+	tmpPath := c.path + resizingSuffix
+	dst, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			_ = dst.Close()
+			_ = os.Remove(tmpPath)
+		}
+	}()
+	c.headerLock.RLock()
+	err = writeHeader(dst, c.header)
+	newHeaderSize, newDataSize := c.header.GetHeaderSize(), c.header.DataSize()
+	c.headerLock.RUnlock()
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	newBinSize := c.getHeaderSize() + fileSize
-	if _, err = f.Seek(newBinSize-1, 0); err != nil {
+	buf := make([]byte, min(oldDataSize, DEFAULT_MOVE_CHUNK_SIZE))
+	if _, err = io.CopyBuffer(io.NewOffsetWriter(dst, newHeaderSize), io.NewSectionReader(c.file, oldHeaderSize, oldDataSize), buf); err != nil {
+		return err
+	}
+	if err = dst.Truncate(newHeaderSize + newDataSize); err != nil {
 		return err
 	}
-	if _, err = f.Write([]byte{0}); err != nil {
+	if err = dst.Sync(); err != nil {
 		return err
 	}
-	if err = f.Truncate(newBinSize); err != nil {
+	if err = os.Rename(tmpPath, c.path); err != nil {
 		return err
 	}
+	committed = true
+	_ = c.file.Close()
+	c.file = dst
+	c.dirtyBlocks = 0
+	c.lastFlush = time.Now()
 	return nil
 }
 
 func (c *DingCache) resizeHeader(blockNum, fileSize int64) error {
-	c.headerLock.RLock()
-	defer c.headerLock.RUnlock()
-	c.header.BlockNumber = uint64(blockNum)
+	c.headerLock.Lock()
+	defer c.headerLock.Unlock()
+	// 原最后一个块不完整，扩大后缺少的数据需要重新获取
+	if oldFileSize, bs := int64(c.header.FileSize), int64(c.header.BlockSize); oldFileSize%bs != 0 {
+		lastBlock := uint64(oldFileSize / bs)
+		_ = c.header.BlockMask.Clear(lastBlock)
+		c.header.ClearChecksum(lastBlock)
+		c.header.ClearPages(lastBlock)
+	}
+	c.header.SetBlockNumber(uint64(blockNum))
 	c.header.FileSize = uint64(fileSize)
 	return c.header.ValidHeader()
 }
 
-func (c *DingCache) getBlockKey(blockIndex int64) string {
-	simpleKey := fmt.Sprintf("%s/%d", c.path, blockIndex)
-	return util.Md5(simpleKey)
+// GetProvenance 返回缓存文件的来源信息，旧版本文件返回nil。
+func (c *DingCache) GetProvenance() *Provenance {
+	c.headerLock.RLock()
+	defer c.headerLock.RUnlock()
+	if !c.header.HasProvenance() {
+		return nil
+	}
+	p := *c.header.Provenance
+	return &p
+}
+
+// BlobModTime 返回blob的Last-Modified，取缓存文件创建时记录的时间，blob重新下载前不变。
+// 文件不存在或为旧版本时返回零值，此时不发送Last-Modified。
+func BlobModTime(path string) time.Time {
+	header, err := readHeader(path)
+	if err != nil || !header.HasProvenance() || header.Provenance.CreateTime == 0 {
+		return time.Time{}
+	}
+	return time.Unix(header.Provenance.CreateTime, 0)
+}
+
+// SetProvenance 记录文件来源信息，保留原有的创建和完成时间。旧版本文件由迁移任务升级后再记录。
+func (c *DingCache) SetProvenance(provenance *Provenance) error {
+	if !c.isOpen {
+		return errors.New("this file has been closed")
+	}
+	c.fileLock.Lock()
+	defer c.fileLock.Unlock()
+	if !c.header.HasProvenance() {
+		return nil
+	}
+	oldHeaderSize := c.getHeaderSize()
+	c.headerLock.Lock()
+	p := *provenance
+	p.CreateTime, p.CompleteTime = c.header.Provenance.CreateTime, c.header.Provenance.CompleteTime
+	c.header.Provenance = &p
+	c.headerLock.Unlock()
+	if c.getHeaderSize() != oldHeaderSize {
+		if err := c.resizeFileSize(oldHeaderSize, c.getDataSize()); err != nil {
+			return err
+		}
+	}
+	return c.flushHeader()
+}
+
+// OpenCachedRange 当[startPos, endPos)已全部缓存且无需逐块校验时，打开一个定位到startPos的只读文件句柄，
+// 调用方读取endPos-startPos个字节后负责关闭。*os.File可被http服务端以sendfile方式零拷贝发送。
+func (c *DingCache) OpenCachedRange(startPos, endPos int64) (*os.File, bool) {
+	if !c.isOpen || startPos < 0 || endPos <= startPos || endPos > c.GetFileSize() {
+		return nil, false
+	}
+	c.fileLock.RLock()
+	defer c.fileLock.RUnlock()
+	// 压缩存放的文件需要逐块解压；带校验值的文件只有整体校验通过后才跳过逐块校验
+	if c.header.IsCompressed() {
+		return nil, false
+	}
+	if c.header.HasChecksum() && !c.verified.Load() {
+		return nil, false
+	}
+	blockSize := c.GetBlockSize()
+	for blockIndex := startPos / blockSize; blockIndex <= (endPos-1)/blockSize; blockIndex++ {
+		if ok, err := c.HasBlock(blockIndex); err != nil || !ok {
+			return nil, false
+		}
+	}
+	f, err := os.Open(c.path)
+	if err != nil {
+		zap.S().Errorf("open cached range err. file:%s, %v", c.path, err)
+		return nil, false
+	}
+	if _, err = f.Seek(c.getHeaderSize()+startPos, io.SeekStart); err != nil {
+		f.Close()
+		zap.S().Errorf("seek cached range err. file:%s, %v", c.path, err)
+		return nil, false
+	}
+	return f, true
+}
+
+// getBlockRealSize 返回块的实际数据长度，最后一个块可能不足BlockSize。
+func (c *DingCache) getBlockRealSize(blockIndex int64) int64 {
+	return min(c.GetBlockSize(), c.GetFileSize()-blockIndex*c.GetBlockSize())
+}
+
+// verifyBlock 使用头部记录的校验值检查块数据，rawBlock可以包含末尾的填充。
+func (c *DingCache) verifyBlock(blockIndex int64, rawBlock []byte) bool {
+	realSize := c.getBlockRealSize(blockIndex)
+	if int64(len(rawBlock)) < realSize {
+		return false
+	}
+	c.headerLock.RLock()
+	defer c.headerLock.RUnlock()
+	return c.header.VerifyChecksum(uint64(blockIndex), rawBlock[:realSize])
+}
+
+// invalidateBlock 将校验失败的块标记为不存在，后续请求会重新从远端获取。
+func (c *DingCache) invalidateBlock(blockIndex int64) {
+	zap.S().Errorf("block checksum mismatch, mark as missing. file:%s, block:%d", c.path, blockIndex)
+	if config.SysConfig.EnableMetric() {
+		prom.BlockChecksumFailCnt.Inc()
+	}
+	c.fileLock.Lock()
+	defer c.fileLock.Unlock()
+	c.headerLock.Lock()
+	defer c.headerLock.Unlock()
+	if err := c.header.BlockMask.Clear(uint64(blockIndex)); err != nil {
+		zap.S().Errorf("clear block err. file:%s, block:%d, %v", c.path, blockIndex, err)
+		return
+	}
+	c.header.ClearChecksum(uint64(blockIndex))
+	c.header.ClearPages(uint64(blockIndex))
+	if err := c.flushHeader(); err != nil {
+		zap.S().Errorf("flushHeader err. file:%s, %v", c.path, err)
+	}
+	c.dropBlockCache()
+	if c.verified.Swap(false) { // 校验之后数据被损坏，重新下载完成后再校验
+		_ = os.Remove(GetVerifyPath(c.path))
+	}
 }
 
 // get_block_info 函数
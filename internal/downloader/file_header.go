@@ -5,45 +5,396 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"os"
+	"io"
+	"math"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
 )
 
 var magicNumber = [4]byte{'O', 'L', 'A', 'H'}
 
+const (
+	// MIN_OLAH_CACHE_VERSION 可直接读取的最低版本，低于该版本的文件无法识别。
+	MIN_OLAH_CACHE_VERSION = 8
+	// CHECKSUM_OLAH_CACHE_VERSION 从该版本开始，头部在位图之后记录每个块的xxhash校验值。
+	CHECKSUM_OLAH_CACHE_VERSION = 9
+	// PROVENANCE_OLAH_CACHE_VERSION 从该版本开始，头部在校验值之后记录文件来源信息。
+	PROVENANCE_OLAH_CACHE_VERSION = 10
+	// COMPACT_MASK_OLAH_CACHE_VERSION 从该版本开始，位图大小按块数量分配，不再固定为DEFAULT_BLOCK_MASK_MAX。
+	COMPACT_MASK_OLAH_CACHE_VERSION = 11
+	// COMPRESSION_OLAH_CACHE_VERSION 从该版本开始，头部记录块的压缩方式，压缩文件的块按写入顺序追加存放，由块索引记录位置。
+	COMPRESSION_OLAH_CACHE_VERSION = 12
+	// SUBPAGE_OLAH_CACHE_VERSION 从该版本开始，头部在最后记录块内子页的位图，不完整的块可按子页缓存。
+	SUBPAGE_OLAH_CACHE_VERSION = 13
+
+	// DEFAULT_PAGE_SIZE 子页大小，块大小不是其整数倍或文件压缩存放时不使用子页
+	DEFAULT_PAGE_SIZE uint64 = 64 * 1024
+
+	headerFixedSize   = 36
+	checksumSize      = 8
+	compressionSize   = 8
+	blockLocationSize = 16
+	pageSizeSize      = 8
+)
+
+const (
+	CompressionNone uint64 = 0
+	CompressionZstd uint64 = 1
+
+	// BlockStoredRaw 压缩没有收益的块按原样存放
+	BlockStoredRaw uint32 = 1
+)
+
 // DingCacheHeader 结构体表示 Olah 缓存文件的头部
 type DingCacheHeader struct {
-	MagicNumber   [4]byte
-	Version       uint64
-	BlockSize     uint64
-	FileSize      uint64
-	BlockMaskSize uint64
-	BlockNumber   uint64
-	BlockMask     *Bitset
+	MagicNumber    [4]byte
+	Version        uint64
+	BlockSize      uint64
+	FileSize       uint64
+	BlockMaskSize  uint64
+	BlockNumber    uint64
+	BlockMask      *Bitset
+	BlockChecksums []uint64        // 每个块的校验值，与BlockNumber等长，v9及以上版本有效
+	Provenance     *Provenance     // 文件来源信息，v10及以上版本有效
+	Compression    uint64          // 块的压缩方式，v12及以上版本有效
+	BlockIndex     []BlockLocation // 压缩文件每个块在数据区中的位置，与BlockNumber等长
+	PageSize       uint64          // 子页大小，0表示不使用子页，v13及以上版本有效
+	PageMask       *Bitset         // 未完整缓存的块中已缓存的子页，第i块第j页对应第i*PagesPerBlock()+j位
+}
+
+// BlockLocation 压缩块在数据区中的位置
+type BlockLocation struct {
+	Offset uint64 // 相对数据区起始位置的偏移
+	Length uint32 // 存放的字节数
+	Flags  uint32
+}
+
+// Provenance 缓存文件的来源信息，使缓存文件脱离目录结构也能说明自身的内容。
+type Provenance struct {
+	Etag         string `json:"etag"`
+	RepoType     string `json:"repoType"`
+	Org          string `json:"org"`
+	Repo         string `json:"repo"`
+	FileName     string `json:"fileName"`
+	Domain       string `json:"domain"`
+	CreateTime   int64  `json:"createTime"`
+	CompleteTime int64  `json:"completeTime"`
+}
+
+func (p *Provenance) strings() []*string {
+	return []*string{&p.Etag, &p.RepoType, &p.Org, &p.Repo, &p.FileName, &p.Domain}
+}
+
+// size 来源信息序列化后的长度，两个时间戳加上每个字符串的2字节长度前缀。
+func (p *Provenance) size() int64 {
+	size := int64(16)
+	for _, str := range p.strings() {
+		size += 2 + int64(len(*str))
+	}
+	return size
+}
+
+func (p *Provenance) read(r io.Reader) error {
+	if err := binary.Read(r, binary.LittleEndian, &p.CreateTime); err != nil {
+		return err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &p.CompleteTime); err != nil {
+		return err
+	}
+	for _, str := range p.strings() {
+		var l uint16
+		if err := binary.Read(r, binary.LittleEndian, &l); err != nil {
+			return err
+		}
+		b := make([]byte, l)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return err
+		}
+		*str = string(b)
+	}
+	return nil
+}
+
+func (p *Provenance) write(w io.Writer) error {
+	if err := binary.Write(w, binary.LittleEndian, p.CreateTime); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, p.CompleteTime); err != nil {
+		return err
+	}
+	for _, str := range p.strings() {
+		if len(*str) > math.MaxUint16 {
+			return fmt.Errorf("provenance field is too long: %d", len(*str))
+		}
+		if err := binary.Write(w, binary.LittleEndian, uint16(len(*str))); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, *str); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func NewDingCacheHeader(version, blockSize, fileSize uint64) *DingCacheHeader {
 	blockNumber := (fileSize + blockSize - 1) / blockSize
-	blockMask := NewBitset(DEFAULT_BLOCK_MASK_MAX)
-	return &DingCacheHeader{
+	blockMaskSize := DEFAULT_BLOCK_MASK_MAX
+	if version >= COMPACT_MASK_OLAH_CACHE_VERSION {
+		blockMaskSize = blockNumber
+	}
+	h := &DingCacheHeader{
 		MagicNumber:   magicNumber,
 		Version:       version,
 		BlockSize:     blockSize,
 		FileSize:      fileSize,
-		BlockMaskSize: DEFAULT_BLOCK_MASK_MAX,
+		BlockMaskSize: blockMaskSize,
 		BlockNumber:   blockNumber,
-		BlockMask:     blockMask,
+		BlockMask:     NewBitset(blockMaskSize),
+	}
+	if h.HasChecksum() {
+		h.BlockChecksums = make([]uint64, blockNumber)
+	}
+	if h.HasProvenance() {
+		h.Provenance = &Provenance{CreateTime: time.Now().Unix()}
+	}
+	if h.HasSubPages() {
+		h.PageSize = defaultPageSize(blockSize)
+		h.PageMask = NewBitset(blockNumber * h.PagesPerBlock())
+	}
+	return h
+}
+
+// defaultPageSize 块大小不是DEFAULT_PAGE_SIZE的整数倍时不使用子页
+func defaultPageSize(blockSize uint64) uint64 {
+	if blockSize <= DEFAULT_PAGE_SIZE || blockSize%DEFAULT_PAGE_SIZE != 0 {
+		return 0
 	}
+	return DEFAULT_PAGE_SIZE
+}
+
+// HasChecksum 当前版本的头部是否记录块校验值
+func (h *DingCacheHeader) HasChecksum() bool {
+	return h.Version >= CHECKSUM_OLAH_CACHE_VERSION
+}
+
+// HasProvenance 当前版本的头部是否记录来源信息
+func (h *DingCacheHeader) HasProvenance() bool {
+	return h.Version >= PROVENANCE_OLAH_CACHE_VERSION
 }
 
 // GetHeaderSize 返回头部的大小
 func (h *DingCacheHeader) GetHeaderSize() int64 {
-	return int64(36 + len(h.BlockMask.bits))
+	size := int64(headerFixedSize + len(h.BlockMask.bits))
+	if h.HasChecksum() {
+		size += int64(h.BlockNumber) * checksumSize
+	}
+	if h.HasProvenance() {
+		size += h.Provenance.size()
+	}
+	if h.HasCompression() {
+		size += compressionSize
+	}
+	if h.IsCompressed() {
+		size += int64(h.BlockNumber) * blockLocationSize
+	}
+	if h.HasSubPages() {
+		size += pageSizeSize + int64(len(h.PageMask.bits))
+	}
+	return size
+}
+
+// HasCompactMask 当前版本的位图是否按块数量分配
+func (h *DingCacheHeader) HasCompactMask() bool {
+	return h.Version >= COMPACT_MASK_OLAH_CACHE_VERSION
+}
+
+// HasCompression 当前版本的头部是否记录压缩方式
+func (h *DingCacheHeader) HasCompression() bool {
+	return h.Version >= COMPRESSION_OLAH_CACHE_VERSION
+}
+
+// HasSubPages 当前版本的头部是否记录子页位图
+func (h *DingCacheHeader) HasSubPages() bool {
+	return h.Version >= SUBPAGE_OLAH_CACHE_VERSION
+}
+
+// PagesPerBlock 每个块的子页数，不使用子页时返回0
+func (h *DingCacheHeader) PagesPerBlock() uint64 {
+	if !h.HasSubPages() || h.PageSize == 0 {
+		return 0
+	}
+	return h.BlockSize / h.PageSize
+}
+
+// IsCompressed 块是否压缩存放
+func (h *DingCacheHeader) IsCompressed() bool {
+	return h.HasCompression() && h.Compression != CompressionNone
+}
+
+// SetCompression 设置压缩方式并分配块索引，只应在写入数据前调用。
+func (h *DingCacheHeader) SetCompression(compression uint64) {
+	if !h.HasCompression() {
+		return
+	}
+	h.Compression = compression
+	h.BlockIndex = nil
+	if h.HasSubPages() { // 压缩的块只能整块读写，不使用子页
+		h.PageSize = 0
+		if compression == CompressionNone {
+			h.PageSize = defaultPageSize(h.BlockSize)
+		}
+		h.PageMask = NewBitset(0)
+	}
+	h.SetBlockNumber(h.BlockNumber)
+}
+
+// DataSize 数据区的长度，压缩文件为已追加的块的末尾位置。
+func (h *DingCacheHeader) DataSize() int64 {
+	if !h.IsCompressed() {
+		return int64(h.FileSize)
+	}
+	var size uint64
+	for _, loc := range h.BlockIndex {
+		size = max(size, loc.Offset+uint64(loc.Length))
+	}
+	return int64(size)
+}
+
+// SetBlockNumber 修改块数量，同步调整位图和校验值表的长度。
+func (h *DingCacheHeader) SetBlockNumber(blockNumber uint64) {
+	h.BlockNumber = blockNumber
+	if h.HasCompactMask() && h.BlockMaskSize != blockNumber {
+		h.BlockMask = h.BlockMask.Resize(blockNumber)
+		h.BlockMaskSize = blockNumber
+	}
+	if h.HasSubPages() {
+		h.PageMask = h.PageMask.Resize(blockNumber * h.PagesPerBlock())
+	}
+	if h.IsCompressed() {
+		if uint64(len(h.BlockIndex)) < blockNumber {
+			h.BlockIndex = append(h.BlockIndex, make([]BlockLocation, blockNumber-uint64(len(h.BlockIndex)))...)
+		} else {
+			h.BlockIndex = h.BlockIndex[:blockNumber]
+		}
+	}
+	if !h.HasChecksum() {
+		return
+	}
+	if uint64(len(h.BlockChecksums)) < blockNumber {
+		h.BlockChecksums = append(h.BlockChecksums, make([]uint64, blockNumber-uint64(len(h.BlockChecksums)))...)
+	} else {
+		h.BlockChecksums = h.BlockChecksums[:blockNumber]
+	}
+}
+
+// SetChecksum 记录块数据的校验值，旧版本头部直接忽略。
+func (h *DingCacheHeader) SetChecksum(blockIndex uint64, blockBytes []byte) {
+	if !h.HasChecksum() || blockIndex >= uint64(len(h.BlockChecksums)) {
+		return
+	}
+	h.BlockChecksums[blockIndex] = BlockChecksum(blockBytes)
+}
+
+// ClearChecksum 清除块的校验值
+func (h *DingCacheHeader) ClearChecksum(blockIndex uint64) {
+	if !h.HasChecksum() || blockIndex >= uint64(len(h.BlockChecksums)) {
+		return
+	}
+	h.BlockChecksums[blockIndex] = 0
+}
+
+// VerifyChecksum 校验块数据，旧版本头部没有校验值，视为通过。
+func (h *DingCacheHeader) VerifyChecksum(blockIndex uint64, blockBytes []byte) bool {
+	if !h.HasChecksum() {
+		return true
+	}
+	if blockIndex >= uint64(len(h.BlockChecksums)) {
+		return false
+	}
+	return h.BlockChecksums[blockIndex] == BlockChecksum(blockBytes)
+}
+
+// blockRealSize 返回块的实际数据长度，最后一个块可能不足BlockSize。
+func (h *DingCacheHeader) blockRealSize(blockIndex uint64) uint64 {
+	return min(h.BlockSize, h.FileSize-blockIndex*h.BlockSize)
+}
+
+// coveredPages 块内偏移[startPos,endPos)完整覆盖的子页[first,last)，到达块末尾时最后一个不足PageSize的子页也视为完整。
+func (h *DingCacheHeader) coveredPages(blockIndex, startPos, endPos uint64) (uint64, uint64) {
+	first, last := (startPos+h.PageSize-1)/h.PageSize, endPos/h.PageSize
+	if realSize := h.blockRealSize(blockIndex); endPos >= realSize {
+		last = (realSize + h.PageSize - 1) / h.PageSize
+	}
+	return first, last
+}
+
+// touchedPages 块内偏移[startPos,endPos)涉及的子页[first,last)
+func (h *DingCacheHeader) touchedPages(startPos, endPos uint64) (uint64, uint64) {
+	return startPos / h.PageSize, (endPos + h.PageSize - 1) / h.PageSize
+}
+
+// SetPages 标记块的第[first,last)个子页已缓存
+func (h *DingCacheHeader) SetPages(blockIndex, first, last uint64) {
+	base := blockIndex * h.PagesPerBlock()
+	for i := first; i < last; i++ {
+		_ = h.PageMask.Set(base + i)
+	}
+}
+
+// TestPages 块的第[first,last)个子页是否都已缓存
+func (h *DingCacheHeader) TestPages(blockIndex, first, last uint64) bool {
+	if h.PagesPerBlock() == 0 || first >= last {
+		return false
+	}
+	base := blockIndex * h.PagesPerBlock()
+	for i := first; i < last; i++ {
+		if ok, err := h.PageMask.Test(base + i); err != nil || !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// ClearPages 清除块的子页记录，块完整缓存或失效时调用
+func (h *DingCacheHeader) ClearPages(blockIndex uint64) {
+	pages := h.PagesPerBlock()
+	if pages == 0 {
+		return
+	}
+	for i := uint64(0); i < pages; i++ {
+		_ = h.PageMask.Clear(blockIndex*pages + i)
+	}
+}
+
+// IsComplete 所有块是否都已缓存
+func (h *DingCacheHeader) IsComplete() bool {
+	if h.BlockNumber == 0 {
+		return false
+	}
+	for i := uint64(0); i < h.BlockNumber; i++ {
+		if ok, err := h.BlockMask.Test(i); err != nil || !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// CachedBlocks 已缓存的块数
+func (h *DingCacheHeader) CachedBlocks() int64 {
+	var cached int64
+	for i := uint64(0); i < h.BlockNumber; i++ {
+		if ok, err := h.BlockMask.Test(i); err == nil && ok {
+			cached++
+		}
+	}
+	return cached
 }
 
 // Read 从文件流中读取头部信息
-func (h *DingCacheHeader) Read(f *os.File) error {
+func (h *DingCacheHeader) Read(f io.Reader) error {
 	magic := make([]byte, 4)
-	if _, err := f.Read(magic); err != nil {
+	if _, err := io.ReadFull(f, magic); err != nil {
 		return errors.New("read magic 4 bytes err")
 	}
 	if !bytes.Equal(magic, []byte{'O', 'L', 'A', 'H'}) {
@@ -66,10 +417,48 @@ func (h *DingCacheHeader) Read(f *os.File) error {
 		return errors.New("BlockSize cannot be 0")
 	}
 	h.BlockNumber = (h.FileSize + h.BlockSize - 1) / h.BlockSize
+	if h.HasCompactMask() && h.BlockMaskSize != h.BlockNumber {
+		return fmt.Errorf("invalid block mask size %d, expected %d", h.BlockMaskSize, h.BlockNumber)
+	}
 	h.BlockMask = NewBitset(h.BlockMaskSize)
-	if _, err := f.Read(h.BlockMask.bits); err != nil {
+	if _, err := io.ReadFull(f, h.BlockMask.bits); err != nil {
 		return err
 	}
+	if h.HasChecksum() {
+		h.BlockChecksums = make([]uint64, h.BlockNumber)
+		if err := binary.Read(f, binary.LittleEndian, h.BlockChecksums); err != nil {
+			return err
+		}
+	}
+	if h.HasProvenance() {
+		h.Provenance = &Provenance{}
+		if err := h.Provenance.read(f); err != nil {
+			return err
+		}
+	}
+	if h.HasCompression() {
+		if err := binary.Read(f, binary.LittleEndian, &h.Compression); err != nil {
+			return err
+		}
+	}
+	if h.IsCompressed() {
+		h.BlockIndex = make([]BlockLocation, h.BlockNumber)
+		if err := binary.Read(f, binary.LittleEndian, h.BlockIndex); err != nil {
+			return err
+		}
+	}
+	if h.HasSubPages() {
+		if err := binary.Read(f, binary.LittleEndian, &h.PageSize); err != nil {
+			return err
+		}
+		if h.PageSize != 0 && h.BlockSize%h.PageSize != 0 {
+			return fmt.Errorf("invalid page size %d, block size %d", h.PageSize, h.BlockSize)
+		}
+		h.PageMask = NewBitset(h.BlockNumber * h.PagesPerBlock())
+		if _, err := io.ReadFull(f, h.PageMask.bits); err != nil {
+			return err
+		}
+	}
 	return h.ValidHeader()
 }
 
@@ -77,17 +466,20 @@ func (h *DingCacheHeader) ValidHeader() error {
 	if h.FileSize > h.BlockMaskSize*h.BlockSize {
 		return fmt.Errorf("the size of file %d is out of the max capability of container (%d * %d)", h.FileSize, h.BlockMaskSize, h.BlockSize)
 	}
-	if h.Version < CURRENT_OLAH_CACHE_VERSION {
+	if h.Version < MIN_OLAH_CACHE_VERSION {
 		return fmt.Errorf("the Olah Cache file is created by older version Olah. Please remove cache files and retry")
 	}
 	if h.Version > CURRENT_OLAH_CACHE_VERSION {
 		return fmt.Errorf("the Olah Cache file is created by newer version Olah. Please remove cache files and retry")
 	}
+	if h.Compression != CompressionNone && h.Compression != CompressionZstd {
+		return fmt.Errorf("unknown compression %d", h.Compression)
+	}
 	return nil
 }
 
 // Write 将头部信息写入文件流
-func (h *DingCacheHeader) Write(f *os.File) error {
+func (h *DingCacheHeader) Write(f io.Writer) error {
 	if _, err := f.Write(h.MagicNumber[:]); err != nil {
 		return err
 	}
@@ -106,5 +498,38 @@ func (h *DingCacheHeader) Write(f *os.File) error {
 	if _, err := f.Write(h.BlockMask.bits); err != nil {
 		return err
 	}
+	if h.HasChecksum() {
+		if err := binary.Write(f, binary.LittleEndian, h.BlockChecksums); err != nil {
+			return err
+		}
+	}
+	if h.HasProvenance() {
+		if err := h.Provenance.write(f); err != nil {
+			return err
+		}
+	}
+	if h.HasCompression() {
+		if err := binary.Write(f, binary.LittleEndian, h.Compression); err != nil {
+			return err
+		}
+	}
+	if h.IsCompressed() {
+		if err := binary.Write(f, binary.LittleEndian, h.BlockIndex); err != nil {
+			return err
+		}
+	}
+	if h.HasSubPages() {
+		if err := binary.Write(f, binary.LittleEndian, h.PageSize); err != nil {
+			return err
+		}
+		if _, err := f.Write(h.PageMask.bits); err != nil {
+			return err
+		}
+	}
 	return nil
 }
+
+// BlockChecksum 计算块数据的校验值，块数据不包含末尾的填充。
+func BlockChecksum(blockBytes []byte) uint64 {
+	return xxhash.Sum64(blockBytes)
+}
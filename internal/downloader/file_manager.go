@@ -1,6 +1,7 @@
 package downloader
 
 import (
+	"errors"
 	"sync"
 	"sync/atomic"
 
@@ -15,11 +16,16 @@ var (
 	once     sync.Once
 )
 
+// ErrBlobInUse 文件正被下载、读取或迁移，不能删除或移动，等待下次清理
+var ErrBlobInUse = errors.New("blob is in use")
+
 func GetInstance() *DingCacheManager {
 	once.Do(func() {
 		instance = &DingCacheManager{
 			dingCacheMap: common.NewSafeMap[string, *DingCache](),
 			dingCacheRef: common.NewSafeMap[string, *atomic.Int64](),
+			migrating:    common.NewSafeMap[string, *atomic.Bool](),
+			inflight:     make(map[string]*blockFetch),
 		}
 	})
 	return instance
@@ -28,10 +34,13 @@ func GetInstance() *DingCacheManager {
 type DingCacheManager struct {
 	dingCacheMap *common.SafeMap[string, *DingCache]
 	dingCacheRef *common.SafeMap[string, *atomic.Int64]
+	migrating    *common.SafeMap[string, *atomic.Bool] // 正在迁移的文件，值为是否被下载请求中断
 	mu           sync.RWMutex
+	inflight     map[string]*blockFetch // 正在回源下载的块，键为文件路径与块编号
+	inflightMu   sync.Mutex
 }
 
-func (f *DingCacheManager) GetDingFile(savePath string, fileSize int64) (*DingCache, error) {
+func (f *DingCacheManager) GetDingFile(savePath string, fileSize int64, provenance *Provenance) (*DingCache, error) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 	var (
@@ -39,6 +48,9 @@ func (f *DingCacheManager) GetDingFile(savePath string, fileSize int64) (*DingCa
 		ok       bool
 		err      error
 	)
+	if aborted, ok := f.migrating.Get(savePath); ok { // 下载请求优先，中断迁移，直接使用旧版本文件
+		aborted.Store(true)
+	}
 	if dingFile, ok = f.dingCacheMap.Get(savePath); ok {
 		if refCount, ok := f.dingCacheRef.Get(savePath); ok {
 			refCount.Add(1)
@@ -52,12 +64,25 @@ func (f *DingCacheManager) GetDingFile(savePath string, fileSize int64) (*DingCa
 			return nil, err
 		}
 		if dingFile.GetFileSize() == 0 && fileSize > 0 { // 表示首次获取当前文件句柄，需要Resize。
+			if provenance != nil {
+				if err = dingFile.SetProvenance(provenance); err != nil {
+					zap.S().Errorf("SetProvenance err.%v", err)
+					return nil, err
+				}
+				if config.SysConfig.ShouldCompress(provenance.RepoType, provenance.FileName) {
+					if err = dingFile.SetCompression(CompressionZstd); err != nil {
+						zap.S().Errorf("SetCompression err.%v", err)
+						return nil, err
+					}
+				}
+			}
 			if err = dingFile.Resize(fileSize); err != nil {
 				zap.S().Errorf("Resize err.%v", err)
 				return nil, err
 			}
 		}
 
+		dingFile.scheduleVerify()
 		f.dingCacheMap.Set(savePath, dingFile)
 		var counter atomic.Int64
 		counter.Store(1)
@@ -85,3 +110,63 @@ func (f *DingCacheManager) ReleasedDingFile(savePath string) {
 		f.dingCacheRef.Set(savePath, refCount)
 	}
 }
+
+// isOpen 文件是否正被下载或读取
+func (f *DingCacheManager) isOpen(savePath string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.dingCacheMap.Exist(savePath)
+}
+
+// inUse 文件是否正被打开或迁移，调用方需持有mu
+func (f *DingCacheManager) inUse(savePath string) bool {
+	return f.dingCacheMap.Exist(savePath) || f.migrating.Exist(savePath)
+}
+
+// whenClosed 持有锁执行删除或移动文件的fn，期间没有请求能打开这些文件；paths中有文件正被使用时返回ErrBlobInUse。
+// fn中判断其他文件需使用inUse，不能调用isOpen。
+func (f *DingCacheManager) whenClosed(fn func() error, paths ...string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, path := range paths {
+		if f.inUse(path) {
+			return ErrBlobInUse
+		}
+	}
+	return fn()
+}
+
+// withOpenFile 持有锁执行fn，期间文件不会被打开或关闭；dingFile为当前打开该文件的实例，未打开时为nil。
+func (f *DingCacheManager) withOpenFile(savePath string, fn func(dingFile *DingCache)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	dingFile, _ := f.dingCacheMap.Get(savePath)
+	fn(dingFile)
+}
+
+// beginMigrate 标记文件开始迁移，文件正在被使用时返回false。
+func (f *DingCacheManager) beginMigrate(savePath string) (*atomic.Bool, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.dingCacheMap.Exist(savePath) {
+		return nil, false
+	}
+	var aborted atomic.Bool
+	f.migrating.Set(savePath, &aborted)
+	return &aborted, true
+}
+
+// commitMigrate 在没有下载请求打开该文件时，用迁移后的文件替换原文件。
+func (f *DingCacheManager) commitMigrate(savePath string, commit func() error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	aborted, ok := f.migrating.Get(savePath)
+	if !ok || aborted.Load() || f.dingCacheMap.Exist(savePath) {
+		return errMigrateAborted
+	}
+	return commit()
+}
+
+func (f *DingCacheManager) endMigrate(savePath string) {
+	f.migrating.Delete(savePath)
+}
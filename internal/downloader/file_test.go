@@ -15,8 +15,20 @@
 package downloader
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
 	"testing"
+	"time"
+
+	"dingospeed/pkg/config"
+	"dingospeed/pkg/util"
 
 	"go.uber.org/zap"
 )
@@ -24,6 +36,7 @@ import (
 func TestFileWrite(t *testing.T) {
 	var dingFile *DingCache
 	var err error
+	config.SysConfig = &config.Config{}
 	savePath := "cachefile"
 	fileSize := int64(8388608)
 	blockSize := int64(8388608)
@@ -52,3 +65,384 @@ func TestFileWrite3(t *testing.T) {
 	s := make([]byte, (size+7)/8)
 	fmt.Println(len(s))
 }
+
+func TestBlockChecksum(t *testing.T) {
+	config.SysConfig = &config.Config{}
+	savePath := filepath.Join(t.TempDir(), "cachefile")
+	blockSize := int64(1024)
+	dingFile := newTestFile(t, savePath, blockSize, blockSize+100)
+	writeTestBlocks(t, dingFile, testContent(blockSize+100))
+	if _, err := dingFile.ReadBlock(1); err != nil {
+		t.Fatalf("ReadBlock err.%v", err)
+	}
+	waitVerify(dingFile)
+	f, err := os.OpenFile(savePath, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteAt([]byte{0xff}, dingFile.getHeaderSize()+10); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	reading := make(chan struct{})
+	go func() { // 标记块缺失时与并发的读取者之间不应有数据竞争
+		defer close(reading)
+		for i := 0; i < 100; i++ {
+			dingFile.HasBlockRange(0, 0, 10)
+		}
+	}()
+	if _, err = dingFile.ReadBlock(0); !errors.Is(err, ErrBlockChecksum) {
+		t.Fatalf("expect ErrBlockChecksum, got %v", err)
+	}
+	<-reading
+	if hasBlock, _ := dingFile.HasBlock(0); hasBlock {
+		t.Fatalf("corrupted block should be marked as missing")
+	}
+	reopen := newTestFile(t, savePath, blockSize, blockSize+100)
+	if hasBlock, _ := reopen.HasBlock(1); !hasBlock {
+		t.Fatalf("block 1 should be kept")
+	}
+}
+
+func TestCompactBlockMask(t *testing.T) {
+	config.SysConfig = &config.Config{}
+	savePath := filepath.Join(t.TempDir(), "cachefile")
+	blockSize := int64(1024)
+	dingFile := newTestFile(t, savePath, blockSize, blockSize+100)
+	content := testContent(blockSize + 100)
+	writeTestBlocks(t, dingFile, content)
+	if headerSize := dingFile.getHeaderSize(); headerSize > 1024 {
+		t.Fatalf("header of small file is too large: %d", headerSize)
+	}
+	// 文件大小后续才确定，位图随之扩大，完整的块保持不变，原最后一个不完整的块需要重新获取
+	if err := dingFile.Resize(blockSize*20 + 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := dingFile.WriteBlock(20, content[:blockSize]); err != nil {
+		t.Fatal(err)
+	}
+	if err := dingFile.Close(); err != nil { // 关闭时刷新尚未落盘的头部
+		t.Fatal(err)
+	}
+	reopen := newTestFile(t, savePath, blockSize, blockSize*20+1)
+	if reopen.header.BlockMaskSize != 21 {
+		t.Fatalf("expect block mask size 21, got %d", reopen.header.BlockMaskSize)
+	}
+	for i, expected := range map[int64]bool{0: true, 1: false, 20: true} {
+		if hasBlock, _ := reopen.HasBlock(i); hasBlock != expected {
+			t.Fatalf("block %d, expect %v, got %v", i, expected, hasBlock)
+		}
+	}
+	got, err := reopen.ReadBlock(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content[:blockSize]) {
+		t.Fatalf("block 0 mismatch after resize")
+	}
+}
+
+func TestResizeRewrite(t *testing.T) {
+	config.SysConfig = &config.Config{}
+	savePath := filepath.Join(t.TempDir(), "cachefile")
+	blockSize := int64(1024)
+	dingFile := newTestFile(t, savePath, blockSize, blockSize*2)
+	content := testContent(blockSize * 2)
+	writeTestBlocks(t, dingFile, content)
+	if err := dingFile.Close(); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.ReadFile(savePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := os.Open(savePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+	// 上次重写中断留下的临时文件
+	if err = os.WriteFile(savePath+resizingSuffix, []byte("stale"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dingFile = newTestFile(t, savePath, blockSize, blockSize*2)
+	oldHeaderSize := dingFile.getHeaderSize()
+	if err = dingFile.Resize(blockSize * 100); err != nil {
+		t.Fatal(err)
+	}
+	if dingFile.getHeaderSize() == oldHeaderSize {
+		t.Fatal("header should grow with the block count")
+	}
+	// 头部变长时写入新文件后替换，原文件的内容在替换前不被修改
+	after, err := io.ReadAll(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Fatal("original file should not be modified in place")
+	}
+	if util.FileExists(savePath + resizingSuffix) {
+		t.Fatal("temp file should be renamed")
+	}
+	if err = dingFile.WriteBlock(99, content[:blockSize]); err != nil {
+		t.Fatal(err)
+	}
+	if err = dingFile.Close(); err != nil {
+		t.Fatal(err)
+	}
+	reopen := newTestFile(t, savePath, blockSize, blockSize*100)
+	for i, want := range map[int64][]byte{0: content[:blockSize], 1: content[blockSize:], 99: content[:blockSize]} {
+		got, err := reopen.ReadBlock(i)
+		if err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("block %d mismatch after resize, err.%v", i, err)
+		}
+	}
+}
+
+func TestOpenCachedRange(t *testing.T) {
+	repos := setupRepos(t)
+	blockSize := int64(1024)
+	content := testContent(blockSize*2 + 10)
+	sum := sha256.Sum256(content)
+	blobPath := filepath.Join(repos, "files", "models", "org", "repo", "blobs", hex.EncodeToString(sum[:]))
+	dingFile := newTestFile(t, blobPath, blockSize, int64(len(content)))
+	writeTestBlocks(t, dingFile, content[:blockSize*2])
+	if _, ok := dingFile.OpenCachedRange(0, int64(len(content))); ok {
+		t.Fatalf("range with missing block should not be served from file")
+	}
+	block := make([]byte, blockSize)
+	copy(block, content[2*blockSize:])
+	if err := dingFile.WriteBlock(2, block); err != nil {
+		t.Fatal(err)
+	}
+	waitVerify(dingFile)
+	f, ok := dingFile.OpenCachedRange(100, blockSize*2+5)
+	if !ok {
+		t.Fatalf("verified range should be served from file")
+	}
+	defer f.Close()
+	got := make([]byte, blockSize*2+5-100)
+	if _, err := io.ReadFull(f, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content[100:blockSize*2+5]) {
+		t.Fatalf("cached range mismatch")
+	}
+	// 校验之后块数据损坏，不再直接发送文件内容
+	dingFile.invalidateBlock(1)
+	if _, ok := dingFile.OpenCachedRange(0, blockSize); ok || util.FileExists(GetVerifyPath(blobPath)) {
+		t.Fatalf("verified state should be cleared after a checksum failure")
+	}
+	if err := dingFile.WriteBlock(1, content[blockSize:2*blockSize]); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && !dingFile.verified.Load(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := dingFile.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// 重新打开时从校验结果读取；没有校验结果的完整文件在打开时补做校验
+	manager := GetInstance()
+	reopen, err := manager.GetDingFile(blobPath, int64(len(content)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reopen.verified.Load() {
+		t.Fatalf("verified state should be loaded on open")
+	}
+	manager.ReleasedDingFile(blobPath)
+	if err = os.Remove(GetVerifyPath(blobPath)); err != nil {
+		t.Fatal(err)
+	}
+	reopen, err = manager.GetDingFile(blobPath, int64(len(content)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.ReleasedDingFile(blobPath)
+	for i := 0; i < 100 && !reopen.verified.Load(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !reopen.verified.Load() || !IsBlobVerified(blobPath, int64(len(content))) {
+		t.Fatalf("complete blob should be verified on open")
+	}
+}
+
+func TestBlobModTime(t *testing.T) {
+	config.SysConfig = &config.Config{}
+	savePath := filepath.Join(t.TempDir(), "cachefile")
+	if !BlobModTime(savePath).IsZero() {
+		t.Fatal("missing blob should have no Last-Modified")
+	}
+	blockSize := int64(1024)
+	dingFile := newTestFile(t, savePath, blockSize, blockSize*2)
+	created := BlobModTime(savePath)
+	if created.IsZero() || created.Unix() != dingFile.GetProvenance().CreateTime {
+		t.Fatalf("Last-Modified should be the create time, got %v", created)
+	}
+	// 写入数据与文件修改时间变化都不影响Last-Modified
+	writeTestBlocks(t, dingFile, testContent(blockSize*2))
+	waitVerify(dingFile)
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(savePath, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if got := BlobModTime(savePath); !got.Equal(created) {
+		t.Fatalf("Last-Modified changed from %v to %v", created, got)
+	}
+}
+
+func TestSubPages(t *testing.T) {
+	config.SysConfig = &config.Config{}
+	savePath := filepath.Join(t.TempDir(), "cachefile")
+	pageSize := int64(DEFAULT_PAGE_SIZE)
+	blockSize := pageSize * 4
+	content := testContent(blockSize*2 + pageSize + 100)
+	fileSize := int64(len(content))
+	dingFile := newTestFile(t, savePath, blockSize, fileSize)
+	// 未对齐的区间只缓存被完整覆盖的子页
+	if err := dingFile.WritePages(10, content[10:pageSize*2+10]); err != nil {
+		t.Fatal(err)
+	}
+	if !dingFile.HasBlockRange(0, pageSize+5, pageSize*2) || dingFile.HasBlockRange(0, 10, 100) || dingFile.HasBlockRange(0, pageSize, pageSize*2+1) {
+		t.Fatalf("only page 1 of block 0 should be cached")
+	}
+	got, err := dingFile.ReadPages(pageSize+5, pageSize*2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content[pageSize+5:pageSize*2]) {
+		t.Fatalf("pages mismatch")
+	}
+	// 最后一个块末尾不足一页的部分随区间到达文件末尾一起缓存
+	tailStart := blockSize*2 + 100
+	if err = dingFile.WritePages(tailStart, content[tailStart:]); err != nil {
+		t.Fatal(err)
+	}
+	states := GetInstance().NewBlockClaims(savePath).Classify(dingFile, blockSize*2+pageSize, fileSize)
+	if !slices.Equal(states, []BlockState{BlockCached}) {
+		t.Fatalf("tail pages should be cached, states %v", states)
+	}
+	if err = dingFile.Close(); err != nil {
+		t.Fatal(err)
+	}
+	reopen := newTestFile(t, savePath, blockSize, fileSize)
+	if !reopen.HasBlockRange(0, pageSize, pageSize*2) {
+		t.Fatalf("pages should be persisted")
+	}
+	// 子页全部缓存后块转为完整的块
+	if err = reopen.WritePages(0, content[:pageSize]); err != nil {
+		t.Fatal(err)
+	}
+	if err = reopen.WritePages(pageSize*2, content[pageSize*2:blockSize]); err != nil {
+		t.Fatal(err)
+	}
+	if hasBlock, _ := reopen.HasBlock(0); !hasBlock {
+		t.Fatalf("block 0 should be complete")
+	}
+	block, err := reopen.ReadBlock(0)
+	if err != nil {
+		t.Fatalf("ReadBlock err.%v", err)
+	}
+	if !bytes.Equal(block, content[:blockSize]) {
+		t.Fatalf("block 0 mismatch")
+	}
+	if reopen.header.TestPages(0, 1, 2) {
+		t.Fatalf("pages of complete block should be cleared")
+	}
+}
+
+// setupRepos 使用临时目录作为仓库根目录
+func setupRepos(t testing.TB) string {
+	repos := t.TempDir()
+	config.SysConfig = &config.Config{}
+	config.SysConfig.Server.Repos = repos
+	return repos
+}
+
+// testContent 生成n字节的测试内容
+func testContent(n int64) []byte {
+	content := make([]byte, n)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	return content
+}
+
+// newTestFile 打开或创建大小为fileSize的缓存文件，测试结束时等待后台校验并关闭
+func newTestFile(t testing.TB, path string, blockSize, fileSize int64) *DingCache {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	dingFile, err := NewDingCache(path, blockSize)
+	if err != nil {
+		t.Fatalf("NewDingCache err.%v", err)
+	}
+	t.Cleanup(func() {
+		waitVerify(dingFile)
+		_ = dingFile.Close()
+	})
+	if err = dingFile.Resize(fileSize); err != nil {
+		t.Fatalf("Resize err.%v", err)
+	}
+	return dingFile
+}
+
+// writeTestBlocks 把content从第0块开始按块写入，最后一个块不足时补零
+func writeTestBlocks(t testing.TB, dingFile *DingCache, content []byte) {
+	t.Helper()
+	blockSize := dingFile.GetBlockSize()
+	for i := int64(0); i*blockSize < int64(len(content)); i++ {
+		block := make([]byte, blockSize)
+		copy(block, content[i*blockSize:])
+		if err := dingFile.WriteBlock(i, block); err != nil {
+			t.Fatalf("WriteBlock %d err.%v", i, err)
+		}
+	}
+}
+
+// waitVerify 等待后台校验结束，避免校验协程读取到下一个测试替换的配置
+func waitVerify(dingFile *DingCache) {
+	for i := 0; i < 100 && dingFile.verifying.Load(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// setupBenchmark 准备32MB的文件内容，块大小8MB，按64KB读取上游响应
+func setupBenchmark(b *testing.B) []byte {
+	config.SysConfig = &config.Config{}
+	config.SysConfig.Retry.Attempts = 1
+	config.SysConfig.Download.BlockSize = 8 * 1024 * 1024
+	config.SysConfig.Download.RespChunkSize = 64 * 1024
+	content := make([]byte, 4*config.SysConfig.Download.BlockSize+100)
+	for i := range content {
+		content[i] = byte(i % 253)
+	}
+	b.SetBytes(int64(len(content)))
+	b.ReportAllocs()
+	return content
+}
+
+// newBenchmarkFile 创建已缓存全部内容的文件
+func newBenchmarkFile(b *testing.B, content []byte) *DingCache {
+	dingFile := newTestFile(b, filepath.Join(b.TempDir(), "cachefile"), config.SysConfig.Download.BlockSize, int64(len(content)))
+	writeTestBlocks(b, dingFile, content)
+	return dingFile
+}
+
+// BenchmarkReadBlock 从缓存文件按块读取
+func BenchmarkReadBlock(b *testing.B) {
+	content := setupBenchmark(b)
+	dingFile := newBenchmarkFile(b, content)
+	blockNumber := dingFile.getBlockNumber()
+	b.SetBytes(dingFile.GetBlockSize())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		block, err := dingFile.ReadBlock(int64(i) % blockNumber)
+		if err != nil {
+			b.Fatal(err)
+		}
+		util.PutBuffer(block)
+	}
+}
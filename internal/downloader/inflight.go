@@ -0,0 +1,152 @@
+//  Copyright (c) 2025 dingodb.com, Inc. All Rights Reserved
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http:www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package downloader
+
+import (
+	"fmt"
+	"sync"
+)
+
+// BlockState 下载请求对块的处理方式
+type BlockState int
+
+const (
+	BlockCached   BlockState = iota // 已缓存，直接读取
+	BlockFetching                   // 其他请求正在回源下载，等待其写入缓存后读取
+	BlockClaimed                    // 由当前请求回源下载，其他请求等待
+	BlockRemote                     // 当前请求只覆盖块的一部分，回源但不写入缓存，也不登记
+)
+
+// blockFetch 一个在途块，下载完成或放弃时关闭done
+type blockFetch struct {
+	done chan struct{}
+}
+
+func inflightKey(savePath string, blockIndex int64) string {
+	return fmt.Sprintf("%s#%d", savePath, blockIndex)
+}
+
+// BlockClaims 一次下载请求登记的在途块。同一块同时只有一个请求回源，其余请求等待其写入缓存后读取。
+type BlockClaims struct {
+	savePath string
+	mu       sync.Mutex
+	owned    map[int64]*blockFetch // 当前请求负责下载的块
+	waits    map[int64]*blockFetch // 当前请求等待的其他请求的块
+}
+
+func (f *DingCacheManager) NewBlockClaims(savePath string) *BlockClaims {
+	return &BlockClaims{
+		savePath: savePath,
+		owned:    make(map[int64]*blockFetch),
+		waits:    make(map[int64]*blockFetch),
+	}
+}
+
+// Classify 依次判断[startPos,endPos)内每个块的处理方式，未缓存且无人下载的完整块登记为当前请求下载。
+// 整个区间在一次加锁内完成登记，请求只会等待先于它登记的请求，不会出现相互等待。
+func (c *BlockClaims) Classify(dingFile *DingCache, startPos, endPos int64) []BlockState {
+	blockSize, fileSize := dingFile.GetBlockSize(), dingFile.GetFileSize()
+	startBlock, endBlock := startPos/blockSize, (endPos-1)/blockSize
+	states := make([]BlockState, 0, endBlock-startBlock+1)
+	m := GetInstance()
+	m.inflightMu.Lock()
+	defer m.inflightMu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for curBlock := startBlock; curBlock <= endBlock; curBlock++ {
+		blockStartPos := curBlock * blockSize
+		blockEndPos := min(blockStartPos+blockSize, fileSize)
+		if dingFile.HasBlockRange(curBlock, max(startPos, blockStartPos), min(endPos, blockEndPos)) { // 整块或所需的子页已缓存
+			states = append(states, BlockCached)
+			continue
+		}
+		key := inflightKey(c.savePath, curBlock)
+		if fetch, ok := m.inflight[key]; ok {
+			if _, own := c.owned[curBlock]; own {
+				states = append(states, BlockRemote)
+			} else {
+				c.waits[curBlock] = fetch
+				states = append(states, BlockFetching)
+			}
+			continue
+		}
+		if blockStartPos < startPos || blockEndPos > endPos { // 不完整覆盖的块不会写入缓存，登记后只会让其他请求白等
+			states = append(states, BlockRemote)
+			continue
+		}
+		fetch := &blockFetch{done: make(chan struct{})}
+		m.inflight[key] = fetch
+		c.owned[curBlock] = fetch
+		states = append(states, BlockClaimed)
+	}
+	return states
+}
+
+// Wait 返回登记时等待的块的完成通知，未登记等待时返回nil。
+func (c *BlockClaims) Wait(blockIndex int64) <-chan struct{} {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fetch, ok := c.waits[blockIndex]
+	if !ok {
+		return nil
+	}
+	delete(c.waits, blockIndex)
+	return fetch.done
+}
+
+// Finish 块已写入缓存或不再下载，唤醒等待该块的请求。
+func (c *BlockClaims) Finish(blockIndex int64) {
+	if c == nil {
+		return
+	}
+	m := GetInstance()
+	m.inflightMu.Lock()
+	defer m.inflightMu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.finishLocked(m, blockIndex)
+}
+
+// Release 请求结束时放弃所有未完成的块，等待者发现块仍未缓存时自行回源。
+func (c *BlockClaims) Release() {
+	if c == nil {
+		return
+	}
+	m := GetInstance()
+	m.inflightMu.Lock()
+	defer m.inflightMu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for blockIndex := range c.owned {
+		c.finishLocked(m, blockIndex)
+	}
+	clear(c.waits)
+}
+
+func (c *BlockClaims) finishLocked(m *DingCacheManager, blockIndex int64) {
+	fetch, ok := c.owned[blockIndex]
+	if !ok {
+		return
+	}
+	key := inflightKey(c.savePath, blockIndex)
+	if m.inflight[key] == fetch {
+		delete(m.inflight, key)
+	}
+	delete(c.owned, blockIndex)
+	close(fetch.done)
+}
@@ -0,0 +1,71 @@
+//  Copyright (c) 2025 dingodb.com, Inc. All Rights Reserved
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http:www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package downloader
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"dingospeed/pkg/config"
+)
+
+func TestBlockClaims(t *testing.T) {
+	config.SysConfig = &config.Config{}
+	savePath := filepath.Join(t.TempDir(), "cachefile")
+	blockSize := int64(1024)
+	dingFile := newTestFile(t, savePath, blockSize, blockSize*3+10)
+	manager := GetInstance()
+	first := manager.NewBlockClaims(savePath)
+	states := first.Classify(dingFile, 100, blockSize*3+10)
+	want := []BlockState{BlockRemote, BlockClaimed, BlockClaimed, BlockClaimed}
+	if !slices.Equal(states, want) {
+		t.Fatalf("first states %v, want %v", states, want)
+	}
+	second := manager.NewBlockClaims(savePath)
+	states = second.Classify(dingFile, 0, blockSize*3+10)
+	want = []BlockState{BlockClaimed, BlockFetching, BlockFetching, BlockFetching}
+	if !slices.Equal(states, want) {
+		t.Fatalf("second states %v, want %v", states, want)
+	}
+	done := second.Wait(1)
+	if err := dingFile.WriteBlock(1, make([]byte, blockSize)); err != nil {
+		t.Fatal(err)
+	}
+	first.Finish(1)
+	select {
+	case <-done:
+	default:
+		t.Fatalf("waiter should be woken after the block is written")
+	}
+	if exist, _ := dingFile.HasBlock(1); !exist {
+		t.Fatalf("block 1 should be cached")
+	}
+	done = second.Wait(2)
+	first.Release()
+	select {
+	case <-done:
+	default:
+		t.Fatalf("waiter should be woken when the owner gives up")
+	}
+	third := manager.NewBlockClaims(savePath)
+	states = third.Classify(dingFile, blockSize, blockSize*3)
+	want = []BlockState{BlockCached, BlockClaimed}
+	if !slices.Equal(states, want) {
+		t.Fatalf("third states %v, want %v", states, want)
+	}
+	second.Release()
+	third.Release()
+}
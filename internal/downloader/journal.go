@@ -0,0 +1,223 @@
+//  Copyright (c) 2025 dingodb.com, Inc. All Rights Reserved
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http:www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package downloader
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"dingospeed/pkg/config"
+
+	"github.com/bytedance/sonic"
+	"go.uber.org/zap"
+)
+
+const (
+	journalDirName = ".journal"
+	legacyKeyName  = "journal.key" // 旧版本与记录存放在一起的密钥
+	journalExt     = ".json"
+)
+
+// JournalEntry 一个进行中的回源下载
+type JournalEntry struct {
+	Id         string `json:"-"`
+	BlobsFile  string `json:"blobsFile"`
+	FileName   string `json:"fileName"`
+	FileSize   int64  `json:"fileSize"`
+	OrgRepo    string `json:"orgRepo"`
+	DataType   string `json:"dataType"`
+	Etag       string `json:"etag"`
+	Uri        string `json:"uri"`
+	XetHash    string `json:"xetHash,omitempty"`
+	StartPos   int64  `json:"startPos"`
+	EndPos     int64  `json:"endPos"`
+	AuthRef    string `json:"authRef,omitempty"` // 使用外部提供的密钥加密的authorization，不保存明文
+	CreateTime int64  `json:"createTime"`
+}
+
+// DownloadJournal 记录进行中的回源下载，进程异常退出后启动时据此恢复。
+// 每个下载一个记录文件，先写临时文件再重命名，崩溃时不会留下残缺记录。
+// authorization使用外部提供的密钥加密，密钥不与记录存放在一起；未提供密钥时不保存authorization。
+type DownloadJournal struct {
+	dir string
+	key []byte // 为空时不保存authorization
+	seq atomic.Uint64
+}
+
+var (
+	journal     *DownloadJournal
+	journalOnce sync.Once
+)
+
+func GetJournal() *DownloadJournal {
+	journalOnce.Do(func() {
+		journal = NewDownloadJournal(filepath.Join(config.SysConfig.Repos(), journalDirName), config.SysConfig.GetJournalKey())
+	})
+	return journal
+}
+
+// NewDownloadJournal secret为加密authorization的密钥，为空时恢复的下载不携带token。
+func NewDownloadJournal(dir, secret string) *DownloadJournal {
+	j := &DownloadJournal{dir: dir}
+	if secret != "" {
+		key := sha256.Sum256([]byte(secret))
+		j.key = key[:]
+	}
+	// 与密文放在一起的密钥起不到保护作用，删除后旧记录中的token无法解密，按不带token恢复
+	legacyKey := filepath.Join(dir, legacyKeyName)
+	if err := os.Remove(legacyKey); err == nil {
+		zap.S().Warnf("remove journal key stored beside the journal, %s", legacyKey)
+	}
+	return j
+}
+
+// Add 记录一个下载，返回记录编号
+func (j *DownloadJournal) Add(entry *JournalEntry, authorization string) (string, error) {
+	if err := os.MkdirAll(j.dir, 0o700); err != nil {
+		return "", err
+	}
+	if authorization != "" && j.key != nil {
+		authRef, err := j.seal(authorization)
+		if err != nil {
+			return "", err
+		}
+		entry.AuthRef = authRef
+	}
+	entry.CreateTime = time.Now().Unix()
+	entry.Id = fmt.Sprintf("%d-%d", time.Now().UnixNano(), j.seq.Add(1))
+	content, err := sonic.Marshal(entry)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(j.dir, entry.Id+journalExt)
+	tmpPath := path + ".tmp"
+	if err = os.WriteFile(tmpPath, content, 0o600); err != nil {
+		return "", err
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	return entry.Id, nil
+}
+
+// Remove 下载结束后删除记录
+func (j *DownloadJournal) Remove(id string) {
+	if id == "" {
+		return
+	}
+	if err := os.Remove(filepath.Join(j.dir, id+journalExt)); err != nil && !os.IsNotExist(err) {
+		zap.S().Warnf("remove journal %s err.%v", id, err)
+	}
+}
+
+// List 返回所有未完成的下载记录，无法解析的记录直接删除
+func (j *DownloadJournal) List() ([]*JournalEntry, error) {
+	dirEntries, err := os.ReadDir(j.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	entries := make([]*JournalEntry, 0, len(dirEntries))
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		path := filepath.Join(j.dir, name)
+		if strings.HasSuffix(name, ".tmp") {
+			os.Remove(path)
+			continue
+		}
+		if !strings.HasSuffix(name, journalExt) {
+			continue
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			zap.S().Warnf("read journal %s err.%v", path, err)
+			continue
+		}
+		entry := &JournalEntry{}
+		if err = sonic.Unmarshal(content, entry); err != nil {
+			zap.S().Warnf("invalid journal %s, removed.%v", path, err)
+			os.Remove(path)
+			continue
+		}
+		entry.Id = strings.TrimSuffix(name, journalExt)
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Authorization 解密记录中的authorization
+func (j *DownloadJournal) Authorization(entry *JournalEntry) (string, error) {
+	if entry.AuthRef == "" {
+		return "", nil
+	}
+	return j.open(entry.AuthRef)
+}
+
+func (j *DownloadJournal) aead() (cipher.AEAD, error) {
+	if j.key == nil {
+		return nil, errors.New("journal key is not set")
+	}
+	block, err := aes.NewCipher(j.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (j *DownloadJournal) seal(plaintext string) (string, error) {
+	gcm, err := j.aead()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(plaintext), nil)), nil
+}
+
+func (j *DownloadJournal) open(sealed string) (string, error) {
+	gcm, err := j.aead()
+	if err != nil {
+		return "", err
+	}
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < gcm.NonceSize() {
+		return "", errors.New("invalid journal auth reference")
+	}
+	plaintext, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
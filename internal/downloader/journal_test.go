@@ -0,0 +1,84 @@
+//  Copyright (c) 2025 dingodb.com, Inc. All Rights Reserved
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http:www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package downloader
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDownloadJournal(t *testing.T) {
+	dir := t.TempDir()
+	secret := "journal-secret"
+	journal := NewDownloadJournal(dir, secret)
+	token := "Bearer hf_secret_token"
+	id, err := journal.Add(&JournalEntry{BlobsFile: "blobs/etag", OrgRepo: "org/repo", FileName: "model.bin", FileSize: 100, EndPos: 100}, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(filepath.Join(dir, id+journalExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(content), "hf_secret_token") {
+		t.Fatalf("token should not be stored in plaintext: %s", content)
+	}
+	// 重启后使用同一密钥解密
+	entries, err := NewDownloadJournal(dir, secret).List()
+	if err != nil || len(entries) != 1 || entries[0].Id != id || entries[0].EndPos != 100 {
+		t.Fatalf("unexpected entries %v, err:%v", entries, err)
+	}
+	if auth, err := NewDownloadJournal(dir, secret).Authorization(entries[0]); err != nil || auth != token {
+		t.Fatalf("authorization mismatch %q, err:%v", auth, err)
+	}
+	if _, err = NewDownloadJournal(dir, "other-secret").Authorization(entries[0]); err == nil {
+		t.Fatalf("authorization should not be decrypted with another key")
+	}
+	files, _ := os.ReadDir(dir)
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), journalExt) {
+			t.Fatalf("no key file should be written beside the journal, got %s", f.Name())
+		}
+	}
+	journal.Remove(id)
+	if entries, _ = journal.List(); len(entries) != 0 {
+		t.Fatalf("journal should be empty, got %d", len(entries))
+	}
+}
+
+func TestJournalWithoutKey(t *testing.T) {
+	dir := t.TempDir()
+	// 旧版本写在记录旁的密钥被删除
+	if err := os.WriteFile(filepath.Join(dir, legacyKeyName), make([]byte, 32), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	journal := NewDownloadJournal(dir, "")
+	if _, err := os.Stat(filepath.Join(dir, legacyKeyName)); !os.IsNotExist(err) {
+		t.Fatalf("legacy key file should be removed.%v", err)
+	}
+	// 未设置密钥时不保存token，恢复的下载不携带token
+	if _, err := journal.Add(&JournalEntry{OrgRepo: "org/repo", FileName: "model.bin"}, "Bearer hf_secret_token"); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := journal.List()
+	if err != nil || len(entries) != 1 || entries[0].AuthRef != "" {
+		t.Fatalf("authorization should not be persisted without a key, %v, err:%v", entries, err)
+	}
+	if auth, err := journal.Authorization(entries[0]); err != nil || auth != "" {
+		t.Fatalf("resumed download should run without authorization, %q, err:%v", auth, err)
+	}
+}
@@ -0,0 +1,423 @@
+//  Copyright (c) 2025 dingodb.com, Inc. All Rights Reserved
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http:www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"dingospeed/internal/model"
+	"dingospeed/pkg/config"
+	"dingospeed/pkg/util"
+
+	"github.com/bytedance/sonic"
+	"go.uber.org/zap"
+)
+
+const (
+	migratingSuffix      = ".migrating"
+	migrateStateSuffix   = ".migrating.json"
+	migrateStateInterval = 64 // 每拷贝64个块记录一次进度
+)
+
+var errMigrateAborted = errors.New("migrate aborted by download request")
+
+// migrateState 迁移的断点信息，源文件未被修改且新头部大小不变时可以从Copied处继续。
+// 推断的来源信息会随软链接等变化，需要一并记录，续传时沿用，保证数据偏移不变。
+type migrateState struct {
+	SourceVersion uint64      `json:"sourceVersion"`
+	SourceModTime int64       `json:"sourceModTime"`
+	SourceSize    int64       `json:"sourceSize"`
+	HeaderSize    int64       `json:"headerSize"`
+	Provenance    *Provenance `json:"provenance,omitempty"`
+	Copied        int64       `json:"copied"`
+}
+
+// CacheMigrator 将旧版本的缓存文件原地升级到当前版本，升级过程可中断、可续传。
+// 新版本格式只需在upgradeHeader中补齐新增字段，即可复用同一套迁移流程。
+type CacheMigrator struct {
+	running  atomic.Bool
+	mu       sync.RWMutex
+	progress model.CacheMigrateProgress
+}
+
+var (
+	migrator     *CacheMigrator
+	migratorOnce sync.Once
+)
+
+func GetMigrator() *CacheMigrator {
+	migratorOnce.Do(func() {
+		migrator = &CacheMigrator{}
+	})
+	return migrator
+}
+
+// Progress 返回当前迁移进度的副本
+func (m *CacheMigrator) Progress() *model.CacheMigrateProgress {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	p := m.progress
+	return &p
+}
+
+func (m *CacheMigrator) update(f func(p *model.CacheMigrateProgress)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f(&m.progress)
+}
+
+// Run 扫描repos/files下所有blob，逐个升级旧版本文件。已在运行时直接返回。
+func (m *CacheMigrator) Run(ctx context.Context) {
+	if !m.running.CompareAndSwap(false, true) {
+		return
+	}
+	defer m.running.Store(false)
+	blobs, totalBytes := scanOldBlobs(filesRoot())
+	m.update(func(p *model.CacheMigrateProgress) {
+		*p = model.CacheMigrateProgress{
+			Running:    true,
+			TotalFiles: int64(len(blobs)),
+			TotalBytes: totalBytes,
+			StartTime:  time.Now().Unix(),
+		}
+	})
+	zap.S().Infof("cache migrate start, files:%d, size:%s", len(blobs), util.ConvertBytesToHumanReadable(totalBytes))
+	reportCtx, cancel := context.WithCancel(ctx)
+	go m.report(reportCtx)
+	for _, blob := range blobs {
+		if ctx.Err() != nil {
+			break
+		}
+		m.update(func(p *model.CacheMigrateProgress) { p.CurrentFile = blob })
+		err := MigrateCacheFile(ctx, blob, func(n int64) {
+			m.update(func(p *model.CacheMigrateProgress) { p.CopiedBytes += n })
+		})
+		m.update(func(p *model.CacheMigrateProgress) {
+			if err == nil {
+				p.MigratedFiles++
+			} else if errors.Is(err, errMigrateAborted) {
+				p.SkippedFiles++
+			} else {
+				p.FailedFiles++
+			}
+		})
+		if err != nil {
+			zap.S().Warnf("migrate %s err.%v", blob, err)
+		}
+	}
+	cancel()
+	m.update(func(p *model.CacheMigrateProgress) {
+		p.Running = false
+		p.CurrentFile = ""
+		p.EndTime = time.Now().Unix()
+	})
+	m.logProgress()
+}
+
+func (m *CacheMigrator) report(ctx context.Context) {
+	ticker := time.NewTicker(config.SysConfig.GetMigrateReportPeriod())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.logProgress()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (m *CacheMigrator) logProgress() {
+	p := m.Progress()
+	zap.S().Infof("cache migrate progress, files:%d/%d, skipped:%d, failed:%d, bytes:%s/%s, current:%s",
+		p.MigratedFiles, p.TotalFiles, p.SkippedFiles, p.FailedFiles,
+		util.ConvertBytesToHumanReadable(p.CopiedBytes), util.ConvertBytesToHumanReadable(p.TotalBytes), p.CurrentFile)
+}
+
+// scanOldBlobs 查找版本低于当前版本的blob文件
+func scanOldBlobs(root string) ([]string, int64) {
+	var (
+		blobs      []string
+		totalBytes int64
+	)
+	_ = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			if info.Name() == QuarantineDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() || !isBlobDir(filepath.Dir(path)) || isSidecar(path) {
+			return nil
+		}
+		header, err := readHeader(path)
+		if err != nil || header.Version >= CURRENT_OLAH_CACHE_VERSION || header.IsCompressed() { // 压缩文件不使用子页，保持原版本
+			return nil
+		}
+		blobs = append(blobs, path)
+		totalBytes += int64(header.FileSize)
+		return nil
+	})
+	return blobs, totalBytes
+}
+
+// isBlobDir 仓库下的blobs目录或全局存储的分桶目录
+func isBlobDir(dir string) bool {
+	return filepath.Base(dir) == "blobs" || filepath.Base(filepath.Dir(dir)) == BlobStoreDir
+}
+
+func isSidecar(path string) bool {
+	return strings.HasSuffix(path, VerifySuffix) || strings.HasSuffix(path, RefsSuffix) || strings.HasSuffix(path, migratingSuffix) || strings.HasSuffix(path, migrateStateSuffix) || strings.HasSuffix(path, resizingSuffix)
+}
+
+func readHeader(path string) (*DingCacheHeader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	header := &DingCacheHeader{}
+	if err = header.Read(f); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+// upgradeHeader 以旧头部为基础构造当前版本的头部，校验值在拷贝数据时补齐。
+func upgradeHeader(old *DingCacheHeader, path string, modTime time.Time) *DingCacheHeader {
+	header := NewDingCacheHeader(CURRENT_OLAH_CACHE_VERSION, old.BlockSize, old.FileSize)
+	for i := uint64(0); i < header.BlockNumber; i++ {
+		if ok, _ := old.BlockMask.Test(i); ok {
+			_ = header.BlockMask.Set(i)
+		}
+	}
+	if old.HasProvenance() {
+		p := *old.Provenance
+		header.Provenance = &p
+	} else if header.HasProvenance() {
+		header.Provenance = inferProvenance(path, modTime, old.IsComplete())
+	}
+	return header
+}
+
+// inferProvenance 旧文件没有来源信息，从目录结构和软链接推断。
+// blob路径为files/<type>/<org>/<repo>/blobs/<etag>，org可能为空；全局存储中的对象按第一个引用推断。
+func inferProvenance(path string, modTime time.Time, complete bool) *Provenance {
+	p := &Provenance{
+		Etag:       filepath.Base(path),
+		CreateTime: modTime.Unix(),
+	}
+	if complete {
+		p.CompleteTime = modTime.Unix()
+	}
+	repoBlob, err := repoBlobOf(path)
+	if err != nil {
+		return p
+	}
+	path = repoBlob
+	if rel, err := filepath.Rel(filesRoot(), filepath.Dir(filepath.Dir(path))); err == nil && !strings.HasPrefix(rel, "..") {
+		parts := strings.SplitN(filepath.ToSlash(rel), "/", 2)
+		if len(parts) == 2 {
+			p.RepoType = parts[0]
+			p.Org, p.Repo = util.SplitOrgRepo(parts[1])
+			if p.Repo == "" {
+				p.Org, p.Repo = "", p.Org
+			}
+		}
+	}
+	if links := findBlobLinks(path); len(links) > 0 {
+		resolveDir := filepath.Join(filepath.Dir(filepath.Dir(path)), "resolve")
+		if rel, err := filepath.Rel(resolveDir, links[0]); err == nil {
+			if parts := strings.SplitN(filepath.ToSlash(rel), "/", 2); len(parts) == 2 {
+				p.FileName = parts[1]
+			}
+		}
+	}
+	return p
+}
+
+// MigrateCacheFile 将单个缓存文件升级到当前版本。
+// 数据先拷贝到<path>.migrating，进度记录在<path>.migrating.json，中断后再次执行可继续；
+// 拷贝完成后在没有下载请求打开该文件时原子替换原文件。
+func MigrateCacheFile(ctx context.Context, path string, onProgress func(n int64)) error {
+	manager := GetInstance()
+	aborted, ok := manager.beginMigrate(path)
+	if !ok {
+		return errMigrateAborted
+	}
+	defer manager.endMigrate(path)
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	stat, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	old := &DingCacheHeader{}
+	if err = old.Read(src); err != nil {
+		return err
+	}
+	if old.Version >= CURRENT_OLAH_CACHE_VERSION {
+		return nil
+	}
+	if old.IsCompressed() {
+		return fmt.Errorf("migrate compressed file is not supported, version:%d", old.Version)
+	}
+	header := upgradeHeader(old, path, stat.ModTime())
+	state := loadMigrateState(path, old.Version, stat)
+	if state.Copied > 0 && state.Provenance != nil && header.HasProvenance() {
+		header.Provenance = state.Provenance
+	}
+	if headerSize := header.GetHeaderSize(); state.HeaderSize != headerSize { // 已拷贝数据的偏移与新头部不一致，从头开始
+		if state.Copied > 0 {
+			zap.S().Warnf("migrate %s, header size changed from %d to %d, restart.", path, state.HeaderSize, headerSize)
+		}
+		state.Copied = 0
+		state.HeaderSize = headerSize
+	}
+	state.Provenance = header.Provenance
+	tmpPath := path + migratingSuffix
+	flag := os.O_RDWR | os.O_CREATE
+	if state.Copied == 0 {
+		flag |= os.O_TRUNC
+	}
+	dst, err := os.OpenFile(tmpPath, flag, 0644)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	var (
+		oldHeaderSize = old.GetHeaderSize()
+		newHeaderSize = header.GetHeaderSize()
+		blockSize     = int64(old.BlockSize)
+		fileSize      = int64(old.FileSize)
+		buf           = make([]byte, blockSize)
+	)
+	for blockIndex := int64(0); blockIndex < int64(old.BlockNumber); blockIndex++ {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if aborted.Load() {
+			return errMigrateAborted
+		}
+		if ok, _ := old.BlockMask.Test(uint64(blockIndex)); !ok {
+			continue
+		}
+		realSize := min(blockSize, fileSize-blockIndex*blockSize)
+		block := buf[:realSize]
+		resumed := blockIndex*blockSize < state.Copied
+		if resumed { // 已拷贝的块只需重新计算校验值
+			if _, err = dst.ReadAt(block, newHeaderSize+blockIndex*blockSize); err != nil && err != io.EOF {
+				return err
+			}
+		} else if _, err = src.ReadAt(block, oldHeaderSize+blockIndex*blockSize); err != nil && err != io.EOF {
+			return err
+		}
+		if !old.VerifyChecksum(uint64(blockIndex), block) {
+			zap.S().Warnf("migrate %s, block %d checksum mismatch, mark as missing.", path, blockIndex)
+			_ = header.BlockMask.Clear(uint64(blockIndex))
+			continue
+		}
+		header.SetChecksum(uint64(blockIndex), block)
+		if resumed {
+			continue
+		}
+		if _, err = dst.WriteAt(block, newHeaderSize+blockIndex*blockSize); err != nil {
+			return err
+		}
+		if onProgress != nil {
+			onProgress(realSize)
+		}
+		if (blockIndex+1)%migrateStateInterval == 0 {
+			if err = dst.Sync(); err != nil {
+				return err
+			}
+			state.Copied = (blockIndex + 1) * blockSize
+			saveMigrateState(path, state)
+		}
+	}
+	if err = dst.Truncate(newHeaderSize + fileSize); err != nil {
+		return err
+	}
+	if _, err = dst.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err = header.Write(dst); err != nil {
+		return err
+	}
+	if err = dst.Sync(); err != nil {
+		return err
+	}
+	if err = manager.commitMigrate(path, func() error {
+		if latest, err := os.Stat(path); err != nil || !latest.ModTime().Equal(stat.ModTime()) {
+			_ = os.Remove(path + migrateStateSuffix)
+			return errMigrateAborted // 拷贝期间源文件被修改，下次重新迁移
+		}
+		if err := os.Rename(tmpPath, path); err != nil {
+			return err
+		}
+		GetBlockCache().RemoveFile(path)
+		_ = os.Remove(path + migrateStateSuffix)
+		zap.S().Infof("migrate %s from v%d to v%d done.", path, old.Version, header.Version)
+		return nil
+	}); err != nil {
+		return err
+	}
+	if header.IsComplete() { // 升级后带有块校验值，完整的文件需通过校验才能直接发送文件内容
+		verifyMigrated(path, header)
+	}
+	return nil
+}
+
+func loadMigrateState(path string, version uint64, stat os.FileInfo) *migrateState {
+	state := &migrateState{
+		SourceVersion: version,
+		SourceModTime: stat.ModTime().UnixNano(),
+		SourceSize:    stat.Size(),
+	}
+	b, err := os.ReadFile(path + migrateStateSuffix)
+	if err != nil || !util.FileExists(path+migratingSuffix) {
+		return state
+	}
+	saved := &migrateState{}
+	if err = sonic.Unmarshal(b, saved); err != nil {
+		return state
+	}
+	if saved.SourceVersion == state.SourceVersion && saved.SourceModTime == state.SourceModTime && saved.SourceSize == state.SourceSize {
+		zap.S().Infof("resume migrate %s from %d.", path, saved.Copied)
+		return saved
+	}
+	return state
+}
+
+func saveMigrateState(path string, state *migrateState) {
+	if err := util.WriteDataToFile(path+migrateStateSuffix, state); err != nil {
+		zap.S().Warnf("save migrate state err. %s, %v", path, err)
+	}
+}
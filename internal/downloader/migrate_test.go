@@ -0,0 +1,113 @@
+//  Copyright (c) 2025 dingodb.com, Inc. All Rights Reserved
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http:www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"dingospeed/pkg/util"
+)
+
+func TestMigrateCacheFile(t *testing.T) {
+	repos := setupRepos(t)
+	blockSize := int64(1024)
+	fileSize := blockSize*2 + 10
+	blobPath := filepath.Join(repos, "files", "models", "org", "repo", "blobs", "etag")
+	if err := os.MkdirAll(filepath.Dir(blobPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	old := NewDingCacheHeader(MIN_OLAH_CACHE_VERSION, uint64(blockSize), uint64(fileSize))
+	_ = old.BlockMask.Set(0)
+	_ = old.BlockMask.Set(2)
+	f, err := os.Create(blobPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = old.Write(f); err != nil {
+		t.Fatal(err)
+	}
+	content := testContent(fileSize)
+	if _, err = f.WriteAt(content, old.GetHeaderSize()); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	// 上次中断时的头部大小与本次不一致，已拷贝的数据不能续用
+	stat, err := os.Stat(blobPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(blobPath+migratingSuffix, make([]byte, fileSize*2), 0644); err != nil {
+		t.Fatal(err)
+	}
+	saveMigrateState(blobPath, &migrateState{
+		SourceVersion: old.Version,
+		SourceModTime: stat.ModTime().UnixNano(),
+		SourceSize:    stat.Size(),
+		HeaderSize:    1,
+		Copied:        blockSize,
+	})
+
+	if err = MigrateCacheFile(context.Background(), blobPath, nil); err != nil {
+		t.Fatalf("MigrateCacheFile err.%v", err)
+	}
+	dingFile := newTestFile(t, blobPath, blockSize, fileSize)
+	if dingFile.header.Version != CURRENT_OLAH_CACHE_VERSION {
+		t.Fatalf("expect version %d, got %d", CURRENT_OLAH_CACHE_VERSION, dingFile.header.Version)
+	}
+	if p := dingFile.GetProvenance(); p == nil || p.RepoType != "models" || p.Org != "org" || p.Repo != "repo" || p.Etag != "etag" {
+		t.Fatalf("unexpected provenance %+v", p)
+	}
+	if hasBlock, _ := dingFile.HasBlock(1); hasBlock {
+		t.Fatalf("block 1 should be missing")
+	}
+	for _, i := range []int64{0, 2} {
+		block, err := dingFile.ReadBlock(i)
+		if err != nil {
+			t.Fatalf("ReadBlock %d err.%v", i, err)
+		}
+		end := min((i+1)*blockSize, fileSize)
+		if !bytes.Equal(block[:end-i*blockSize], content[i*blockSize:end]) {
+			t.Fatalf("block %d mismatch", i)
+		}
+	}
+	if util.FileExists(blobPath+migratingSuffix) || util.FileExists(blobPath+migrateStateSuffix) {
+		t.Fatalf("temp files should be removed")
+	}
+
+	// 完整的文件迁移后立即校验
+	completePath := filepath.Join(filepath.Dir(blobPath), "complete")
+	f, err = os.Create(completePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = old.BlockMask.Set(1)
+	if err = old.Write(f); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteAt(content, old.GetHeaderSize()); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err = MigrateCacheFile(context.Background(), completePath, nil); err != nil {
+		t.Fatalf("MigrateCacheFile err.%v", err)
+	}
+	if !IsBlobVerified(completePath, fileSize) {
+		t.Fatalf("complete blob should be verified after migration")
+	}
+}
@@ -0,0 +1,244 @@
+//  Copyright (c) 2025 dingodb.com, Inc. All Rights Reserved
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http:www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package downloader
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"dingospeed/pkg/config"
+	"dingospeed/pkg/prom"
+)
+
+// Priority 回源分段的优先级，数值越小优先级越高
+type Priority int
+
+const (
+	PriorityInteractive Priority = iota // 客户端直接发起的请求
+	PriorityInner                       // 集群内其他节点的请求
+	PriorityBackground                  // 预热、断点恢复等后台下载
+	priorityCount
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityInner:
+		return "inner"
+	case PriorityBackground:
+		return "background"
+	default:
+		return "interactive"
+	}
+}
+
+// Slot 一个回源连接名额，分段下载结束或被抢占后释放
+type Slot struct {
+	scheduler *UpstreamScheduler
+	priority  Priority
+	ready     chan struct{}
+	elem      *list.Element // 等待队列中的位置
+	granted   bool
+	released  bool
+	preempted atomic.Bool
+}
+
+// UpstreamScheduler 按优先级分配回源连接。连接空闲时按权重在各优先级的等待队列间轮转分配，
+// 避免低优先级任务饿死；连接已满且有更高优先级的任务等待时，通知一个最低优先级的分段让出连接。
+type UpstreamScheduler struct {
+	mu       sync.Mutex
+	waiting  [priorityCount]*list.List
+	running  [priorityCount]map[*Slot]struct{}
+	current  [priorityCount]int // 平滑加权轮询的当前权重
+	pending  int                // 已通知但尚未让出的连接数
+	inflight int
+}
+
+var (
+	upstreamScheduler     *UpstreamScheduler
+	upstreamSchedulerOnce sync.Once
+)
+
+// GetUpstreamScheduler 未启用优先级调度时返回nil，nil可直接使用，此时不限制连接数。
+func GetUpstreamScheduler() *UpstreamScheduler {
+	if !config.SysConfig.EnablePriority() {
+		return nil
+	}
+	upstreamSchedulerOnce.Do(func() {
+		upstreamScheduler = NewUpstreamScheduler()
+	})
+	return upstreamScheduler
+}
+
+func NewUpstreamScheduler() *UpstreamScheduler {
+	s := &UpstreamScheduler{}
+	for i := range s.waiting {
+		s.waiting[i] = list.New()
+		s.running[i] = make(map[*Slot]struct{})
+	}
+	return s
+}
+
+// Acquire 获取一个回源连接，连接已满时排队等待。ctx取消时返回错误。
+func (s *UpstreamScheduler) Acquire(ctx context.Context, priority Priority) (*Slot, error) {
+	if s == nil {
+		return nil, nil
+	}
+	priority = min(max(priority, PriorityInteractive), PriorityBackground)
+	slot := &Slot{scheduler: s, priority: priority, ready: make(chan struct{})}
+	s.mu.Lock()
+	slot.elem = s.waiting[priority].PushBack(slot)
+	s.dispatch()
+	if !slot.granted {
+		s.preempt(priority)
+	}
+	s.report()
+	s.mu.Unlock()
+	select {
+	case <-slot.ready:
+		return slot, nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		granted := slot.granted
+		if !granted {
+			s.waiting[priority].Remove(slot.elem)
+			s.report()
+		}
+		s.mu.Unlock()
+		if granted { // 取消的同时已分配到连接
+			slot.Release()
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// dispatch 把空闲连接分配给等待的任务，多个优先级同时等待时按平滑加权轮询选择。
+func (s *UpstreamScheduler) dispatch() {
+	maxConcurrent := config.SysConfig.GetPriorityMaxConcurrent()
+	weights := config.SysConfig.GetPriorityWeights()
+	for s.inflight < maxConcurrent {
+		pick, total := Priority(-1), 0
+		for p := PriorityInteractive; p < priorityCount; p++ {
+			if s.waiting[p].Len() == 0 {
+				continue
+			}
+			s.current[p] += weights[p]
+			total += weights[p]
+			if pick < 0 || s.current[p] > s.current[pick] {
+				pick = p
+			}
+		}
+		if pick < 0 {
+			return
+		}
+		s.current[pick] -= total
+		s.grant(pick)
+	}
+}
+
+// dispatchFirst 被抢占让出的连接直接分配给最高优先级的等待任务
+func (s *UpstreamScheduler) dispatchFirst() {
+	if s.inflight >= config.SysConfig.GetPriorityMaxConcurrent() {
+		return
+	}
+	for p := PriorityInteractive; p < priorityCount; p++ {
+		if s.waiting[p].Len() > 0 {
+			s.grant(p)
+			return
+		}
+	}
+}
+
+func (s *UpstreamScheduler) grant(p Priority) {
+	slot := s.waiting[p].Remove(s.waiting[p].Front()).(*Slot)
+	slot.elem = nil
+	slot.granted = true
+	s.running[p][slot] = struct{}{}
+	s.inflight++
+	close(slot.ready)
+}
+
+// preempt 连接已满时，通知一个优先级低于priority的分段让出连接，每个新的等待任务最多抢占一个连接。
+func (s *UpstreamScheduler) preempt(priority Priority) {
+	if !config.SysConfig.EnablePriorityPreempt() {
+		return
+	}
+	// 已通知的连接足够分给所有更高优先级的等待任务时不再抢占
+	waiters := 0
+	for p := PriorityInteractive; p < PriorityBackground; p++ {
+		waiters += s.waiting[p].Len()
+	}
+	if s.pending >= waiters {
+		return
+	}
+	for p := PriorityBackground; p > priority; p-- {
+		for slot := range s.running[p] {
+			if slot.preempted.CompareAndSwap(false, true) {
+				s.pending++
+				if config.SysConfig.EnableMetric() {
+					prom.UpstreamPreemptCnt.WithLabelValues(p.String()).Inc()
+				}
+				return
+			}
+		}
+	}
+}
+
+func (s *UpstreamScheduler) report() {
+	if !config.SysConfig.EnableMetric() {
+		return
+	}
+	for p := PriorityInteractive; p < priorityCount; p++ {
+		prom.UpstreamTaskRunning.WithLabelValues(p.String()).Set(float64(len(s.running[p])))
+		prom.UpstreamTaskWaiting.WithLabelValues(p.String()).Set(float64(s.waiting[p].Len()))
+	}
+}
+
+// Release 释放连接，可重复调用
+func (slot *Slot) Release() {
+	if slot == nil {
+		return
+	}
+	s := slot.scheduler
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if slot.released {
+		return
+	}
+	slot.released = true
+	delete(s.running[slot.priority], slot)
+	s.inflight--
+	if slot.preempted.Load() {
+		s.pending--
+		s.dispatchFirst()
+	}
+	s.dispatch()
+	s.report()
+}
+
+// Preempted 有更高优先级的任务在等待，分段应在当前数据块处理完后让出连接
+func (slot *Slot) Preempted() bool {
+	return slot != nil && slot.preempted.Load()
+}
+
+// Yield 让出连接并重新排队，返回新分配的连接
+func (slot *Slot) Yield(ctx context.Context) (*Slot, error) {
+	if slot == nil {
+		return nil, nil
+	}
+	slot.Release()
+	return slot.scheduler.Acquire(ctx, slot.priority)
+}
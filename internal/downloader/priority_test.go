@@ -0,0 +1,72 @@
+//  Copyright (c) 2025 dingodb.com, Inc. All Rights Reserved
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http:www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package downloader
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"dingospeed/pkg/config"
+)
+
+func TestUpstreamScheduler(t *testing.T) {
+	config.SysConfig = &config.Config{}
+	config.SysConfig.Download.Priority = config.Priority{Enabled: true, MaxConcurrent: 1, Preempt: true}
+	s := NewUpstreamScheduler()
+	ctx := context.Background()
+	background, err := s.Acquire(ctx, PriorityBackground)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 连接已满，客户端请求到达后通知后台分段让出连接
+	interactive := make(chan *Slot)
+	go func() {
+		slot, _ := s.Acquire(ctx, PriorityInteractive)
+		interactive <- slot
+	}()
+	deadline := time.Now().Add(time.Second)
+	for !background.Preempted() {
+		if time.Now().After(deadline) {
+			t.Fatal("background slot should be preempted")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	yielded := make(chan *Slot)
+	go func() {
+		slot, _ := background.Yield(ctx)
+		yielded <- slot
+	}()
+	slot := <-interactive
+	select {
+	case <-yielded:
+		t.Fatal("background task should wait until the interactive task releases")
+	case <-time.After(20 * time.Millisecond):
+	}
+	slot.Release()
+	slot.Release() // 重复释放无影响
+	(<-yielded).Release()
+	// 取消排队
+	holder, _ := s.Acquire(ctx, PriorityInteractive)
+	cancelCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err = s.Acquire(cancelCtx, PriorityInner); err == nil {
+		t.Fatal("acquire should fail when ctx is done")
+	}
+	holder.Release()
+	if s.inflight != 0 || s.waiting[PriorityInner].Len() != 0 {
+		t.Fatalf("unexpected state, inflight:%d, waiting:%d", s.inflight, s.waiting[PriorityInner].Len())
+	}
+}
@@ -15,13 +15,13 @@
 package downloader
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"sync"
+	"time"
 
 	"dingospeed/internal/data"
 	"dingospeed/pkg/common"
@@ -34,6 +34,9 @@ import (
 	"go.uber.org/zap"
 )
 
+// maxThrottleWait 上游限流时单次等待的上限
+const maxThrottleWait = 30 * time.Second
+
 type RemoteFileTask struct {
 	*DownloadTask
 	Authorization string
@@ -41,8 +44,17 @@ type RemoteFileTask struct {
 	Uri           string
 	DataType      string
 	Etag          string
-	Queue         chan []byte `json:"-"`
+	XetHash       string          // 非空表示文件存放在Xet存储，数据从cas-bridge的预签名地址获取
+	Queue         chan util.Chunk `json:"-"`
 	Cancel        context.CancelFunc
+	OnThrottle    func(wait time.Duration) `json:"-"` // 上游限流时回调，自适应分段据此减少连接数
+	OnError       func(err error) bool     `json:"-"` // 下载出错时回调，返回true表示由调用方改用其他上游或重试，不取消整个请求
+	Source        *config.Upstream         // 多源下载时指定的上游，为空时按默认方式选择
+
+	splitMu   sync.Mutex // 保护RangeEndPos、curPos，分段可能被空闲连接拆走后半部分
+	curPos    int64      // 已接收数据的位置
+	startTime time.Time
+	throttles int
 }
 
 func NewRemoteFileTask(taskNo int, rangeStartPos int64, rangeEndPos int64) *RemoteFileTask {
@@ -51,31 +63,45 @@ func NewRemoteFileTask(taskNo int, rangeStartPos int64, rangeEndPos int64) *Remo
 	r.TaskNo = taskNo
 	r.RangeStartPos = rangeStartPos
 	r.RangeEndPos = rangeEndPos
+	r.curPos = rangeStartPos
 	return r
 }
 
-// 分段下载
+// 分段下载。上游数据按块内偏移直接读入池化的块缓冲区，chunk为其子切片，由响应方与持久化共同持有，
+// 双方都释放后缓冲区才归还，块写满后持久化。
 func (r *RemoteFileTask) DoTask() {
 	var (
-		curBlock    int64
-		wg          sync.WaitGroup
-		streamCache = bytes.Buffer{}
+		curBlock  int64
+		wg        sync.WaitGroup
+		blockSize = r.DingFile.GetBlockSize()
+		blockRef  util.Chunk // 持有当前块的缓冲区，直到块持久化
+		block     []byte     // 当前块已收到的数据，与chunk共用缓冲区
 	)
-	contentChan := make(chan []byte, consts.RespChanSize)
-	rangeStartPos, rangeEndPos := r.RangeStartPos, r.RangeEndPos
+	defer func() {
+		blockRef.Release()
+	}()
+	contentChan := make(chan util.Chunk, consts.RespChanSize)
+	r.splitMu.Lock()
+	r.startTime = time.Now()
+	r.splitMu.Unlock()
+	rangeStartPos, rangeEndPos := r.RangeStartPos, r.rangeEnd()
 	zap.S().Infof("start remote dotask:%s/%s, taskNo:%d, size:%d, domain:%s, startPos:%d, endPos:%d", r.OrgRepo, r.FileName, r.TaskNo, r.TaskSize, r.Domain, rangeStartPos, rangeEndPos)
 	wg.Add(2)
 	go func() {
 		defer wg.Done()
 		if err := r.getFileRangeFromRemote(rangeStartPos, rangeEndPos, contentChan); err != nil {
 			zap.S().Errorf("getFileRangeFromRemote err.%v", err)
-			r.Cancel()
+			if r.OnError != nil && r.OnError(err) {
+				close(contentChan)
+			} else {
+				r.Cancel()
+			}
 		} else {
 			close(contentChan)
 		}
 	}()
 	curPos, lastReportPos := rangeStartPos, rangeStartPos
-	lastBlock, lastBlockStartPos, lastBlockEndPos := GetBlockInfo(curPos, r.DingFile.GetBlockSize(), r.DingFile.GetFileSize()) // 块编号，开始位置，结束位置
+	lastBlock, lastBlockStartPos, lastBlockEndPos := GetBlockInfo(curPos, blockSize, r.DingFile.GetFileSize()) // 块编号，开始位置，结束位置
 	blockNumber := r.DingFile.getBlockNumber()
 	go func() {
 		defer func() {
@@ -90,59 +116,51 @@ func (r *RemoteFileTask) DoTask() {
 					if !ok {
 						return
 					}
-					select {
-					case r.Queue <- chunk:
-					case <-r.Context.Done():
-						zap.S().Warnf("send chunk err:%s/%s, task %d, ctx done, DoTask exit.", r.OrgRepo, r.FileName, r.TaskNo)
-						data.ReportFileProcess(r.Context, r.constructFileProcessParam(lastReportPos, lastBlockEndPos, consts.StatusDownloadBreak))
-						return
+					// 同一块的数据在同一缓冲区中连续存放，直接扩展block，无需拷贝
+					for rest := chunk.Data; len(rest) > 0; {
+						n := min(int64(len(rest)), lastBlockEndPos-curPos)
+						if n <= 0 {
+							zap.S().Errorf("chunk exceeds file size. file:%s/%s, taskNo:%d, pos:%d", r.OrgRepo, r.FileName, r.TaskNo, curPos)
+							break
+						}
+						if block == nil {
+							blockRef, block = chunk.Retain(), rest[:0]
+						}
+						block = block[:len(block)+int(n)]
+						rest = rest[n:]
+						curPos += n
+						// 若是一个新的数据块，则将上一个数据块持久化。文件末尾不足一块的数据在结束后补全。
+						if curPos != lastBlockEndPos || lastBlockEndPos-lastBlockStartPos != blockSize {
+							continue
+						}
+						if r.persistBlock(lastBlock, max(lastBlockStartPos, rangeStartPos), block) {
+							zap.S().Debugf("from:%s, %s/%s, taskNo:%d, block：%d(%d)write done, range：%d-%d.", r.Domain, r.OrgRepo, r.FileName, r.TaskNo, lastBlock, blockNumber, lastBlockStartPos, lastBlockEndPos)
+							if interval == config.SysConfig.GetSyncProcessInterval() {
+								data.ReportFileProcess(r.Context, r.constructFileProcessParam(lastReportPos, lastBlockEndPos, consts.StatusDownloading))
+								lastReportPos = lastBlockEndPos
+								interval = 1
+							} else {
+								interval++
+							}
+						}
+						blockRef.Release()
+						blockRef, block = util.Chunk{}, nil
+						lastBlock, lastBlockStartPos, lastBlockEndPos = GetBlockInfo(curPos, blockSize, r.DingFile.GetFileSize())
 					}
-					chunkLen := int64(len(chunk))
-					curPos += chunkLen
+					curBlock = curPos / blockSize
+					chunkLen := int64(len(chunk.Data))
 					if config.SysConfig.EnableMetric() {
 						// 原子性地更新总下载字节数
 						source := util.Itoa(r.Context.Value(consts.PromSource))
 						prom.PromRequestByteCounter(prom.RequestRemoteByte, source, r.OrgRepo, r.Domain, chunkLen)
 					}
-
-					if len(chunk) != 0 {
-						streamCache.Write(chunk)
-					}
-					curBlock = curPos / r.DingFile.GetBlockSize()
-					// 若是一个新的数据块，则将上一个数据块持久化。
-					if curBlock != lastBlock {
-						splitPos := lastBlockEndPos - max(lastBlockStartPos, rangeStartPos)
-						cacheLen := int64(streamCache.Len())
-						if splitPos > cacheLen {
-							// 正常不会出现splitPos>len(streamCacheBytes),若出现只能降级处理。
-							zap.S().Errorf("splitPos err.%d-%d", splitPos, cacheLen)
-							splitPos = cacheLen
-						}
-						streamCacheBytes := streamCache.Bytes()
-						rawBlock := streamCacheBytes[:splitPos] // 当前块的数据
-						if int64(len(rawBlock)) == r.DingFile.GetBlockSize() {
-							hasBlockBool, err := r.DingFile.HasBlock(lastBlock)
-							if err != nil {
-								zap.S().Errorf("HasBlock err.%v", err)
-							}
-							if err == nil && !hasBlockBool {
-								if err = r.DingFile.WriteBlock(lastBlock, rawBlock); err != nil {
-									zap.S().Errorf("writeBlock err.%v", err)
-								}
-								zap.S().Debugf("from:%s, %s/%s, taskNo:%d, block：%d(%d)write done, range：%d-%d.", r.Domain, r.OrgRepo, r.FileName, r.TaskNo, lastBlock, blockNumber, lastBlockStartPos, lastBlockEndPos)
-								if interval == config.SysConfig.GetSyncProcessInterval() {
-									data.ReportFileProcess(r.Context, r.constructFileProcessParam(lastReportPos, lastBlockEndPos, consts.StatusDownloading))
-									lastReportPos = lastBlockEndPos
-									interval = 1
-								} else {
-									interval++
-								}
-							}
-						}
-						nextBlock := streamCacheBytes[splitPos:] // 下一个块的数据
-						streamCache.Truncate(0)
-						streamCache.Write(nextBlock)
-						lastBlock, lastBlockStartPos, lastBlockEndPos = GetBlockInfo(curPos, r.DingFile.GetBlockSize(), r.DingFile.GetFileSize())
+					select {
+					case r.Queue <- chunk:
+					case <-r.Context.Done():
+						chunk.Release()
+						zap.S().Warnf("send chunk err:%s/%s, task %d, ctx done, DoTask exit.", r.OrgRepo, r.FileName, r.TaskNo)
+						data.ReportFileProcess(r.Context, r.constructFileProcessParam(lastReportPos, lastBlockEndPos, consts.StatusDownloadBreak))
+						return
 					}
 				}
 			case <-r.Context.Done():
@@ -153,19 +171,19 @@ func (r *RemoteFileTask) DoTask() {
 		}
 	}()
 	wg.Wait()
-	rawBlock := streamCache.Bytes()
+	rawBlock := block
 	if curBlock == r.DingFile.getBlockNumber()-1 {
 		// 对不足一个block的数据做补全
-		if int64(len(rawBlock)) == r.DingFile.GetFileSize()%r.DingFile.GetBlockSize() {
-			padding := bytes.Repeat([]byte{0}, int(r.DingFile.GetBlockSize())-len(rawBlock))
-			rawBlock = append(rawBlock, padding...)
+		if len(rawBlock) > 0 && int64(len(rawBlock)) == r.DingFile.GetFileSize()%blockSize {
+			rawBlock = rawBlock[:blockSize]
+			clear(rawBlock[len(block):])
 		}
 		lastBlock = curBlock
 	}
 	// 一个空文件，或文件刚好为blocksize的整数倍，直接标记为完成
 	if len(rawBlock) == 0 {
 		data.ReportFileProcess(r.Context, r.constructFileProcessParam(lastReportPos, curPos, consts.StatusDownloaded))
-	} else if int64(len(rawBlock)) == r.DingFile.GetBlockSize() {
+	} else if int64(len(rawBlock)) == blockSize {
 		hasBlockBool, err := r.DingFile.HasBlock(lastBlock)
 		if err != nil {
 			zap.S().Errorf("HasBlock err.%v", err)
@@ -178,7 +196,11 @@ func (r *RemoteFileTask) DoTask() {
 			zap.S().Debugf("from:%s, %s/%s, taskNo:%d, last block：%d(%d)write done, range：%d-%d.", r.Domain, r.OrgRepo, r.FileName, r.TaskNo, lastBlock, blockNumber, lastBlockStartPos, lastBlockEndPos)
 			data.ReportFileProcess(r.Context, r.constructFileProcessParam(lastReportPos, curPos, consts.StatusDownloaded))
 		}
+		r.Claims.Finish(lastBlock)
+	} else {
+		r.writePages(max(lastBlockStartPos, rangeStartPos), rawBlock)
 	}
+	rangeEndPos = r.rangeEnd()
 	if curPos != rangeEndPos {
 		zap.S().Errorf("file:%s/%s, taskNo:%d, remote range (%d) is different from sent size (%d).", r.OrgRepo, r.FileName, r.TaskNo, rangeEndPos-rangeStartPos, curPos-rangeStartPos)
 		return
@@ -186,6 +208,38 @@ func (r *RemoteFileTask) DoTask() {
 	zap.S().Infof("end remote dotask:%s/%s, taskNo:%d, size:%d, domain:%s, startPos:%d, endPos:%d", r.OrgRepo, r.FileName, r.TaskNo, r.TaskSize, r.Domain, rangeStartPos, rangeEndPos)
 }
 
+// persistBlock 持久化收到的一个块的数据，整块时写入缓存并唤醒等待者，区间只覆盖块的一部分时按子页缓存。
+// 返回是否新写入了整块。
+func (r *RemoteFileTask) persistBlock(blockIndex, startPos int64, block []byte) bool {
+	if int64(len(block)) != r.DingFile.GetBlockSize() {
+		r.writePages(startPos, block)
+		return false
+	}
+	defer r.Claims.Finish(blockIndex) // 块已写入或已由其他任务写入，唤醒等待者
+	hasBlockBool, err := r.DingFile.HasBlock(blockIndex)
+	if err != nil {
+		zap.S().Errorf("HasBlock err.%v", err)
+		return false
+	}
+	if hasBlockBool {
+		return false
+	}
+	if err = r.DingFile.WriteBlock(blockIndex, block); err != nil {
+		zap.S().Errorf("writeBlock err.%v", err)
+	}
+	return true
+}
+
+// writePages 区间只覆盖块的一部分时按子页缓存，小范围或未对齐的读取（如parquet尾部、safetensors头部）下次可直接命中缓存。
+func (r *RemoteFileTask) writePages(startPos int64, rawBlock []byte) {
+	if len(rawBlock) == 0 {
+		return
+	}
+	if err := r.DingFile.WritePages(startPos, rawBlock); err != nil {
+		zap.S().Errorf("writePages err. file:%s/%s, startPos:%d, %v", r.OrgRepo, r.FileName, startPos, err)
+	}
+}
+
 func (r *RemoteFileTask) constructFileProcessParam(startPos, endPos int64, status int32) *data.FileProcessParam {
 	org, repo := util.SplitOrgRepo(r.OrgRepo)
 	return &data.FileProcessParam{
@@ -212,6 +266,7 @@ func (r *RemoteFileTask) OutResult() {
 			select {
 			case r.ResponseChan <- chunk:
 			case <-r.Context.Done():
+				chunk.Release()
 				zap.S().Debugf("end remote outResult Context.Done() %s/%s", r.OrgRepo, r.FileName)
 				return
 			}
@@ -222,32 +277,47 @@ func (r *RemoteFileTask) OutResult() {
 	}
 }
 
-func (r *RemoteFileTask) GetResponseChan() chan []byte {
-	return r.ResponseChan
-}
-
-func (r *RemoteFileTask) getFileRangeFromRemote(startPos, endPos int64, contentChan chan<- []byte) error {
+func (r *RemoteFileTask) getFileRangeFromRemote(startPos, endPos int64, contentChan chan<- util.Chunk) error {
 	var (
-		rawData         []byte
-		chunkByteLen    = 0
-		attempts        = 2
-		contentEncoding = ""
-		err             error
-		n               int
-		headers         = make(map[string]string)
+		shared       *util.SharedBuffer // 当前块的缓冲区，上游数据按块内偏移读入，chunk不会跨块
+		buf          []byte             // 当前块缓冲区中尚未读入的部分
+		chunkByteLen = 0                // 已接收的解码后字节数
+		attempts     = 2
+		err          error
+		n            int
+		reachEnd     bool
+		preempted    bool
+		headers      = make(map[string]string)
+		watchdog     = newStallWatchdog(config.SysConfig.GetStallTimeout())
 	)
+	defer watchdog.close()
+	defer func() {
+		shared.Release()
+	}()
+	slot, err := r.acquireSlot()
+	if err != nil { // 排队时任务已取消
+		return fmt.Errorf("acquire upstream slot err.%v", err)
+	}
+	defer func() {
+		slot.Release()
+	}()
 	if r.Authorization != "" {
 		headers["authorization"] = r.Authorization
 	}
 	if startPos > 0 || endPos < r.DingFile.GetFileSize() {
-		headers["range"] = fmt.Sprintf("bytes=%d-%d", startPos, endPos-1)
+		setRangeHeader(headers, startPos, endPos)
 	}
 	for i := 0; i < attempts; {
+		ctx := watchdog.attempt(r.Context)
 		if _, err = util.RetryRequest(func() (*common.Response, error) {
-			err = util.GetStream(r.Domain, r.Uri, headers, func(resp *http.Response) error {
-				contentEncoding = resp.Header.Get("content-encoding")
+			watchdog.wait()
+			err = r.getStream(ctx, headers, func(resp *http.Response) error {
 				code := resp.StatusCode
 				if code != http.StatusOK && code != http.StatusPartialContent {
+					if code == http.StatusTooManyRequests || code == http.StatusServiceUnavailable {
+						watchdog.progress() // 限流等待不计入停滞
+						return r.throttled(resp)
+					}
 					if code == http.StatusNotFound {
 						zap.S().Errorf("The resource was not found. %s", r.OrgRepo)
 					} else if code == http.StatusUnauthorized || code == http.StatusForbidden {
@@ -255,46 +325,77 @@ func (r *RemoteFileTask) getFileRangeFromRemote(startPos, endPos int64, contentC
 					} else {
 						zap.S().Errorf("Failed resource request.(%d) %s", code, r.OrgRepo)
 					}
-					return nil
+					return util.NewStatusError(resp) // 5xx重试，其余4xx不重试
 				}
+				if err = r.checkRangeResponse(resp, headers["range"]); err != nil {
+					return err
+				}
+				var body io.ReadCloser
+				if body, err = r.decodeBody(resp, startPos+int64(chunkByteLen)); err != nil {
+					return err
+				}
+				defer body.Close()
 				for {
 					select {
 					case <-r.Context.Done():
 						return nil
 					default:
-						chunk := make([]byte, config.SysConfig.Download.RespChunkSize)
-						n, err = resp.Body.Read(chunk)
+						if len(buf) == 0 {
+							pos := startPos + int64(chunkByteLen)
+							shared.Release()
+							shared = util.NewSharedBuffer(int(r.DingFile.GetBlockSize()))
+							buf = shared.Bytes()[pos%r.DingFile.GetBlockSize():]
+						}
+						watchdog.wait()
+						n, err = body.Read(buf[:min(len(buf), int(config.SysConfig.Download.RespChunkSize))])
 						if n > 0 {
-							if contentEncoding != "" { // 数据有编码，先收集，后面解码
-								rawData = append(rawData, chunk[:n]...)
-							} else {
+							watchdog.progress()
+							n, reachEnd = r.accept(startPos+int64(chunkByteLen), n)
+							if n > 0 {
+								chunk := shared.Share(buf[:n]) // 发送后由接收方持有一个引用
 								select {
-								case contentChan <- chunk[:n]:
+								case contentChan <- chunk:
 								case <-r.Context.Done():
+									chunk.Release()
 									return fmt.Errorf("form remote ctx done")
 								}
+								buf = buf[n:]
+							}
+							chunkByteLen += n
+							if reachEnd { // 已到达分段结束位置（可能已被拆分），剩余数据由其他分段下载
+								return nil
+							}
+							if slot.Preempted() { // 让出连接，重新排队后从当前位置继续
+								preempted = true
+								setRangeHeader(headers, startPos+int64(chunkByteLen), r.rangeEnd())
+								return nil
 							}
-							chunkByteLen += n // 原始数量
 						}
 						if err != nil {
+							if r.Context.Err() != nil { // 等待令牌时任务已取消
+								return nil
+							}
 							if err == io.EOF {
-								if int64(chunkByteLen) < (endPos - startPos) {
+								if int64(chunkByteLen) < (r.rangeEnd() - startPos) {
 									// 数据不完整，将EOF视为读取错误以触发重试/断点续传
-									zap.S().Errorf("file:%s/%s, taskNo:%d, premature EOF: expected %d bytes, got %d", r.OrgRepo, r.FileName, r.TaskNo, endPos-startPos, chunkByteLen)
-									headers["range"] = fmt.Sprintf("bytes=%d-%d", startPos+int64(chunkByteLen), endPos-1)
-									return fmt.Errorf("premature EOF: expected %d bytes, got %d", endPos-startPos, chunkByteLen)
+									zap.S().Errorf("file:%s/%s, taskNo:%d, premature EOF: expected %d bytes, got %d", r.OrgRepo, r.FileName, r.TaskNo, r.rangeEnd()-startPos, chunkByteLen)
+									setRangeHeader(headers, startPos+int64(chunkByteLen), r.rangeEnd())
+									return fmt.Errorf("premature EOF: expected %d bytes, got %d", r.rangeEnd()-startPos, chunkByteLen)
 								}
 								return nil
 							}
 							zap.S().Errorf("file:%s/%s, taskNo:%d, statusCode:%d, chunkByteLen:%d, %v", r.OrgRepo, r.FileName, r.TaskNo, resp.StatusCode, chunkByteLen, err)
 							if chunkByteLen > 0 {
-								headers["range"] = fmt.Sprintf("bytes=%d-%d", startPos+int64(chunkByteLen), endPos-1)
+								setRangeHeader(headers, startPos+int64(chunkByteLen), r.rangeEnd())
 							}
 							return err
 						}
 					}
 				}
 			})
+			if err != nil && ctx.Err() != nil && r.Context.Err() == nil { // 看门狗取消了停滞的请求，不在同一上游上重试
+				err = r.stalled(startPos+int64(chunkByteLen), err)
+			}
 			return nil, err
 		}); err != nil {
 			var t myerr.Error
@@ -307,12 +408,20 @@ func (r *RemoteFileTask) getFileRangeFromRemote(startPos, endPos int64, contentC
 				zap.S().Infof("request fail %s/%s req from %s to %s", r.OrgRepo, r.FileName, r.Domain, officialDomain)
 				r.Domain = officialDomain
 				if chunkByteLen > 0 {
-					headers["range"] = fmt.Sprintf("bytes=%d-%d", startPos+int64(chunkByteLen), endPos-1)
+					setRangeHeader(headers, startPos+int64(chunkByteLen), r.rangeEnd())
 				}
 				i++
+			} else if errors.Is(err, util.ErrStalled) && r.Source == nil { // 指定了上游时由调用方改用其他上游
+				r.hedge()
+				i++
 			} else {
 				break
 			}
+		} else if preempted {
+			preempted = false
+			if slot, err = slot.Yield(r.Context); err != nil {
+				return fmt.Errorf("acquire upstream slot err.%v", err)
+			}
 		} else {
 			break // 访问无异常直接退出
 		}
@@ -320,19 +429,211 @@ func (r *RemoteFileTask) getFileRangeFromRemote(startPos, endPos int64, contentC
 	if err != nil {
 		return fmt.Errorf("GetStream err.%v", err)
 	}
-	if contentEncoding != "" {
-		// 这里需要实现解压缩逻辑
-		finalData, err := util.DecompressData(rawData, contentEncoding)
-		if err != nil {
-			zap.S().Errorf("DecompressData err.%v", err)
-			return err
-		}
-		contentChan <- finalData      // 返回解码后的数据流
-		chunkByteLen = len(finalData) // 将解码后的长度复制为原始的chunkByteLen
-	}
-	expectedLength := endPos - startPos
+	expectedLength := r.rangeEnd() - startPos
 	if expectedLength != int64(chunkByteLen) {
 		return fmt.Errorf("file:%s/%s, taskNo:%d,The block is incomplete. Expected-%d. Accepted-%d", r.OrgRepo, r.FileName, r.TaskNo, expectedLength, chunkByteLen)
 	}
 	return nil
 }
+
+// setRangeHeader 请求[startPos,endPos)区间。编码后的字节偏移与文件偏移无法对应，区间请求只接受原始内容。
+func setRangeHeader(headers map[string]string, startPos, endPos int64) {
+	headers["range"] = fmt.Sprintf("bytes=%d-%d", startPos, endPos-1)
+	headers["accept-encoding"] = "identity"
+}
+
+// acquireSlot 按优先级获取回源连接，集群内部节点之间的传输不参与调度。
+func (r *RemoteFileTask) acquireSlot() (*Slot, error) {
+	if r.Source == nil && util.IsInnerDomain(r.Domain) {
+		return nil, nil
+	}
+	return GetUpstreamScheduler().Acquire(r.Context, r.Priority)
+}
+
+// waitBandwidth 按上游与仓库带宽限制获取令牌，集群内部节点之间的传输不限速。
+func (r *RemoteFileTask) waitBandwidth(n int) error {
+	if r.Source == nil && util.IsInnerDomain(r.Domain) {
+		return nil
+	}
+	return util.WaitUpstream(r.Context, r.OrgRepo, n)
+}
+
+// decodeBody 返回从pos开始的原始内容。带宽按线上传输的字节计算；有编码时边读边解码，
+// 编码的响应只能是完整文件，需跳过pos之前的内容，编码的部分内容无法还原偏移，视为错误。
+func (r *RemoteFileTask) decodeBody(resp *http.Response, pos int64) (io.ReadCloser, error) {
+	var body io.Reader = &shapedReader{task: r, body: resp.Body}
+	contentEncoding := resp.Header.Get("content-encoding")
+	if contentEncoding == "" {
+		return io.NopCloser(body), nil
+	}
+	if resp.StatusCode == http.StatusPartialContent {
+		return nil, fmt.Errorf("upstream %s returned encoded partial content, encoding %s", r.Domain, contentEncoding)
+	}
+	decoder, err := util.NewDecompressReader(body, contentEncoding)
+	if err != nil {
+		return nil, err
+	}
+	if pos > 0 {
+		if _, err = io.CopyN(io.Discard, decoder, pos); err != nil {
+			decoder.Close()
+			return nil, fmt.Errorf("skip decoded content to %d err.%v", pos, err)
+		}
+	}
+	return decoder, nil
+}
+
+// shapedReader 读取上游响应时按带宽限制等待
+type shapedReader struct {
+	task *RemoteFileTask
+	body io.Reader
+}
+
+func (s *shapedReader) Read(p []byte) (int, error) {
+	n, err := s.body.Read(p)
+	if n > 0 {
+		if werr := s.task.waitBandwidth(n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+func (r *RemoteFileTask) getStream(ctx context.Context, headers map[string]string, f func(resp *http.Response) error) error {
+	if r.XetHash != "" && (r.Source != nil || !util.IsInnerDomain(r.Domain)) { // 集群内节点按普通文件提供数据
+		return r.getXetStream(ctx, headers, f)
+	}
+	if r.Source != nil {
+		return util.GetUpstreamStream(ctx, r.Source.Domain, r.Source.Proxy, r.Uri, headers, f)
+	}
+	return util.GetStream(ctx, r.Domain, r.Uri, headers, f)
+}
+
+// stalled 当前上游停滞，请求已被取消且不会再输出数据，剩余区间从pos开始重新请求。
+func (r *RemoteFileTask) stalled(pos int64, err error) error {
+	zap.S().Warnf("upstream stalled. %s/%s, taskNo:%d, domain:%s, pos:%d, %v", r.OrgRepo, r.FileName, r.TaskNo, r.Domain, pos, err)
+	if config.SysConfig.EnableMetric() {
+		prom.UpstreamStallCnt.WithLabelValues(r.Domain).Inc()
+	}
+	return fmt.Errorf("%w at %d, domain %s", util.ErrStalled, pos, r.Domain)
+}
+
+// hedge 剩余区间改用直连的备用上游请求，已在使用备用上游或未配置时在同一上游上重新建立连接。
+func (r *RemoteFileTask) hedge() {
+	if r.Source != nil {
+		return
+	}
+	if backup := config.SysConfig.GetBackupUpstream(); backup != nil {
+		zap.S().Infof("request stalled %s/%s req from %s to %s", r.OrgRepo, r.FileName, r.Domain, backup.Domain)
+		r.Source = backup
+		r.Domain = backup.Domain
+	}
+}
+
+// checkRangeResponse 校验上游按请求的区间返回了同一文件的数据，避免异常的镜像返回整个文件或其他版本的内容。
+// 集群内部节点不做校验。
+func (r *RemoteFileTask) checkRangeResponse(resp *http.Response, rangeHeader string) error {
+	if rangeHeader == "" || util.IsInnerDomain(r.Domain) {
+		return nil
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("upstream %s ignored range %s, status %d", r.Domain, rangeHeader, resp.StatusCode)
+	}
+	var reqStart, start, end, total int64
+	if _, err := fmt.Sscanf(rangeHeader, "bytes=%d-", &reqStart); err != nil {
+		return fmt.Errorf("parse range %s err.%v", rangeHeader, err)
+	}
+	contentRange := resp.Header.Get("Content-Range")
+	if _, err := fmt.Sscanf(contentRange, "bytes %d-%d/%d", &start, &end, &total); err != nil {
+		return fmt.Errorf("upstream %s content-range %q err.%v", r.Domain, contentRange, err)
+	}
+	if start != reqStart || total != r.DingFile.GetFileSize() {
+		return fmt.Errorf("upstream %s content-range %s mismatch, range %s, file size %d", r.Domain, contentRange, rangeHeader, r.DingFile.GetFileSize())
+	}
+	return nil
+}
+
+// throttled 上游返回429/503时，按Retry-After或指数退避等待后重试，并通知自适应分段减少连接数。
+func (r *RemoteFileTask) throttled(resp *http.Response) error {
+	wait := util.ParseRetryAfter(resp.Header.Get("Retry-After"))
+	if wait <= 0 {
+		wait = time.Second << min(r.throttles, 5)
+	}
+	wait = min(wait, maxThrottleWait)
+	r.throttles++
+	zap.S().Warnf("upstream throttled.(%d) %s/%s, taskNo:%d, wait %s", resp.StatusCode, r.OrgRepo, r.FileName, r.TaskNo, wait)
+	if r.OnThrottle != nil {
+		r.OnThrottle(wait)
+	}
+	select {
+	case <-time.After(wait):
+	case <-r.Context.Done():
+	}
+	return &util.StatusError{StatusCode: resp.StatusCode} // 已按Retry-After等待，重试时只需退避
+}
+
+func (r *RemoteFileTask) rangeEnd() int64 {
+	r.splitMu.Lock()
+	defer r.splitMu.Unlock()
+	return r.RangeEndPos
+}
+
+// accept 登记从pos开始收到的n字节，返回不超过分段结束位置的有效长度，以及是否已到达结束位置。
+func (r *RemoteFileTask) accept(pos int64, n int) (int, bool) {
+	r.splitMu.Lock()
+	defer r.splitMu.Unlock()
+	allowed := max(r.RangeEndPos-pos, 0)
+	reachEnd := int64(n) >= allowed
+	if reachEnd {
+		n = int(allowed)
+	}
+	r.curPos = pos + int64(n)
+	return n, reachEnd
+}
+
+// unfinished 返回尚未下载的区间
+func (r *RemoteFileTask) unfinished() (int64, int64) {
+	r.splitMu.Lock()
+	defer r.splitMu.Unlock()
+	return r.curPos, r.RangeEndPos
+}
+
+// received 已接收的字节数
+func (r *RemoteFileTask) received() int64 {
+	r.splitMu.Lock()
+	defer r.splitMu.Unlock()
+	return r.curPos - r.RangeStartPos
+}
+
+func (r *RemoteFileTask) remaining() int64 {
+	r.splitMu.Lock()
+	defer r.splitMu.Unlock()
+	return r.RangeEndPos - r.curPos
+}
+
+// trySplit 将未下载部分从块边界处一分为二，分段缩短到拆分点，返回拆出的后半部分区间。
+// 剩余数据过少，或按当前速度很快就能下载完时不拆分。
+func (r *RemoteFileTask) trySplit(minSize int64, minTime time.Duration) (int64, int64, bool) {
+	r.splitMu.Lock()
+	defer r.splitMu.Unlock()
+	if r.startTime.IsZero() {
+		return 0, 0, false
+	}
+	remaining := r.RangeEndPos - r.curPos
+	if remaining < minSize {
+		return 0, 0, false
+	}
+	if received, elapsed := r.curPos-r.RangeStartPos, time.Since(r.startTime); received > 0 && elapsed > 0 {
+		rate := float64(received) / elapsed.Seconds()
+		if time.Duration(float64(remaining)/rate*float64(time.Second)) < minTime {
+			return 0, 0, false
+		}
+	}
+	blockSize := r.DingFile.GetBlockSize()
+	split := (r.curPos + remaining/2 + blockSize - 1) / blockSize * blockSize
+	if split <= r.curPos || split >= r.RangeEndPos {
+		return 0, 0, false
+	}
+	end := r.RangeEndPos
+	r.RangeEndPos = split
+	return split, end, true
+}
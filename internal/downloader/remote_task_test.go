@@ -0,0 +1,97 @@
+//  Copyright (c) 2025 dingodb.com, Inc. All Rights Reserved
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http:www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"dingospeed/pkg/config"
+	"dingospeed/pkg/util"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestEncodedRemoteResponse(t *testing.T) {
+	content := setupAdaptiveTest()
+	encoder, _ := zstd.NewWriter(nil)
+	encoded := encoder.EncodeAll(content, nil)
+	encoder.Close()
+	// 上游忽略区间，返回编码后的完整文件，应边解码边跳到各分段的起始位置
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Accept-Encoding") != "identity" {
+			t.Errorf("ranged request should ask for identity encoding")
+		}
+		w.Header().Set("Content-Encoding", "zstd")
+		w.WriteHeader(http.StatusOK)
+		w.Write(encoded)
+	}))
+	defer server.Close()
+	runAdaptiveTask(t, content, nil, server.URL)
+}
+
+// BenchmarkRemoteDoTask 回源下载、写入缓存并输出给响应方的完整流程
+func BenchmarkRemoteDoTask(b *testing.B) {
+	content := setupBenchmark(b)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+	dir := b.TempDir()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dingFile, err := NewDingCache(filepath.Join(dir, fmt.Sprintf("cachefile%d", i)), config.SysConfig.Download.BlockSize)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err = dingFile.Resize(int64(len(content))); err != nil {
+			b.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		r := NewRemoteFileTask(0, 0, int64(len(content)))
+		r.Context = ctx
+		r.Cancel = cancel
+		r.DingFile = dingFile
+		r.Source = &config.Upstream{Domain: server.URL}
+		r.Queue = make(chan util.Chunk, 100)
+		r.ResponseChan = make(chan util.Chunk, 100)
+		finished := make(chan struct{})
+		go func() {
+			defer close(finished)
+			r.DoTask()
+		}()
+		go func() {
+			defer close(r.ResponseChan)
+			r.OutResult()
+		}()
+		var received int
+		for chunk := range r.ResponseChan {
+			received += len(chunk.Data)
+			chunk.Release()
+		}
+		<-finished
+		if received != len(content) {
+			b.Fatalf("received %d bytes, expected %d", received, len(content))
+		}
+		cancel()
+		dingFile.Close()
+	}
+}
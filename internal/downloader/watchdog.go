@@ -0,0 +1,104 @@
+//  Copyright (c) 2025 dingodb.com, Inc. All Rights Reserved
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http:www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package downloader
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// stallWatchdog 分段等待上游数据超过timeout时取消当前请求，由分段改用其他上游请求剩余区间。
+// 只计算等待上游的时间，同一上游上的多次重试累计计算；等待客户端读取和上游要求的限流等待不计入。
+type stallWatchdog struct {
+	timeout time.Duration
+	since   atomic.Int64 // 开始等待上游的时间，0表示未在等待
+	mu      sync.Mutex
+	cancel  context.CancelFunc // 取消当前请求
+	stop    chan struct{}
+}
+
+// newStallWatchdog timeout不大于0时返回nil，nil可直接使用，此时不做检测。
+func newStallWatchdog(timeout time.Duration) *stallWatchdog {
+	if timeout <= 0 {
+		return nil
+	}
+	w := &stallWatchdog{timeout: timeout, stop: make(chan struct{})}
+	go w.run()
+	return w
+}
+
+func (w *stallWatchdog) run() {
+	ticker := time.NewTicker(max(w.timeout/4, 10*time.Millisecond))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			since := w.since.Load()
+			if since == 0 || time.Since(time.Unix(0, since)) < w.timeout || !w.since.CompareAndSwap(since, 0) {
+				continue
+			}
+			w.mu.Lock()
+			if w.cancel != nil {
+				w.cancel()
+			}
+			w.mu.Unlock()
+		}
+	}
+}
+
+// attempt 返回一次请求使用的ctx，停滞时被取消，parent未取消而ctx已取消即表示停滞。
+func (w *stallWatchdog) attempt(parent context.Context) context.Context {
+	if w == nil {
+		return parent
+	}
+	ctx, cancel := context.WithCancel(parent)
+	w.mu.Lock()
+	if w.cancel != nil {
+		w.cancel()
+	}
+	w.cancel = cancel
+	w.mu.Unlock()
+	return ctx
+}
+
+// wait 开始等待上游数据，已在等待时保留原来的起始时间
+func (w *stallWatchdog) wait() {
+	if w != nil {
+		w.since.CompareAndSwap(0, time.Now().UnixNano())
+	}
+}
+
+// progress 收到数据或暂停等待上游
+func (w *stallWatchdog) progress() {
+	if w != nil {
+		w.since.Store(0)
+	}
+}
+
+func (w *stallWatchdog) close() {
+	if w == nil {
+		return
+	}
+	close(w.stop)
+	w.mu.Lock()
+	if w.cancel != nil {
+		w.cancel()
+	}
+	w.mu.Unlock()
+}
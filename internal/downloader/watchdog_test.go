@@ -0,0 +1,58 @@
+//  Copyright (c) 2025 dingodb.com, Inc. All Rights Reserved
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http:www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package downloader
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"dingospeed/pkg/config"
+)
+
+func TestStallWatchdog(t *testing.T) {
+	content := setupAdaptiveTest()
+	config.SysConfig.Download.AdaptiveRange.InitialRanges = 1
+	config.SysConfig.Download.Timeout = config.Timeout{IdleRead: -1, Stall: 200}
+	var stalled atomic.Bool
+	var resumed atomic.Int64
+	serve := rangeHandler(content, func(int64) time.Duration { return 0 })
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if stalled.CompareAndSwap(false, true) { // 第一个请求发送部分数据后不再响应，连接保持打开
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(content)-1, len(content)))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(content[:1536])
+			w.(http.Flusher).Flush()
+			<-req.Context().Done()
+			return
+		}
+		var start int64
+		fmt.Sscanf(req.Header.Get("Range"), "bytes=%d-", &start)
+		resumed.Store(start)
+		serve(w, req)
+	}))
+	defer server.Close()
+	start := time.Now()
+	runAdaptiveTask(t, content, []config.Upstream{{Domain: server.URL}}, "")
+	if resumed.Load() != 1536 {
+		t.Fatalf("remaining range should be requested again from 1536, got %d", resumed.Load())
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("stalled request should be cancelled, elapsed:%v", elapsed)
+	}
+}
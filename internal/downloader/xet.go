@@ -0,0 +1,117 @@
+//  Copyright (c) 2025 dingodb.com, Inc. All Rights Reserved
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http:www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"dingospeed/pkg/common"
+	"dingospeed/pkg/consts"
+	"dingospeed/pkg/util"
+
+	"go.uber.org/zap"
+)
+
+// xetLocationTTL 预签名地址的复用时间，cas-bridge的签名有效期更长，提前重新解析
+const xetLocationTTL = 10 * time.Minute
+
+type xetLocation struct {
+	url    string
+	expire time.Time
+}
+
+// xetLocations Xet哈希到cas-bridge预签名地址，同一文件的各分段复用
+var xetLocations sync.Map
+
+// resolveXetLocation 向上游请求resolve地址但不跟随重定向，返回Xet存储的预签名下载地址。
+// 上游未返回重定向时返回空，按普通文件下载；refresh为true时忽略已解析的地址。
+func resolveXetLocation(domain string, proxy bool, uri, authorization, xetHash string, refresh bool) (string, error) {
+	if v, ok := xetLocations.Load(xetHash); ok && !refresh && time.Now().Before(v.(*xetLocation).expire) {
+		return v.(*xetLocation).url, nil
+	}
+	headers := map[string]string{}
+	if authorization != "" {
+		headers["authorization"] = authorization
+	}
+	resp, err := util.RetryRequest(func() (*common.Response, error) {
+		return util.HeadUpstream(domain, proxy, uri, headers)
+	})
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return "", nil
+	}
+	location := resp.GetKey(consts.HUGGINGFACE_LOCATION)
+	if resp.StatusCode < http.StatusMultipleChoices || resp.StatusCode > http.StatusPermanentRedirect || location == "" {
+		return "", &util.StatusError{StatusCode: resp.StatusCode}
+	}
+	if hash := resp.GetKey(consts.HUGGINGFACE_HEADER_X_XET_HASH); hash != "" && hash != xetHash {
+		zap.S().Warnf("xet hash changed. %s, expected:%s, actual:%s", uri, xetHash, hash)
+	}
+	base, err := url.Parse(domain + uri)
+	if err != nil {
+		return "", err
+	}
+	ref, err := url.Parse(location)
+	if err != nil {
+		return "", fmt.Errorf("invalid xet location %s.%v", location, err)
+	}
+	location = base.ResolveReference(ref).String()
+	xetLocations.Store(xetHash, &xetLocation{url: location, expire: time.Now().Add(xetLocationTTL)})
+	return location, nil
+}
+
+// getXetStream Xet存储的文件先解析预签名地址，再带区间直接请求cas-bridge，数据与普通文件一样写入块缓存。
+// 预签名地址不携带用户token，签名过期（401/403）时重新解析一次。
+func (r *RemoteFileTask) getXetStream(ctx context.Context, headers map[string]string, f func(resp *http.Response) error) error {
+	domain, proxy := util.DefaultUpstream()
+	if r.Source != nil {
+		domain, proxy = r.Source.Domain, r.Source.Proxy
+	}
+	xetHeaders := maps.Clone(headers)
+	delete(xetHeaders, "authorization")
+	for refresh := false; ; refresh = true {
+		location, err := resolveXetLocation(domain, proxy, r.Uri, r.Authorization, r.XetHash, refresh)
+		if err != nil {
+			return err
+		}
+		if location == "" {
+			return util.GetUpstreamStream(ctx, domain, proxy, r.Uri, headers, f)
+		}
+		target, err := url.Parse(location)
+		if err != nil {
+			return err
+		}
+		expired := false
+		err = util.GetUpstreamStream(ctx, fmt.Sprintf("%s://%s", target.Scheme, target.Host), proxy, target.RequestURI(), xetHeaders, func(resp *http.Response) error {
+			if !refresh && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+				expired = true
+				return nil
+			}
+			return f(resp)
+		})
+		if !expired {
+			return err
+		}
+		zap.S().Warnf("xet location expired, resolve again. %s/%s", r.OrgRepo, r.FileName)
+	}
+}
@@ -0,0 +1,118 @@
+//  Copyright (c) 2025 dingodb.com, Inc. All Rights Reserved
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http:www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"dingospeed/pkg/config"
+	"dingospeed/pkg/util"
+)
+
+func TestXetRemoteTask(t *testing.T) {
+	content := setupAdaptiveTest()
+	xetHash := "0123456789abcdef"
+	resolveUri := "/org/repo/resolve/main/model.bin"
+	xetLocations.Delete(xetHash)
+	var resolves atomic.Int32
+	// 上游对resolve返回Xet重定向，第一次签发的地址已过期
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.URL.Path == resolveUri && req.Method == http.MethodHead:
+			if req.Header.Get("Authorization") != "Bearer token" {
+				t.Errorf("resolve should carry the user token")
+			}
+			n := resolves.Add(1)
+			w.Header().Set("Location", fmt.Sprintf("/cas/%s?sig=%d", xetHash, n))
+			w.Header().Set("X-Xet-Hash", xetHash)
+			w.Header().Set("X-Linked-Size", util.Itoa(int64(len(content))))
+			w.WriteHeader(http.StatusFound)
+		case strings.HasPrefix(req.URL.Path, "/cas/"):
+			if req.Header.Get("Authorization") != "" {
+				t.Errorf("user token should not be sent to cas-bridge")
+			}
+			if req.URL.Query().Get("sig") == "1" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(content))
+		default:
+			t.Errorf("unexpected request %s %s", req.Method, req.URL)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	blockSize := config.SysConfig.Download.BlockSize
+	dingFile := newTestFile(t, filepath.Join(t.TempDir(), "cachefile"), blockSize, int64(len(content)))
+	run := func(startPos, endPos int64) []byte {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		r := NewRemoteFileTask(0, startPos, endPos)
+		r.Context = ctx
+		r.Cancel = cancel
+		r.DingFile = dingFile
+		r.Source = &config.Upstream{Domain: server.URL}
+		r.Uri = resolveUri
+		r.Authorization = "Bearer token"
+		r.XetHash = xetHash
+		r.Queue = make(chan util.Chunk, 1024)
+		r.ResponseChan = make(chan util.Chunk, 1024)
+		finished := make(chan struct{})
+		go func() {
+			defer close(finished)
+			r.DoTask()
+		}()
+		go func() {
+			defer close(r.ResponseChan)
+			r.OutResult()
+		}()
+		var got []byte
+		for chunk := range r.ResponseChan {
+			got = append(got, chunk.Data...)
+			chunk.Release()
+		}
+		<-finished
+		return got
+	}
+	half := blockSize * 8
+	if got := run(0, half); !bytes.Equal(got, content[:half]) {
+		t.Fatalf("first half mismatch, got %d bytes", len(got))
+	}
+	if resolves.Load() != 2 {
+		t.Fatalf("expired location should be resolved again, resolves:%d", resolves.Load())
+	}
+	if got := run(half, int64(len(content))); !bytes.Equal(got, content[half:]) {
+		t.Fatalf("second half mismatch, got %d bytes", len(got))
+	}
+	if resolves.Load() != 2 {
+		t.Fatalf("resolved location should be reused, resolves:%d", resolves.Load())
+	}
+	// 数据已写入块缓存，离线时可直接提供
+	for i := int64(0); i < dingFile.getBlockNumber(); i++ {
+		if exist, _ := dingFile.HasBlock(i); !exist {
+			t.Fatalf("block %d should be cached", i)
+		}
+	}
+}
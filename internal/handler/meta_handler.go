@@ -17,8 +17,10 @@ package handler
 import (
 	"net/http"
 	"strings"
+	"time"
 
 	"dingospeed/internal/service"
+	"dingospeed/pkg/common"
 	"dingospeed/pkg/consts"
 	myerr "dingospeed/pkg/error"
 	"dingospeed/pkg/util"
@@ -62,13 +64,24 @@ func (handler *MetaHandler) GetMetadataHandler(c echo.Context) error {
 		return util.ErrorProxyError(c)
 	}
 	if cacheContent != nil {
+		if cacheContent.Headers == nil {
+			cacheContent.Headers = make(map[string]string)
+		}
+		if cacheContent.Headers["content-type"] == "" {
+			cacheContent.Headers["content-type"] = echo.MIMEApplicationJSONCharsetUTF8
+		}
+		etag, lastModified := metadataValidators(cacheContent, method)
+		util.SetValidators(cacheContent.Headers, etag, lastModified)
+		if util.CheckNotModified(c.Request(), etag, lastModified) {
+			return util.ResponseNotModified(c, cacheContent.Headers)
+		}
 		if method == consts.RequestTypeHead {
 			return util.ResponseHeaders(c, http.StatusOK, cacheContent.Headers)
 		}
 		var bodyStreamChan = make(chan []byte, consts.RespChanSize)
 		bodyStreamChan <- cacheContent.OriginContent
 		close(bodyStreamChan)
-		err = util.ResponseStream(c, orgRepo, cacheContent.Headers, bodyStreamChan)
+		err = util.ResponseStream(c, orgRepo, cacheContent.Headers, bodyStreamChan, int64(len(cacheContent.OriginContent)))
 		if err != nil {
 			return err
 		}
@@ -76,6 +89,19 @@ func (handler *MetaHandler) GetMetadataHandler(c echo.Context) error {
 	return nil
 }
 
+// metadataValidators 优先使用上游返回的etag与Last-Modified；没有时etag按内容生成，Last-Modified取缓存文件的写入时间。
+func metadataValidators(cacheContent *common.CacheContent, method string) (string, time.Time) {
+	etag := cacheContent.Headers["etag"]
+	if etag == "" && method == consts.RequestTypeGet {
+		etag = util.ContentEtag(cacheContent.OriginContent)
+	}
+	lastModified := cacheContent.ModTime
+	if t, err := http.ParseTime(cacheContent.Headers["last-modified"]); err == nil {
+		lastModified = t
+	}
+	return etag, lastModified
+}
+
 func (handler *MetaHandler) WhoamiV2Handler(c echo.Context) error {
 	return handler.metaService.WhoamiV2(c)
 }
@@ -1,7 +1,9 @@
 package handler
 
 import (
+	"dingospeed/internal/downloader"
 	"dingospeed/internal/model"
+	"dingospeed/internal/model/query"
 	"dingospeed/internal/service"
 	"dingospeed/pkg/app"
 	"dingospeed/pkg/config"
@@ -9,6 +11,7 @@ import (
 
 	"github.com/bytedance/sonic"
 	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
 )
 
 type SysHandler struct {
@@ -36,5 +39,56 @@ func (s *SysHandler) Info(c echo.Context) error {
 		return err
 	}
 	info.DynamicProxy = string(marshal)
+	if config.SysConfig.EnableCacheMigrate() {
+		info.CacheMigrate = downloader.GetMigrator().Progress()
+	}
+	if config.SysConfig.EnableBreaker() {
+		info.Breakers = util.BreakerInfos()
+	}
 	return util.ResponseData(c, info)
 }
+
+func (s *SysHandler) GetBandwidth(c echo.Context) error {
+	return util.NormalResponseData(c, config.SysConfig.GetBandwidthLimit())
+}
+
+// SetBandwidth 热更新带宽限制，立即作用于正在进行的下载
+func (s *SysHandler) SetBandwidth(c echo.Context) error {
+	req := new(query.BandwidthReq)
+	if err := c.Bind(req); err != nil {
+		return util.ErrorRequestParam(c)
+	}
+	limit := config.SysConfig.GetBandwidthLimit()
+	for _, v := range []*int{req.Rate, req.Capacity} {
+		if v != nil && *v < 0 {
+			return util.ErrorRequestParam(c)
+		}
+	}
+	for _, v := range []*int64{req.ClientRate, req.ClientCapacity, req.RepoRate, req.RepoCapacity} {
+		if v != nil && *v < 0 {
+			return util.ErrorRequestParam(c)
+		}
+	}
+	if req.Rate != nil {
+		limit.Rate = *req.Rate
+	}
+	if req.Capacity != nil {
+		limit.Capacity = *req.Capacity
+	}
+	if req.ClientRate != nil {
+		limit.ClientRate = *req.ClientRate
+	}
+	if req.ClientCapacity != nil {
+		limit.ClientCapacity = *req.ClientCapacity
+	}
+	if req.RepoRate != nil {
+		limit.RepoRate = *req.RepoRate
+	}
+	if req.RepoCapacity != nil {
+		limit.RepoCapacity = *req.RepoCapacity
+	}
+	util.SetBandwidthLimit(limit)
+	zap.S().Infof("bandwidth limit updated, rate:%d, capacity:%d, clientRate:%d, clientCapacity:%d, repoRate:%d, repoCapacity:%d",
+		limit.Rate, limit.Capacity, limit.ClientRate, limit.ClientCapacity, limit.RepoRate, limit.RepoCapacity)
+	return util.NormalResponseData(c, limit)
+}
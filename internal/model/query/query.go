@@ -34,3 +34,13 @@ type RealtimeResp struct {
 	StockSpeed   string  `json:"stockSpeed"`
 	StockProcess float32 `json:"stockProcess"`
 }
+
+// BandwidthReq 热更新带宽限制，未填写的字段保持原值，单位为字节/秒，0表示不限速
+type BandwidthReq struct {
+	Rate           *int   `json:"rate"`
+	Capacity       *int   `json:"capacity"`
+	ClientRate     *int64 `json:"clientRate"`
+	ClientCapacity *int64 `json:"clientCapacity"`
+	RepoRate       *int64 `json:"repoRate"`
+	RepoCapacity   *int64 `json:"repoCapacity"`
+}
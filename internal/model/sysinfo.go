@@ -10,6 +10,32 @@ type SystemInfo struct {
 	MemoryUsedPercent float64 `json:"-"`
 	ProxyIsAvailable  bool    `json:"proxyIsAvailable"`
 	DynamicProxy      string  `json:"dynamicProxy"`
+
+	CacheMigrate *CacheMigrateProgress `json:"cacheMigrate,omitempty"`
+	Breakers     []BreakerInfo         `json:"breakers,omitempty"`
+}
+
+// BreakerInfo 上游熔断状态
+type BreakerInfo struct {
+	Host      string `json:"host"`
+	State     string `json:"state"`
+	Failures  int    `json:"failures"`
+	OpenUntil string `json:"openUntil,omitempty"`
+	LastError string `json:"lastError,omitempty"`
+}
+
+// CacheMigrateProgress 缓存文件格式迁移进度
+type CacheMigrateProgress struct {
+	Running       bool   `json:"running"`
+	TotalFiles    int64  `json:"totalFiles"`
+	MigratedFiles int64  `json:"migratedFiles"`
+	SkippedFiles  int64  `json:"skippedFiles"`
+	FailedFiles   int64  `json:"failedFiles"`
+	TotalBytes    int64  `json:"totalBytes"`
+	CopiedBytes   int64  `json:"copiedBytes"`
+	CurrentFile   string `json:"currentFile"`
+	StartTime     int64  `json:"startTime"`
+	EndTime       int64  `json:"endTime"`
 }
 
 func (s *SystemInfo) SetMemoryUsed(collectTime int64, usedPercent float64) {
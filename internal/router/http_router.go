@@ -48,6 +48,9 @@ func NewHttpRouter(echo *echo.Echo, fileHandler *handler.FileHandler, metaHandle
 func (r *HttpRouter) initRouter() {
 	// 系统信息
 	r.echo.GET("/info", r.sysHandler.Info)
+	// 带宽限制，POST热更新
+	r.echo.GET("/api/bandwidth", r.sysHandler.GetBandwidth)
+	r.echo.POST("/api/bandwidth", r.sysHandler.SetBandwidth)
 	if config.SysConfig.EnableMetric() {
 		r.echo.GET("/metrics", echo.WrapHandler(promhttp.Handler()))
 	}
@@ -79,7 +79,7 @@ func (m *MetaService) RepoRefs(c echo.Context, repoType, org, repo string) error
 		return util.ErrorProxyError(c)
 	}
 	var cacheContent *common.CacheContent
-	if !config.SysConfig.Online() && util.FileExists(localRefsPath) {
+	if !util.UpstreamOnline() && util.FileExists(localRefsPath) {
 		cacheContent, err = m.fileDao.ReadCacheRequest(localRefsPath)
 		if err != nil {
 			zap.S().Errorf("ReadCacheRequest %s dir err.%v", localRefsPath, err)
@@ -104,7 +104,7 @@ func (m *MetaService) RepoRefs(c echo.Context, repoType, org, repo string) error
 	var bodyStreamChan = make(chan []byte, consts.RespChanSize)
 	bodyStreamChan <- cacheContent.OriginContent
 	close(bodyStreamChan)
-	return util.ResponseStream(c, orgRepo, cacheContent.Headers, bodyStreamChan)
+	return util.ResponseStream(c, orgRepo, cacheContent.Headers, bodyStreamChan, int64(len(cacheContent.OriginContent)))
 }
 
 func (m *MetaService) ForwardToNewSite(c echo.Context) error {
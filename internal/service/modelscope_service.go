@@ -1,10 +1,11 @@
 package service
 
 import (
-	"context"
 	"dingospeed/pkg/config"
 	"dingospeed/pkg/util"
+	"errors"
 	"fmt"
+	"github.com/bytedance/sonic"
 	"github.com/gofrs/flock"
 	"github.com/labstack/echo/v4"
 	"go.uber.org/zap"
@@ -15,231 +16,13 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 )
 
-type ModelscopeService struct {
-	downloadingMap sync.Map
-	mapMu          sync.Mutex
-}
+type ModelscopeService struct{}
 
 func NewModelscopeService() *ModelscopeService {
-	return &ModelscopeService{
-		downloadingMap: sync.Map{},
-		mapMu:          sync.Mutex{},
-	}
-}
-
-// CalculateBlockInfo 计算块信息：块编号、块起始偏移、块结束偏移
-func (m *ModelscopeService) CalculateBlockInfo(offset int64, chunkSize int64) (blockNum int64, blockStart int64, blockEnd int64) {
-	blockNum = offset / chunkSize
-	blockStart = blockNum * chunkSize
-	blockEnd = blockStart + chunkSize - 1
-	return
-}
-
-// IsBlockComplete 检查指定块是否完整
-func (m *ModelscopeService) IsBlockComplete(cachePath string, blockNum int64, chunkSize int64) (bool, error) {
-	fileInfo, err := os.Stat(cachePath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return false, nil
-		}
-		return false, fmt.Errorf("stat cache file failed: %w", err)
-	}
-
-	blockStart := blockNum * chunkSize
-	blockEnd := blockStart + chunkSize - 1
-	fileSize := fileInfo.Size()
-
-	if fileSize <= blockStart {
-		return false, nil // 块为空
-	}
-	if fileSize > blockEnd {
-		return true, nil // 块完整
-	}
-	return false, nil
-}
-
-// getCacheLock 获取缓存文件对应的锁文件
-func (m *ModelscopeService) getCacheLock(cachePath string) *flock.Flock {
-	lockPath := cachePath + ".lock"
-	return flock.New(lockPath)
-}
-
-func (m *ModelscopeService) openCacheFile(cachePath string, c echo.Context) (*os.File, *flock.Flock, error) {
-	lockPath := cachePath + ".lock"
-	fileLock := flock.New(lockPath)
-
-	ctx, cancel := context.WithTimeout(c.Request().Context(), 3*time.Second)
-	defer cancel()
-	locked, lockErr := fileLock.TryLockContext(ctx, time.Duration(0))
-	if lockErr != nil {
-		zap.S().Errorf("获取缓存文件锁失败: %s, err: %v", lockPath, lockErr)
-		return nil, nil, c.JSON(http.StatusInternalServerError, map[string]string{
-			"code":  "500",
-			"error": "get cache file lock failed",
-			"msg":   lockErr.Error(),
-		})
-	}
-	if !locked {
-		zap.S().Warnf("缓存文件锁超时，无法独占写入: %s", cachePath)
-		return nil, nil, c.JSON(http.StatusTooManyRequests, map[string]string{
-			"code":  "429",
-			"error": "cache file is being written by another request",
-			"msg":   "please try again later",
-		})
-	}
-
-	var cacheFile *os.File
-	var err error
-	if _, statErr := os.Stat(cachePath); os.IsNotExist(statErr) {
-		cacheFile, err = os.OpenFile(cachePath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0664)
-	} else {
-		cacheFile, err = os.OpenFile(cachePath, os.O_RDWR, 0664)
-	}
-
-	if err != nil {
-		zap.S().Errorf("打开缓存文件失败: %s, err: %v", cachePath, err)
-		_ = fileLock.Unlock()
-		return nil, nil, c.JSON(http.StatusInternalServerError, map[string]string{
-			"code":  "500",
-			"error": "open cache file failed",
-			"msg":   err.Error(),
-		})
-	}
-
-	return cacheFile, fileLock, nil
-}
-
-func (m *ModelscopeService) copyResponseToCacheAndClient(c echo.Context, resp *http.Response, cacheFile *os.File, cachePath string, totalFileSize int64) error {
-	chunkSize := config.SysConfig.Modelscope.ChunkSize
-	if chunkSize <= 0 {
-		chunkSize = 1024 * 1024 * 8
-	}
-
-	currentOffset := int64(0)
-	contentRange := resp.Header.Get("Content-Range")
-	if contentRange != "" {
-		parts := strings.Split(contentRange, " ")
-		if len(parts) >= 2 {
-			rangeParts := strings.Split(parts[1], "-")
-			if len(rangeParts) >= 1 {
-				parsedOffset, err := strconv.ParseInt(rangeParts[0], 10, 64)
-				if err == nil {
-					currentOffset = parsedOffset
-				}
-			}
-		}
-	}
-
-	buf := make([]byte, chunkSize)
-	written := int64(0)
-
-	for {
-		if c.Request().Context().Err() != nil {
-			zap.S().Warnf("客户端断开连接，停止续传: %s", cachePath)
-			if cacheFile != nil {
-				_ = cacheFile.Sync()
-				closeErr := cacheFile.Close()
-				if closeErr != nil {
-					zap.S().Errorf("关闭缓存文件失败: %s, err: %v", cachePath, closeErr)
-				}
-			}
-			return nil
-		}
-
-		currentWriteOffset := currentOffset + written
-		blockNum, _, blockEnd := m.CalculateBlockInfo(currentWriteOffset, chunkSize)
-
-		isComplete, err := m.IsBlockComplete(cachePath, blockNum, chunkSize)
-		if err != nil {
-			zap.S().Errorf("检查块%d完整性失败: %v", blockNum, err)
-			return c.JSON(http.StatusInternalServerError, map[string]string{
-				"code":  "500",
-				"error": "check block complete failed",
-				"msg":   err.Error(),
-			})
-		}
-
-		if isComplete {
-			skipBytes := blockEnd - currentWriteOffset + 1
-			written += skipBytes
-			continue
-		}
-
-		readSize := blockEnd - currentWriteOffset + 1
-		if readSize > int64(len(buf)) {
-			readSize = int64(len(buf))
-		}
-
-		n, err := resp.Body.Read(buf[:readSize])
-		if n > 0 {
-			if _, seekErr := cacheFile.Seek(currentWriteOffset, io.SeekStart); seekErr != nil {
-				zap.S().Errorf("定位缓存文件到偏移%d失败: %v", currentWriteOffset, seekErr)
-				return c.JSON(http.StatusInternalServerError, map[string]string{
-					"code":  "500",
-					"error": "seek cache file failed",
-					"msg":   seekErr.Error(),
-				})
-			}
-
-			if _, writeErr := cacheFile.Write(buf[:n]); writeErr != nil {
-				zap.S().Errorf("写入缓存块%d失败: %s, err: %v", blockNum, cachePath, writeErr)
-				return c.JSON(http.StatusInternalServerError, map[string]string{
-					"code":  "500",
-					"error": "write cache block failed",
-					"msg":   writeErr.Error(),
-				})
-			}
-			if syncErr := cacheFile.Sync(); syncErr != nil {
-				zap.S().Warnf("缓存块%d刷盘失败: %s, err: %v", blockNum, cachePath, syncErr)
-			}
-
-			if _, writeErr := c.Response().Write(buf[:n]); writeErr != nil {
-				if strings.Contains(writeErr.Error(), "http2: stream closed") ||
-					strings.Contains(writeErr.Error(), "broken pipe") ||
-					strings.Contains(writeErr.Error(), "connection reset by peer") {
-					zap.S().Warnf("客户端断开连接，停止返回续传数据: %s, err: %v", cachePath, writeErr)
-					return nil
-				}
-				zap.S().Errorf("返回续传数据失败: %s, err: %v", cachePath, writeErr)
-				return c.JSON(http.StatusInternalServerError, map[string]string{
-					"code":  "500",
-					"error": "write response failed",
-					"msg":   writeErr.Error(),
-				})
-			}
-
-			written += int64(n)
-			if f, ok := c.Response().Writer.(http.Flusher); ok {
-				f.Flush()
-			}
-
-			if written%(100*1024*1024) == 0 {
-				zap.S().Infof("续传进度: %dMB, 文件: %s", written/(1024*1024), cachePath)
-			}
-		}
-
-		if err == io.EOF {
-			if syncErr := cacheFile.Sync(); syncErr != nil {
-				zap.S().Warnf("缓存文件最终刷盘失败: %s, err: %v", cachePath, syncErr)
-			}
-			zap.S().Infof("续传完成: %s, 共下载%d字节，完整文件%d字节", cachePath, written, totalFileSize)
-			break
-		}
-		if err != nil {
-			zap.S().Errorf("续传中断: %s, err: %v", cachePath, err)
-			return c.JSON(http.StatusBadGateway, map[string]string{
-				"code":  "502",
-				"error": "download interrupted",
-				"msg":   err.Error(),
-			})
-		}
-	}
-
-	return nil
+	return &ModelscopeService{}
 }
 
 func (m *ModelscopeService) ForwardModelInfo(c echo.Context, owner, repo string, repoType string) error {
@@ -333,7 +116,16 @@ func (m *ModelscopeService) forwardRequest(c echo.Context, officialURL string) e
 	return nil
 }
 
-// HandleFileDownload 处理ModelScope文件下载请求
+const (
+	modelscopePollInterval = 1 * time.Second // 等待其他请求回源时轮询缓存的间隔
+	modelscopeMaxPollCount = 30              // 缓存连续未增长的最大轮询次数
+)
+
+// errCacheBusy 其他请求持有缓存文件锁且长时间没有写入
+var errCacheBusy = errors.New("cache file is being written by another request")
+
+// HandleFileDownload 处理ModelScope文件下载请求。Range与条件请求按util.RangeResponse处理，与HF文件一致；
+// 缓存文件从头顺序写入，请求的数据已缓存时直接读取，否则由持有文件锁的请求回源追加，其他请求等待缓存增长。
 func (m *ModelscopeService) HandleFileDownload(c echo.Context, owner, repo, repoType string) error {
 	repoId := fmt.Sprintf("%s/%s", owner, repo)
 	revision := c.Request().URL.Query().Get("Revision")
@@ -379,287 +171,305 @@ func (m *ModelscopeService) HandleFileDownload(c echo.Context, owner, repo, repo
 		})
 	}
 
-	cachedSize := util.GetFileSize(cachePath)
-	zap.S().Infof("缓存文件状态: %s (已下载: %d字节)", cachePath, cachedSize)
-	if cacheExists && cachedSize == 0 {
-		zap.S().Warnf("缓存文件存在但大小为0，视为无效缓存: %s", cachePath)
-		if err := os.Remove(cachePath); err != nil {
-			zap.S().Errorf("删除空缓存文件失败: %s, err: %v", cachePath, err)
+	file := &modelscopeFile{m: m, c: c, owner: owner, repo: repo, repoType: repoType, cachePath: cachePath}
+	defer file.close()
+	meta := readModelscopeMeta(cachePath)
+	if meta == nil {
+		if cacheExists && file.cachedSize() == 0 {
+			zap.S().Warnf("缓存文件存在但大小为0，视为无效缓存: %s", cachePath)
+			if err := os.Remove(cachePath); err != nil {
+				zap.S().Errorf("删除空缓存文件失败: %s, err: %v", cachePath, err)
+			}
+		}
+		var err error
+		if meta, err = file.waitMeta(); err != nil {
+			zap.S().Errorf("获取文件信息失败: %s, err: %v", cachePath, err)
+			return m.responseDownloadError(c, err)
 		}
-		cachedSize = 0
-		cacheExists = false
 	}
+	zap.S().Infof("缓存文件状态: %s (已下载: %d字节, 文件大小: %d字节)", cachePath, file.cachedSize(), meta.Size)
 
-	clientStart, clientEnd, err := util.ParseRangeHeader(c.Request())
-	if err != nil {
-		zap.S().Errorf("解析Range失败: %v", err)
-		return c.JSON(http.StatusBadRequest, map[string]string{
-			"code":  "400",
-			"error": "parse Range header failed",
-			"msg":   err.Error(),
-		})
+	headers := map[string]string{
+		echo.HeaderContentType:          util.ContentTypeByName(filePath),
+		"Access-Control-Expose-Headers": "Content-Range, Content-Type",
 	}
-
-	actualStart := clientStart
-	if cachedSize > 0 && actualStart < cachedSize {
-		actualStart = cachedSize
+	resp := util.NewRangeResponse(c.Request(), meta.Size, meta.Etag, meta.lastModified(), headers)
+	if err := resp.Write(c, file.writeRange); err != nil { // 响应已开始，只能中断连接
+		zap.S().Warnf("返回文件数据中断: %s, err: %v", cachePath, err)
+		return err
 	}
-	zap.S().Infof("续传起始位置: 客户端请求=%d, 缓存末尾=%d, 实际起始=%d", clientStart, cachedSize, actualStart)
-
-	headerWritten := false
-	c.Response().Header().Set("Transfer-Encoding", "chunked")
-	c.Response().Header().Set("Content-Type", "application/octet-stream")
-	c.Response().Header().Set("Access-Control-Expose-Headers", "Content-Range, Content-Type")
+	return nil
+}
 
-	var cacheWritten int64 = 0
-	var needRemoteDownload bool
-	if cachedSize > 0 && clientStart < cachedSize {
-		cacheWritten, headerWritten, needRemoteDownload, err = m.writeCacheData(c, cachePath, clientStart, clientEnd, cachedSize, headerWritten)
-		if err != nil {
-			zap.S().Errorf("读取缓存数据失败: %v", err)
-			return c.JSON(http.StatusInternalServerError, map[string]string{
-				"code":  "500",
-				"error": "write cache data failed",
-				"msg":   err.Error(),
-			})
-		}
+// modelscopeMeta 上游文件的大小与校验值，回源时从响应头获取并保存在缓存文件旁，之后的请求无需回源即可处理Range与条件请求
+type modelscopeMeta struct {
+	Size         int64  `json:"size"`
+	Etag         string `json:"etag"`
+	LastModified string `json:"lastModified"`
+}
 
-		if clientEnd != -1 && (clientStart+cacheWritten-1) >= clientEnd {
-			zap.S().Infof("缓存数据已满足客户端Range请求，无需续传")
-			return nil
-		}
+func (m *modelscopeMeta) lastModified() time.Time {
+	t, err := http.ParseTime(m.LastModified)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
 
-		if needRemoteDownload {
-			m.mapMu.Lock()
-			defer m.mapMu.Unlock()
-
-			isDownloading := false
-			loaded := m.downloadingMap.CompareAndSwap(cachePath, false, true)
-			if !loaded {
-				val, exists := m.downloadingMap.Load(cachePath)
-				if exists && val.(bool) {
-					isDownloading = true
-				} else {
-					m.downloadingMap.Store(cachePath, true)
-				}
-			}
+func modelscopeMetaPath(cachePath string) string {
+	return cachePath + ".meta"
+}
 
-			if !isDownloading {
-				zap.S().Infof("触发远程下载: 连续10次空轮询，当前偏移=%d, 文件=%s (标记为已发起远程下载)", clientStart+cacheWritten, cachePath)
-				actualStart = clientStart + cacheWritten
-			} else {
-				zap.S().Infof("文件%s已发起远程下载，不重复触发，继续轮询缓存", cachePath)
-				cacheWritten, headerWritten, needRemoteDownload, err = m.writeCacheData(c, cachePath, clientStart+cacheWritten, clientEnd, cachedSize, headerWritten)
-				if err != nil {
-					zap.S().Errorf("再次轮询缓存数据失败: %v", err)
-					return c.JSON(http.StatusInternalServerError, map[string]string{
-						"code":  "500",
-						"error": "retry write cache data failed",
-						"msg":   err.Error(),
-					})
-				}
-				actualStart = clientStart + cacheWritten
-				if needRemoteDownload {
-					zap.S().Warnf("文件%s已标记为下载中，但仍触发远程下载请求，终止流程", cachePath)
-					return nil
-				}
-			}
-		}
+func readModelscopeMeta(cachePath string) *modelscopeMeta {
+	data, err := util.ReadFileToBytes(modelscopeMetaPath(cachePath))
+	if err != nil {
+		return nil
 	}
-
-	if err := m.downloadAndWriteRemaining(c, owner, repo, actualStart, clientEnd, cachePath, headerWritten, repoType); err != nil {
-		zap.S().Errorf("远程下载并写入剩余数据失败: %v", err)
-		m.downloadingMap.Delete(cachePath)
-		return c.JSON(http.StatusInternalServerError, map[string]string{
-			"code":  "500",
-			"error": "download and write remaining data failed",
-			"msg":   err.Error(),
-		})
+	meta := &modelscopeMeta{}
+	if err = sonic.Unmarshal(data, meta); err != nil {
+		zap.S().Warnf("解析缓存文件信息失败: %s, err: %v", cachePath, err)
+		return nil
 	}
+	return meta
+}
 
-	// 下载完成后清除标识
-	m.downloadingMap.Delete(cachePath)
-	zap.S().Infof("文件%s远程下载完成，清除下载标识", cachePath)
+// parseModelscopeMeta 从回源响应获取文件大小与校验值，416表示请求的位置已到文件末尾
+func parseModelscopeMeta(resp *http.Response) (*modelscopeMeta, error) {
+	var size int64
+	switch resp.StatusCode {
+	case http.StatusOK:
+		size = resp.ContentLength
+	case http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable:
+		size = parseTotalFileSize(resp)
+	default:
+		return nil, util.NewStatusError(resp)
+	}
+	if size < 0 {
+		return nil, fmt.Errorf("unknown file size, status code: %d", resp.StatusCode)
+	}
+	return &modelscopeMeta{Size: size, Etag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified")}, nil
+}
 
-	return nil
+// modelscopeFile 一次下载请求使用的缓存文件
+type modelscopeFile struct {
+	m         *ModelscopeService
+	c         echo.Context
+	owner     string
+	repo      string
+	repoType  string
+	cachePath string
+	reader    *os.File
+	fill      *modelscopeFill // 持有文件锁时回源追加缓存
+	buf       []byte
 }
 
-func (m *ModelscopeService) writeCacheData(c echo.Context, cachePath string, clientStart, clientEnd, cachedSize int64, headerWritten bool) (int64, bool, bool, error) {
-	pollInterval := 1 * time.Second // 每秒轮询一次缓存
-	maxPollCount := 30              // 最大连续空轮询次数
+// modelscopeFill 从缓存末尾回源的连接，数据按顺序追加到缓存文件
+type modelscopeFill struct {
+	lock *flock.Flock
+	file *os.File
+	body io.ReadCloser
+	pos  int64
+	size int64
+}
 
-	totalWritten := int64(0)
-	currentCacheOffset := clientStart // 当前读取到的缓存偏移量
-	emptyPollCount := 0               // 连续空轮询计数器
+func (f *modelscopeFile) cachedSize() int64 {
+	info, err := os.Stat(f.cachePath)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
 
-	for {
-		// 客户端断开连接则直接返回
-		if c.Request().Context().Err() != nil {
-			zap.S().Warnf("客户端断开连接，停止返回缓存数据: %s", cachePath)
-			return totalWritten, headerWritten, false, nil
+// waitMeta 缓存没有文件信息时回源获取；其他请求正在回源时等待其写入文件信息
+func (f *modelscopeFile) waitMeta() (*modelscopeMeta, error) {
+	for polls := 0; ; polls++ {
+		meta, err := f.openFill()
+		if err != nil || meta != nil {
+			return meta, err
 		}
-
-		cacheFile, err := os.Open(cachePath)
-		if err != nil {
-			zap.S().Errorf("打开缓存文件失败: %s, err: %v", cachePath, err)
-			return totalWritten, headerWritten, false, fmt.Errorf("open cache file failed: %w", err)
+		if meta = readModelscopeMeta(f.cachePath); meta != nil {
+			return meta, nil
 		}
-
-		fileInfo, err := cacheFile.Stat()
-		if err != nil {
-			_ = cacheFile.Close()
-			zap.S().Errorf("获取缓存文件信息失败: %s, err: %v", cachePath, err)
-			return totalWritten, headerWritten, false, fmt.Errorf("stat cache file failed: %w", err)
+		if polls >= modelscopeMaxPollCount {
+			return nil, errCacheBusy
 		}
-		latestCacheSize := fileInfo.Size()
-
-		cacheEnd := latestCacheSize - 1
-		if clientEnd != -1 && clientEnd < cacheEnd {
-			cacheEnd = clientEnd
+		if err = f.sleep(); err != nil {
+			return nil, err
 		}
+	}
+}
 
-		if currentCacheOffset > cacheEnd {
-			emptyPollCount++
-			_ = cacheFile.Close()
-
-			isDownloading := false
-			if downloadingVal, exists := m.downloadingMap.Load(cachePath); exists {
-				isDownloading = downloadingVal.(bool)
-			}
-
-			zap.S().Debugf("缓存暂未更新，第%d次空轮询（最大%d次）: 当前偏移=%d, 缓存末尾=%d, 文件=%s, 有客户端下载中: %t",
-				emptyPollCount, maxPollCount, currentCacheOffset, cacheEnd, cachePath, isDownloading)
-
-			if emptyPollCount >= maxPollCount && !isDownloading {
-				zap.S().Warnf("连续%d次空轮询且无客户端下载中，触发当前客户端发起远程下载: %s", maxPollCount, cachePath)
-				return totalWritten, headerWritten, true, nil
-			}
-
-			zap.S().Debugf("继续轮询缓存: 文件=%s, 原因: %s", cachePath,
-				func() string {
-					if isDownloading {
-						return "有客户端正在远程下载"
-					}
-					return fmt.Sprintf("空轮询次数未到上限（当前%d次，最大%d次）", emptyPollCount, maxPollCount)
-				}())
-			time.Sleep(pollInterval)
-			continue
+// openFill 取得文件锁后从缓存末尾回源，并更新文件信息。其他请求持有锁时返回nil；缓存已完整时不保留连接与锁。
+func (f *modelscopeFile) openFill() (*modelscopeMeta, error) {
+	lock := flock.New(f.cachePath + ".lock")
+	locked, err := lock.TryLock()
+	if err != nil {
+		return nil, fmt.Errorf("get cache file lock failed: %w", err)
+	}
+	if !locked {
+		return nil, nil
+	}
+	fill, meta, err := f.requestFill()
+	if err != nil || fill == nil {
+		if unlockErr := lock.Unlock(); unlockErr != nil {
+			zap.S().Errorf("解锁缓存文件锁失败: %s, err: %v", f.cachePath+".lock", unlockErr)
 		}
+		return meta, err
+	}
+	fill.lock = lock
+	f.fill = fill
+	return meta, nil
+}
 
-		emptyPollCount = 0
-		if !headerWritten {
-			contentRange := fmt.Sprintf("bytes %d-%d/%d", clientStart, cacheEnd, latestCacheSize)
-			c.Response().Header().Set("Content-Range", contentRange)
-			c.Response().WriteHeader(http.StatusPartialContent)
-			headerWritten = true
-			zap.S().Infof("设置缓存响应头: Content-Range=%s", contentRange)
+func (f *modelscopeFile) requestFill() (*modelscopeFill, *modelscopeMeta, error) {
+	pos := f.cachedSize()
+	req, err := f.m.buildDownloadRequest(f.c, f.owner, f.repo, pos, f.repoType)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := util.DoRequestWithRetry(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	meta, err := parseModelscopeMeta(resp)
+	if err != nil {
+		_ = resp.Body.Close()
+		return nil, nil, err
+	}
+	if err = util.WriteDataToFile(modelscopeMetaPath(f.cachePath), meta); err != nil {
+		zap.S().Warnf("保存缓存文件信息失败: %s, err: %v", f.cachePath, err)
+	}
+	if pos >= meta.Size {
+		_ = resp.Body.Close()
+		return nil, meta, nil
+	}
+	if resp.StatusCode == http.StatusOK && pos > 0 { // 上游未按Range返回，跳过已缓存的部分
+		if _, err = io.CopyN(io.Discard, resp.Body, pos); err != nil {
+			_ = resp.Body.Close()
+			return nil, nil, err
 		}
+	}
+	file, err := os.OpenFile(f.cachePath, os.O_WRONLY|os.O_CREATE, 0664)
+	if err != nil {
+		_ = resp.Body.Close()
+		return nil, nil, fmt.Errorf("open cache file failed: %w", err)
+	}
+	zap.S().Infof("回源续传: %s, 起始位置: %d, 文件大小: %d", f.cachePath, pos, meta.Size)
+	return &modelscopeFill{file: file, body: resp.Body, pos: pos, size: meta.Size}, meta, nil
+}
 
-		if _, err := cacheFile.Seek(currentCacheOffset, io.SeekStart); err != nil {
-			_ = cacheFile.Close()
-			zap.S().Errorf("定位缓存文件失败: %s, err: %v", cachePath, err)
-			return totalWritten, headerWritten, false, fmt.Errorf("seek cache file failed: %w", err)
+// writeRange 将[start,end)写入响应体。已缓存的部分直接读取；缺少的数据在持有文件锁时回源追加，
+// 否则等待其他请求写入，持有锁的请求结束后由当前请求接手回源。
+func (f *modelscopeFile) writeRange(start, end int64) error {
+	polls := 0
+	for pos := start; pos < end; {
+		if err := f.c.Request().Context().Err(); err != nil {
+			return err
 		}
-
-		buf := make([]byte, config.SysConfig.Modelscope.ChunkSize)
-		readableSize := cacheEnd - currentCacheOffset + 1
-		writtenInRound := int64(0)
-
-		for writtenInRound < readableSize {
-			if c.Request().Context().Err() != nil {
-				_ = cacheFile.Close()
-				zap.S().Warnf("客户端断开连接，停止返回缓存数据: %s", cachePath)
-				return totalWritten, headerWritten, false, nil
-			}
-
-			readSize := readableSize - writtenInRound
-			if readSize > int64(len(buf)) {
-				readSize = int64(len(buf))
-			}
-
-			n, err := cacheFile.Read(buf[:readSize])
-			if n > 0 {
-				if _, writeErr := c.Response().Write(buf[:n]); writeErr != nil {
-					_ = cacheFile.Close()
-					zap.S().Errorf("返回缓存数据失败: %s, err: %v", cachePath, writeErr)
-					return totalWritten, headerWritten, false, fmt.Errorf("write cache data to response failed: %w", writeErr)
-				}
-
-				writtenInRound += int64(n)
-				totalWritten += int64(n)
-				currentCacheOffset += int64(n)
-
-				if f, ok := c.Response().Writer.(http.Flusher); ok {
-					f.Flush()
-				}
+		if cached := f.cachedSize(); pos < cached {
+			n, err := f.copyCache(pos, min(end, cached))
+			pos += n
+			if err != nil {
+				return err
 			}
-
-			if err == io.EOF {
-				break
+			polls = 0
+			continue
+		}
+		if f.fill == nil {
+			if _, err := f.openFill(); err != nil {
+				return err
 			}
-			if err != nil {
-				_ = cacheFile.Close()
-				zap.S().Errorf("读取缓存数据失败: %s, err: %v", cachePath, err)
-				return totalWritten, headerWritten, false, fmt.Errorf("read cache file failed: %w", err)
+		}
+		if f.fill != nil {
+			if err := f.fill.next(f.buffer()); err != nil {
+				return err
 			}
+			continue
 		}
-		_ = cacheFile.Close()
-		zap.S().Debugf("本轮读取缓存完成: 文件=%s, 读取字节=%d, 累计读取=%d, 当前偏移=%d",
-			cachePath, writtenInRound, totalWritten, currentCacheOffset)
-
-		if clientEnd == -1 || currentCacheOffset > clientEnd {
-			zap.S().Infof("缓存数据已满足客户端Range请求: 文件=%s, 累计读取=%d字节", cachePath, totalWritten)
-			return totalWritten, headerWritten, false, nil
+		if polls++; polls > modelscopeMaxPollCount {
+			return errCacheBusy
+		}
+		if err := f.sleep(); err != nil {
+			return err
 		}
-
-		time.Sleep(pollInterval)
 	}
+	return nil
 }
 
-// downloadAndWriteRemaining 下载剩余部分并写入响应+缓存
-func (m *ModelscopeService) downloadAndWriteRemaining(c echo.Context, owner, repo string, actualStart, clientEnd int64, cachePath string, headerWritten bool, repoType string) error {
-	req, err := m.buildDownloadRequest(c, owner, repo, actualStart, clientEnd, repoType)
-	if err != nil {
-		return err
+func (f *modelscopeFile) copyCache(start, end int64) (int64, error) {
+	if f.reader == nil {
+		reader, err := os.Open(f.cachePath)
+		if err != nil {
+			return 0, fmt.Errorf("open cache file failed: %w", err)
+		}
+		f.reader = reader
 	}
+	return io.CopyN(f.c.Response(), io.NewSectionReader(f.reader, start, end-start), end-start)
+}
 
-	resp, err := m.sendDownloadRequest(req, c, owner, repo, repoType)
-	if err != nil {
-		return err
+func (f *modelscopeFile) buffer() []byte {
+	if f.buf == nil {
+		chunkSize := config.SysConfig.Modelscope.ChunkSize
+		if chunkSize <= 0 {
+			chunkSize = 1024 * 1024 * 8
+		}
+		f.buf = make([]byte, chunkSize)
 	}
-	defer resp.Body.Close()
+	return f.buf
+}
 
-	totalFileSize := m.parseTotalFileSize(resp)
+func (f *modelscopeFile) sleep() error {
+	select {
+	case <-f.c.Request().Context().Done():
+		return f.c.Request().Context().Err()
+	case <-time.After(modelscopePollInterval):
+		return nil
+	}
+}
 
-	cacheFile, fileLock, err := m.openCacheFile(cachePath, c)
-	if err != nil {
-		return err
+func (f *modelscopeFile) close() {
+	if f.reader != nil {
+		_ = f.reader.Close()
 	}
-	defer func() {
-		if cacheFile != nil {
-			if closeErr := cacheFile.Close(); closeErr != nil {
-				zap.S().Errorf("关闭缓存文件失败: %s, err: %v", cachePath, closeErr)
-			}
+	if f.fill != nil {
+		f.fill.close(f.cachePath)
+	}
+}
+
+// next 回源读取一段数据追加到缓存文件
+func (f *modelscopeFill) next(buf []byte) error {
+	n, err := f.body.Read(buf)
+	if n > 0 {
+		if _, writeErr := f.file.WriteAt(buf[:n], f.pos); writeErr != nil {
+			return fmt.Errorf("write cache file failed: %w", writeErr)
 		}
-		if fileLock != nil {
-			if unlockErr := fileLock.Unlock(); unlockErr != nil {
-				zap.S().Errorf("解锁缓存文件锁失败: %s, err: %v", cachePath+".lock", unlockErr)
-			}
+		f.pos += int64(n)
+	}
+	if err == io.EOF {
+		if f.pos < f.size {
+			return io.ErrUnexpectedEOF
 		}
-	}()
-
-	headerWritten = m.writeResponseHeader(c, resp, headerWritten)
-
-	err = m.copyResponseToCacheAndClient(c, resp, cacheFile, cachePath, totalFileSize)
-	if err != nil {
-		return err
+		return nil
 	}
+	return err
+}
 
-	return nil
+func (f *modelscopeFill) close(cachePath string) {
+	_ = f.body.Close()
+	if err := f.file.Sync(); err != nil {
+		zap.S().Warnf("缓存文件刷盘失败: %s, err: %v", cachePath, err)
+	}
+	if err := f.file.Close(); err != nil {
+		zap.S().Errorf("关闭缓存文件失败: %s, err: %v", cachePath, err)
+	}
+	if err := f.lock.Unlock(); err != nil {
+		zap.S().Errorf("解锁缓存文件锁失败: %s, err: %v", cachePath+".lock", err)
+	}
+	zap.S().Infof("回源结束: %s, 已缓存%d字节，完整文件%d字节", cachePath, f.pos, f.size)
 }
 
-// buildDownloadRequest 构建下载剩余部分的HTTP请求
-func (m *ModelscopeService) buildDownloadRequest(c echo.Context, owner, repo string, actualStart, clientEnd int64, repoType string) (*http.Request, error) {
+// buildDownloadRequest 构建从缓存末尾回源的HTTP请求，不转发客户端的Range与条件请求头
+func (m *ModelscopeService) buildDownloadRequest(c echo.Context, owner, repo string, actualStart int64, repoType string) (*http.Request, error) {
 	apiPrefix := util.GetAPIPathPrefix(repoType)
 	query := c.Request().URL.RawQuery
 	officialURL := fmt.Sprintf("%s/api/v1/%s/%s/%s/repo?%s",
@@ -674,21 +484,21 @@ func (m *ModelscopeService) buildDownloadRequest(c echo.Context, owner, repo str
 	req, err := http.NewRequest(http.MethodGet, officialURL, nil)
 	if err != nil {
 		zap.S().Errorf("构建请求失败: %v", err)
-		return nil, c.JSON(http.StatusInternalServerError, map[string]string{
-			"code":  "500",
-			"error": "build request failed",
-			"msg":   err.Error(),
-		})
+		return nil, err
 	}
 
 	skipHeaders := map[string]bool{
-		"Range":      true,
-		"User-Agent": true,
-		"Host":       true,
+		"Range":               true,
+		"If-Range":            true,
+		"If-None-Match":       true,
+		"If-Modified-Since":   true,
+		"If-Match":            true,
+		"If-Unmodified-Since": true,
+		"User-Agent":          true,
+		"Host":                true,
 	}
 	for k, v := range c.Request().Header {
-		key := strings.ToLower(k)
-		if !skipHeaders[key] {
+		if !skipHeaders[http.CanonicalHeaderKey(k)] {
 			req.Header[k] = v
 		}
 	}
@@ -696,61 +506,53 @@ func (m *ModelscopeService) buildDownloadRequest(c echo.Context, owner, repo str
 	util.AddCLIHeaders(req.Header, c.Request().Header.Get("User-Agent"))
 
 	rangeHeader := fmt.Sprintf("bytes=%d-", actualStart)
-	if clientEnd != -1 {
-		rangeHeader = fmt.Sprintf("bytes=%d-%d", actualStart, clientEnd)
-	}
 	req.Header.Set("Range", rangeHeader)
 	zap.S().Infof("向官方请求剩余部分: %s", rangeHeader)
 
 	return req, nil
 }
 
-// sendDownloadRequest 发送下载请求并校验响应状态码
-func (m *ModelscopeService) sendDownloadRequest(req *http.Request, c echo.Context, owner, repo, repoType string) (*http.Response, error) {
-	resp, err := util.DoRequestWithRetry(req)
-	if err != nil {
-		zap.S().Errorf("下载剩余部分失败: %v", err)
-		return nil, c.JSON(http.StatusBadGateway, map[string]string{
+// responseDownloadError 响应头发送前回源失败，按上游状态码返回错误
+func (m *ModelscopeService) responseDownloadError(c echo.Context, err error) error {
+	if errors.Is(err, errCacheBusy) {
+		return c.JSON(http.StatusTooManyRequests, map[string]string{
+			"code":  "429",
+			"error": "cache file is being written by another request",
+			"msg":   "please try again later",
+		})
+	}
+	var statusErr *util.StatusError
+	if !errors.As(err, &statusErr) {
+		return c.JSON(http.StatusBadGateway, map[string]string{
 			"code":  "502",
-			"error": "download remaining failed",
+			"error": "download failed",
 			"msg":   err.Error(),
 		})
 	}
-
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		officialURL := req.URL.String()
-		zap.S().Errorf("ModelScope返回错误状态码: %d, URL: %s", resp.StatusCode, officialURL)
-		errorMsg := fmt.Sprintf("modelscope server return status code: %d", resp.StatusCode)
-
-		var respJSON error
-		switch resp.StatusCode {
-		case http.StatusNotFound:
-			respJSON = c.JSON(http.StatusNotFound, map[string]string{
-				"code":  "404",
-				"error": "resource not found",
-				"msg":   "model or file does not exist on ModelScope",
-			})
-		case http.StatusForbidden:
-			respJSON = c.JSON(http.StatusForbidden, map[string]string{
-				"code":  "403",
-				"error": "forbidden",
-				"msg":   "no permission to access the resource",
-			})
-		default:
-			respJSON = c.JSON(http.StatusBadGateway, map[string]string{
-				"code":  "502",
-				"error": "modelscope server error",
-				"msg":   errorMsg,
-			})
-		}
-		return nil, respJSON
+	switch statusErr.StatusCode {
+	case http.StatusNotFound:
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"code":  "404",
+			"error": "resource not found",
+			"msg":   "model or file does not exist on ModelScope",
+		})
+	case http.StatusForbidden:
+		return c.JSON(http.StatusForbidden, map[string]string{
+			"code":  "403",
+			"error": "forbidden",
+			"msg":   "no permission to access the resource",
+		})
+	default:
+		return c.JSON(http.StatusBadGateway, map[string]string{
+			"code":  "502",
+			"error": "modelscope server error",
+			"msg":   fmt.Sprintf("modelscope server return status code: %d", statusErr.StatusCode),
+		})
 	}
-
-	return resp, nil
 }
 
 // parseTotalFileSize 从响应头解析Content-Range获取总文件大小
-func (m *ModelscopeService) parseTotalFileSize(resp *http.Response) int64 {
+func parseTotalFileSize(resp *http.Response) int64 {
 	totalFileSize := int64(-1)
 	contentRange := resp.Header.Get("Content-Range")
 	if contentRange != "" {
@@ -766,18 +568,3 @@ func (m *ModelscopeService) parseTotalFileSize(resp *http.Response) int64 {
 	}
 	return totalFileSize
 }
-
-// writeResponseHeader 写入续传响应头
-func (m *ModelscopeService) writeResponseHeader(c echo.Context, resp *http.Response, headerWritten bool) bool {
-	if !headerWritten {
-		if resp.StatusCode == http.StatusPartialContent {
-			c.Response().Header().Set("Content-Range", resp.Header.Get("Content-Range"))
-			c.Response().WriteHeader(http.StatusPartialContent)
-		} else {
-			c.Response().WriteHeader(http.StatusOK)
-		}
-		headerWritten = true
-		zap.S().Infof("设置续传响应头，状态码: %d", resp.StatusCode)
-	}
-	return headerWritten
-}
@@ -1,6 +1,8 @@
 package service
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
@@ -12,6 +14,7 @@ import (
 	"time"
 
 	"dingospeed/internal/dao"
+	"dingospeed/internal/downloader"
 	"dingospeed/pkg/config"
 	"dingospeed/pkg/proto/manager"
 	"dingospeed/pkg/util"
@@ -23,13 +26,15 @@ import (
 var once sync.Once
 
 type SysService struct {
-	Client       manager.ManagerClient
-	schedulerDao *dao.SchedulerDao
+	Client        manager.ManagerClient
+	schedulerDao  *dao.SchedulerDao
+	downloaderDao *dao.DownloaderDao
 }
 
-func NewSysService(schedulerDao *dao.SchedulerDao) *SysService {
+func NewSysService(schedulerDao *dao.SchedulerDao, downloaderDao *dao.DownloaderDao) *SysService {
 	sysSvc := &SysService{
-		schedulerDao: schedulerDao,
+		schedulerDao:  schedulerDao,
+		downloaderDao: downloaderDao,
 	}
 	once.Do(
 		func() {
@@ -43,6 +48,12 @@ func NewSysService(schedulerDao *dao.SchedulerDao) *SysService {
 			if config.SysConfig.DynamicProxy.HttpProxyConnTest {
 				go sysSvc.cycleTestProxyConnectivity()
 			}
+			if config.SysConfig.EnableCacheMigrate() {
+				go downloader.GetMigrator().Run(context.Background())
+			}
+			if config.SysConfig.EnableDownloadJournal() {
+				go downloaderDao.ResumeJournal()
+			}
 		})
 	return sysSvc
 }
@@ -136,17 +147,59 @@ func (s *SysService) checkDiskUsage() {
 			break
 		}
 		filePath := file.Path
-		fileSize := file.Info.Size()
+		fileSize, err := util.GetFilePhysicalSize(file.Info, filePath) // 与GetFolderSize保持一致，按实际占用空间计算
+		if err != nil {
+			fileSize = file.Info.Size()
+		}
+		if strings.HasSuffix(filePath, downloader.VerifySuffix) || strings.HasSuffix(filePath, downloader.RefsSuffix) { // 校验结果、引用记录随blob一起删除
+			continue
+		}
+		if _, err = os.Lstat(filePath); os.IsNotExist(err) { // 已随共享对象一起删除
+			continue
+		}
 
-		if s.Client != nil {
-			s.deleteRecordByFilePath(baseRepoPath, filePath, instanceID)
+		if downloader.IsStorePath(filePath) { // 全局存储中的对象被多个仓库共享，连同所有仓库下的链接一起删除
+			links, err := downloader.RemoveStoreBlob(filePath)
+			if errors.Is(err, downloader.ErrBlobInUse) {
+				zap.S().Infof("Store blob %s is in use, skip it\n", filePath)
+				continue
+			} else if err != nil {
+				zap.S().Errorf("Error removing store blob %s: %v\n", filePath, err)
+				continue
+			}
+			if s.Client != nil {
+				for _, link := range links {
+					s.deleteRecordByFilePath(baseRepoPath, link, instanceID)
+				}
+			}
+			currentSize -= fileSize
+			zap.S().Infof("Remove store blob: %s. File Size: %s\n", filePath, util.ConvertBytesToHumanReadable(fileSize))
+			continue
+		}
+		if downloader.IsStoreLink(filePath) { // 仓库下的链接只减少引用计数，最后一个引用删除时才释放对象
+			freed, err := downloader.UnlinkBlob(filePath)
+			if err != nil {
+				zap.S().Errorf("Error unlinking blob %s: %v\n", filePath, err)
+				continue
+			}
+			if s.Client != nil {
+				s.deleteRecordByFilePath(baseRepoPath, filePath, instanceID)
+			}
+			currentSize -= freed
+			zap.S().Infof("Unlink blob: %s. Freed Size: %s\n", filePath, util.ConvertBytesToHumanReadable(freed))
+			continue
 		}
 
-		err := os.Remove(filePath)
-		if err != nil {
+		if err = downloader.RemoveBlob(filePath); errors.Is(err, downloader.ErrBlobInUse) { // 正在下载或读取，等待下次清理
+			zap.S().Infof("File %s is in use, skip it\n", filePath)
+			continue
+		} else if err != nil {
 			zap.S().Errorf("Error removing file %s: %v\n", filePath, err)
 			continue
 		}
+		if s.Client != nil {
+			s.deleteRecordByFilePath(baseRepoPath, filePath, instanceID)
+		}
 		currentSize -= fileSize
 		zap.S().Infof("Remove file: %s. File Size: %s\n", filePath, util.ConvertBytesToHumanReadable(fileSize))
 	}
@@ -161,6 +214,12 @@ func (s *SysService) checkDiskUsage() {
 }
 
 func (s *SysService) deleteRecordByFilePath(baseRepoPath, filePath, instanceID string) {
+	if downloader.IsStorePath(filePath) { // 全局存储中的对象按引用它的仓库逐个删除记录
+		for _, ref := range downloader.GetBlobRefs(filePath) {
+			s.deleteRecordByFilePath(baseRepoPath, ref, instanceID)
+		}
+		return
+	}
 	relPath, err := filepath.Rel(baseRepoPath, filePath)
 	if err != nil {
 		zap.S().Errorf("Failed to get relative path for %s: %v", filePath, err)
@@ -13,6 +13,7 @@ import (
 	"dingospeed/internal/model/query"
 	"dingospeed/pkg/config"
 	"dingospeed/pkg/consts"
+	"dingospeed/pkg/util"
 
 	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
@@ -111,18 +112,19 @@ func (p *PreheatCacheTask) preheatProcess(orgRepo string) error {
 func (p *PreheatCacheTask) startPreheat(hfUri, orgRepo, fileName, commit, etag, authorization string, fileSize, offset int64) error {
 	var wg sync.WaitGroup
 	bgCtx := context.WithValue(p.Ctx, consts.PromSource, "localhost")
-	responseChan := make(chan []byte, config.SysConfig.Download.RespChanSize)
+	responseChan := make(chan util.Chunk, config.SysConfig.Download.RespChanSize)
 	blobsDir := fmt.Sprintf("%s/files/%s/%s/blobs", config.SysConfig.Repos(), p.Job.Datatype, orgRepo)
 	blobsFile := fmt.Sprintf("%s/%s", blobsDir, etag)
 	filesDir := fmt.Sprintf("%s/files/%s/%s/resolve/%s", config.SysConfig.Repos(), p.Job.Datatype, orgRepo, commit)
 	filesPath := fmt.Sprintf("%s/%s", filesDir, fileName)
-	if err := p.FileDao.ConstructBlobsAndFileFile(blobsFile, filesPath); err != nil {
+	storeFile, err := p.FileDao.ConstructBlobsAndFileFile(blobsFile, filesPath)
+	if err != nil {
 		zap.S().Errorf("ConstructBlobsAndFileFile err.%v", err)
 		return err
 	}
 	taskParam := &downloader.TaskParam{
 		TaskNo:        0,
-		BlobsFile:     blobsFile,
+		BlobsFile:     storeFile,
 		FileName:      fileName,
 		FileSize:      fileSize,
 		OrgRepo:       orgRepo,
@@ -130,6 +132,7 @@ func (p *PreheatCacheTask) startPreheat(hfUri, orgRepo, fileName, commit, etag,
 		Uri:           hfUri,
 		DataType:      p.Job.Datatype,
 		Etag:          etag,
+		Priority:      downloader.PriorityBackground,
 	}
 	taskParam.Context = bgCtx
 	taskParam.ResponseChan = responseChan
@@ -148,14 +151,15 @@ func (p *PreheatCacheTask) startPreheat(hfUri, orgRepo, fileName, commit, etag,
 	return eg.Wait()
 }
 
-func (p *PreheatCacheTask) result(ctx context.Context, responseChan chan []byte) error {
+func (p *PreheatCacheTask) result(ctx context.Context, responseChan chan util.Chunk) error {
 	for {
 		select {
-		case b, ok := <-responseChan:
+		case chunk, ok := <-responseChan:
 			if !ok {
 				return nil
 			}
-			p.stockLen.Add(uint64(len(b)))
+			p.stockLen.Add(uint64(len(chunk.Data)))
+			chunk.Release()
 		case <-ctx.Done():
 			return ctx.Err()
 		}
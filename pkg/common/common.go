@@ -85,7 +85,7 @@ type PathsInfo struct {
 	Size     int64  `json:"size"`
 	Lfs      Lfs    `json:"lfs"`
 	Path     string `json:"path"`
-	XXetHash string `json:"-"`
+	XXetHash string `json:"xetHash,omitempty"` // 随文件信息缓存，离线时仍返回一致的X-Xet-Hash
 	Location string `json:"-"`
 	Link     string `json:"-"`
 }
@@ -102,6 +102,7 @@ type CacheContent struct {
 	Headers       map[string]string `json:"headers"`
 	Content       string            `json:"content"`
 	OriginContent []byte            `json:"-"`
+	ModTime       time.Time         `json:"-"` // 缓存文件的写入时间
 }
 
 type ErrorResp struct {
@@ -33,7 +33,6 @@ type Task interface {
 type DownloadTask interface {
 	Task
 	OutResult()
-	GetResponseChan() chan []byte
 	SetTaskSize(taskSize int)
 }
 
@@ -0,0 +1,97 @@
+//  Copyright (c) 2025 dingodb.com, Inc. All Rights Reserved
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http:www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package common
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// TokenBucket 按字节限速的令牌桶，rate<=0表示不限速。令牌可以预支为负数，后到的请求按顺序等待。
+type TokenBucket struct {
+	mu       sync.Mutex
+	rate     float64 // 每秒产生的令牌数
+	capacity float64 // 最多积攒的令牌数，即允许的突发量
+	tokens   float64
+	last     time.Time
+}
+
+func NewTokenBucket(rate, capacity int64) *TokenBucket {
+	b := &TokenBucket{}
+	b.SetLimit(rate, capacity)
+	b.tokens = b.capacity
+	return b
+}
+
+// SetLimit 调整速率与容量，capacity<=0时取1秒的令牌数，正在等待的请求不受影响。
+func (b *TokenBucket) SetLimit(rate, capacity int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	b.rate = float64(rate)
+	if capacity <= 0 {
+		capacity = rate
+	}
+	b.capacity = float64(capacity)
+	b.tokens = min(b.tokens, b.capacity)
+}
+
+func (b *TokenBucket) Limited() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rate > 0
+}
+
+func (b *TokenBucket) refill(now time.Time) {
+	if !b.last.IsZero() && b.rate > 0 {
+		b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*b.rate, b.capacity)
+	}
+	b.last = now
+}
+
+// WaitN 获取n个令牌，令牌不足时等待，返回实际等待的时长。n超过容量时按容量分批获取。
+func (b *TokenBucket) WaitN(ctx context.Context, n int) (time.Duration, error) {
+	var waited time.Duration
+	for remaining := float64(n); remaining > 0; {
+		b.mu.Lock()
+		if b.rate <= 0 {
+			b.mu.Unlock()
+			return waited, nil
+		}
+		now := time.Now()
+		b.refill(now)
+		take := min(remaining, b.capacity)
+		b.tokens -= take
+		var wait time.Duration
+		if b.tokens < 0 {
+			wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+		}
+		b.mu.Unlock()
+		remaining -= take
+		if wait <= 0 {
+			continue
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+			waited += wait
+		case <-ctx.Done():
+			timer.Stop()
+			return waited, ctx.Err()
+		}
+	}
+	return waited, nil
+}
@@ -0,0 +1,57 @@
+//  Copyright (c) 2025 dingodb.com, Inc. All Rights Reserved
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http:www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package common
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := NewTokenBucket(10000, 1000)
+	ctx := context.Background()
+	// 初始积攒的令牌允许突发，超出部分按速率等待
+	if waited, err := b.WaitN(ctx, 1000); err != nil || waited != 0 {
+		t.Fatalf("burst should not wait, waited:%v, err:%v", waited, err)
+	}
+	start := time.Now()
+	if _, err := b.WaitN(ctx, 2000); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Fatalf("2000 tokens at 10000/s should wait about 200ms, elapsed:%v", elapsed)
+	}
+	// 令牌已预支，等待期间任务取消
+	cancelCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := b.WaitN(cancelCtx, 5000); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expect deadline exceeded, got %v", err)
+	}
+	// 不限速时立即返回
+	b.SetLimit(0, 0)
+	if b.Limited() {
+		t.Fatal("bucket should be unlimited")
+	}
+	if waited, err := b.WaitN(ctx, 1<<30); err != nil || waited != 0 {
+		t.Fatalf("unlimited bucket should not wait, waited:%v, err:%v", waited, err)
+	}
+	// 容量默认取1秒的令牌数
+	b = NewTokenBucket(100, 0)
+	if b.capacity != 100 || b.tokens != 100 {
+		t.Fatalf("unexpected capacity %v, tokens %v", b.capacity, b.tokens)
+	}
+}
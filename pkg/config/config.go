@@ -19,6 +19,8 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
@@ -51,19 +53,20 @@ type Config struct {
 }
 
 type ServerConfig struct {
-	Mode       string `json:"mode" yaml:"mode"`
-	Host       string `json:"host" yaml:"host"`
-	Port       int    `json:"port" yaml:"port"`
-	PProf      bool   `json:"pprof" yaml:"pprof"`
-	PProfPort  int    `json:"pprofPort" yaml:"pprofPort"`
-	Metrics    bool   `json:"metrics" yaml:"metrics"`
-	Online     bool   `json:"online" yaml:"online"`
-	Repos      string `json:"repos" yaml:"repos"`
-	HfNetLoc   string `json:"hfNetLoc" yaml:"hfNetLoc"`
-	BpHfNetLoc string `json:"bpHfNetLoc" yaml:"bpHfNetLoc"`
-	XetNetLoc  string `json:"xetNetLoc" yaml:"xetNetLoc"`
-	HfScheme   string `json:"hfScheme" yaml:"hfScheme" validate:"oneof=https http"`
-	Ssl        SSL    `json:"ssl" yaml:"ssl"`
+	Mode        string `json:"mode" yaml:"mode"`
+	Host        string `json:"host" yaml:"host"`
+	Port        int    `json:"port" yaml:"port"`
+	PProf       bool   `json:"pprof" yaml:"pprof"`
+	PProfPort   int    `json:"pprofPort" yaml:"pprofPort"`
+	Metrics     bool   `json:"metrics" yaml:"metrics"`
+	Online      bool   `json:"online" yaml:"online"`
+	Repos       string `json:"repos" yaml:"repos"`
+	HfNetLoc    string `json:"hfNetLoc" yaml:"hfNetLoc"`
+	BpHfNetLoc  string `json:"bpHfNetLoc" yaml:"bpHfNetLoc"`
+	XetNetLoc   string `json:"xetNetLoc" yaml:"xetNetLoc"`
+	XetRedirect bool   `json:"xetRedirect" yaml:"xetRedirect"`
+	HfScheme    string `json:"hfScheme" yaml:"hfScheme" validate:"oneof=https http"`
+	Ssl         SSL    `json:"ssl" yaml:"ssl"`
 }
 
 type SSL struct {
@@ -73,22 +76,93 @@ type SSL struct {
 }
 
 type Download struct {
-	RetryChannelNum         int   `json:"retryChannelNum" yaml:"retryChannelNum"`
-	GoroutineMaxNumPerFile  int   `json:"goroutineMaxNumPerFile" yaml:"goroutineMaxNumPerFile" validate:"min=1,max=8"`
-	BlockSize               int64 `json:"blockSize" yaml:"blockSize" validate:"min=1048576,max=134217728"`
-	ReqTimeout              int64 `json:"reqTimeout" yaml:"reqTimeout"`
-	RespChunkSize           int64 `json:"respChunkSize" yaml:"respChunkSize" validate:"min=1024,max=8388608"`
-	RespChanSize            int64 `json:"respChanSize" yaml:"respChanSize"`
-	RemoteFileRangeSize     int64 `json:"remoteFileRangeSize" yaml:"remoteFileRangeSize" validate:"min=0,max=1073741824"`
-	RemoteFileRangeWaitTime int64 `json:"remoteFileRangeWaitTime" yaml:"remoteFileRangeWaitTime" validate:"min=1,max=10"`
-	RemoteFileBufferSize    int64 `json:"remoteFileBufferSize" yaml:"remoteFileBufferSize" validate:"min=0,max=134217728"`
+	RetryChannelNum         int             `json:"retryChannelNum" yaml:"retryChannelNum"`
+	GoroutineMaxNumPerFile  int             `json:"goroutineMaxNumPerFile" yaml:"goroutineMaxNumPerFile" validate:"min=1,max=8"`
+	BlockSize               int64           `json:"blockSize" yaml:"blockSize" validate:"min=1048576,max=134217728"`
+	ReqTimeout              int64           `json:"reqTimeout" yaml:"reqTimeout"`
+	RespChunkSize           int64           `json:"respChunkSize" yaml:"respChunkSize" validate:"min=1024,max=8388608"`
+	RespChanSize            int64           `json:"respChanSize" yaml:"respChanSize"`
+	RemoteFileRangeSize     int64           `json:"remoteFileRangeSize" yaml:"remoteFileRangeSize" validate:"min=0,max=1073741824"`
+	RemoteFileRangeWaitTime int64           `json:"remoteFileRangeWaitTime" yaml:"remoteFileRangeWaitTime" validate:"min=1,max=10"`
+	RemoteFileBufferSize    int64           `json:"remoteFileBufferSize" yaml:"remoteFileBufferSize" validate:"min=0,max=134217728"`
+	AdaptiveRange           AdaptiveRange   `json:"adaptiveRange" yaml:"adaptiveRange"`
+	MultiSource             MultiSource     `json:"multiSource" yaml:"multiSource"`
+	DownloadThrough         DownloadThrough `json:"downloadThrough" yaml:"downloadThrough"`
+	Journal                 bool            `json:"journal" yaml:"journal"` // 记录进行中的回源下载，重启后自动恢复
+	Priority                Priority        `json:"priority" yaml:"priority"`
+	Timeout                 Timeout         `json:"timeout" yaml:"timeout"`
+}
+
+// Timeout 回源请求各阶段的超时，reqTimeout为0时避免在失效的连接上无限等待。单位毫秒，0使用默认值，负数表示不限制。
+type Timeout struct {
+	Connect   int64 `json:"connect" yaml:"connect"`     // 建立连接（含TLS握手），默认10秒
+	FirstByte int64 `json:"firstByte" yaml:"firstByte"` // 发出请求后等待响应头，默认30秒
+	IdleRead  int64 `json:"idleRead" yaml:"idleRead"`   // 读取响应体时等待下一段数据，超时后从断点重试，默认30秒
+	Stall     int64 `json:"stall" yaml:"stall"`         // 分段持续收不到数据（含重试）时，改用其他上游请求剩余区间，默认60秒
+}
+
+// Priority 回源连接按优先级调度：客户端请求优先于集群内其他节点的请求，其次是预热与后台下载。
+type Priority struct {
+	Enabled       bool  `json:"enabled" yaml:"enabled"`
+	MaxConcurrent int   `json:"maxConcurrent" yaml:"maxConcurrent"` // 全局回源连接数
+	Weights       []int `json:"weights" yaml:"weights"`             // 各优先级同时等待时按权重分配连接，依次为客户端、节点、后台
+	Preempt       bool  `json:"preempt" yaml:"preempt"`             // 连接已满时让低优先级的连接暂停，把连接让给高优先级
+}
+
+// DownloadThrough 客户端断开后继续在后台下载请求的区间并写入缓存。
+type DownloadThrough struct {
+	Policy        string `json:"policy" yaml:"policy" validate:"omitempty,oneof=never always size progress"` // never、always、size（文件不超过MaxFileSize）、progress（已缓存超过MinProgress）
+	MaxFileSize   int64  `json:"maxFileSize" yaml:"maxFileSize"`                                             // 单位字节
+	MinProgress   int    `json:"minProgress" yaml:"minProgress"`                                             // 已缓存的百分比
+	MaxTasks      int    `json:"maxTasks" yaml:"maxTasks"`                                                   // 同时在后台下载的请求数
+	MaxBudgetSize int64  `json:"maxBudgetSize" yaml:"maxBudgetSize"`                                         // 后台下载的剩余字节数总和上限，0表示不限
+}
+
+// MultiSource 同一文件的不同区间同时从多个上游下载，按各上游的实际速度分配，合并写入同一缓存文件。
+type MultiSource struct {
+	Enabled   bool       `json:"enabled" yaml:"enabled"`
+	Upstreams []Upstream `json:"upstreams" yaml:"upstreams"`
+}
+
+type Upstream struct {
+	Domain string `json:"domain" yaml:"domain"` // 上游地址，如https://huggingface.co
+	Proxy  bool   `json:"proxy" yaml:"proxy"`   // 是否经由httpProxy访问
+}
+
+// AdaptiveRange 自适应分段下载：先以少量连接下载，按吞吐逐步增加连接，空闲连接拆分剩余最多的分段。
+type AdaptiveRange struct {
+	Enabled       bool  `json:"enabled" yaml:"enabled"`
+	InitialRanges int   `json:"initialRanges" yaml:"initialRanges"` // 初始分段数
+	MinSplitSize  int64 `json:"minSplitSize" yaml:"minSplitSize"`   // 剩余字节数小于该值的分段不再拆分，单位字节
+	MinStealTime  int64 `json:"minStealTime" yaml:"minStealTime"`   // 按当前速度剩余下载时间小于该值的分段不再拆分，单位毫秒
 }
 
 type Cache struct {
-	DefaultExpiration int       `json:"defaultExpiration" yaml:"defaultExpiration" `
-	CleanupInterval   int       `json:"cleanupInterval" yaml:"cleanupInterval"`
-	ReadBlock         ReadBlock `json:"readBlock" yaml:"readBlock"`
-	MountModelDir     string    `json:"mountModelDir" yaml:"mountModelDir"`
+	DefaultExpiration int         `json:"defaultExpiration" yaml:"defaultExpiration" `
+	CleanupInterval   int         `json:"cleanupInterval" yaml:"cleanupInterval"`
+	ReadBlock         ReadBlock   `json:"readBlock" yaml:"readBlock"`
+	MountModelDir     string      `json:"mountModelDir" yaml:"mountModelDir"`
+	Migrate           Migrate     `json:"migrate" yaml:"migrate"`
+	HeaderFlush       HeaderFlush `json:"headerFlush" yaml:"headerFlush"`
+	Compression       Compression `json:"compression" yaml:"compression"`
+}
+
+type Compression struct {
+	Enabled           bool     `json:"enabled" yaml:"enabled"`
+	RepoTypes         []string `json:"repoTypes" yaml:"repoTypes"`                 // 按仓库类型压缩，如datasets
+	Extensions        []string `json:"extensions" yaml:"extensions"`               // 按扩展名压缩，如.json、.csv
+	ExcludeExtensions []string `json:"excludeExtensions" yaml:"excludeExtensions"` // 不压缩的扩展名，优先于RepoTypes，如.safetensors
+}
+
+type HeaderFlush struct {
+	Blocks   int    `json:"blocks" yaml:"blocks"`     // 每写入N个块刷新一次头部
+	Interval int    `json:"interval" yaml:"interval"` // 头部最长刷新间隔，单位毫秒
+	Fsync    string `json:"fsync" yaml:"fsync"`       // 落盘方式：none/header/always
+}
+
+type Migrate struct {
+	Enabled      bool `json:"enabled" yaml:"enabled"`           // 启动时将旧版本缓存文件升级到当前版本
+	ReportPeriod int  `json:"reportPeriod" yaml:"reportPeriod"` // 迁移进度输出周期，单位秒
 }
 
 type ReadBlock struct {
@@ -96,8 +170,8 @@ type ReadBlock struct {
 	Type                        int     `json:"type" yaml:"type"`
 	CollectTimePeriod           int     `json:"collectTimePeriod" yaml:"collectTimePeriod" validate:"min=1,max=600"` // 周期采集内存使用量，单位秒
 	PrefetchMemoryUsedThreshold float64 `json:"prefetchMemoryUsedThreshold" yaml:"prefetchMemoryUsedThreshold" validate:"min=50,max=99"`
-	PrefetchBlocks              int64   `json:"prefetchBlocks" yaml:"prefetchBlocks" validate:"min=1,max=32"`      // 读取块数据，预先缓存的块数据数量
-	PrefetchBlockTTL            int64   `json:"prefetchBlockTTL" yaml:"prefetchBlockTTL" validate:"min=1,max=120"` // 读取块数据，预先缓存的块数据数量
+	PrefetchBlocks              int64   `json:"prefetchBlocks" yaml:"prefetchBlocks" validate:"min=1,max=32"` // 顺序读取时预读窗口的最大块数
+	MaxSize                     int64   `json:"maxSize" yaml:"maxSize"`                                       // 内存块缓存占用的上限，单位字节
 }
 
 type Scheduler struct {
@@ -123,8 +197,18 @@ type Discovery struct {
 }
 
 type Retry struct {
-	Delay    int  `json:"delay" yaml:"delay" validate:"min=0,max=60"`
-	Attempts uint `json:"attempts" yaml:"attempts" validate:"min=1,max=5"`
+	Delay    int     `json:"delay" yaml:"delay" validate:"min=0,max=60"`
+	Attempts uint    `json:"attempts" yaml:"attempts" validate:"min=1,max=5"`
+	MaxDelay int     `json:"maxDelay" yaml:"maxDelay"` // 指数退避的最大间隔，单位秒
+	Breaker  Breaker `json:"breaker" yaml:"breaker"`
+}
+
+// Breaker 按上游域名熔断，连续失败达到阈值后在熔断时长内直接失败，之后放行一个探测请求。
+type Breaker struct {
+	Enabled          bool `json:"enabled" yaml:"enabled"`
+	FailureThreshold int  `json:"failureThreshold" yaml:"failureThreshold"`
+	OpenTime         int  `json:"openTime" yaml:"openTime"`       // 首次熔断时长，单位秒，之后每次翻倍
+	MaxOpenTime      int  `json:"maxOpenTime" yaml:"maxOpenTime"` // 最长熔断时长，单位秒
 }
 
 type LogConfig struct {
@@ -133,10 +217,15 @@ type LogConfig struct {
 	MaxAge     int `json:"maxAge" yaml:"maxAge"`
 }
 
+// TokenBucketLimit 带宽限制，速率单位为字节/秒，0表示不限速；容量为允许的突发字节数，0表示取1秒的速率。
 type TokenBucketLimit struct {
-	Capacity        int `json:"capacity" yaml:"capacity"`
-	Rate            int `json:"rate" yaml:"rate"`
-	HandlerCapacity int `json:"handlerCapacity" yaml:"handlerCapacity"`
+	Capacity        int   `json:"capacity" yaml:"capacity"` // 上游下载总带宽
+	Rate            int   `json:"rate" yaml:"rate"`
+	ClientCapacity  int64 `json:"clientCapacity" yaml:"clientCapacity"` // 每个客户端IP的响应带宽
+	ClientRate      int64 `json:"clientRate" yaml:"clientRate"`
+	RepoCapacity    int64 `json:"repoCapacity" yaml:"repoCapacity"` // 每个仓库的上游下载带宽
+	RepoRate        int64 `json:"repoRate" yaml:"repoRate"`
+	HandlerCapacity int   `json:"handlerCapacity" yaml:"handlerCapacity"`
 }
 
 type DiskClean struct {
@@ -183,6 +272,12 @@ func (c *Config) GetXetNetLoc() string {
 	return c.Server.XetNetLoc
 }
 
+// EnableXetRedirect 为true时大文件仍按官方方式返回Location/Link，客户端直连cas-bridge下载，离线时改由本服务提供已缓存的数据；
+// 默认由本服务解析cas-bridge的预签名地址拉取数据并写入块缓存，离线与集群节点均可复用。
+func (c *Config) EnableXetRedirect() bool {
+	return c.Server.XetRedirect
+}
+
 func (c *Config) GetMinimumFileSize() int64 {
 	return c.Scheduler.Strategy.MinimumFileSize
 }
@@ -215,13 +310,132 @@ func (c *Config) GetBpHfNetLoc() string {
 }
 
 func (c *Config) GetCapacity() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	return c.TokenBucketLimit.Capacity
 }
 
 func (c *Config) GetRate() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	return c.TokenBucketLimit.Rate
 }
 
+// GetBandwidthLimit 带宽限制可热更新，读取时需加锁
+func (c *Config) GetBandwidthLimit() TokenBucketLimit {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.TokenBucketLimit
+}
+
+// SetBandwidthLimit 更新带宽限制，HandlerCapacity在启动时已生效，不随之修改
+func (c *Config) SetBandwidthLimit(limit TokenBucketLimit) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	limit.HandlerCapacity = c.TokenBucketLimit.HandlerCapacity
+	c.TokenBucketLimit = limit
+}
+
+func (c *Config) GetRetryDelay() time.Duration {
+	return time.Duration(c.Retry.Delay) * time.Second
+}
+
+func (c *Config) GetRetryMaxDelay() time.Duration {
+	if c.Retry.MaxDelay <= 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(c.Retry.MaxDelay) * time.Second
+}
+
+func (c *Config) EnableBreaker() bool {
+	return c.Retry.Breaker.Enabled
+}
+
+func (c *Config) GetBreakerFailureThreshold() int {
+	if c.Retry.Breaker.FailureThreshold <= 0 {
+		return 5
+	}
+	return c.Retry.Breaker.FailureThreshold
+}
+
+func (c *Config) GetBreakerOpenTime() time.Duration {
+	if c.Retry.Breaker.OpenTime <= 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(c.Retry.Breaker.OpenTime) * time.Second
+}
+
+func (c *Config) GetBreakerMaxOpenTime() time.Duration {
+	if c.Retry.Breaker.MaxOpenTime <= 0 {
+		return 5 * time.Minute
+	}
+	return max(time.Duration(c.Retry.Breaker.MaxOpenTime)*time.Second, c.GetBreakerOpenTime())
+}
+
+func (c *Config) EnableDownloadJournal() bool {
+	return c.Download.Journal
+}
+
+// JournalKeyEnv 加密下载记录中token的密钥所在的环境变量，不放在配置文件中，避免随配置输出到日志
+const JournalKeyEnv = "DINGOSPEED_JOURNAL_KEY"
+
+// GetJournalKey 未设置时下载记录不保存token，恢复的下载不携带token
+func (c *Config) GetJournalKey() string {
+	return os.Getenv(JournalKeyEnv)
+}
+
+func (c *Config) EnablePriority() bool {
+	return c.Download.Priority.Enabled
+}
+
+func (c *Config) GetPriorityMaxConcurrent() int {
+	if c.Download.Priority.MaxConcurrent <= 0 {
+		return 32
+	}
+	return c.Download.Priority.MaxConcurrent
+}
+
+// GetPriorityWeights 返回各优先级的权重，未配置或配置不全时使用默认值8:4:1
+func (c *Config) GetPriorityWeights() []int {
+	weights := []int{8, 4, 1}
+	for i, w := range c.Download.Priority.Weights {
+		if i < len(weights) && w > 0 {
+			weights[i] = w
+		}
+	}
+	return weights
+}
+
+func (c *Config) EnablePriorityPreempt() bool {
+	return c.Download.Priority.Preempt
+}
+
+func (c *Config) GetDownloadThroughPolicy() string {
+	if c.Download.DownloadThrough.Policy == "" {
+		return consts.DownloadThroughNever
+	}
+	return c.Download.DownloadThrough.Policy
+}
+
+func (c *Config) GetDownloadThroughMaxFileSize() int64 {
+	return c.Download.DownloadThrough.MaxFileSize
+}
+
+func (c *Config) GetDownloadThroughMinProgress() int {
+	return c.Download.DownloadThrough.MinProgress
+}
+
+func (c *Config) GetDownloadThroughMaxTasks() int {
+	if c.Download.DownloadThrough.MaxTasks <= 0 {
+		return 4
+	}
+	return c.Download.DownloadThrough.MaxTasks
+}
+
+func (c *Config) GetDownloadThroughMaxBudgetSize() int64 {
+	return c.Download.DownloadThrough.MaxBudgetSize
+}
+
 func (c *Config) GetHfScheme() string {
 	return c.Server.HfScheme
 }
@@ -230,6 +444,33 @@ func (c *Config) GetReqTimeOut() time.Duration {
 	return time.Duration(c.Download.ReqTimeout) * time.Second
 }
 
+func (c *Config) GetConnectTimeout() time.Duration {
+	return timeoutOrDefault(c.Download.Timeout.Connect, 10*time.Second)
+}
+
+func (c *Config) GetFirstByteTimeout() time.Duration {
+	return timeoutOrDefault(c.Download.Timeout.FirstByte, 30*time.Second)
+}
+
+func (c *Config) GetIdleReadTimeout() time.Duration {
+	return timeoutOrDefault(c.Download.Timeout.IdleRead, 30*time.Second)
+}
+
+func (c *Config) GetStallTimeout() time.Duration {
+	return timeoutOrDefault(c.Download.Timeout.Stall, 60*time.Second)
+}
+
+// timeoutOrDefault 将毫秒转换为时长，0使用默认值，负数返回0表示不限制
+func timeoutOrDefault(ms int64, defaultTimeout time.Duration) time.Duration {
+	if ms < 0 {
+		return 0
+	}
+	if ms == 0 {
+		return defaultTimeout
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
 func (c *Config) GetCollectTimePeriod() time.Duration {
 	if c.Cache.ReadBlock.CollectTimePeriod == 0 {
 		c.Cache.ReadBlock.CollectTimePeriod = 5
@@ -245,6 +486,55 @@ func (c *Config) GetRemoteFileRangeWaitTime() time.Duration {
 	return time.Duration(c.Download.RemoteFileRangeWaitTime) * time.Millisecond
 }
 
+func (c *Config) EnableAdaptiveRange() bool {
+	return c.Download.AdaptiveRange.Enabled
+}
+
+func (c *Config) GetAdaptiveInitialRanges() int {
+	if c.Download.AdaptiveRange.InitialRanges <= 0 {
+		c.Download.AdaptiveRange.InitialRanges = 2
+	}
+	return min(c.Download.AdaptiveRange.InitialRanges, c.Download.GoroutineMaxNumPerFile)
+}
+
+func (c *Config) GetAdaptiveMinSplitSize() int64 {
+	if c.Download.AdaptiveRange.MinSplitSize <= 0 {
+		c.Download.AdaptiveRange.MinSplitSize = 2 * c.Download.BlockSize
+	}
+	return c.Download.AdaptiveRange.MinSplitSize
+}
+
+func (c *Config) GetAdaptiveMinStealTime() time.Duration {
+	if c.Download.AdaptiveRange.MinStealTime <= 0 {
+		c.Download.AdaptiveRange.MinStealTime = 2000
+	}
+	return time.Duration(c.Download.AdaptiveRange.MinStealTime) * time.Millisecond
+}
+
+func (c *Config) EnableMultiSource() bool {
+	return c.Download.MultiSource.Enabled
+}
+
+// GetUpstreams 返回多源下载的上游，未配置时使用经由代理的hfNetLoc与直连的bpHfNetLoc。
+func (c *Config) GetUpstreams() []Upstream {
+	if len(c.Download.MultiSource.Upstreams) > 0 {
+		return c.Download.MultiSource.Upstreams
+	}
+	upstreams := []Upstream{{Domain: c.GetHFURLBase(), Proxy: true}}
+	if backup := c.GetBackupUpstream(); backup != nil {
+		upstreams = append(upstreams, *backup)
+	}
+	return upstreams
+}
+
+// GetBackupUpstream 返回直连的bpHfNetLoc，分段在hfNetLoc上停滞时改用该地址，未配置时返回nil。
+func (c *Config) GetBackupUpstream() *Upstream {
+	if c.GetBpHfNetLoc() == "" || c.GetBpHfNetLoc() == c.GetHfNetLoc() {
+		return nil
+	}
+	return &Upstream{Domain: c.GetBpHFURLBase()}
+}
+
 func (c *Config) GetDefaultExpiration() time.Duration {
 	if c.Cache.DefaultExpiration == 0 {
 		c.Cache.DefaultExpiration = 30
@@ -270,11 +560,60 @@ func (c *Config) GetPrefetchBlocks() int64 {
 	return c.Cache.ReadBlock.PrefetchBlocks
 }
 
-func (c *Config) GetPrefetchBlockTTL() time.Duration {
-	if c.Cache.ReadBlock.PrefetchBlockTTL == 0 {
-		c.Cache.ReadBlock.PrefetchBlockTTL = 30
+func (c *Config) GetBlockCacheMaxSize() int64 {
+	if c.Cache.ReadBlock.MaxSize == 0 {
+		c.Cache.ReadBlock.MaxSize = 1 << 30
+	}
+	return c.Cache.ReadBlock.MaxSize
+}
+
+func (c *Config) EnableCacheMigrate() bool {
+	return c.Cache.Migrate.Enabled
+}
+
+func (c *Config) GetMigrateReportPeriod() time.Duration {
+	if c.Cache.Migrate.ReportPeriod <= 0 {
+		c.Cache.Migrate.ReportPeriod = 30
+	}
+	return time.Duration(c.Cache.Migrate.ReportPeriod) * time.Second
+}
+
+func (c *Config) GetHeaderFlushBlocks() int {
+	if c.Cache.HeaderFlush.Blocks <= 0 {
+		c.Cache.HeaderFlush.Blocks = 16
+	}
+	return c.Cache.HeaderFlush.Blocks
+}
+
+func (c *Config) GetHeaderFlushInterval() time.Duration {
+	if c.Cache.HeaderFlush.Interval <= 0 {
+		c.Cache.HeaderFlush.Interval = 1000
+	}
+	return time.Duration(c.Cache.HeaderFlush.Interval) * time.Millisecond
+}
+
+func (c *Config) GetFsyncMode() string {
+	switch c.Cache.HeaderFlush.Fsync {
+	case consts.FsyncHeader, consts.FsyncAlways:
+		return c.Cache.HeaderFlush.Fsync
+	default:
+		return consts.FsyncNone
+	}
+}
+
+// ShouldCompress 新缓存的文件是否压缩存放，扩展名匹配优先，其次按仓库类型（排除不可压缩的扩展名）。
+func (c *Config) ShouldCompress(repoType, fileName string) bool {
+	if !c.Cache.Compression.Enabled {
+		return false
+	}
+	ext := strings.ToLower(filepath.Ext(fileName))
+	if ext != "" && slices.Contains(c.Cache.Compression.Extensions, ext) {
+		return true
+	}
+	if ext != "" && slices.Contains(c.Cache.Compression.ExcludeExtensions, ext) {
+		return false
 	}
-	return time.Duration(c.Cache.ReadBlock.PrefetchBlockTTL) * time.Second
+	return slices.Contains(c.Cache.Compression.RepoTypes, repoType)
 }
 
 func (c *Config) GetDiskCollectTimePeriod() time.Duration {
@@ -105,6 +105,21 @@ const (
 	TaskMoreErrMsg = "当前缓存任务较多导致启动失败，请稍后再启动。"
 )
 
+// 缓存文件落盘方式
+const (
+	FsyncNone   = "none"   // 不主动fsync，由操作系统决定落盘时机
+	FsyncHeader = "header" // 刷新头部时fsync
+	FsyncAlways = "always" // 每写入一个块都fsync
+)
+
+// 客户端断开后是否继续后台下载
+const (
+	DownloadThroughNever    = "never"    // 随客户端一起取消
+	DownloadThroughAlways   = "always"   // 总是继续
+	DownloadThroughSize     = "size"     // 文件不超过maxFileSize时继续
+	DownloadThroughProgress = "progress" // 已缓存超过minProgress时继续
+)
+
 const (
 	ModelCacheRoot   = "modelscope/models"
 	DatasetCacheRoot = "modelscope/datasets"
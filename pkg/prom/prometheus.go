@@ -55,6 +55,109 @@ var (
 		Name: "request_response_byte",
 		Help: "Total number of request response byte",
 	}, []string{"source", "orgRepo"})
+
+	// 缓存块校验失败数
+
+	BlockChecksumFailCnt = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "block_checksum_fail_cnt",
+		Help: "Total number of cached blocks failing checksum verification",
+	})
+
+	// blob完整性校验结果，mismatch表示已被隔离
+
+	BlobVerifyCnt = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "blob_verify_cnt",
+		Help: "Total number of completed blobs verified against the upstream oid",
+	}, []string{"result"})
+
+	// 上游熔断状态，0关闭，1半开，2熔断
+
+	UpstreamBreakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "upstream_breaker_state",
+		Help: "Circuit breaker state of each upstream host, 0 closed, 1 half-open, 2 open",
+	}, []string{"host"})
+
+	UpstreamBreakerOpenCnt = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "upstream_breaker_open_cnt",
+		Help: "Total number of times the circuit breaker of each upstream host opened",
+	}, []string{"host"})
+
+	// 客户端断开后在后台继续下载的请求数与剩余字节数
+
+	BackgroundDownloadCnt = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "background_download_cnt",
+		Help: "Number of downloads continuing after the client disconnected",
+	})
+
+	BackgroundDownloadByte = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "background_download_byte",
+		Help: "Remaining bytes reserved by background downloads",
+	})
+
+	// 限速等待时长，level为upstream、repo或client
+
+	BandwidthWaitSeconds = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bandwidth_wait_seconds",
+		Help: "Total seconds spent waiting for bandwidth tokens",
+	}, []string{"level"})
+
+	// 回源分段按优先级调度，priority为interactive、inner或background
+
+	UpstreamTaskRunning = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "upstream_task_running",
+		Help: "Number of upstream range tasks holding a connection slot",
+	}, []string{"priority"})
+
+	UpstreamTaskWaiting = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "upstream_task_waiting",
+		Help: "Number of upstream range tasks waiting for a connection slot",
+	}, []string{"priority"})
+
+	UpstreamPreemptCnt = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "upstream_preempt_cnt",
+		Help: "Number of upstream range tasks asked to yield to higher priority tasks",
+	}, []string{"priority"})
+
+	// 回源分段停滞后改用其他上游的次数
+
+	UpstreamStallCnt = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "upstream_stall_cnt",
+		Help: "Number of upstream range requests cancelled by the stall watchdog",
+	}, []string{"domain"})
+
+	// 内存块缓存的命中、未命中与淘汰次数，以及预读的块数
+
+	BlockCacheHitCnt = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "block_cache_hit_cnt",
+		Help: "Number of block reads served from the in-memory block cache",
+	})
+
+	BlockCacheMissCnt = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "block_cache_miss_cnt",
+		Help: "Number of block reads that missed the in-memory block cache",
+	})
+
+	BlockCachePrefetchCnt = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "block_cache_prefetch_cnt",
+		Help: "Number of blocks read ahead into the in-memory block cache",
+	})
+
+	BlockCacheEvictCnt = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "block_cache_evict_cnt",
+		Help: "Number of blocks evicted from the in-memory block cache",
+	})
+
+	// 内存块缓存占用的字节数与块数
+
+	BlockCacheByte = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "block_cache_byte",
+		Help: "Bytes held by the in-memory block cache",
+	})
+
+	BlockCacheBlockCnt = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "block_cache_block_cnt",
+		Help: "Number of blocks held by the in-memory block cache",
+	})
 )
 
 func PromSourceCounter(vec *prometheus.GaugeVec, source string) {
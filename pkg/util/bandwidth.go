@@ -0,0 +1,166 @@
+//  Copyright (c) 2025 dingodb.com, Inc. All Rights Reserved
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http:www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package util
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"dingospeed/pkg/common"
+	"dingospeed/pkg/config"
+	"dingospeed/pkg/consts"
+	"dingospeed/pkg/prom"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	BandwidthUpstream = "upstream"
+	BandwidthRepo     = "repo"
+	BandwidthClient   = "client"
+
+	bucketIdleTimeout = 10 * time.Minute
+	bucketPruneSize   = 256
+	limitedReadSize   = 64 * 1024
+)
+
+type keyedBucket struct {
+	bucket   *common.TokenBucket
+	lastUsed time.Time
+}
+
+// keyedBuckets 按客户端IP或仓库划分的令牌桶，长时间未使用的桶在数量较多时清理。
+type keyedBuckets struct {
+	mu      sync.Mutex
+	buckets map[string]*keyedBucket
+}
+
+func (k *keyedBuckets) get(key string, rate, capacity int64) *common.TokenBucket {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	now := time.Now()
+	if b, ok := k.buckets[key]; ok {
+		b.lastUsed = now
+		return b.bucket
+	}
+	if len(k.buckets) >= bucketPruneSize {
+		for key, b := range k.buckets {
+			if now.Sub(b.lastUsed) > bucketIdleTimeout {
+				delete(k.buckets, key)
+			}
+		}
+	}
+	b := &keyedBucket{bucket: common.NewTokenBucket(rate, capacity), lastUsed: now}
+	k.buckets[key] = b
+	return b.bucket
+}
+
+func (k *keyedBuckets) setLimit(rate, capacity int64) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if rate <= 0 { // 不限速时丢弃所有桶，正在等待的请求按原速率完成本次等待
+		clear(k.buckets)
+		return
+	}
+	for _, b := range k.buckets {
+		b.bucket.SetLimit(rate, capacity)
+	}
+}
+
+var (
+	upstreamBucket *common.TokenBucket
+	repoBuckets    = &keyedBuckets{buckets: make(map[string]*keyedBucket)}
+	clientBuckets  = &keyedBuckets{buckets: make(map[string]*keyedBucket)}
+	bandwidthOnce  sync.Once
+)
+
+func getUpstreamBucket() *common.TokenBucket {
+	bandwidthOnce.Do(func() {
+		limit := config.SysConfig.GetBandwidthLimit()
+		upstreamBucket = common.NewTokenBucket(int64(limit.Rate), int64(limit.Capacity))
+	})
+	return upstreamBucket
+}
+
+// SetBandwidthLimit 热更新带宽限制，已有的令牌桶立即按新速率发放令牌。
+func SetBandwidthLimit(limit config.TokenBucketLimit) {
+	config.SysConfig.SetBandwidthLimit(limit)
+	getUpstreamBucket().SetLimit(int64(limit.Rate), int64(limit.Capacity))
+	repoBuckets.setLimit(limit.RepoRate, limit.RepoCapacity)
+	clientBuckets.setLimit(limit.ClientRate, limit.ClientCapacity)
+}
+
+// WaitUpstream 回源读取n字节前获取令牌，依次受全局上游带宽与所属仓库带宽限制。
+func WaitUpstream(ctx context.Context, orgRepo string, n int) error {
+	if err := waitBucket(ctx, getUpstreamBucket(), BandwidthUpstream, n); err != nil {
+		return err
+	}
+	limit := config.SysConfig.GetBandwidthLimit()
+	if limit.RepoRate <= 0 || orgRepo == "" {
+		return nil
+	}
+	return waitBucket(ctx, repoBuckets.get(orgRepo, limit.RepoRate, limit.RepoCapacity), BandwidthRepo, n)
+}
+
+// WaitClient 向客户端写入n字节前获取令牌，集群内节点之间的请求不限速。
+func WaitClient(c echo.Context, n int) error {
+	bucket := clientBucket(c)
+	if bucket == nil {
+		return nil
+	}
+	return waitBucket(c.Request().Context(), bucket, BandwidthClient, n)
+}
+
+func clientBucket(c echo.Context) *common.TokenBucket {
+	limit := config.SysConfig.GetBandwidthLimit()
+	if limit.ClientRate <= 0 || c.Request().Header.Get(consts.RequestSourceInner) == "1" {
+		return nil
+	}
+	ip := Itoa(c.Get(consts.PromSource))
+	if ip == "" {
+		ip = c.RealIP()
+	}
+	return clientBuckets.get(ip, limit.ClientRate, limit.ClientCapacity)
+}
+
+func waitBucket(ctx context.Context, bucket *common.TokenBucket, level string, n int) error {
+	waited, err := bucket.WaitN(ctx, n)
+	if waited > 0 && config.SysConfig.EnableMetric() {
+		prom.BandwidthWaitSeconds.WithLabelValues(level).Add(waited.Seconds())
+	}
+	return err
+}
+
+// clientLimitedReader 按客户端带宽限制读取，每次最多读取limitedReadSize字节。
+type clientLimitedReader struct {
+	ctx    context.Context
+	bucket *common.TokenBucket
+	r      io.Reader
+}
+
+func (l *clientLimitedReader) Read(p []byte) (int, error) {
+	if len(p) > limitedReadSize {
+		p = p[:limitedReadSize]
+	}
+	n, err := l.r.Read(p)
+	if n > 0 {
+		if werr := waitBucket(l.ctx, l.bucket, BandwidthClient, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
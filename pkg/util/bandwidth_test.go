@@ -0,0 +1,91 @@
+//  Copyright (c) 2025 dingodb.com, Inc. All Rights Reserved
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http:www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package util
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"dingospeed/pkg/config"
+	"dingospeed/pkg/consts"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestBandwidthLimit(t *testing.T) {
+	config.SysConfig = &config.Config{}
+	SetBandwidthLimit(config.TokenBucketLimit{Rate: 16 * 1024, Capacity: 4096, RepoRate: 1 << 30})
+	defer SetBandwidthLimit(config.TokenBucketLimit{})
+	ctx := context.Background()
+	start := time.Now()
+	// 突发4KB，其余约12KB按16KB/s发放
+	for i := 0; i < 4; i++ {
+		if err := WaitUpstream(ctx, "org/repo", 4096); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 600*time.Millisecond {
+		t.Fatalf("upstream should be shaped, elapsed:%v", elapsed)
+	}
+	// 仓库限速在全局限速之后生效
+	SetBandwidthLimit(config.TokenBucketLimit{RepoRate: 16 * 1024, RepoCapacity: 4096})
+	start = time.Now()
+	for i := 0; i < 2; i++ {
+		if err := WaitUpstream(ctx, "org/limited", 4096); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Fatalf("repo should be shaped, elapsed:%v", elapsed)
+	}
+	if err := WaitUpstream(ctx, "", 1<<20); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientBandwidth(t *testing.T) {
+	config.SysConfig = &config.Config{}
+	SetBandwidthLimit(config.TokenBucketLimit{ClientRate: 16 * 1024, ClientCapacity: 4096})
+	defer SetBandwidthLimit(config.TokenBucketLimit{})
+	newContext := func(ip string, inner bool) echo.Context {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(echo.HeaderXRealIP, ip)
+		if inner {
+			req.Header.Set(consts.RequestSourceInner, "1")
+		}
+		return echo.New().NewContext(req, httptest.NewRecorder())
+	}
+	// 集群内节点之间的请求不限速
+	if clientBucket(newContext("10.0.0.1", true)) != nil {
+		t.Fatal("inner request should not be limited")
+	}
+	// 每个客户端IP使用各自的令牌桶
+	if clientBucket(newContext("10.0.0.1", false)) == clientBucket(newContext("10.0.0.2", false)) {
+		t.Fatal("clients should not share a bucket")
+	}
+	c := newContext("10.0.0.3", false)
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		if err := WaitClient(c, 4096); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Fatalf("client should be shaped, elapsed:%v", elapsed)
+	}
+}
@@ -0,0 +1,274 @@
+//  Copyright (c) 2025 dingodb.com, Inc. All Rights Reserved
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http:www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"dingospeed/internal/model"
+	"dingospeed/pkg/config"
+	"dingospeed/pkg/prom"
+
+	"github.com/avast/retry-go"
+	"go.uber.org/zap"
+)
+
+type BreakerState int
+
+const (
+	BreakerClosed   BreakerState = iota // 正常放行
+	BreakerHalfOpen                     // 熔断到期，放行一个探测请求
+	BreakerOpen                         // 熔断中，请求直接失败
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerHalfOpen:
+		return "half-open"
+	case BreakerOpen:
+		return "open"
+	default:
+		return "closed"
+	}
+}
+
+// BreakerOpenError 上游处于熔断状态，请求未发出
+type BreakerOpenError struct {
+	Host       string
+	RetryAfter time.Duration
+}
+
+func (e *BreakerOpenError) Error() string {
+	return fmt.Sprintf("upstream %s circuit breaker is open, retry after %s", e.Host, e.RetryAfter)
+}
+
+// Breaker 单个上游域名的熔断器
+type Breaker struct {
+	host      string
+	mu        sync.Mutex
+	state     BreakerState
+	failures  int // 连续失败次数
+	opens     int // 连续熔断次数，决定熔断时长
+	openUntil time.Time
+	probing   bool
+	lastError string
+}
+
+var (
+	breakers   = make(map[string]*Breaker)
+	breakersMu sync.Mutex
+)
+
+// GetBreaker 返回域名对应的熔断器，未启用熔断时返回nil，nil可直接使用。
+func GetBreaker(domain string) *Breaker {
+	if !config.SysConfig.EnableBreaker() {
+		return nil
+	}
+	host := breakerHost(domain)
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	b, ok := breakers[host]
+	if !ok {
+		b = &Breaker{host: host}
+		breakers[host] = b
+	}
+	return b
+}
+
+func breakerHost(domain string) string {
+	if u, err := url.Parse(domain); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return domain
+}
+
+// Allow 判断请求能否发出。熔断到期后只放行一个探测请求，其余请求在探测结束前仍直接失败。
+func (b *Breaker) Allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if wait := time.Until(b.openUntil); wait > 0 {
+			return &BreakerOpenError{Host: b.host, RetryAfter: wait}
+		}
+		b.setState(BreakerHalfOpen)
+	case BreakerClosed:
+		return nil
+	}
+	if b.probing {
+		return &BreakerOpenError{Host: b.host}
+	}
+	b.probing = true
+	return nil
+}
+
+// Record 记录请求结果。网络错误、429与5xx计为失败，其余状态码说明上游可用；请求被取消不计入。
+func (b *Breaker) Record(resp *http.Response, err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	if err == nil && resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < http.StatusInternalServerError {
+		if b.state != BreakerClosed {
+			zap.S().Infof("upstream %s recovered, circuit breaker closed", b.host)
+		}
+		b.failures, b.opens = 0, 0
+		b.setState(BreakerClosed)
+		return
+	}
+	var retryAfter time.Duration
+	if err != nil {
+		b.lastError = err.Error()
+	} else {
+		b.lastError = resp.Status
+		retryAfter = ParseRetryAfter(resp.Header.Get("Retry-After"))
+	}
+	b.failures++
+	// 探测失败或连续失败达到阈值时熔断
+	if b.state == BreakerHalfOpen || b.failures >= config.SysConfig.GetBreakerFailureThreshold() {
+		b.open(retryAfter)
+	}
+}
+
+// open 熔断时长按连续熔断次数指数增长并加入随机抖动，避免各节点同时恢复请求；Retry-After更长时以其为准。
+func (b *Breaker) open(retryAfter time.Duration) {
+	maxOpen := config.SysConfig.GetBreakerMaxOpenTime()
+	wait := config.SysConfig.GetBreakerOpenTime() << min(b.opens, 16)
+	wait = min(wait, maxOpen)
+	wait -= time.Duration(rand.Int63n(int64(wait)/4 + 1))
+	wait = min(max(wait, retryAfter), maxOpen)
+	b.opens++
+	b.openUntil = time.Now().Add(wait)
+	b.setState(BreakerOpen)
+	zap.S().Warnf("upstream %s circuit breaker open for %s, failures:%d, last error:%s", b.host, wait, b.failures, b.lastError)
+	if config.SysConfig.EnableMetric() {
+		prom.UpstreamBreakerOpenCnt.WithLabelValues(b.host).Inc()
+	}
+}
+
+func (b *Breaker) setState(state BreakerState) {
+	b.state = state
+	if config.SysConfig.EnableMetric() {
+		prom.UpstreamBreakerState.WithLabelValues(b.host).Set(float64(state))
+	}
+}
+
+// IsOpen 上游熔断中或探测请求尚未返回，此时应按离线模式处理。熔断到期后返回false，以便放行探测请求。
+func (b *Breaker) IsOpen() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state == BreakerOpen && time.Now().Before(b.openUntil) || b.state == BreakerHalfOpen && b.probing
+}
+
+// BreakerInfos 返回所有上游的熔断状态，按域名排序
+func BreakerInfos() []model.BreakerInfo {
+	breakersMu.Lock()
+	all := make([]*Breaker, 0, len(breakers))
+	for _, b := range breakers {
+		all = append(all, b)
+	}
+	breakersMu.Unlock()
+	infos := make([]model.BreakerInfo, 0, len(all))
+	for _, b := range all {
+		b.mu.Lock()
+		info := model.BreakerInfo{Host: b.host, State: b.state.String(), Failures: b.failures, LastError: b.lastError}
+		if b.state == BreakerOpen {
+			info.OpenUntil = b.openUntil.Format(time.DateTime)
+		}
+		b.mu.Unlock()
+		infos = append(infos, info)
+	}
+	slices.SortFunc(infos, func(x, y model.BreakerInfo) int {
+		return strings.Compare(x.Host, y.Host)
+	})
+	return infos
+}
+
+// UpstreamOnline 节点在线且官方上游未熔断。熔断期间按离线模式使用本地缓存，而不是让每个请求都等待超时。
+func UpstreamOnline() bool {
+	domain, _ := upstreamDomain()
+	return config.SysConfig.Online() && !GetBreaker(domain).IsOpen()
+}
+
+// doRequest 经熔断器发出请求并记录结果
+func doRequest(client *http.Client, req *http.Request) (*http.Response, error) {
+	breaker := GetBreaker(req.URL.Host)
+	if err := breaker.Allow(); err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	breaker.Record(resp, err)
+	return resp, err
+}
+
+// StatusError 上游返回的错误状态码。429与5xx可重试，按Retry-After等待；其余4xx说明请求本身有误，不再重试。
+type StatusError struct {
+	StatusCode int
+	RetryAfter time.Duration
+}
+
+func NewStatusError(resp *http.Response) *StatusError {
+	return &StatusError{StatusCode: resp.StatusCode, RetryAfter: ParseRetryAfter(resp.Header.Get("Retry-After"))}
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("upstream status %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+func retryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+}
+
+// isRetryable 熔断、取消、停滞与4xx不再重试，429、5xx与网络错误按退避间隔重试
+func isRetryable(err error) bool {
+	var open *BreakerOpenError
+	if errors.As(err, &open) || errors.Is(err, context.Canceled) || errors.Is(err, ErrStalled) {
+		return false
+	}
+	var status *StatusError
+	if errors.As(err, &status) {
+		return retryableStatus(status.StatusCode)
+	}
+	return true
+}
+
+// retryDelay 上游给出Retry-After时按其等待，否则指数退避加随机抖动，都不超过配置的最大间隔
+func retryDelay(n uint, err error, c *retry.Config) time.Duration {
+	var status *StatusError
+	if errors.As(err, &status) && status.RetryAfter > 0 {
+		return status.RetryAfter
+	}
+	return retry.CombineDelay(retry.BackOffDelay, retry.RandomDelay)(n, err, c)
+}
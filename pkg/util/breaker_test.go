@@ -0,0 +1,131 @@
+//  Copyright (c) 2025 dingodb.com, Inc. All Rights Reserved
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http:www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package util
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"dingospeed/pkg/common"
+	"dingospeed/pkg/config"
+)
+
+func TestUpstreamBreaker(t *testing.T) {
+	config.SysConfig = &config.Config{}
+	config.SysConfig.Retry.Breaker = config.Breaker{Enabled: true, FailureThreshold: 2, OpenTime: 1}
+	var healthy atomic.Bool
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests.Add(1)
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	get := func() error {
+		return GetStream(context.Background(), server.URL, "/", map[string]string{}, func(*http.Response) error { return nil })
+	}
+	for i := 0; i < 2; i++ {
+		if err := get(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var open *BreakerOpenError
+	if err := get(); !errors.As(err, &open) || requests.Load() != 2 {
+		t.Fatalf("breaker should be open after 2 failures, err:%v, requests:%d", err, requests.Load())
+	}
+	// 熔断到期后放行探测请求，成功后恢复
+	healthy.Store(true)
+	time.Sleep(time.Second)
+	if err := get(); err != nil {
+		t.Fatal(err)
+	}
+	if GetBreaker(server.URL).IsOpen() || requests.Load() != 3 {
+		t.Fatalf("breaker should be closed after a successful probe, requests:%d", requests.Load())
+	}
+}
+
+func TestRetryRequest(t *testing.T) {
+	var requests atomic.Int32
+	var status atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if requests.Add(1) == 1 && status.Load() == http.StatusServiceUnavailable {
+			w.Header().Set("Retry-After", "1")
+		} else if status.Load() == http.StatusServiceUnavailable { // 等待Retry-After后重试成功
+			return
+		}
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer server.Close()
+	config.SysConfig = &config.Config{}
+	config.SysConfig.Retry.Attempts = 3
+	config.SysConfig.Server.HfScheme = "http"
+	config.SysConfig.Server.HfNetLoc = strings.TrimPrefix(server.URL, "http://")
+	get := func() (*common.Response, error) {
+		return RetryRequest(func() (*common.Response, error) {
+			return Get("/", map[string]string{})
+		})
+	}
+	for _, c := range []struct {
+		status   int
+		requests int32
+		want     int
+	}{
+		{http.StatusNotFound, 1, http.StatusNotFound},                       // 4xx不重试
+		{http.StatusInternalServerError, 3, http.StatusInternalServerError}, // 重试用尽后返回上游的响应
+		{http.StatusServiceUnavailable, 2, http.StatusOK},
+	} {
+		requests.Store(0)
+		status.Store(int32(c.status))
+		start := time.Now()
+		resp, err := get()
+		if err != nil || resp.StatusCode != c.want || requests.Load() != c.requests {
+			t.Fatalf("status %d, got %v, err:%v, requests:%d", c.status, resp, err, requests.Load())
+		}
+		if c.status == http.StatusServiceUnavailable && time.Since(start) < time.Second {
+			t.Fatalf("retry should wait for Retry-After, elapsed:%v", time.Since(start))
+		}
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		want bool
+	}{
+		{errors.New("connection reset"), true},
+		{&StatusError{StatusCode: http.StatusTooManyRequests}, true},
+		{&StatusError{StatusCode: http.StatusBadGateway}, true},
+		{&StatusError{StatusCode: http.StatusForbidden}, false},
+		{&StatusError{StatusCode: http.StatusNotFound}, false},
+		{&BreakerOpenError{Host: "hf.co"}, false},
+		{context.Canceled, false},
+		{ErrStalled, false},
+	} {
+		if got := isRetryable(c.err); got != c.want {
+			t.Errorf("isRetryable(%v) = %v, want %v", c.err, got, c.want)
+		}
+	}
+	delay := retryDelay(0, &StatusError{StatusCode: http.StatusServiceUnavailable, RetryAfter: 3 * time.Second}, nil)
+	if delay != 3*time.Second {
+		t.Fatalf("delay should follow Retry-After, got %v", delay)
+	}
+}
@@ -0,0 +1,129 @@
+//  Copyright (c) 2025 dingodb.com, Inc. All Rights Reserved
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http:www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package util
+
+import (
+	"math/bits"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	minBufferShift = 10 // 最小分级1KB
+	maxBufferShift = 27 // 最大分级128MB，覆盖允许配置的最大块大小
+)
+
+// bufferPools 按2的幂分级的缓冲池，第i级的容量为1<<(minBufferShift+i)
+var bufferPools [maxBufferShift - minBufferShift + 1]sync.Pool
+
+// GetBuffer 从缓冲池取出长度为size的缓冲区，内容未清零。超过最大分级时直接分配。
+// 缓冲区的持有者用完后调用PutBuffer归还，归还后不能再使用。
+func GetBuffer(size int) []byte {
+	class, ok := bufferClass(size)
+	if !ok {
+		return make([]byte, size)
+	}
+	if p, _ := bufferPools[class].Get().(*[]byte); p != nil {
+		return (*p)[:size]
+	}
+	return make([]byte, size, 1<<(minBufferShift+class))
+}
+
+// PutBuffer 归还GetBuffer取出的缓冲区。容量不是分级大小的切片（如带偏移的子切片、空切片）直接丢弃，由GC回收。
+// 只有独占的缓冲区才能归还，仍被其他地方引用的数据（如内存缓存中的块）不能归还。
+func PutBuffer(buf []byte) {
+	c := cap(buf)
+	if c < 1<<minBufferShift || c&(c-1) != 0 {
+		return
+	}
+	class, ok := bufferClass(c)
+	if !ok {
+		return
+	}
+	buf = buf[:c]
+	bufferPools[class].Put(&buf)
+}
+
+// bufferClass 返回能容纳size字节的最小分级
+func bufferClass(size int) (int, bool) {
+	if size <= 0 {
+		return 0, false
+	}
+	shift := bits.Len(uint(size - 1))
+	if shift > maxBufferShift {
+		return 0, false
+	}
+	return max(shift-minBufferShift, 0), true
+}
+
+// SharedBuffer 由多个持有者共用的池化缓冲区，如同一个块的数据同时交给缓存写入方与响应方。
+// 每个持有者用完后释放自己的引用，最后一个引用释放时归还缓冲池；未释放的缓冲区由GC回收，不会泄漏。
+type SharedBuffer struct {
+	buf  []byte
+	refs atomic.Int32
+}
+
+// NewSharedBuffer 从缓冲池取出长度为size的共用缓冲区，调用方持有第一个引用。
+func NewSharedBuffer(size int) *SharedBuffer {
+	return WrapBuffer(GetBuffer(size))
+}
+
+// WrapBuffer 把GetBuffer取出的缓冲区转为共用缓冲区，调用方持有第一个引用。
+func WrapBuffer(buf []byte) *SharedBuffer {
+	b := &SharedBuffer{buf: buf}
+	b.refs.Store(1)
+	return b
+}
+
+func (b *SharedBuffer) Bytes() []byte {
+	return b.buf
+}
+
+// Share 为data增加一个引用，data需是该缓冲区的子切片。
+func (b *SharedBuffer) Share(data []byte) Chunk {
+	b.refs.Add(1)
+	return Chunk{Data: data, buf: b}
+}
+
+// Release 释放一个引用，nil可直接使用。
+func (b *SharedBuffer) Release() {
+	if b != nil && b.refs.Add(-1) == 0 {
+		PutBuffer(b.buf)
+	}
+}
+
+// Chunk 数据流中的一段数据，Data可能是共用缓冲区的子切片，不能直接PutBuffer，接收方用完后调用Release。
+type Chunk struct {
+	Data []byte
+	buf  *SharedBuffer
+}
+
+// NewChunk 把GetBuffer取出的buf整个交给chunk，data为buf的子切片，chunk释放时归还buf。
+func NewChunk(buf, data []byte) Chunk {
+	return Chunk{Data: data, buf: WrapBuffer(buf)}
+}
+
+// Retain 为同一缓冲区增加一个持有者，新持有者用完后同样需要Release。
+func (c Chunk) Retain() Chunk {
+	if c.buf != nil {
+		c.buf.refs.Add(1)
+	}
+	return c
+}
+
+// Release 释放chunk持有的引用，不持有缓冲区的chunk（如建立连接用的空chunk）释放时不做任何事。
+func (c Chunk) Release() {
+	c.buf.Release()
+}
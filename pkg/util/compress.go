@@ -18,6 +18,7 @@ import (
 	"bytes"
 	"compress/gzip"
 	"compress/zlib"
+	"errors"
 	"fmt"
 	"io"
 	"strings"
@@ -28,84 +29,78 @@ import (
 
 // DecompressData 对压缩的数据进行解压缩
 func DecompressData(rawData []byte, contentEncoding string) ([]byte, error) {
-	fmt.Printf("decompress_data parameters:\n- content_encoding: %s\n", contentEncoding)
 	if contentEncoding == "" {
 		return rawData, nil
 	}
+	r, err := NewDecompressReader(bytes.NewReader(rawData), contentEncoding)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// NewDecompressReader 按content-encoding流式解码，多个编码按声明的逆序解码。
+func NewDecompressReader(r io.Reader, contentEncoding string) (io.ReadCloser, error) {
 	algorithms := strings.Split(contentEncoding, ",")
-	finalData := rawData
-	for _, algo := range algorithms {
-		algo = strings.TrimSpace(strings.ToLower(algo))
-		var err error
+	decoder := &multiReadCloser{Reader: r}
+	for i := len(algorithms) - 1; i >= 0; i-- {
+		algo := strings.TrimSpace(strings.ToLower(algorithms[i]))
 		switch algo {
-		case "gzip":
-			finalData, err = decompressGzip(finalData)
+		case "", "identity":
+			continue
+		case "gzip", "x-gzip":
+			gzr, err := gzip.NewReader(decoder.Reader)
 			if err != nil {
+				decoder.Close()
 				return nil, fmt.Errorf("error decompressing gzip data: %w", err)
 			}
+			decoder.push(gzr, gzr.Close)
 		case "deflate":
-			finalData, err = decompressDeflate(finalData)
+			zr, err := zlib.NewReader(decoder.Reader)
 			if err != nil {
+				decoder.Close()
 				return nil, fmt.Errorf("error decompressing deflate data: %w", err)
 			}
+			decoder.push(zr, zr.Close)
 		case "br":
-			finalData, err = decompressBrotli(finalData)
-			if err != nil {
-				return nil, fmt.Errorf("error decompressing Brotli data: %w", err)
-			}
+			decoder.push(brotli.NewReader(decoder.Reader), nil)
 		case "zstd":
-			finalData, err = decompressZstd(finalData)
+			zr, err := zstd.NewReader(decoder.Reader, zstd.WithDecoderConcurrency(1))
 			if err != nil {
+				decoder.Close()
 				return nil, fmt.Errorf("error decompressing Zstandard data: %w", err)
 			}
-		case "compress":
-			return nil, fmt.Errorf("unsupported decompression algorithm: %s", algo)
+			decoder.push(zr, func() error {
+				zr.Close()
+				return nil
+			})
 		default:
+			decoder.Close()
 			return nil, fmt.Errorf("unsupported compression algorithm: %s", algo)
 		}
 	}
-	return finalData, nil
+	return decoder, nil
 }
 
-// decompressGzip 解压缩 gzip 数据
-func decompressGzip(data []byte) ([]byte, error) {
-	buf := bytes.NewBuffer(data)
-	gzr, err := gzip.NewReader(buf)
-	if err != nil {
-		return nil, err
-	}
-	defer gzr.Close()
-	return io.ReadAll(gzr)
+// multiReadCloser 逐层包装的解码器，关闭时释放各层资源，不关闭最内层的原始Reader。
+type multiReadCloser struct {
+	io.Reader
+	closers []func() error
 }
 
-// decompressDeflate 解压缩 deflate 数据
-func decompressDeflate(data []byte) ([]byte, error) {
-	buf := bytes.NewBuffer(data)
-	r, err := zlib.NewReader(buf)
-	if err != nil {
-		return nil, err
+func (m *multiReadCloser) push(r io.Reader, closer func() error) {
+	m.Reader = r
+	if closer != nil {
+		m.closers = append(m.closers, closer)
 	}
-	defer r.Close()
-	return io.ReadAll(r)
-}
-
-// decompressBrotli 解压缩 Brotli 数据
-func decompressBrotli(data []byte) ([]byte, error) {
-	buf := bytes.NewBuffer(data)
-	br := brotli.NewReader(buf)
-	return io.ReadAll(br)
 }
 
-// decompressZstd 解压缩 Zstandard 数据
-func decompressZstd(data []byte) ([]byte, error) {
-	decoder, err := zstd.NewReader(nil)
-	if err != nil {
-		return nil, err
-	}
-	defer decoder.Close()
-	decompressed, err := decoder.DecodeAll(data, nil)
-	if err != nil {
-		return nil, err
+func (m *multiReadCloser) Close() error {
+	var err error
+	for i := len(m.closers) - 1; i >= 0; i-- {
+		err = errors.Join(err, m.closers[i]())
 	}
-	return decompressed, nil
+	m.closers = nil
+	return err
 }
@@ -0,0 +1,61 @@
+//  Copyright (c) 2025 dingodb.com, Inc. All Rights Reserved
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http:www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package util
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestDecompressReader(t *testing.T) {
+	content := []byte(strings.Repeat("hello world\n", 1000))
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	gw.Write(content)
+	gw.Close()
+	encoder, _ := zstd.NewWriter(nil)
+	zstdOfGzip := encoder.EncodeAll(gzipped.Bytes(), nil)
+	encoder.Close()
+	for _, c := range []struct {
+		name     string
+		data     []byte
+		encoding string
+	}{
+		{"identity", content, "identity"},
+		{"gzip", gzipped.Bytes(), "gzip"},
+		{"multiple", zstdOfGzip, "gzip, zstd"}, // 按声明的逆序解码
+	} {
+		r, err := NewDecompressReader(bytes.NewReader(c.data), c.encoding)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		got, err := io.ReadAll(io.LimitReader(r, int64(len(content))+1))
+		r.Close()
+		if err != nil || !bytes.Equal(got, content) {
+			t.Fatalf("%s: decoded %d bytes, err:%v", c.name, len(got), err)
+		}
+	}
+	if _, err := NewDecompressReader(bytes.NewReader(content), "gzip, compress"); err == nil {
+		t.Fatal("unsupported encoding should fail")
+	}
+	if _, err := NewDecompressReader(bytes.NewReader(content), "gzip"); err == nil {
+		t.Fatal("invalid gzip data should fail")
+	}
+}
@@ -0,0 +1,83 @@
+//  Copyright (c) 2025 dingodb.com, Inc. All Rights Reserved
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http:www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package util
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// CheckNotModified 按RFC 7232判断GET/HEAD请求的客户端缓存是否仍然有效。
+// If-None-Match优先于If-Modified-Since，etag按弱比较，时间精确到秒。
+func CheckNotModified(req *http.Request, etag string, lastModified time.Time) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	if ifNoneMatch := req.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		return etag != "" && etagListMatch(ifNoneMatch, etag)
+	}
+	ifModifiedSince := req.Header.Get("If-Modified-Since")
+	if ifModifiedSince == "" || lastModified.IsZero() {
+		return false
+	}
+	t, err := http.ParseTime(ifModifiedSince)
+	if err != nil {
+		return false
+	}
+	return !lastModified.Truncate(time.Second).After(t)
+}
+
+func etagListMatch(list, etag string) bool {
+	etag = opaqueTag(etag)
+	for _, tag := range strings.Split(list, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || opaqueTag(tag) == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// opaqueTag 去掉弱校验前缀与引号
+func opaqueTag(tag string) string {
+	return strings.Trim(strings.TrimPrefix(strings.TrimSpace(tag), "W/"), `"`)
+}
+
+// QuoteEtag 按ETag头的格式加上引号，已带引号或弱校验前缀的原样返回
+func QuoteEtag(etag string) string {
+	if strings.HasPrefix(etag, `"`) || strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return `"` + etag + `"`
+}
+
+// ContentEtag 根据内容生成弱校验的etag，用于上游未返回etag的元数据
+func ContentEtag(content []byte) string {
+	return fmt.Sprintf(`W/"%016x"`, xxhash.Sum64(content))
+}
+
+// SetValidators 写入ETag与Last-Modified
+func SetValidators(headers map[string]string, etag string, lastModified time.Time) {
+	if etag != "" {
+		headers["etag"] = QuoteEtag(etag)
+	}
+	if !lastModified.IsZero() {
+		headers["last-modified"] = lastModified.UTC().Format(http.TimeFormat)
+	}
+}
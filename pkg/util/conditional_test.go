@@ -0,0 +1,103 @@
+//  Copyright (c) 2025 dingodb.com, Inc. All Rights Reserved
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http:www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package util
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCheckNotModified(t *testing.T) {
+	etag := "abc123"
+	lastModified := time.Date(2025, 1, 2, 3, 4, 5, 600, time.UTC)
+	cases := []struct {
+		name    string
+		method  string
+		headers map[string]string
+		want    bool
+	}{
+		{"no validators", http.MethodGet, nil, false},
+		{"if-none-match hit", http.MethodGet, map[string]string{"If-None-Match": `"abc123"`}, true},
+		{"if-none-match weak", http.MethodHead, map[string]string{"If-None-Match": `W/"abc123"`}, true},
+		{"if-none-match list", http.MethodGet, map[string]string{"If-None-Match": `"other", "abc123"`}, true},
+		{"if-none-match star", http.MethodGet, map[string]string{"If-None-Match": "*"}, true},
+		{"if-none-match miss", http.MethodGet, map[string]string{"If-None-Match": `"other"`}, false},
+		{"if-none-match wins over date", http.MethodGet, map[string]string{"If-None-Match": `"other"`, "If-Modified-Since": lastModified.Add(time.Hour).Format(http.TimeFormat)}, false},
+		{"if-modified-since equal", http.MethodGet, map[string]string{"If-Modified-Since": lastModified.Format(http.TimeFormat)}, true},
+		{"if-modified-since later", http.MethodGet, map[string]string{"If-Modified-Since": lastModified.Add(time.Hour).Format(http.TimeFormat)}, true},
+		{"if-modified-since earlier", http.MethodGet, map[string]string{"If-Modified-Since": lastModified.Add(-time.Second).Format(http.TimeFormat)}, false},
+		{"if-modified-since invalid", http.MethodGet, map[string]string{"If-Modified-Since": "yesterday"}, false},
+		{"not get or head", http.MethodPost, map[string]string{"If-None-Match": `"abc123"`}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(c.method, "/", nil)
+			for k, v := range c.headers {
+				req.Header.Set(k, v)
+			}
+			if got := CheckNotModified(req, etag, lastModified); got != c.want {
+				t.Fatalf("CheckNotModified = %v, want %v", got, c.want)
+			}
+		})
+	}
+	// 没有Last-Modified时不按日期判断
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("If-Modified-Since", lastModified.Format(http.TimeFormat))
+	if CheckNotModified(req, etag, time.Time{}) {
+		t.Fatal("If-Modified-Since should be ignored without Last-Modified")
+	}
+}
+
+func TestIfRange(t *testing.T) {
+	etag := "abc123"
+	lastModified := time.Date(2025, 1, 2, 3, 4, 5, 600, time.UTC)
+	full := []HttpRange(nil)
+	partial := []HttpRange{{Start: 0, End: 10}}
+	cases := []struct {
+		name         string
+		ifRange      string
+		etag         string
+		lastModified time.Time
+		want         []HttpRange
+	}{
+		{"no if-range", "", etag, lastModified, partial},
+		{"etag match", `"abc123"`, etag, lastModified, partial},
+		{"etag mismatch", `"other"`, etag, lastModified, full},
+		{"weak etag in request", `W/"abc123"`, etag, lastModified, full},
+		{"weak etag of file", `"abc123"`, `W/"abc123"`, lastModified, full},
+		{"date match", lastModified.Format(http.TimeFormat), etag, lastModified, partial},
+		{"date earlier", lastModified.Add(-time.Second).Format(http.TimeFormat), etag, lastModified, full},
+		{"date later", lastModified.Add(time.Second).Format(http.TimeFormat), etag, lastModified, full},
+		{"date without last-modified", lastModified.Format(http.TimeFormat), etag, time.Time{}, full},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Range", "bytes=0-9")
+			if c.ifRange != "" {
+				req.Header.Set("If-Range", c.ifRange)
+			}
+			got, err := RequestRanges(req, 100, c.etag, c.lastModified)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(c.want) || (len(got) == 1 && got[0] != c.want[0]) {
+				t.Fatalf("ranges = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
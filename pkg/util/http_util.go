@@ -16,13 +16,17 @@ package util
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"dingospeed/pkg/common"
@@ -41,95 +45,138 @@ var (
 	proxyClient      *http.Client
 	simpleOnce       sync.Once
 	proxyOnce        sync.Once
+	directTransport  *http.Transport
+	transportOnce    sync.Once
 )
 
+var (
+	// ErrIdleTimeout 读取响应体时超过idleRead未收到数据，连接可能已失效，可从断点重试。
+	ErrIdleTimeout = errors.New("upstream idle read timeout")
+	// ErrStalled 分段持续收不到数据，不在同一上游上重试，由调用方改用其他上游。
+	ErrStalled = errors.New("upstream stalled")
+)
+
+// RetryRequest 按指数退避加随机抖动重试，上游熔断或请求被取消时不再重试。
 func RetryRequest(f func() (*common.Response, error)) (*common.Response, error) {
 	var resp *common.Response
+	delay := config.SysConfig.GetRetryDelay()
 	err := retry.Do(
 		func() error {
 			var err error
 			resp, err = f()
+			if err == nil && resp != nil && retryableStatus(resp.StatusCode) {
+				return &StatusError{StatusCode: resp.StatusCode, RetryAfter: ParseRetryAfter(resp.GetKey("retry-after"))}
+			}
 			return err
 		},
-		retry.Delay(time.Duration(config.SysConfig.Retry.Delay)*time.Second),
+		retry.Delay(delay),
+		retry.MaxDelay(config.SysConfig.GetRetryMaxDelay()),
+		retry.MaxJitter(max(delay/2, 100*time.Millisecond)),
 		retry.Attempts(config.SysConfig.Retry.Attempts),
-		retry.DelayType(retry.FixedDelay),
+		retry.DelayType(retryDelay),
+		retry.RetryIf(isRetryable),
+		retry.LastErrorOnly(true),
 	)
+	var status *StatusError
+	if errors.As(err, &status) && resp != nil && resp.StatusCode == status.StatusCode { // 重试用尽后返回上游的响应，由调用方处理状态码
+		return resp, nil
+	}
 	return resp, err
 }
 
+// newTransport 按配置设置建立连接与等待响应头的超时，proxyURL为空时直连。
+func newTransport(proxyURL *url.URL) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	connectTimeout := config.SysConfig.GetConnectTimeout()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   connectTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.TLSHandshakeTimeout = connectTimeout
+	transport.ResponseHeaderTimeout = config.SysConfig.GetFirstByteTimeout()
+	if proxyURL != nil {
+		transport.Proxy = http.ProxyURL(proxyURL)
+		transport.ForceAttemptHTTP2 = false
+	}
+	return transport
+}
+
+func getDirectTransport() *http.Transport {
+	transportOnce.Do(func() {
+		directTransport = newTransport(nil)
+	})
+	return directTransport
+}
+
 func NewHTTPClient(method string) (*http.Client, error) {
 	if method == http.MethodHead {
 		return &http.Client{
 			CheckRedirect: func(req *http.Request, via []*http.Request) error {
 				return http.ErrUseLastResponse // 阻止跟随重定向
 			},
-			Timeout: config.SysConfig.GetReqTimeOut()}, nil
+			Transport: getDirectTransport(),
+			Timeout:   config.SysConfig.GetReqTimeOut()}, nil
 	}
 	simpleOnce.Do(
 		func() {
-			simpleClient = &http.Client{Timeout: config.SysConfig.GetReqTimeOut()}
+			simpleClient = &http.Client{Transport: getDirectTransport(), Timeout: config.SysConfig.GetReqTimeOut()}
 		})
 	return simpleClient, nil
 }
 
 func NewHTTPClientWithProxy(method string) (*http.Client, error) {
-	var transport *http.Transport
+	transport := getDirectTransport()
 	if config.SysConfig.GetHttpProxy() != "" {
 		proxyURL, err := url.Parse(config.SysConfig.GetHttpProxy())
 		if err != nil {
 			zap.S().Errorf("代理地址解析失败: %v", err)
 			return nil, err
 		}
-		transport = &http.Transport{
-			Proxy: http.ProxyURL(proxyURL),
-			DialContext: (&net.Dialer{
-				Timeout:   30 * time.Second,
-				KeepAlive: 30 * time.Second,
-			}).DialContext,
-			TLSHandshakeTimeout:   10 * time.Second,
-			ForceAttemptHTTP2:     false,
-			ResponseHeaderTimeout: 10 * time.Second,
-			IdleConnTimeout:       90 * time.Second,
-		}
+		transport = newTransport(proxyURL)
 	}
 	if method == http.MethodHead {
-		proxyHeadClient := &http.Client{
+		return &http.Client{
 			CheckRedirect: func(req *http.Request, via []*http.Request) error {
 				return http.ErrUseLastResponse // 阻止跟随重定向
 			},
-			Timeout: config.SysConfig.GetReqTimeOut()}
-		if transport != nil {
-			proxyHeadClient.Transport = transport
-		}
-		return proxyHeadClient, nil
+			Transport: transport,
+			Timeout:   config.SysConfig.GetReqTimeOut()}, nil
 	}
 	proxyOnce.Do(func() {
-		proxyClient = &http.Client{Timeout: config.SysConfig.GetReqTimeOut()}
-		if transport != nil {
-			proxyClient.Transport = transport
-		}
+		proxyClient = &http.Client{Transport: transport, Timeout: config.SysConfig.GetReqTimeOut()}
 	})
 	return proxyClient, nil
 }
 
 func constructClient(method string) (string, *http.Client, error) {
 	var (
-		domain string
 		client *http.Client
 		err    error
 	)
-	// 代理不可用，且允许代理切换到备用，使用直联。
-	if !ProxyIsAvailable && config.SysConfig.DynamicProxy.Enabled {
-		domain = config.SysConfig.GetBpHFURLBase()
+	domain, direct := upstreamDomain()
+	if direct {
 		client, err = NewHTTPClient(method)
 	} else {
-		domain = config.SysConfig.GetHFURLBase()
 		client, err = NewHTTPClientWithProxy(method)
 	}
 	return domain, client, err
 }
 
+// upstreamDomain 代理不可用，且允许代理切换到备用，使用直联的备用地址，返回是否直联。
+// 是否直联只取决于代理是否可用，备用地址可能与hfNetLoc相同。
+func upstreamDomain() (string, bool) {
+	if !ProxyIsAvailable && config.SysConfig.DynamicProxy.Enabled {
+		return config.SysConfig.GetBpHFURLBase(), true
+	}
+	return config.SysConfig.GetHFURLBase(), false
+}
+
+// DefaultUpstream 返回未指定上游时使用的地址，以及是否经由代理访问
+func DefaultUpstream() (string, bool) {
+	domain, direct := upstreamDomain()
+	return domain, !direct
+}
+
 func Head(requestUri string, headers map[string]string) (*common.Response, error) {
 	domain, client, err := constructClient(http.MethodHead)
 	if err != nil {
@@ -139,6 +186,23 @@ func Head(requestUri string, headers map[string]string) (*common.Response, error
 	return doHead(client, requestURL, headers)
 }
 
+// HeadUpstream 向指定的上游发起HEAD请求，不跟随重定向，proxy为true时经由配置的代理访问。
+func HeadUpstream(domain string, proxy bool, uri string, headers map[string]string) (*common.Response, error) {
+	var (
+		client *http.Client
+		err    error
+	)
+	if proxy {
+		client, err = NewHTTPClientWithProxy(http.MethodHead)
+	} else {
+		client, err = NewHTTPClient(http.MethodHead)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("construct http client err: %v", err)
+	}
+	return doHead(client, fmt.Sprintf("%s%s", domain, uri), headers)
+}
+
 func doHead(client *http.Client, targetURL string, headers map[string]string) (*common.Response, error) {
 	req, err := http.NewRequest("HEAD", targetURL, nil)
 	if err != nil {
@@ -147,10 +211,10 @@ func doHead(client *http.Client, targetURL string, headers map[string]string) (*
 	for key, value := range headers {
 		req.Header.Set(key, value)
 	}
-	resp, err := client.Do(req)
+	resp, err := doRequest(client, req)
 	if err != nil {
 		zap.S().Warnf("URL请求失败: %s, 错误: %v", targetURL, err)
-		return nil, fmt.Errorf("执行HEAD请求失败: %v", err)
+		return nil, fmt.Errorf("执行HEAD请求失败: %w", err)
 	}
 	defer func() {
 		if r := recover(); r != nil {
@@ -185,10 +249,10 @@ func doGet(client *http.Client, targetURL string, headers map[string]string) (*c
 	for key, value := range headers {
 		req.Header.Set(key, value)
 	}
-	resp, err := client.Do(req)
+	resp, err := doRequest(client, req)
 	if err != nil {
 		zap.S().Warnf("URL请求失败: %s, 错误: %v", targetURL, err)
-		return nil, fmt.Errorf("执行GET请求失败: %v", err)
+		return nil, fmt.Errorf("执行GET请求失败: %w", err)
 	}
 
 	defer func() {
@@ -215,7 +279,8 @@ func doGet(client *http.Client, targetURL string, headers map[string]string) (*c
 	}, nil
 }
 
-func GetStream(domain, uri string, headers map[string]string, f func(r *http.Response) error) error {
+// GetStream 发起GET请求并由f处理响应，ctx取消时中断请求。
+func GetStream(ctx context.Context, domain, uri string, headers map[string]string, f func(r *http.Response) error) error {
 	var (
 		client *http.Client
 		err    error
@@ -230,19 +295,39 @@ func GetStream(domain, uri string, headers map[string]string, f func(r *http.Res
 		return fmt.Errorf("construct http client err: %v", err)
 	}
 	requestURL := fmt.Sprintf("%s%s", domain, uri)
-	return doGetStream(client, requestURL, headers, f)
+	return doGetStream(ctx, client, requestURL, headers, f)
+}
+
+// GetUpstreamStream 向指定的上游发起GET请求，proxy为true时经由配置的代理访问。
+func GetUpstreamStream(ctx context.Context, domain string, proxy bool, uri string, headers map[string]string, f func(r *http.Response) error) error {
+	var (
+		client *http.Client
+		err    error
+	)
+	if proxy {
+		client, err = NewHTTPClientWithProxy(http.MethodGet)
+	} else {
+		client, err = NewHTTPClient(http.MethodGet)
+	}
+	if err != nil {
+		return fmt.Errorf("construct http client err: %v", err)
+	}
+	return doGetStream(ctx, client, fmt.Sprintf("%s%s", domain, uri), headers, f)
 }
 
-func doGetStream(client *http.Client, targetURL string, headers map[string]string, f func(r *http.Response) error) error {
+// doGetStream 响应体按idleRead超时读取，单次读取等待过久时取消请求，避免在失效的连接上无限等待。
+func doGetStream(ctx context.Context, client *http.Client, targetURL string, headers map[string]string, f func(r *http.Response) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	escapedURL := strings.ReplaceAll(targetURL, "#", "%23")
-	req, err := http.NewRequest("GET", escapedURL, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", escapedURL, nil)
 	if err != nil {
 		return fmt.Errorf("创建GET请求失败: %v", err)
 	}
 	for key, value := range headers {
 		req.Header.Set(key, value)
 	}
-	resp, err := client.Do(req)
+	resp, err := doRequest(client, req)
 	if err != nil {
 		return err
 	}
@@ -251,9 +336,41 @@ func doGetStream(client *http.Client, targetURL string, headers map[string]strin
 	for key, value := range resp.Header {
 		respHeaders[strings.ToLower(key)] = value
 	}
+	resp.Body = newIdleTimeoutBody(resp.Body, config.SysConfig.GetIdleReadTimeout(), cancel)
 	return f(resp)
 }
 
+// idleTimeoutBody 单次读取等待超过timeout时取消请求，只计算阻塞在读取上的时间，下游处理数据的时间不计入。
+type idleTimeoutBody struct {
+	io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	expired atomic.Bool
+}
+
+func newIdleTimeoutBody(body io.ReadCloser, timeout time.Duration, cancel context.CancelFunc) io.ReadCloser {
+	if timeout <= 0 {
+		return body
+	}
+	b := &idleTimeoutBody{ReadCloser: body, timeout: timeout}
+	b.timer = time.AfterFunc(timeout, func() {
+		b.expired.Store(true)
+		cancel()
+	})
+	b.timer.Stop()
+	return b
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	b.timer.Reset(b.timeout)
+	n, err := b.ReadCloser.Read(p)
+	b.timer.Stop()
+	if err != nil && b.expired.Load() {
+		err = fmt.Errorf("%w, no data in %s", ErrIdleTimeout, b.timeout)
+	}
+	return n, err
+}
+
 func Post(requestUri string, contentType string, data []byte, headers map[string]string) (*common.Response, error) {
 	domain, client, err := constructClient(http.MethodPost)
 	if err != nil {
@@ -274,10 +391,10 @@ func doPost(client *http.Client, targetURL string, contentType string, data []by
 		req.Header.Set(key, value)
 	}
 
-	resp, err := client.Do(req)
+	resp, err := doRequest(client, req)
 	if err != nil {
 		zap.S().Warnf("URL请求失败: %s, 错误: %v", targetURL, err)
-		return nil, fmt.Errorf("执行POST请求失败: %v", err)
+		return nil, fmt.Errorf("执行POST请求失败: %w", err)
 	}
 
 	defer func() {
@@ -304,36 +421,82 @@ func doPost(client *http.Client, targetURL string, contentType string, data []by
 	}, nil
 }
 
-func ResponseStream(c echo.Context, fileName string, headers map[string]string, content <-chan []byte) error {
-	c.Response().Header().Set("Content-Type", "text/event-stream")
-	c.Response().Header().Set("Cache-Control", "no-cache")
-	c.Response().Header().Set("Connection", "keep-alive")
+// ResponseStream 以流的方式发送内容。length>=0时设置Content-Length，content提前关闭导致字节数不足时返回
+// ErrShortResponse，http服务端会因实际长度与Content-Length不符而断开连接，客户端据此识别出响应不完整，
+// 而不是得到一个被截断的文件。
+func ResponseStream(c echo.Context, fileName string, headers map[string]string, content <-chan []byte, length int64) error {
+	writeStreamHeader(c, headers, length)
+	return WriteStream(c, fileName, content, length)
+}
+
+// ResponsePooledStream 与ResponseStream相同，content中的chunk由响应方持有，写出后调用Release。
+func ResponsePooledStream(c echo.Context, fileName string, headers map[string]string, content <-chan Chunk, length int64) error {
+	writeStreamHeader(c, headers, length)
+	return WritePooledStream(c, fileName, content, length)
+}
+
+func writeStreamHeader(c echo.Context, headers map[string]string, length int64) {
 	for k, v := range headers {
-		// 流式响应不应预设Content-Length，因为数据是流式传输的，无法保证字节数与预估值一致。
-		// 若实际传输字节数与Content-Length不符，客户端会报错（如curl: (18) transfer closed with N bytes remaining to read）。
 		c.Response().Header().Set(k, v)
 	}
+	if c.Response().Header().Get(echo.HeaderContentType) == "" {
+		c.Response().Header().Set(echo.HeaderContentType, echo.MIMEOctetStream)
+	}
+	if length >= 0 {
+		c.Response().Header().Set(echo.HeaderContentLength, Itoa(length))
+	} else {
+		c.Response().Header().Del(echo.HeaderContentLength)
+	}
 	// 根据 headers 中是否包含 Content-Range 来决定状态码
 	statusCode := http.StatusOK
 	if c.Response().Header().Get("Content-Range") != "" {
 		statusCode = http.StatusPartialContent
 	}
 	c.Response().WriteHeader(statusCode)
+}
+
+// ErrShortResponse 数据源提前结束，已发送的字节数少于声明的长度
+var ErrShortResponse = errors.New("response shorter than content length")
+
+// WriteStream 将content中的数据依次写入响应体，响应头需已发送。length>=0时校验发送的字节数。
+func WriteStream(c echo.Context, fileName string, content <-chan []byte, length int64) error {
+	return writeStream(c, fileName, content, length, func(b []byte) []byte { return b }, func([]byte) {})
+}
+
+// WritePooledStream 与WriteStream相同，content中的chunk由响应方持有，写出后调用Release。
+func WritePooledStream(c echo.Context, fileName string, content <-chan Chunk, length int64) error {
+	return writeStream(c, fileName, content, length, func(chunk Chunk) []byte { return chunk.Data }, Chunk.Release)
+}
+
+func writeStream[T any](c echo.Context, fileName string, content <-chan T, length int64, data func(T) []byte, release func(T)) error {
 	flusher, ok := c.Response().Writer.(http.Flusher)
 	if !ok {
-		return c.String(http.StatusInternalServerError, "Streaming unsupported!")
+		return errors.New("streaming unsupported")
 	}
+	var written int64
 	for {
 		select {
-		case b, ok := <-content:
+		case v, ok := <-content:
 			if !ok {
+				if length >= 0 && written != length {
+					zap.S().Errorf("ResponseStream incomplete, file:%s, expected %d bytes, sent %d", fileName, length, written)
+					return fmt.Errorf("%w: expected %d bytes, sent %d", ErrShortResponse, length, written)
+				}
 				zap.S().Infof("ResponseStream complete, %s", fileName)
 				return nil
 			}
-			if len(b) > 0 {
-				if _, err := c.Response().Write(b); err != nil {
+			if b := data(v); len(b) > 0 {
+				if err := WaitClient(c, len(b)); err != nil {
+					release(v)
+					zap.S().Warnf("ResponseStream wait bandwidth err,file:%s,%v", fileName, err)
+					return err
+				}
+				n, err := c.Response().Write(b)
+				written += int64(n)
+				release(v)
+				if err != nil { // 响应已开始，无法再返回错误内容
 					zap.S().Warnf("ResponseStream write err,file:%s,%v", fileName, err)
-					return ErrorProxyTimeout(c)
+					return err
 				}
 				if config.SysConfig.EnableMetric() {
 					// 原子性地更新响应总数
@@ -341,12 +504,56 @@ func ResponseStream(c echo.Context, fileName string, headers map[string]string,
 					orgRepo := Itoa(c.Get(consts.PromOrgRepo))
 					prom.PromResponseByteCounter(prom.RequestResponseByte, source, orgRepo, int64(len(b)))
 				}
+			} else {
+				release(v)
 			}
 			flusher.Flush()
+		case <-c.Request().Context().Done():
+			zap.S().Warnf("ResponseStream client gone, file:%s", fileName)
+			return c.Request().Context().Err()
 		}
 	}
 }
 
+// ResponseContent 发送长度确定的内容，content为*os.File时由http服务端以sendfile方式零拷贝发送。
+func ResponseContent(c echo.Context, fileName string, headers map[string]string, content io.Reader, length int64) error {
+	for k, v := range headers {
+		c.Response().Header().Set(k, v)
+	}
+	if c.Response().Header().Get(echo.HeaderContentType) == "" {
+		c.Response().Header().Set(echo.HeaderContentType, echo.MIMEOctetStream)
+	}
+	c.Response().Header().Set(echo.HeaderContentLength, Itoa(length))
+	c.Response().Header().Set("Accept-Ranges", "bytes")
+	statusCode := http.StatusOK
+	if c.Response().Header().Get("Content-Range") != "" {
+		statusCode = http.StatusPartialContent
+	}
+	c.Response().WriteHeader(statusCode)
+	return WriteContent(c, fileName, content, length)
+}
+
+// WriteContent 将content的length字节写入响应体，响应头需已发送
+func WriteContent(c echo.Context, fileName string, content io.Reader, length int64) error {
+	if bucket := clientBucket(c); bucket != nil { // 限速时放弃sendfile，按令牌分段发送
+		content = &clientLimitedReader{ctx: c.Request().Context(), bucket: bucket, r: content}
+	}
+	// 直接写入底层Writer，才能命中http.response的ReadFrom
+	n, err := io.CopyN(c.Response().Writer, content, length)
+	c.Response().Size += n
+	if config.SysConfig.EnableMetric() {
+		source := Itoa(c.Get(consts.PromSource))
+		orgRepo := Itoa(c.Get(consts.PromOrgRepo))
+		prom.PromResponseByteCounter(prom.RequestResponseByte, source, orgRepo, n)
+	}
+	if err != nil {
+		zap.S().Warnf("ResponseContent write err,file:%s,%v", fileName, err)
+		return err
+	}
+	zap.S().Infof("ResponseContent complete, %s", fileName)
+	return nil
+}
+
 func ForwardRequest(originalReq echo.Context) (*http.Response, error) {
 	domain, client, err := constructClient(http.MethodGet)
 	if err != nil {
@@ -373,10 +580,10 @@ func ForwardRequest(originalReq echo.Context) (*http.Response, error) {
 			proxyReq.Header.Add(key, value)
 		}
 	}
-	resp, err := client.Do(proxyReq)
+	resp, err := doRequest(client, proxyReq)
 	if err != nil {
 		zap.S().Warnf("转发请求失败: %s, 错误: %v", targetURL, err)
-		return nil, fmt.Errorf("执行转发请求失败: %v", err)
+		return nil, fmt.Errorf("执行转发请求失败: %w", err)
 	}
 	return resp, nil
 }
@@ -384,3 +591,18 @@ func ForwardRequest(originalReq echo.Context) (*http.Response, error) {
 func IsInnerDomain(url string) bool {
 	return !strings.Contains(url, consts.Huggingface) && !strings.Contains(url, consts.Hfmirror)
 }
+
+// ParseRetryAfter 解析Retry-After响应头，支持秒数与HTTP日期两种格式，无法解析时返回0。
+func ParseRetryAfter(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(max(seconds, 0)) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return max(time.Until(t), 0)
+	}
+	return 0
+}
@@ -0,0 +1,128 @@
+//  Copyright (c) 2025 dingodb.com, Inc. All Rights Reserved
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http:www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package util
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"dingospeed/pkg/config"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestConstructClient(t *testing.T) {
+	config.SysConfig = &config.Config{}
+	config.SysConfig.Server.HfScheme = "https"
+	// 默认配置中hfNetLoc与bpHfNetLoc相同，代理不可用时仍应直联
+	config.SysConfig.Server.HfNetLoc = "hf-mirror.com"
+	config.SysConfig.Server.BpHfNetLoc = "hf-mirror.com"
+	config.SysConfig.DynamicProxy.Enabled = true
+	direct, _ := NewHTTPClient(http.MethodGet)
+	proxy, _ := NewHTTPClientWithProxy(http.MethodGet)
+	defer func() { ProxyIsAvailable = true }()
+	for _, c := range []struct {
+		available bool
+		want      *http.Client
+	}{
+		{true, proxy},
+		{false, direct},
+	} {
+		ProxyIsAvailable = c.available
+		domain, client, err := constructClient(http.MethodGet)
+		if err != nil || domain != "https://hf-mirror.com" || client != c.want {
+			t.Fatalf("proxy available:%v, domain:%s, direct:%v, err:%v", c.available, domain, client == direct, err)
+		}
+	}
+}
+
+func TestResponseStreamLength(t *testing.T) {
+	config.SysConfig = &config.Config{}
+	body := strings.Repeat("x", 100)
+	cases := []struct {
+		name    string
+		sent    int // 上游实际发送的字节数，声明的长度始终为100
+		wantErr error
+	}{
+		{"complete", 100, nil},
+		{"upstream short", 40, ErrShortResponse},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// 上游声明Content-Length后提前结束
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set(echo.HeaderContentLength, Itoa(len(body)))
+				w.WriteHeader(http.StatusOK)
+				_, _ = io.WriteString(w, body[:c.sent])
+			}))
+			defer upstream.Close()
+			result := make(chan error, 1)
+			e := echo.New()
+			e.GET("/file", func(ctx echo.Context) error {
+				resp, err := http.Get(upstream.URL)
+				if err != nil {
+					return err
+				}
+				defer resp.Body.Close()
+				content := make(chan []byte)
+				go func() {
+					defer close(content)
+					for {
+						buf := make([]byte, 16)
+						n, err := resp.Body.Read(buf)
+						if n > 0 {
+							content <- buf[:n]
+						}
+						if err != nil {
+							return
+						}
+					}
+				}()
+				err = ResponseStream(ctx, "file", nil, content, resp.ContentLength)
+				result <- err
+				return err
+			})
+			proxy := httptest.NewServer(e)
+			defer proxy.Close()
+
+			resp, err := http.Get(proxy.URL + "/file")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.ContentLength != int64(len(body)) {
+				t.Fatalf("Content-Length = %d, want %d", resp.ContentLength, len(body))
+			}
+			got, err := io.ReadAll(resp.Body)
+			if string(got) != body[:c.sent] {
+				t.Fatalf("body length = %d, want %d", len(got), c.sent)
+			}
+			// 长度不足时连接被断开，客户端不会把截断的内容当作完整文件
+			if c.wantErr == nil && err != nil {
+				t.Fatalf("read body: %v", err)
+			}
+			if c.wantErr != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Fatalf("read body err = %v, want %v", err, io.ErrUnexpectedEOF)
+			}
+			if err := <-result; !errors.Is(err, c.wantErr) {
+				t.Fatalf("ResponseStream err = %v, want %v", err, c.wantErr)
+			}
+		})
+	}
+}
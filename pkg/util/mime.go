@@ -0,0 +1,71 @@
+//  Copyright (c) 2025 dingodb.com, Inc. All Rights Reserved
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http:www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package util
+
+import (
+	"mime"
+	"path"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// contentTypes 仓库中常见文件的类型，优先于系统的mime配置，保证各节点返回一致
+var contentTypes = map[string]string{
+	".json":        echo.MIMEApplicationJSONCharsetUTF8,
+	".jsonl":       "application/jsonl; charset=utf-8",
+	".txt":         echo.MIMETextPlainCharsetUTF8,
+	".md":          "text/markdown; charset=utf-8",
+	".py":          "text/x-python; charset=utf-8",
+	".yaml":        "application/yaml; charset=utf-8",
+	".yml":         "application/yaml; charset=utf-8",
+	".csv":         "text/csv; charset=utf-8",
+	".tsv":         "text/tab-separated-values; charset=utf-8",
+	".model":       echo.MIMEOctetStream, // sentencepiece
+	".safetensors": echo.MIMEOctetStream,
+	".bin":         echo.MIMEOctetStream,
+	".pt":          echo.MIMEOctetStream,
+	".pth":         echo.MIMEOctetStream,
+	".ckpt":        echo.MIMEOctetStream,
+	".gguf":        echo.MIMEOctetStream,
+	".onnx":        echo.MIMEOctetStream,
+	".h5":          "application/x-hdf5",
+	".msgpack":     "application/msgpack",
+	".parquet":     "application/vnd.apache.parquet",
+	".arrow":       "application/vnd.apache.arrow.file",
+	".zip":         "application/zip",
+	".gz":          "application/gzip",
+	".tar":         "application/x-tar",
+	".png":         "image/png",
+	".jpg":         "image/jpeg",
+	".jpeg":        "image/jpeg",
+	".wav":         "audio/wav",
+	".mp3":         "audio/mpeg",
+}
+
+// ContentTypeByName 按文件扩展名返回Content-Type，未知类型返回application/octet-stream
+func ContentTypeByName(fileName string) string {
+	ext := strings.ToLower(path.Ext(fileName))
+	if ext == "" {
+		return echo.MIMEOctetStream
+	}
+	if contentType, ok := contentTypes[ext]; ok {
+		return contentType
+	}
+	if contentType := mime.TypeByExtension(ext); contentType != "" {
+		return contentType
+	}
+	return echo.MIMEOctetStream
+}
@@ -0,0 +1,42 @@
+//  Copyright (c) 2025 dingodb.com, Inc. All Rights Reserved
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http:www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package util
+
+import (
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestContentTypeByName(t *testing.T) {
+	cases := []struct {
+		fileName string
+		want     string
+	}{
+		{"config.json", echo.MIMEApplicationJSONCharsetUTF8},
+		{"data/train.PARQUET", "application/vnd.apache.parquet"},
+		{"model.safetensors", echo.MIMEOctetStream},
+		{"index.html", "text/html; charset=utf-8"}, // 表中没有的按系统mime配置
+		{"weights.unknownext", echo.MIMEOctetStream},
+		{"README", echo.MIMEOctetStream},
+	}
+	for _, c := range cases {
+		t.Run(c.fileName, func(t *testing.T) {
+			if got := ContentTypeByName(c.fileName); got != c.want {
+				t.Fatalf("ContentTypeByName(%s) = %s, want %s", c.fileName, got, c.want)
+			}
+		})
+	}
+}
@@ -8,7 +8,6 @@ import (
 	"path/filepath"
 	"regexp"
 	"runtime"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -166,37 +165,6 @@ func DoRequestWithRetry(req *http.Request) (*http.Response, error) {
 	return nil, fmt.Errorf("failed after %d retries: %v", config.SysConfig.Modelscope.MaxRetry, err)
 }
 
-// ParseRangeHeader 解析Range请求头，返回起始字节和结束字节（-1表示到末尾）
-func ParseRangeHeader(r *http.Request) (start int64, end int64, err error) {
-	rangeHeader := r.Header.Get("Range")
-	if rangeHeader == "" {
-		return 0, -1, nil
-	}
-
-	// 解析Range头格式：bytes=start-end
-	parts := strings.SplitN(rangeHeader, "=", 2)
-	if len(parts) != 2 || parts[0] != "bytes" {
-		return 0, -1, fmt.Errorf("invalid Range header: %s", rangeHeader)
-	}
-
-	rangeParts := strings.SplitN(parts[1], "-", 2)
-	start, err = strconv.ParseInt(rangeParts[0], 10, 64)
-	if err != nil {
-		return 0, -1, fmt.Errorf("invalid start byte: %s, err: %v", rangeParts[0], err)
-	}
-
-	if len(rangeParts) == 2 && rangeParts[1] != "" {
-		end, err = strconv.ParseInt(rangeParts[1], 10, 64)
-		if err != nil {
-			return 0, -1, fmt.Errorf("invalid end byte: %s, err: %v", rangeParts[1], err)
-		}
-	} else {
-		end = -1
-	}
-
-	return start, end, nil
-}
-
 func GetAPIPathPrefix(repoType string) string {
 	repoType = strings.TrimSpace(strings.ToLower(repoType))
 	switch repoType {
@@ -0,0 +1,311 @@
+//  Copyright (c) 2025 dingodb.com, Inc. All Rights Reserved
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http:www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package util
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"dingospeed/pkg/consts"
+
+	"github.com/labstack/echo/v4"
+)
+
+// maxRanges 单个请求允许的区间数，超过时忽略Range返回完整内容，避免大量小区间放大开销
+const maxRanges = 64
+
+var (
+	// ErrInvalidRange Range格式错误或单位不支持，按RFC 7233应忽略Range返回完整内容
+	ErrInvalidRange = errors.New("invalid range")
+	// ErrRangeNotSatisfiable 所有区间都超出文件范围，应返回416
+	ErrRangeNotSatisfiable = errors.New("range not satisfiable")
+)
+
+// RangeSpec Range头中的一个区间，End为闭区间，End<0表示到文件末尾；后缀区间表示最后Start字节。
+type RangeSpec struct {
+	Start  int64
+	End    int64
+	Suffix bool
+}
+
+// HttpRange 解析后的区间[Start,End)
+type HttpRange struct {
+	Start int64
+	End   int64
+}
+
+func (r HttpRange) Length() int64 {
+	return r.End - r.Start
+}
+
+// ContentRange 返回Content-Range头的值
+func (r HttpRange) ContentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.Start, r.End-1, size)
+}
+
+// ParseRangeSpecs 按RFC 7233解析Range头的语法，不依赖文件大小。
+func ParseRangeSpecs(header string) ([]RangeSpec, error) {
+	unit, set, ok := strings.Cut(strings.TrimSpace(header), "=")
+	if !ok || !strings.EqualFold(strings.TrimSpace(unit), "bytes") {
+		return nil, ErrInvalidRange
+	}
+	var specs []RangeSpec
+	for _, part := range strings.Split(set, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" { // 允许空元素，如"bytes=0-1,,5-6"
+			continue
+		}
+		if len(specs) == maxRanges {
+			return nil, ErrInvalidRange
+		}
+		first, last, ok := strings.Cut(part, "-")
+		if !ok {
+			return nil, ErrInvalidRange
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+		if first == "" { // 后缀区间 bytes=-N
+			n, err := parseRangeInt(last)
+			if err != nil {
+				return nil, err
+			}
+			specs = append(specs, RangeSpec{Start: n, End: -1, Suffix: true})
+			continue
+		}
+		start, err := parseRangeInt(first)
+		if err != nil {
+			return nil, err
+		}
+		spec := RangeSpec{Start: start, End: -1}
+		if last != "" {
+			if spec.End, err = parseRangeInt(last); err != nil {
+				return nil, err
+			}
+			if spec.End < start {
+				return nil, ErrInvalidRange
+			}
+		}
+		specs = append(specs, spec)
+	}
+	if len(specs) == 0 {
+		return nil, ErrInvalidRange
+	}
+	return specs, nil
+}
+
+func parseRangeInt(s string) (int64, error) {
+	if s == "" || s[0] < '0' || s[0] > '9' { // 不接受符号
+		return 0, ErrInvalidRange
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, ErrInvalidRange
+	}
+	return n, nil
+}
+
+// ResolveRanges 按文件大小计算各区间的实际范围，丢弃超出文件的区间，全部超出时返回ErrRangeNotSatisfiable。
+func ResolveRanges(specs []RangeSpec, size int64) ([]HttpRange, error) {
+	ranges := make([]HttpRange, 0, len(specs))
+	for _, spec := range specs {
+		var r HttpRange
+		if spec.Suffix {
+			r = HttpRange{Start: max(size-spec.Start, 0), End: size}
+		} else {
+			if spec.Start >= size {
+				continue
+			}
+			r = HttpRange{Start: spec.Start, End: size}
+			if spec.End >= 0 {
+				r.End = min(spec.End+1, size)
+			}
+		}
+		if r.Length() > 0 {
+			ranges = append(ranges, r)
+		}
+	}
+	if len(ranges) == 0 {
+		return nil, ErrRangeNotSatisfiable
+	}
+	return ranges, nil
+}
+
+// ParseRange 解析Range头并按文件大小计算区间
+func ParseRange(header string, size int64) ([]HttpRange, error) {
+	specs, err := ParseRangeSpecs(header)
+	if err != nil {
+		return nil, err
+	}
+	return ResolveRanges(specs, size)
+}
+
+// IfRangeMatch 判断If-Range是否满足，不满足时应忽略Range返回完整内容。
+// etag按强比较，弱etag视为不满足；日期形式需与Last-Modified完全一致。
+func IfRangeMatch(ifRange, etag string, lastModified time.Time) bool {
+	ifRange = strings.TrimSpace(ifRange)
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, `"`) {
+		return etag != "" && !strings.HasPrefix(etag, "W/") && strings.Trim(ifRange, `"`) == strings.Trim(etag, `"`)
+	}
+	if strings.HasPrefix(ifRange, "W/") || lastModified.IsZero() {
+		return false
+	}
+	t, err := http.ParseTime(ifRange)
+	return err == nil && t.Equal(lastModified.Truncate(time.Second))
+}
+
+// RequestRanges 解析请求的Range与If-Range。返回nil表示发送完整内容；
+// 区间全部超出文件范围时返回ErrRangeNotSatisfiable。
+func RequestRanges(req *http.Request, size int64, etag string, lastModified time.Time) ([]HttpRange, error) {
+	header := req.Header.Get("Range")
+	if header == "" || !IfRangeMatch(req.Header.Get("If-Range"), etag, lastModified) {
+		return nil, nil
+	}
+	ranges, err := ParseRange(header, size)
+	if errors.Is(err, ErrInvalidRange) {
+		return nil, nil
+	}
+	return ranges, err
+}
+
+// MultipartRanges multipart/byteranges响应的分段格式，用于预先计算Content-Length。
+type MultipartRanges struct {
+	Ranges      []HttpRange
+	Size        int64
+	ContentType string
+	Boundary    string
+}
+
+func NewMultipartRanges(ranges []HttpRange, size int64, contentType string) *MultipartRanges {
+	boundary := make([]byte, 16)
+	_, _ = rand.Read(boundary)
+	return &MultipartRanges{Ranges: ranges, Size: size, ContentType: contentType, Boundary: hex.EncodeToString(boundary)}
+}
+
+func (m *MultipartRanges) HeaderContentType() string {
+	return "multipart/byteranges; boundary=" + m.Boundary
+}
+
+// PartHeader 第i个分段之前的分隔符与分段头
+func (m *MultipartRanges) PartHeader(i int) string {
+	prefix := "\r\n"
+	if i == 0 {
+		prefix = ""
+	}
+	return fmt.Sprintf("%s--%s\r\nContent-Type: %s\r\nContent-Range: %s\r\n\r\n", prefix, m.Boundary, m.ContentType, m.Ranges[i].ContentRange(m.Size))
+}
+
+// Trailer 最后一个分段之后的结束分隔符
+func (m *MultipartRanges) Trailer() string {
+	return fmt.Sprintf("\r\n--%s--\r\n", m.Boundary)
+}
+
+func (m *MultipartRanges) ContentLength() int64 {
+	length := int64(len(m.Trailer()))
+	for i, r := range m.Ranges {
+		length += int64(len(m.PartHeader(i))) + r.Length()
+	}
+	return length
+}
+
+// RangeResponse 文件响应的状态与响应头，按条件请求、Range与If-Range确定，HF文件与ModelScope文件共用。
+type RangeResponse struct {
+	StatusCode int // 200、206、304或416
+	Size       int64
+	Ranges     []HttpRange // 为空表示发送完整内容
+	Multipart  *MultipartRanges
+	Headers    map[string]string
+}
+
+// NewRangeResponse 依次判断If-None-Match/If-Modified-Since与Range/If-Range，并在headers中写入校验值、
+// Content-Length与Content-Range；headers中的Content-Type作为multipart各分段的类型。
+func NewRangeResponse(req *http.Request, size int64, etag string, lastModified time.Time, headers map[string]string) *RangeResponse {
+	r := &RangeResponse{StatusCode: http.StatusOK, Size: size, Headers: headers}
+	headers["Accept-Ranges"] = "bytes"
+	SetValidators(headers, etag, lastModified)
+	if CheckNotModified(req, etag, lastModified) {
+		r.StatusCode = http.StatusNotModified
+		return r
+	}
+	if size > 0 { // 空文件忽略Range
+		ranges, err := RequestRanges(req, size, etag, lastModified)
+		if err != nil {
+			r.StatusCode = http.StatusRequestedRangeNotSatisfiable
+			return r
+		}
+		r.Ranges = ranges
+	}
+	switch {
+	case len(r.Ranges) == 1:
+		r.StatusCode = http.StatusPartialContent
+		headers[consts.HUGGINGFACE_HEADER_CONTENT_LENGTH] = Itoa(r.Ranges[0].Length())
+		headers["Content-Range"] = r.Ranges[0].ContentRange(size)
+	case len(r.Ranges) > 1:
+		r.StatusCode = http.StatusPartialContent
+		r.Multipart = NewMultipartRanges(r.Ranges, size, headers[echo.HeaderContentType])
+		headers[echo.HeaderContentType] = r.Multipart.HeaderContentType()
+		headers[consts.HUGGINGFACE_HEADER_CONTENT_LENGTH] = Itoa(r.Multipart.ContentLength())
+	default:
+		headers[consts.HUGGINGFACE_HEADER_CONTENT_LENGTH] = Itoa(size)
+	}
+	return r
+}
+
+// Span 单区间或完整内容的范围[start,end)
+func (r *RangeResponse) Span() (int64, int64) {
+	if len(r.Ranges) == 1 {
+		return r.Ranges[0].Start, r.Ranges[0].End
+	}
+	return 0, r.Size
+}
+
+// Write 发送响应。304、416与HEAD请求只发送响应头；其余按区间依次调用write写入响应体，
+// 多个区间时在各分段前写入分段头。响应头发送后出错只能中断连接。
+func (r *RangeResponse) Write(c echo.Context, write func(start, end int64) error) error {
+	switch r.StatusCode {
+	case http.StatusNotModified:
+		return ResponseNotModified(c, r.Headers)
+	case http.StatusRequestedRangeNotSatisfiable:
+		return ErrorRangeNotSatisfiable(c, r.Size)
+	}
+	if c.Request().Method == http.MethodHead {
+		return ResponseHeaders(c, r.StatusCode, r.Headers)
+	}
+	for k, v := range r.Headers {
+		c.Response().Header().Set(k, v)
+	}
+	c.Response().WriteHeader(r.StatusCode)
+	if r.Multipart == nil {
+		start, end := r.Span()
+		return write(start, end)
+	}
+	for i, hr := range r.Multipart.Ranges {
+		if _, err := c.Response().Write([]byte(r.Multipart.PartHeader(i))); err != nil {
+			return err
+		}
+		if err := write(hr.Start, hr.End); err != nil {
+			return err
+		}
+	}
+	_, err := c.Response().Write([]byte(r.Multipart.Trailer()))
+	return err
+}
@@ -0,0 +1,186 @@
+//  Copyright (c) 2025 dingodb.com, Inc. All Rights Reserved
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http:www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package util
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestParseRange(t *testing.T) {
+	size := int64(100)
+	cases := []struct {
+		name   string
+		header string
+		want   []HttpRange
+		err    error
+	}{
+		{"closed", "bytes=0-9", []HttpRange{{0, 10}}, nil},
+		{"open-ended", "bytes=90-", []HttpRange{{90, 100}}, nil},
+		{"end past size", "bytes=50-500", []HttpRange{{50, 100}}, nil},
+		{"suffix", "bytes=-10", []HttpRange{{90, 100}}, nil},
+		{"suffix larger than file", "bytes=-500", []HttpRange{{0, 100}}, nil},
+		{"multiple", "bytes=0-9, 20-29", []HttpRange{{0, 10}, {20, 30}}, nil},
+		{"overlapping", "bytes=0-49,40-59,-10", []HttpRange{{0, 50}, {40, 60}, {90, 100}}, nil},
+		{"empty element", "bytes=0-1,,5-6", []HttpRange{{0, 2}, {5, 7}}, nil},
+		{"unit case", "Bytes=0-0", []HttpRange{{0, 1}}, nil},
+		{"partly unsatisfiable", "bytes=0-9,200-300", []HttpRange{{0, 10}}, nil},
+		{"start at size", "bytes=100-", nil, ErrRangeNotSatisfiable},
+		{"unsatisfiable set", "bytes=100-199,300-", nil, ErrRangeNotSatisfiable},
+		{"empty suffix", "bytes=-0", nil, ErrRangeNotSatisfiable},
+		{"end before start", "bytes=10-5", nil, ErrInvalidRange},
+		{"unknown unit", "items=0-1", nil, ErrInvalidRange},
+		{"no dash", "bytes=10", nil, ErrInvalidRange},
+		{"no numbers", "bytes=-", nil, ErrInvalidRange},
+		{"signed", "bytes=+1-2", nil, ErrInvalidRange},
+		{"not a number", "bytes=a-b", nil, ErrInvalidRange},
+		{"empty set", "bytes=", nil, ErrInvalidRange},
+		{"too many ranges", "bytes=" + strings.Repeat("0-0,", maxRanges) + "0-0", nil, ErrInvalidRange},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := ParseRange(c.header, size)
+			if !errors.Is(err, c.err) {
+				t.Fatalf("err = %v, want %v", err, c.err)
+			}
+			if !slices.Equal(got, c.want) {
+				t.Fatalf("ranges = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestRangeResponse(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 10))
+	size := int64(len(content))
+	etag := "abc123"
+	lastModified := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	cases := []struct {
+		name    string
+		method  string
+		headers map[string]string
+		status  int
+		ranges  []HttpRange // 期望的响应体区间，nil表示完整内容
+	}{
+		{"full", http.MethodGet, nil, http.StatusOK, nil},
+		{"single", http.MethodGet, map[string]string{"Range": "bytes=10-19"}, http.StatusPartialContent, []HttpRange{{10, 20}}},
+		{"suffix", http.MethodGet, map[string]string{"Range": "bytes=-5"}, http.StatusPartialContent, []HttpRange{{95, 100}}},
+		{"open-ended", http.MethodGet, map[string]string{"Range": "bytes=98-"}, http.StatusPartialContent, []HttpRange{{98, 100}}},
+		{"multipart", http.MethodGet, map[string]string{"Range": "bytes=0-4,-5,3-7"}, http.StatusPartialContent, []HttpRange{{0, 5}, {95, 100}, {3, 8}}},
+		{"invalid range ignored", http.MethodGet, map[string]string{"Range": "bytes=9-1"}, http.StatusOK, nil},
+		{"if-range match", http.MethodGet, map[string]string{"Range": "bytes=0-4", "If-Range": `"abc123"`}, http.StatusPartialContent, []HttpRange{{0, 5}}},
+		{"if-range mismatch", http.MethodGet, map[string]string{"Range": "bytes=0-4", "If-Range": `"other"`}, http.StatusOK, nil},
+		{"not modified", http.MethodGet, map[string]string{"If-None-Match": `"abc123"`, "Range": "bytes=0-4"}, http.StatusNotModified, nil},
+		{"unsatisfiable", http.MethodGet, map[string]string{"Range": "bytes=100-,200-300"}, http.StatusRequestedRangeNotSatisfiable, nil},
+		{"head", http.MethodHead, map[string]string{"Range": "bytes=0-4"}, http.StatusPartialContent, []HttpRange{{0, 5}}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, "/", nil)
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			c := echo.New().NewContext(req, rec)
+			resp := NewRangeResponse(req, size, etag, lastModified, map[string]string{echo.HeaderContentType: "text/plain"})
+			err := resp.Write(c, func(start, end int64) error {
+				_, err := c.Response().Write(content[start:end])
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != tc.status {
+				t.Fatalf("status = %d, want %d", rec.Code, tc.status)
+			}
+			body := rec.Body.Bytes()
+			switch {
+			case tc.status == http.StatusRequestedRangeNotSatisfiable:
+				if got := rec.Header().Get("Content-Range"); got != fmt.Sprintf("bytes */%d", size) {
+					t.Fatalf("Content-Range = %q", got)
+				}
+				return
+			case tc.status == http.StatusNotModified:
+				if rec.Header().Get("Content-Length") != "" || rec.Header().Get("Content-Range") != "" || len(body) != 0 {
+					t.Fatal("304 should not carry content")
+				}
+				if rec.Header().Get("Etag") != `"abc123"` {
+					t.Fatalf("ETag = %q", rec.Header().Get("Etag"))
+				}
+				return
+			case tc.method == http.MethodHead:
+				if rec.Header().Get("Content-Range") != "bytes 0-4/100" || rec.Header().Get("Content-Length") != "5" {
+					t.Fatalf("unexpected headers %v", rec.Header())
+				}
+				return
+			}
+			if rec.Header().Get("Content-Length") != Itoa(int64(len(body))) {
+				t.Fatalf("Content-Length = %s, body %d bytes", rec.Header().Get("Content-Length"), len(body))
+			}
+			if rec.Header().Get("Accept-Ranges") != "bytes" || rec.Header().Get("Last-Modified") != lastModified.Format(http.TimeFormat) {
+				t.Fatalf("missing validators %v", rec.Header())
+			}
+			if len(tc.ranges) <= 1 {
+				want := content
+				if len(tc.ranges) == 1 {
+					want = content[tc.ranges[0].Start:tc.ranges[0].End]
+					if got := rec.Header().Get("Content-Range"); got != tc.ranges[0].ContentRange(size) {
+						t.Fatalf("Content-Range = %q", got)
+					}
+				}
+				if !bytes.Equal(body, want) {
+					t.Fatalf("body = %q, want %q", body, want)
+				}
+				return
+			}
+			mediaType, params, err := mime.ParseMediaType(rec.Header().Get(echo.HeaderContentType))
+			if err != nil || mediaType != "multipart/byteranges" {
+				t.Fatalf("Content-Type = %q", rec.Header().Get(echo.HeaderContentType))
+			}
+			reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+			for _, r := range tc.ranges {
+				part, err := reader.NextPart()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if part.Header.Get("Content-Type") != "text/plain" || part.Header.Get("Content-Range") != r.ContentRange(size) {
+					t.Fatalf("unexpected part headers %v", part.Header)
+				}
+				data, err := io.ReadAll(part)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(data, content[r.Start:r.End]) {
+					t.Fatalf("part %v = %q", r, data)
+				}
+			}
+			if _, err = reader.NextPart(); err != io.EOF {
+				t.Fatalf("expected end of parts, got %v", err)
+			}
+		})
+	}
+}
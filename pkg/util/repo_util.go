@@ -154,6 +154,15 @@ func GetFileSize(path string) int64 {
 	return fileInfo.Size()
 }
 
+// GetFileModTime 获取文件修改时间，文件不存在时返回零值
+func GetFileModTime(path string) time.Time {
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return fileInfo.ModTime()
+}
+
 func ReadDir(dir string) ([]string, error) {
 	dirNames := make([]string, 0)
 	repoEntries, err := os.ReadDir(dir)
@@ -297,7 +306,7 @@ func GetFolderSize(folderPath string) (int64, error) {
 			return nil
 		}
 
-		filePhysicalSize, err := getFilePhysicalSize(info, path)
+		filePhysicalSize, err := GetFilePhysicalSize(info, path)
 		if err != nil {
 			return fmt.Errorf("get physical size for %s: %w", path, err)
 		}
@@ -313,7 +322,8 @@ func GetFolderSize(folderPath string) (int64, error) {
 	return totalPhysicalSize, nil
 }
 
-func getFilePhysicalSize(info os.FileInfo, path string) (int64, error) {
+// GetFilePhysicalSize 返回文件实际占用的磁盘空间，稀疏文件未写入的部分不计算在内。
+func GetFilePhysicalSize(info os.FileInfo, path string) (int64, error) {
 	switch runtime.GOOS {
 	case "linux":
 		return getLinuxFilePhysicalSize(info)
@@ -18,6 +18,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 
 	myerr "dingospeed/pkg/error"
 
@@ -137,6 +138,26 @@ func ErrorMethodError(ctx echo.Context) error {
 	return Response(ctx, http.StatusInternalServerError, headers, content)
 }
 
+// ResponseNotModified 客户端缓存仍然有效，返回304。只保留校验与仓库信息相关的头，不发送实体相关的头。
+func ResponseNotModified(ctx echo.Context, headers map[string]string) error {
+	for k, v := range headers {
+		switch strings.ToLower(k) {
+		case "content-length", "content-type", "content-range", "content-encoding", "accept-ranges":
+			continue
+		}
+		ctx.Response().Header().Set(k, v)
+	}
+	return ctx.NoContent(http.StatusNotModified)
+}
+
+// ErrorRangeNotSatisfiable 请求的区间全部超出文件范围，告知客户端文件大小
+func ErrorRangeNotSatisfiable(ctx echo.Context, size int64) error {
+	headers := map[string]string{
+		"Content-Range": fmt.Sprintf("bytes */%d", size),
+	}
+	return Response(ctx, http.StatusRequestedRangeNotSatisfiable, headers, nil)
+}
+
 func ErrorTooManyRequest(ctx echo.Context) error {
 	content := map[string]string{
 		"error": "Too many requests",